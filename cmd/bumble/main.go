@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
@@ -73,6 +74,9 @@ func main() {
 	var portFlag = flag.Int("p", DEFAULT_PORT, "port number")
 	var promptFlag = flag.Bool("c", true, "use prompt?")
 	var projectFlag = flag.String("project", "", "choose project: [go,pager,db,query,concurrency,recovery] (required)")
+	var collisionsFlag = flag.String("collisions", "error", "how to combine REPLs with the same command: [error,namespace,last]")
+	var manifestFlag = flag.String("manifest", "", "file listing tables to open at startup, one `<name> <btree|hash> <file>` per line")
+	var timeoutFlag = flag.Duration("timeout", 0, "how long each command may run before it is cancelled, e.g. 30s (0 for no limit)")
 	flag.Parse()
 	// Open the db; if recovery, prime the database.
 	var database *db.Database
@@ -93,6 +97,18 @@ func main() {
 	// Setup close conditions.
 	defer database.Close()
 	setupCloseHandler(database)
+	// Open the tables listed in the manifest, if any.
+	if *manifestFlag != "" {
+		entries, err := db.ReadManifest(*manifestFlag)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if err = database.OpenManifest(entries, db.OpenIndex); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
 	// Set up REPL resources.
 	prompt := config.GetPrompt(*promptFlag)
 	repls := make([]*repl.REPL, 0)
@@ -143,16 +159,38 @@ func main() {
 		fmt.Println("must specify -project [go,pager,db,query,concurrency,recovery]")
 		return
 	}
+	// Serve the manifest's tables even if the project doesn't otherwise use the database.
+	if *manifestFlag != "" && (*projectFlag == "go" || *projectFlag == "pager") {
+		repls = append(repls, db.DatabaseRepl(database))
+	}
 	// Combine the REPLs.
-	r, err := repl.CombineRepls(repls)
+	var policy repl.CollisionPolicy
+	switch *collisionsFlag {
+	case "error":
+		policy = repl.COLLISION_ERROR
+	case "namespace":
+		policy = repl.COLLISION_NAMESPACE
+	case "last":
+		policy = repl.COLLISION_LAST_WINS
+	default:
+		fmt.Println("must specify -collisions [error,namespace,last]")
+		return
+	}
+	r, err := repl.CombineReplsWithPolicy(repls, policy, os.Stdout)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	if *timeoutFlag < 0 {
+		fmt.Println("-timeout must not be negative")
+		return
+	}
+	r.SetTimeout(*timeoutFlag)
 	// Start server if server (concurrency or recovery), else run REPL here.
 	if server {
 		startServer(r, tm, prompt, *portFlag)
 	} else {
+		r.SetHistoryFile(filepath.Join(*dbFlag, config.HistoryFileName), config.HistoryLimit)
 		r.Run(nil, uuid.New(), prompt)
 	}
 }
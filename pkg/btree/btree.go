@@ -1,39 +1,139 @@
 package btree
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 
+	hash "github.com/brown-csci1270/db/pkg/hash"
 	pager "github.com/brown-csci1270/db/pkg/pager"
 	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
 // Tables are an abstraction over the entries stored in our database.
 type BTreeIndex struct {
-	pager  *pager.Pager // The page handler to read from files.
-	rootPN int64        // The root page number.
+	pager        *pager.Pager              // The page handler to read from files.
+	rootPN       int64                     // The root page number.
+	leafCapacity int64                     // The number of entries a leaf holds before splitting.
+	tombstones   bool                      // Whether deletes mark entries instead of removing them.
+	order        KeyOrder                  // The order keys are kept in.
+	maxHeight    int64                     // The deepest a descent may go before giving up with ErrTreeTooDeep.
+	frozen       int32                     // 1 once the table has been frozen, set atomically; see Freeze.
+	count        int64                     // The number of entries, cached atomically when the table was frozen.
+	filter       *hash.BloomFilter         // Filter over every key inserted since the last RebuildFilter, if any.
+	filterMtx    sync.RWMutex              // Guards filter.
+	keyLocks     [NUM_KEY_LOCKS]sync.Mutex // Serialize the writes that may change whether a key is live; see keyLock.
 }
 
+// Number of locks that keys are striped over, to serialize inserts and deletes of each key.
+const NUM_KEY_LOCKS = 64
+
 // OpenTable returns a table associated with the given database filename.
 func OpenTable(filename string) (table *BTreeIndex, err error) {
+	return OpenTableWithLeafCapacity(filename, ENTRIES_PER_LEAF_NODE)
+}
+
+// OpenTableWithLeafCapacity returns a table associated with the given database filename.
+// If the table is new, its leaves split once they hold more than leafCapacity entries;
+// existing tables keep their stored capacity.
+func OpenTableWithLeafCapacity(filename string, leafCapacity int64) (table *BTreeIndex, err error) {
+	return openTable(filename, leafCapacity, ASCENDING)
+}
+
+// OpenTableWithOrder returns a table associated with the given database filename.
+// If the table is new, it keeps its keys in the given order; existing tables keep
+// their stored order.
+func OpenTableWithOrder(filename string, order KeyOrder) (table *BTreeIndex, err error) {
+	return openTable(filename, ENTRIES_PER_LEAF_NODE, order)
+}
+
+// openTable returns a table associated with the given database filename, initializing
+// it with the given leaf capacity and key order if it's new.
+func openTable(filename string, leafCapacity int64, order KeyOrder) (table *BTreeIndex, err error) {
+	if leafCapacity < 1 || leafCapacity > ENTRIES_PER_LEAF_NODE {
+		return nil, fmt.Errorf("leaf capacity must be between 1 and %d", ENTRIES_PER_LEAF_NODE)
+	}
+	if order != ASCENDING && order != DESCENDING {
+		return nil, fmt.Errorf("invalid key order %d", order)
+	}
 	// Create a pager for the table
 	pager := pager.NewPager()
 	err = pager.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	table, err = openTableWithPager(pager, leafCapacity, order)
+	if err != nil {
+		pager.Close()
+		return nil, err
+	}
+	return table, nil
+}
+
+// OpenTableWithPager returns a table stored in the given pager, which must already
+// be open. This lets tables live in e.g. an in-memory pager rather than a file.
+func OpenTableWithPager(pager *pager.Pager) (*BTreeIndex, error) {
+	return openTableWithPager(pager, ENTRIES_PER_LEAF_NODE, ASCENDING)
+}
+
+// openTableWithPager reads the table from the given pager, initializing it if it's new.
+func openTableWithPager(pager *pager.Pager, leafCapacity int64, order KeyOrder) (*BTreeIndex, error) {
 	// Initialize the pager if it's new.
 	if pager.GetNumPages() == 0 {
-		rootPage, err := pager.GetPage(ROOT_PN)
+		// Write the metadata page.
+		metaPage, err := pager.AllocatePage()
+		if err != nil {
+			return nil, err
+		}
+		defer metaPage.Put()
+		writeMetaField(metaPage, META_LEAF_CAPACITY_OFFSET, META_LEAF_CAPACITY_SIZE, leafCapacity)
+		writeMetaField(metaPage, META_ORDER_OFFSET, META_ORDER_SIZE, int64(order))
+		metaPage.Update([]byte{FORMAT_VERSION}, META_VERSION_OFFSET, META_VERSION_SIZE)
+		metaPage.Update([]byte(META_MAGIC), META_MAGIC_OFFSET, META_MAGIC_SIZE)
+		writeMetaField(metaPage, META_ENTRY_SIZE_OFFSET, META_ENTRY_SIZE_SIZE, ENTRYSIZE)
+		// Write the root page.
+		rootPage, err := pager.AllocatePage()
 		if err != nil {
 			return nil, err
 		}
 		defer rootPage.Put()
 		initPage(rootPage, LEAF_NODE)
 		rootNode := pageToLeafNode(rootPage)
-		rootNode.setRightSibling(-1)
+		rootNode.setRightSibling(NO_SIBLING_PN)
+		rootNode.setCapacity(leafCapacity)
+		return &BTreeIndex{pager: pager, rootPN: ROOT_PN, leafCapacity: leafCapacity, order: order, maxHeight: DEFAULT_MAX_HEIGHT}, nil
+	}
+	// Else, read the metadata back in.
+	metaPage, err := pager.GetPage(META_PN)
+	if err != nil {
+		return nil, err
+	}
+	defer metaPage.Put()
+	// Check that this is a B+ tree file in a layout we know before trusting anything else in it.
+	if string((*metaPage.GetData())[META_MAGIC_OFFSET:META_MAGIC_OFFSET+META_MAGIC_SIZE]) != META_MAGIC {
+		return nil, fmt.Errorf("%w: no b+ tree metadata page; the file was written before format versions were stored", utils.ErrUnsupportedVersion)
+	}
+	if version := (*metaPage.GetData())[META_VERSION_OFFSET]; version != FORMAT_VERSION {
+		return nil, fmt.Errorf("%w: file has version %d, expected %d", utils.ErrUnsupportedVersion, version, FORMAT_VERSION)
 	}
-	return &BTreeIndex{pager: pager, rootPN: ROOT_PN}, nil
+	// Leaf cells are laid out by ENTRYSIZE, so a file written with another size would be misread.
+	if entrySize := readMetaField(metaPage, META_ENTRY_SIZE_OFFSET, META_ENTRY_SIZE_SIZE); entrySize != ENTRYSIZE {
+		return nil, fmt.Errorf("%w: file has entry size %d, expected %d", utils.ErrUnsupportedVersion, entrySize, ENTRYSIZE)
+	}
+	leafCapacity = readMetaField(metaPage, META_LEAF_CAPACITY_OFFSET, META_LEAF_CAPACITY_SIZE)
+	if leafCapacity < 1 || leafCapacity > ENTRIES_PER_LEAF_NODE {
+		return nil, fmt.Errorf("invalid leaf capacity %d", leafCapacity)
+	}
+	tombstones := readMetaField(metaPage, META_TOMBSTONE_OFFSET, META_TOMBSTONE_SIZE) != 0
+	order = KeyOrder(readMetaField(metaPage, META_ORDER_OFFSET, META_ORDER_SIZE))
+	if order != ASCENDING && order != DESCENDING {
+		return nil, fmt.Errorf("invalid key order %d", order)
+	}
+	return &BTreeIndex{pager: pager, rootPN: ROOT_PN, leafCapacity: leafCapacity, tombstones: tombstones, order: order, maxHeight: DEFAULT_MAX_HEIGHT}, nil
 }
 
 // Get this index's filename.
@@ -46,6 +146,147 @@ func (table *BTreeIndex) GetPager() *pager.Pager {
 	return table.pager
 }
 
+// Get the number of entries a leaf holds before splitting.
+func (table *BTreeIndex) GetLeafCapacity() int64 {
+	return table.leafCapacity
+}
+
+// Get the order the table keeps its keys in.
+func (table *BTreeIndex) GetOrder() KeyOrder {
+	return table.order
+}
+
+// Get whether deletes leave tombstones rather than compacting leaves.
+func (table *BTreeIndex) GetTombstoneMode() bool {
+	return table.tombstones
+}
+
+// SetTombstoneMode sets whether deletes leave tombstones rather than compacting leaves.
+// In tombstone mode, deleted entries keep their cells until the next Vacuum,
+// so cursors stay valid while entries are deleted during a scan.
+func (table *BTreeIndex) SetTombstoneMode(tombstones bool) error {
+	if table.IsFrozen() {
+		return utils.ErrImmutable
+	}
+	metaPage, err := table.pager.GetPage(META_PN)
+	if err != nil {
+		return err
+	}
+	defer metaPage.Put()
+	var flag int64
+	if tombstones {
+		flag = 1
+	}
+	writeMetaField(metaPage, META_TOMBSTONE_OFFSET, META_TOMBSTONE_SIZE, flag)
+	table.tombstones = tombstones
+	return nil
+}
+
+// Get the deepest a descent may go before giving up with ErrTreeTooDeep.
+func (table *BTreeIndex) GetMaxHeight() int64 {
+	return table.maxHeight
+}
+
+// SetMaxHeight sets the deepest a descent may go, counting the root as level 1, before
+// giving up with ErrTreeTooDeep. The limit is not stored, so it resets on reopen.
+func (table *BTreeIndex) SetMaxHeight(maxHeight int64) error {
+	if maxHeight < 1 {
+		return fmt.Errorf("max height must be at least 1, got %d", maxHeight)
+	}
+	table.maxHeight = maxHeight
+	return nil
+}
+
+// Freeze makes the table immutable, e.g. to serve it from a read replica: from then on,
+// every call that would modify it fails with utils.ErrImmutable. Unlike opening the
+// file read-only, this is a promise by the caller, who must only freeze a table once
+// all writes to it are done and must not write to its file behind its back. In return,
+// reads of a frozen table skip latching, and its entry count is cached. Freezing can't
+// be undone short of reopening the table.
+func (table *BTreeIndex) Freeze() error {
+	if table.IsFrozen() {
+		return nil
+	}
+	count, err := table.Count()
+	if err != nil {
+		return err
+	}
+	// Cache the count before setting the flag, so that readers who see the flag see the count.
+	atomic.StoreInt64(&table.count, count)
+	atomic.StoreInt32(&table.frozen, 1)
+	return nil
+}
+
+// IsFrozen returns true if the table has been frozen.
+func (table *BTreeIndex) IsFrozen() bool {
+	return atomic.LoadInt32(&table.frozen) == 1
+}
+
+// Height returns the number of levels in the tree, counting a lone root leaf as 1.
+// Only the start of each node is read, which is all the leftmost child pointer needs, so
+// where the pager can read page headers this takes no frames and evicts nothing.
+func (table *BTreeIndex) Height() (int64, error) {
+	pagenum := table.rootPN
+	// Every leaf is at the same depth, so follow the leftmost children down to one.
+	for depth := int64(1); ; depth++ {
+		header, err := table.readNodeHeader(pagenum, PNS_OFFSET+PN_SIZE)
+		if err != nil {
+			return 0, err
+		}
+		if header[NODETYPE_OFFSET] != 0 {
+			return depth, nil
+		}
+		childPN, _ := binary.Varint(header[PNS_OFFSET : PNS_OFFSET+PN_SIZE])
+		if childPN <= ROOT_PN {
+			return 0, fmt.Errorf("invalid child pagenum %d in node %d", childPN, pagenum)
+		}
+		if table.maxHeight > 0 && depth >= table.maxHeight {
+			return 0, fmt.Errorf("%w: page %d is past the height limit of %d", ErrTreeTooDeep, childPN, table.maxHeight)
+		}
+		if childPN == pagenum {
+			return 0, fmt.Errorf("%w: page %d points back to page %d", ErrTreeTooDeep, pagenum, childPN)
+		}
+		pagenum = childPN
+	}
+}
+
+// readNodeHeader returns a copy of the first size bytes of the given page. Pagers that can't
+// read part of a page pin it read-only instead, so this cannot modify the table either way.
+func (table *BTreeIndex) readNodeHeader(pagenum int64, size int64) ([]byte, error) {
+	header, err := table.pager.ReadPageHeader(pagenum, size)
+	if !errors.Is(err, pager.ErrPartialReadUnsupported) {
+		return header, err
+	}
+	page, err := table.pager.GetPageReadOnly(pagenum)
+	if err != nil {
+		return nil, err
+	}
+	defer page.Put()
+	header = make([]byte, size)
+	copy(header, *page.GetData())
+	return header, nil
+}
+
+// NextID returns the table's next auto-increment id and advances the stored counter.
+// Ids start at 0 and are never handed out twice, but they are not checked against
+// keys inserted by hand, so callers should pick one approach per table.
+func (table *BTreeIndex) NextID() (int64, error) {
+	if table.IsFrozen() {
+		return 0, utils.ErrImmutable
+	}
+	metaPage, err := table.pager.GetPage(META_PN)
+	if err != nil {
+		return 0, err
+	}
+	defer metaPage.Put()
+	// [CONCURRENCY] Hold the metadata page's lock so that concurrent callers get distinct ids.
+	metaPage.WLock()
+	defer metaPage.WUnlock()
+	id := readMetaField(metaPage, META_NEXT_ID_OFFSET, META_NEXT_ID_SIZE)
+	writeMetaField(metaPage, META_NEXT_ID_OFFSET, META_NEXT_ID_SIZE, id+1)
+	return id, nil
+}
+
 // Close flushes all changes to disk.
 func (table *BTreeIndex) Close() (err error) {
 	err = table.pager.Close()
@@ -54,6 +295,9 @@ func (table *BTreeIndex) Close() (err error) {
 
 // Finds the given key.
 func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
+	if table.IsFrozen() {
+		return table.findFrozen(key)
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -65,16 +309,89 @@ func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
 	initRootNode(rootNode)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
-	// Insert the entry into the root node.
-	value, found := rootNode.get(key)
+	table.startDescent(rootNode)
+	// Find the entry under the root node.
+	value, found, err := rootNode.get(key)
+	if err != nil {
+		return nil, err
+	}
 	if found {
 		return BTreeEntry{key: key, value: value}, nil
 	}
-	return nil, errors.New("entry could not be found")
+	return nil, utils.ErrNotFound
+}
+
+// findFrozen finds the given key in a frozen table. No writers can be running, so the
+// descent takes no latches, and pins each node read-only to keep it that way.
+func (table *BTreeIndex) findFrozen(key int64) (utils.Entry, error) {
+	rootPage, err := table.pager.GetPageReadOnly(table.rootPN)
+	if err != nil {
+		return nil, err
+	}
+	node := pageToNode(rootPage)
+	table.startDescent(node)
+	for {
+		internal, ok := node.(*InternalNode)
+		if !ok {
+			break
+		}
+		node, err = internal.getChildReadOnly(internal.search(key))
+		internal.getPage().Put()
+		if err != nil {
+			return nil, err
+		}
+	}
+	leaf := node.(*LeafNode)
+	defer leaf.getPage().Put()
+	index := leaf.search(key)
+	if index < leaf.numKeys {
+		if entry := leaf.getCell(index); entry.GetKey() == key && !entry.isTombstone() {
+			return BTreeEntry{key: key, value: entry.GetValue(), flags: entry.flags & NULL_FLAG}, nil
+		}
+	}
+	return nil, utils.ErrNotFound
 }
 
 // Inserts an entry to the table.
 func (table *BTreeIndex) Insert(key int64, value int64) error {
+	if err := table.insert(key, value, INSERT_ONLY); err != nil {
+		return err
+	}
+	table.addToFilter(key)
+	return nil
+}
+
+// Upsert inserts an entry if its key is absent, or else overwrites its value,
+// in a single descent of the tree.
+func (table *BTreeIndex) Upsert(key int64, value int64) error {
+	if err := table.insert(key, value, UPSERT); err != nil {
+		return err
+	}
+	table.addToFilter(key)
+	return nil
+}
+
+// insert inserts an entry according to the given mode, splitting the root if necessary.
+func (table *BTreeIndex) insert(key int64, value int64, mode InsertMode) error {
+	if table.IsFrozen() {
+		return utils.ErrImmutable
+	}
+	// [CONCURRENCY] Work out whether the insert adds an entry before descending, and hold
+	// the key so that no other write can change that meanwhile.
+	lock := table.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	live, err := table.isLive(key)
+	if err != nil {
+		return err
+	}
+	if live && mode == INSERT_ONLY {
+		return errors.New("cannot insert duplicate key")
+	}
+	delta := int64(0)
+	if !live && mode != UPDATE_ONLY {
+		delta = 1
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -86,15 +403,21 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 	initRootNode(rootNode)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
+	// Pin the pages created by splits through a scope, which each split releases once it's done.
+	scope := table.pager.PinSet()
+	defer scope.Release()
+	setScope(rootNode, scope)
+	setDelta(rootNode, delta)
+	table.startDescent(rootNode)
 	// Insert the entry into the root node.
-	result := rootNode.insert(key, value, false)
+	result := rootNode.insert(key, value, mode)
 	// Check if we need to split the root node.
-	// Remember to preserve the invariant that the root node occupies page 0.
+	// Remember to preserve the invariant that the root node occupies ROOT_PN.
 	if result.isSplit {
 		// [CONCURRENCY] Unlock the root node.
 		defer SUPER_NODE.unlock()
 		// Ensure that our left PN hasn't changed.
-		if result.leftPN != 0 {
+		if result.leftPN != table.rootPN {
 			return errors.New("splitting was corrupted")
 		}
 		// Create a new node to transfer our data.
@@ -102,26 +425,26 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 		// Depending on whether the root is a leaf or an internal node...
 		if rootNode.getNodeType() == LEAF_NODE {
 			// Create a new leaf node.
-			newNode, err := createLeafNode(table.pager)
+			newNode, err := createLeafNode(table.pager, scope)
 			if err != nil {
 				return errors.New("failed to split root node")
 			}
-			defer newNode.page.Put()
 			// Copy the attributes from the root node.
 			leafyRoot := pageToLeafNode(rootNode.getPage())
 			newNode.copy(leafyRoot)
 			newNodePN = newNode.page.GetPageNum()
+			putNodePage(newNode.getPage(), scope)
 		} else {
 			// Create a new internal node.
-			newNode, err := createInternalNode(table.pager)
+			newNode, err := createInternalNode(table.pager, scope)
 			if err != nil {
 				return errors.New("failed to split root node")
 			}
-			defer newNode.page.Put()
 			// Copy the attributes from the root node.
 			internedRoot := pageToInternalNode(rootNode.getPage())
 			newNode.copy(internedRoot)
 			newNodePN = newNode.page.GetPageNum()
+			putNodePage(newNode.getPage(), scope)
 		}
 		// Reinitialize the root node.
 		initPage(rootNode.getPage(), INTERNAL_NODE)
@@ -130,13 +453,36 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 		newRoot.updateKeyAt(0, result.key)
 		newRoot.updatePNAt(0, newNodePN)
 		newRoot.updatePNAt(1, result.rightPN)
+		newRoot.updateCountAt(0, result.leftCount)
+		newRoot.updateCountAt(1, result.rightCount)
 		newRoot.updateNumKeys(1)
 	}
 	return result.err
 }
 
+// keyLock returns the lock that the given key is striped over. Subtree counts are updated
+// on the way down, before the leaf is reached, so that ancestors can be released as soon
+// as the descent passes a node that won't split. That needs the change in live entries to
+// be known up front, so inserts and deletes hold the key's lock while they check whether
+// the key is live and then write it. Updates never change the count, and don't take it.
+func (table *BTreeIndex) keyLock(key int64) *sync.Mutex {
+	return &table.keyLocks[uint64(key)%NUM_KEY_LOCKS]
+}
+
+// isLive returns whether the table holds an entry with the given key that isn't deleted.
+func (table *BTreeIndex) isLive(key int64) (bool, error) {
+	_, err := table.Find(key)
+	if err == utils.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // Update modifies an existing entry.
 func (table *BTreeIndex) Update(key int64, value int64) error {
+	if table.IsFrozen() {
+		return utils.ErrImmutable
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -148,13 +494,25 @@ func (table *BTreeIndex) Update(key int64, value int64) error {
 	initRootNode(rootNode)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
+	table.startDescent(rootNode)
 	// Update the entry.
-	result := rootNode.insert(key, value, true)
+	result := rootNode.insert(key, value, UPDATE_ONLY)
 	return result.err
 }
 
 // Delete removes a key from the table.
 func (table *BTreeIndex) Delete(key int64) error {
+	if table.IsFrozen() {
+		return utils.ErrImmutable
+	}
+	// [CONCURRENCY] As in insert, hold the key while checking that the delete removes an entry.
+	lock := table.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	live, err := table.isLive(key)
+	if err != nil || !live {
+		return err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -166,13 +524,148 @@ func (table *BTreeIndex) Delete(key int64) error {
 	initRootNode(rootNode)
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
+	setDelta(rootNode, -1)
+	table.startDescent(rootNode)
 	// Delete the key.
-	rootNode.delete(key)
+	rootNode.delete(key, table.tombstones)
 	return nil
 }
 
+// Vacuum permanently removes all tombstoned entries from the table.
+// Cursors created before the vacuum are invalidated by it.
+func (table *BTreeIndex) Vacuum() error {
+	if table.IsFrozen() {
+		return utils.ErrImmutable
+	}
+	// Get the root page.
+	rootPage, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return err
+	}
+	// [CONCURRENCY] Every writer descends through the root, so holding its lock for the
+	// whole vacuum keeps them from changing the leaves while we compact them.
+	rootPage.WLock()
+	defer rootPage.Put()
+	defer rootPage.WUnlock()
+	// Traverse the leftmost children until we reach a leaf node.
+	curPage := rootPage
+	for pageToNodeHeader(curPage).nodeType != LEAF_NODE {
+		leftmostPN, err := pageToInternalNode(curPage).getChildPNAt(0)
+		if curPage != rootPage {
+			curPage.Put()
+		}
+		if err != nil {
+			return err
+		}
+		curPage, err = table.pager.GetPage(leftmostPN)
+		if err != nil {
+			return err
+		}
+	}
+	// A root leaf is the only leaf, and is locked already.
+	if curPage == rootPage {
+		pageToLeafNode(curPage).compact()
+		return nil
+	}
+	// Compact each leaf node in turn, releasing each one before moving on.
+	for {
+		// [CONCURRENCY] Lock the leaf while we compact it, since open cursors may still hold it.
+		curPage.WLock()
+		leaf := pageToLeafNode(curPage)
+		leaf.compact()
+		hasNext, nextPN := leaf.hasRightSibling(), leaf.rightSiblingPN
+		curPage.WUnlock()
+		curPage.Put()
+		if !hasNext {
+			return nil
+		}
+		curPage, err = table.pager.GetPage(nextPN)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Count returns the number of entries in the table.
+func (table *BTreeIndex) Count() (int64, error) {
+	if table.IsFrozen() {
+		return atomic.LoadInt64(&table.count), nil
+	}
+	rootPage, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return 0, err
+	}
+	defer rootPage.Put()
+	switch rootNode := pageToNode(rootPage).(type) {
+	case *InternalNode:
+		return rootNode.getTotalCount(), nil
+	case *LeafNode:
+		return rootNode.getLiveCount(), nil
+	}
+	return 0, errors.New("unknown node type")
+}
+
+// Rank returns the number of entries in the table with keys before the given key in the
+// table's order, i.e. less than it in an ascending table, or greater in a descending one.
+func (table *BTreeIndex) Rank(key int64) (int64, error) {
+	var rank int64
+	err := table.readDescent(func(node *InternalNode) int64 {
+		// Count the subtrees that lie entirely before the key.
+		childIdx := node.search(key)
+		for i := int64(0); i < childIdx; i++ {
+			rank += node.getCountAt(i)
+		}
+		return childIdx
+	}, func(leaf *LeafNode) error {
+		// Count the live entries in the leaf that come before the key.
+		for cellnum := int64(0); cellnum < leaf.numKeys; cellnum++ {
+			entry := leaf.getCell(cellnum)
+			if table.order.compare(entry.GetKey(), key) >= 0 {
+				break
+			}
+			if !entry.isTombstone() {
+				rank++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return rank, nil
+}
+
+// EstimateRangeCount returns the number of entries with keys from lo up to but not
+// including hi, in the table's order, as TableFindRange would return. Rather than
+// scanning the range, it reads the subtree counts along the paths to lo and hi, so it
+// only visits the two leaves at the ends of the range. The count is exact while no
+// writes are running; since the two paths are not read atomically, concurrent writes
+// may skew it by up to the number of entries they insert or delete in the meantime.
+func (table *BTreeIndex) EstimateRangeCount(lo int64, hi int64) (int64, error) {
+	if table.order.compare(lo, hi) >= 0 {
+		return 0, nil
+	}
+	loRank, err := table.Rank(lo)
+	if err != nil {
+		return 0, err
+	}
+	hiRank, err := table.Rank(hi)
+	if err != nil {
+		return 0, err
+	}
+	if hiRank < loRank {
+		return 0, nil
+	}
+	return hiRank - loRank, nil
+}
+
 // Select returns a slice of all entries in the table.
 func (table *BTreeIndex) Select() ([]utils.Entry, error) {
+	return table.SelectCtx(context.Background())
+}
+
+// SelectCtx is like Select, but gives up with ctx.Err() once ctx is cancelled.
+func (table *BTreeIndex) SelectCtx(ctx context.Context) ([]utils.Entry, error) {
 	/* SOLUTION {{{ */
 	// Use a cursor to traverse the table from start to end.
 	entries := make([]utils.Entry, 0)
@@ -181,7 +674,13 @@ func (table *BTreeIndex) Select() ([]utils.Entry, error) {
 		return nil, err
 	}
 	// Traverse over all entries.
-	for {
+	for n := int64(0); ; n++ {
+		// Periodically check whether the scan has been cancelled.
+		if n%SCAN_CHECK_INTERVAL == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
 		if !cursor.IsEnd() {
 			entry, err := cursor.GetEntry()
 			if err != nil {
@@ -197,6 +696,32 @@ func (table *BTreeIndex) Select() ([]utils.Entry, error) {
 	/* SOLUTION }}} */
 }
 
+// SelectProject returns just the keys or just the values of all entries in the
+// table, in key order, reading them straight off the leaves rather than building
+// an Entry for each.
+func (table *BTreeIndex) SelectProject(fields utils.Projection) ([]int64, error) {
+	if !fields.Valid() {
+		return nil, errors.New("invalid projection")
+	}
+	ret := make([]int64, 0)
+	start, err := table.TableStart()
+	if err != nil {
+		return nil, err
+	}
+	cursor := start.(*BTreeCursor)
+	// Traverse over all entries.
+	for {
+		if !cursor.IsEnd() {
+			node, cellnum := cursor.curNode, cursor.cellnum
+			ret = append(ret, fields.Project(node.getKeyAt(cellnum), node.getValueAt(cellnum)))
+		}
+		if err := cursor.StepForward(); err != nil {
+			break
+		}
+	}
+	return ret, nil
+}
+
 // Print will pretty-print all nodes in the table.
 func (table *BTreeIndex) Print(w io.Writer) {
 	rootPage, err := table.pager.GetPage(table.rootPN)
@@ -4,14 +4,43 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
 )
 
-// We'll always maintain the invariant that the root's pagenum is 0.
-// This saves us the effort of having to find the root node every time
-// we open the database.
-var ROOT_PN int64 = 0
+// Page 0 holds index-wide metadata, and we'll always maintain the invariant
+// that the root's pagenum is 1. This saves us the effort of having to find
+// the root node every time we open the database.
+var META_PN int64 = 0
+var ROOT_PN int64 = 1
+var NO_SIBLING_PN int64 = -1 // Right sibling of the last leaf.
+
+// Metadata page constants.
+var META_LEAF_CAPACITY_OFFSET int64 = 0
+var META_LEAF_CAPACITY_SIZE int64 = binary.MaxVarintLen64
+var META_TOMBSTONE_OFFSET int64 = META_LEAF_CAPACITY_OFFSET + META_LEAF_CAPACITY_SIZE
+var META_TOMBSTONE_SIZE int64 = binary.MaxVarintLen64
+var META_NEXT_ID_OFFSET int64 = META_TOMBSTONE_OFFSET + META_TOMBSTONE_SIZE
+var META_NEXT_ID_SIZE int64 = binary.MaxVarintLen64
+var META_VERSION_OFFSET int64 = META_NEXT_ID_OFFSET + META_NEXT_ID_SIZE
+var META_VERSION_SIZE int64 = 1
+var META_ORDER_OFFSET int64 = META_VERSION_OFFSET + META_VERSION_SIZE
+var META_ORDER_SIZE int64 = binary.MaxVarintLen64
+var META_MAGIC_OFFSET int64 = META_ORDER_OFFSET + META_ORDER_SIZE
+var META_MAGIC_SIZE int64 = int64(len(META_MAGIC))
+var META_ENTRY_SIZE_OFFSET int64 = META_MAGIC_OFFSET + META_MAGIC_SIZE
+var META_ENTRY_SIZE_SIZE int64 = binary.MaxVarintLen64
+
+// Magic bytes on the metadata page of every B+ tree file. Files written before tables had a
+// metadata page keep their root on page 0 instead, so they lack it and are refused on open.
+const META_MAGIC = "DBBTREE\x00"
+
+// Version of the file layout, stored on the metadata page. Bump it whenever the layout changes.
+// Version 2 added the metadata page; version 3 added a flags byte to each leaf entry;
+// version 4 added the number of entries under each child to internal nodes; version 5
+// stored the leaf entry size on the metadata page.
+var FORMAT_VERSION byte = 5
 
 // Node header constants.
 var NODETYPE_OFFSET int64 = 0
@@ -23,21 +52,33 @@ var NODE_HEADER_SIZE int64 = NODETYPE_SIZE + NUM_KEYS_SIZE
 // Leaf node header constants.
 var RIGHT_SIBLING_PN_OFFSET int64 = NODE_HEADER_SIZE
 var RIGHT_SIBLING_PN_SIZE int64 = binary.MaxVarintLen64
-var LEAF_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE + RIGHT_SIBLING_PN_SIZE
+var LEAF_CAPACITY_OFFSET int64 = RIGHT_SIBLING_PN_OFFSET + RIGHT_SIBLING_PN_SIZE
+var LEAF_CAPACITY_SIZE int64 = binary.MaxVarintLen64
+var LEAF_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE + RIGHT_SIBLING_PN_SIZE + LEAF_CAPACITY_SIZE
 var ENTRIES_PER_LEAF_NODE int64 = ((pager.PAGESIZE - LEAF_NODE_HEADER_SIZE) / ENTRYSIZE) - 1
 
 // Internal node header constants.
 var KEY_SIZE int64 = binary.MaxVarintLen64
 var PN_SIZE int64 = binary.MaxVarintLen64
+var COUNT_SIZE int64 = binary.MaxVarintLen64
 var INTERNAL_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE
 var ptrSpace int64 = pager.PAGESIZE - INTERNAL_NODE_HEADER_SIZE - KEY_SIZE
-var KEYS_PER_INTERNAL_NODE int64 = (ptrSpace / (KEY_SIZE + PN_SIZE)) - 1
+var KEYS_PER_INTERNAL_NODE int64 = (ptrSpace / (KEY_SIZE + PN_SIZE + COUNT_SIZE)) - 1
 var KEYS_OFFSET int64 = INTERNAL_NODE_HEADER_SIZE
 var KEYS_SIZE int64 = KEY_SIZE * (KEYS_PER_INTERNAL_NODE + 1)
 var PNS_OFFSET int64 = KEYS_OFFSET + KEYS_SIZE
+var PNS_SIZE int64 = PN_SIZE * (KEYS_PER_INTERNAL_NODE + 2)
+var COUNTS_OFFSET int64 = PNS_OFFSET + PNS_SIZE
+
+// The deepest a descent may go in a table that hasn't set its own limit. Real trees are
+// far shallower; a descent this deep means a corrupted page pointer sent it in circles.
+var DEFAULT_MAX_HEIGHT int64 = 32
+
+// Returned when a descent would pass its table's height limit, or loop back to a page it holds.
+var ErrTreeTooDeep = errors.New("b+ tree descent went too deep")
 
 // [CONCURRENCY]
-var SUPER_NODE *InternalNode = &InternalNode{NodeHeader{INTERNAL_NODE, 0, &pager.Page{}}, nil}
+var SUPER_NODE *InternalNode = &InternalNode{NodeHeader{nodeType: INTERNAL_NODE, page: &pager.Page{}}, nil, nil}
 
 // NodeType identifies if a node is a leaf node or internal node.
 type NodeType bool
@@ -47,24 +88,60 @@ const (
 	LEAF_NODE     NodeType = true
 )
 
+// KeyOrder is the order a table keeps its keys in, and so the order scans return them in.
+type KeyOrder int64
+
+const (
+	ASCENDING  KeyOrder = 0 // Smallest key first; the default.
+	DESCENDING KeyOrder = 1 // Largest key first.
+)
+
+// compare returns a negative number if a comes before b in this order, a positive
+// number if it comes after, and 0 if they are equal.
+func (order KeyOrder) compare(a int64, b int64) int {
+	switch {
+	case a == b:
+		return 0
+	case (a < b) == (order == ASCENDING):
+		return -1
+	default:
+		return 1
+	}
+}
+
+// next returns the key right after the given one in this order, or false if there is none.
+func (order KeyOrder) next(key int64) (int64, bool) {
+	if order == DESCENDING {
+		return key - 1, key != math.MinInt64
+	}
+	return key + 1, key != math.MaxInt64
+}
+
 // NodeHeaders contain metadata common to all types of nodes
 type NodeHeader struct {
-	nodeType NodeType
-	numKeys  int64
-	page     *pager.Page
+	nodeType  NodeType
+	numKeys   int64
+	page      *pager.Page
+	depth     int64    // Level of this node in the current descent, counting the root as 1.
+	maxHeight int64    // Deepest level the current descent may reach, or 0 for no limit.
+	order     KeyOrder // Order of the keys in this node's table.
+	delta     int64    // Change in live entries the current write makes under this node.
 }
 
 // Leaf Node definition
 type LeafNode struct {
-	NodeHeader           // Include header information
-	rightSiblingPN int64 // Page number of the right sibling node
-	parent         Node  // Pointer to the parent node for unlocking.
+	NodeHeader                     // Include header information
+	rightSiblingPN int64           // Page number of the right sibling node
+	capacity       int64           // Number of entries this node holds before splitting
+	parent         Node            // Pointer to the parent node for unlocking.
+	scope          *pager.PinScope // Pins the pages created by the insert this node is part of, if any.
 }
 
 // Internal Node definition
 type InternalNode struct {
-	NodeHeader      // Include header information
-	parent     Node // Pointer to the parent node for unlocking.
+	NodeHeader                 // Include header information
+	parent     Node            // Pointer to the parent node for unlocking.
+	scope      *pager.PinScope // Pins the pages created by the insert this node is part of, if any.
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -73,10 +150,9 @@ type InternalNode struct {
 
 // initPage resets the page then sets the nodeType variable.
 func initPage(page *pager.Page, nodeType NodeType) {
-	page.SetDirty(true)
-	copy(*page.GetData(), make([]byte, pager.PAGESIZE))
+	page.Update(make([]byte, pager.PAGESIZE), 0, pager.PAGESIZE)
 	if nodeType == LEAF_NODE {
-		(*page.GetData())[int(NODETYPE_OFFSET)] = 1 // Set the nodeType bit
+		page.Update([]byte{1}, NODETYPE_OFFSET, 1) // Set the nodeType bit
 	}
 }
 
@@ -107,6 +183,53 @@ func pageToNodeHeader(page *pager.Page) NodeHeader {
 	}
 }
 
+// DescribePage returns the header fields of the given pinned page, one per line with the
+// offset they are stored at, for dumps of its raw bytes.
+func DescribePage(page *pager.Page) string {
+	if page.GetPageNum() == META_PN {
+		return fmt.Sprintf("btree metadata page\n"+
+			"leaf capacity: %d (offset %d)\n"+
+			"tombstones: %d (offset %d)\n"+
+			"next id: %d (offset %d)\n"+
+			"format version: %d (offset %d)\n"+
+			"entry size: %d (offset %d)\n",
+			readMetaField(page, META_LEAF_CAPACITY_OFFSET, META_LEAF_CAPACITY_SIZE), META_LEAF_CAPACITY_OFFSET,
+			readMetaField(page, META_TOMBSTONE_OFFSET, META_TOMBSTONE_SIZE), META_TOMBSTONE_OFFSET,
+			readMetaField(page, META_NEXT_ID_OFFSET, META_NEXT_ID_SIZE), META_NEXT_ID_OFFSET,
+			(*page.GetData())[META_VERSION_OFFSET], META_VERSION_OFFSET,
+			readMetaField(page, META_ENTRY_SIZE_OFFSET, META_ENTRY_SIZE_SIZE), META_ENTRY_SIZE_OFFSET)
+	}
+	header := pageToNodeHeader(page)
+	typeByte := (*page.GetData())[NODETYPE_OFFSET]
+	if header.nodeType == INTERNAL_NODE {
+		return fmt.Sprintf("btree internal node\n"+
+			"node type: 0x%02x (offset %d)\n"+
+			"numKeys: %d (offset %d)\n",
+			typeByte, NODETYPE_OFFSET, header.numKeys, NUM_KEYS_OFFSET)
+	}
+	return fmt.Sprintf("btree leaf node\n"+
+		"node type: 0x%02x (offset %d)\n"+
+		"numKeys: %d (offset %d)\n"+
+		"right sibling: %d (offset %d)\n"+
+		"leaf capacity: %d (offset %d)\n",
+		typeByte, NODETYPE_OFFSET, header.numKeys, NUM_KEYS_OFFSET,
+		readMetaField(page, RIGHT_SIBLING_PN_OFFSET, RIGHT_SIBLING_PN_SIZE), RIGHT_SIBLING_PN_OFFSET,
+		readMetaField(page, LEAF_CAPACITY_OFFSET, LEAF_CAPACITY_SIZE), LEAF_CAPACITY_OFFSET)
+}
+
+// readMetaField reads the varint stored at the given offset of the metadata page.
+func readMetaField(page *pager.Page, offset int64, size int64) int64 {
+	value, _ := binary.Varint((*page.GetData())[offset : offset+size])
+	return value
+}
+
+// writeMetaField writes a varint at the given offset of the metadata page.
+func writeMetaField(page *pager.Page, offset int64, size int64, value int64) {
+	data := make([]byte, size)
+	binary.PutVarint(data, value)
+	page.Update(data, offset, size)
+}
+
 // cellPos computes the position of a cell within a page given a headersize.
 func cellPos(headersize int64, cellnum int64) int64 {
 	return headersize + cellnum*ENTRYSIZE
@@ -122,6 +245,11 @@ func pnPos(index int64) int64 {
 	return PNS_OFFSET + index*PN_SIZE
 }
 
+// countPos returns the page offset to the internal node's ith child's subtree count.
+func countPos(index int64) int64 {
+	return COUNTS_OFFSET + index*COUNT_SIZE
+}
+
 /////////////////////////////////////////////////////////////////////////////
 //////////////////// Leaf Node Subroutine Functions /////////////////////////
 /////////////////////////////////////////////////////////////////////////////
@@ -132,23 +260,51 @@ func pageToLeafNode(page *pager.Page) *LeafNode {
 	rightSiblingPN, _ := binary.Varint(
 		(*page.GetData())[RIGHT_SIBLING_PN_OFFSET : RIGHT_SIBLING_PN_OFFSET+RIGHT_SIBLING_PN_SIZE],
 	)
+	capacity, _ := binary.Varint(
+		(*page.GetData())[LEAF_CAPACITY_OFFSET : LEAF_CAPACITY_OFFSET+LEAF_CAPACITY_SIZE],
+	)
+	// A freshly initialized leaf has no capacity until its creator sets one; use the default until then.
+	if capacity == 0 {
+		capacity = ENTRIES_PER_LEAF_NODE
+	}
 	return &LeafNode{
 		nodeHeader,
 		rightSiblingPN,
+		capacity,
+		nil,
 		nil,
 	}
 }
 
+// allocateNodePage allocates the page of a new node. If a scope is given, it holds the page's pin.
+func allocateNodePage(pager *pager.Pager, scope *pager.PinScope) (*pager.Page, error) {
+	if scope != nil {
+		return scope.Allocate()
+	}
+	return pager.AllocatePage()
+}
+
 // createLeafNode creates and returns a new leaf node.
-// Nodes created with this function must be `Put()` accordingly after use.
-func createLeafNode(pager *pager.Pager) (*LeafNode, error) {
-	newPN := pager.GetFreePN()
-	newPage, err := pager.GetPage(newPN)
+// putNodePage releases the pin on the page of a new node, through the scope it was created in, if any.
+func putNodePage(page *pager.Page, scope *pager.PinScope) {
+	if scope != nil {
+		scope.Put(page)
+		return
+	}
+	page.Put()
+}
+
+// Unless they are created in a scope, nodes created with this function must be `Put()` accordingly after use.
+func createLeafNode(pager *pager.Pager, scope *pager.PinScope) (*LeafNode, error) {
+	newPage, err := allocateNodePage(pager, scope)
 	if err != nil {
 		return &LeafNode{}, err
 	}
 	initPage(newPage, LEAF_NODE)
-	return pageToLeafNode(newPage), nil
+	node := pageToLeafNode(newPage)
+	// A zeroed sibling would point at the metadata page.
+	node.setRightSibling(NO_SIBLING_PN)
+	return node, nil
 }
 
 // getPage returns a pointer to the leaf node's page.
@@ -163,9 +319,10 @@ func (node *LeafNode) getNodeType() NodeType {
 
 // copy copies the attributes and data of toCopy to the leaf node.
 func (node *LeafNode) copy(toCopy *LeafNode) {
-	copy(*node.page.GetData(), *toCopy.page.GetData())
+	node.page.Update(*toCopy.page.GetData(), 0, pager.PAGESIZE)
 	node.updateNumKeys(toCopy.numKeys)
 	node.setRightSibling(toCopy.rightSiblingPN)
+	node.setCapacity(toCopy.capacity)
 }
 
 // isRoot returns true if the current node is the root node.
@@ -173,6 +330,13 @@ func (node *LeafNode) isRoot() bool {
 	return node.page.GetPageNum() == ROOT_PN
 }
 
+// hasRightSibling returns true if the leaf node is not the last leaf. A sibling can
+// never be the metadata page or the root, so leaves written with a zeroed sibling
+// are treated as the last leaf too.
+func (node *LeafNode) hasRightSibling() bool {
+	return node.rightSiblingPN > ROOT_PN
+}
+
 // setRightSibling sets the right sibling pagenumber attribute of the leaf node
 // and updates the leaf node's page accordingly. returns the old right sibling.
 func (node *LeafNode) setRightSibling(siblingPN int64) int64 {
@@ -190,6 +354,19 @@ func (node *LeafNode) setRightSibling(siblingPN int64) int64 {
 	return oldSiblingPN
 }
 
+// setCapacity sets the number of entries the leaf node holds before splitting
+// and updates the leaf node's page accordingly.
+func (node *LeafNode) setCapacity(capacity int64) {
+	node.capacity = capacity
+	capacityData := make([]byte, LEAF_CAPACITY_SIZE)
+	binary.PutVarint(capacityData, node.capacity)
+	node.page.Update(
+		capacityData,
+		LEAF_CAPACITY_OFFSET,
+		LEAF_CAPACITY_SIZE,
+	)
+}
+
 // cellPos returns the page offset to the cell at the given index.
 func (node *LeafNode) cellPos(index int64) int64 {
 	return cellPos(LEAF_NODE_HEADER_SIZE, index)
@@ -215,11 +392,12 @@ func (node *LeafNode) getKeyAt(index int64) int64 {
 	return node.getCell(index).GetKey()
 }
 
-// updateKeyAt updates the key at the given index of the leaf node.
+// updateKeyAt updates the key at the given index of the leaf node,
+// leaving the rest of the cell untouched.
 func (node *LeafNode) updateKeyAt(index int64, key int64) {
-	entry := node.getCell(index)
-	entry.SetKey(key)
-	node.modifyCell(index, entry)
+	data := make([]byte, ENTRY_KEY_SIZE)
+	binary.PutVarint(data, key)
+	node.page.Update(data, node.cellPos(index)+ENTRY_KEY_OFFSET, ENTRY_KEY_SIZE)
 }
 
 // getValueAt returns the value stored at the given index of the leaf node.
@@ -227,11 +405,12 @@ func (node *LeafNode) getValueAt(index int64) int64 {
 	return node.getCell(index).GetValue()
 }
 
-// updateValueAt updates the value at the given index of the leaf node.
+// updateValueAt updates the value at the given index of the leaf node,
+// leaving the rest of the cell untouched.
 func (node *LeafNode) updateValueAt(index int64, value int64) {
-	entry := node.getCell(index)
-	entry.SetValue(value)
-	node.modifyCell(index, entry)
+	data := make([]byte, ENTRY_VALUE_SIZE)
+	binary.PutVarint(data, value)
+	node.page.Update(data, node.cellPos(index)+ENTRY_VALUE_OFFSET, ENTRY_VALUE_SIZE)
 }
 
 // updateNumKeys updates the numKeys field in the node struct and the page.
@@ -243,6 +422,16 @@ func (node *LeafNode) updateNumKeys(nKeys int64) {
 	node.page.Update(nKeysData, NUM_KEYS_OFFSET, NUM_KEYS_SIZE)
 }
 
+// getLiveCount returns the number of entries in the leaf node that aren't tombstoned.
+func (node *LeafNode) getLiveCount() (count int64) {
+	for i := int64(0); i < node.numKeys; i++ {
+		if !node.getCell(i).isTombstone() {
+			count++
+		}
+	}
+	return count
+}
+
 /////////////////////////////////////////////////////////////////////////////
 ///////////////// Internal Node Subroutine Functions ////////////////////////
 /////////////////////////////////////////////////////////////////////////////
@@ -250,14 +439,13 @@ func (node *LeafNode) updateNumKeys(nKeys int64) {
 // pageToInternalNode returns the internal node corresponding to the given page.
 func pageToInternalNode(page *pager.Page) *InternalNode {
 	nodeHeader := pageToNodeHeader(page)
-	return &InternalNode{nodeHeader, nil}
+	return &InternalNode{nodeHeader, nil, nil}
 }
 
 // createInternalNode creates and returns a new internal node.
-// Nodes created with this function must be `Put()` accordingly after use.
-func createInternalNode(pager *pager.Pager) (*InternalNode, error) {
-	newPN := pager.GetFreePN()
-	newPage, err := pager.GetPage(newPN)
+// Unless they are created in a scope, nodes created with this function must be `Put()` accordingly after use.
+func createInternalNode(pager *pager.Pager, scope *pager.PinScope) (*InternalNode, error) {
+	newPage, err := allocateNodePage(pager, scope)
 	if err != nil {
 		return &InternalNode{}, err
 	}
@@ -277,7 +465,7 @@ func (node *InternalNode) getNodeType() NodeType {
 
 // copy copies the attributes and data of toCopy to node.
 func (node *InternalNode) copy(toCopy *InternalNode) {
-	copy(*node.page.GetData(), *toCopy.page.GetData())
+	node.page.Update(*toCopy.page.GetData(), 0, pager.PAGESIZE)
 	node.updateNumKeys(toCopy.numKeys)
 }
 
@@ -318,12 +506,87 @@ func (node *InternalNode) updatePNAt(index int64, pagenum int64) {
 	node.page.Update(data, startPos, PN_SIZE)
 }
 
+// getCountAt returns the number of live entries in the subtree of the internal node's ith child.
+func (node *InternalNode) getCountAt(index int64) int64 {
+	startPos := countPos(index)
+	count, _ := binary.Varint((*node.page.GetData())[startPos : startPos+COUNT_SIZE])
+	return count
+}
+
+// updateCountAt updates the subtree count of the internal node's ith child.
+func (node *InternalNode) updateCountAt(index int64, count int64) {
+	// Serialize the count data
+	data := make([]byte, COUNT_SIZE)
+	binary.PutVarint(data, count)
+	startPos := countPos(int64(index))
+	node.page.Update(data, startPos, COUNT_SIZE)
+}
+
+// countChange adds the change in live entries that the current write makes to the subtree
+// count of the ith child, which the write descends into next.
+// [CONCURRENCY] The child must already be locked, so that no one sees its count before
+// the change is made beneath it.
+func (node *InternalNode) countChange(index int64) {
+	if node.delta != 0 {
+		node.updateCountAt(index, node.getCountAt(index)+node.delta)
+	}
+}
+
+// getTotalCount returns the number of live entries in the internal node's subtree.
+func (node *InternalNode) getTotalCount() (total int64) {
+	for i := int64(0); i <= node.numKeys; i++ {
+		total += node.getCountAt(i)
+	}
+	return total
+}
+
+// getChildPNAt returns the pagenumber of the internal node's ith child.
+// Errors if the node is degenerate, e.g. an empty root whose pointers were never
+// written, rather than letting callers descend into the metadata or root pages.
+func (node *InternalNode) getChildPNAt(index int64) (int64, error) {
+	if index < 0 || index > node.numKeys {
+		return 0, fmt.Errorf("child index %d out of bounds", index)
+	}
+	pagenum := node.getPNAt(index)
+	if pagenum <= ROOT_PN {
+		return 0, fmt.Errorf("invalid child pagenum %d in node %d", pagenum, node.page.GetPageNum())
+	}
+	return pagenum, nil
+}
+
+// checkDescent returns ErrTreeTooDeep if descending to the given child would pass the
+// height limit, or would revisit this node or one of the ancestors it still holds, whose
+// locks we would otherwise wait on forever.
+func (node *InternalNode) checkDescent(pagenum int64) error {
+	if node.maxHeight > 0 && node.depth >= node.maxHeight {
+		return fmt.Errorf("%w: page %d is past the height limit of %d", ErrTreeTooDeep, pagenum, node.maxHeight)
+	}
+	for cur := Node(node); cur != nil && cur != SUPER_NODE; {
+		if cur.getPage().GetPageNum() == pagenum {
+			return fmt.Errorf("%w: page %d points back to page %d", ErrTreeTooDeep, node.page.GetPageNum(), pagenum)
+		}
+		switch castedCur := cur.(type) {
+		case *InternalNode:
+			cur = castedCur.parent
+		default:
+			cur = nil
+		}
+	}
+	return nil
+}
+
 // getChildAt returns the internal node's ith child.
 // if lock is true, the child page will be locked.
 // Nodes created with this function must be `Put()` accordingly after use.
 func (node *InternalNode) getChildAt(index int64, lock bool) (Node, error) {
 	// Get the child's page
-	pagenum := node.getPNAt(index)
+	pagenum, err := node.getChildPNAt(index)
+	if err != nil {
+		return &InternalNode{}, err
+	}
+	if err = node.checkDescent(pagenum); err != nil {
+		return &InternalNode{}, err
+	}
 	page, err := node.page.GetPager().GetPage(pagenum)
 	if err != nil {
 		return &InternalNode{}, err
@@ -331,7 +594,27 @@ func (node *InternalNode) getChildAt(index int64, lock bool) (Node, error) {
 	if lock {
 		page.WLock()
 	}
-	return pageToNode(page), nil
+	child := pageToNode(page)
+	setDescent(child, node.depth+1, node.maxHeight, node.order)
+	return child, nil
+}
+
+// getChildReadOnly gets the child at the given index, pinned read-only.
+func (node *InternalNode) getChildReadOnly(index int64) (Node, error) {
+	pagenum, err := node.getChildPNAt(index)
+	if err != nil {
+		return &InternalNode{}, err
+	}
+	if err = node.checkDescent(pagenum); err != nil {
+		return &InternalNode{}, err
+	}
+	page, err := node.page.GetPager().GetPageReadOnly(pagenum)
+	if err != nil {
+		return &InternalNode{}, err
+	}
+	child := pageToNode(page)
+	setDescent(child, node.depth+1, node.maxHeight, node.order)
+	return child, nil
 }
 
 // updateNumKeys updates the numKeys field in the node struct and the page.
@@ -356,6 +639,112 @@ func initRootNode(root Node) {
 	}
 }
 
+// setScope sets the scope that pins the pages created under the given root; children inherit it.
+func setScope(root Node, scope *pager.PinScope) {
+	switch castedRootNode := root.(type) {
+	case *InternalNode:
+		castedRootNode.scope = scope
+	case *LeafNode:
+		castedRootNode.scope = scope
+	}
+}
+
+// setDelta sets the change in live entries that the write starting at the given root makes;
+// children inherit it.
+func setDelta(root Node, delta int64) {
+	switch castedRootNode := root.(type) {
+	case *InternalNode:
+		castedRootNode.delta = delta
+	case *LeafNode:
+		castedRootNode.delta = delta
+	}
+}
+
+// setDescent sets the node's level in the current descent, the deepest level the descent
+// may reach, and the order of the table's keys; children inherit the last two.
+func setDescent(node Node, depth int64, maxHeight int64, order KeyOrder) {
+	switch castedNode := node.(type) {
+	case *InternalNode:
+		castedNode.depth, castedNode.maxHeight, castedNode.order = depth, maxHeight, order
+	case *LeafNode:
+		castedNode.depth, castedNode.maxHeight, castedNode.order = depth, maxHeight, order
+	}
+}
+
+// startDescent readies the table's root node for a descent.
+func (table *BTreeIndex) startDescent(root Node) {
+	setDescent(root, 1, table.maxHeight, table.order)
+}
+
+// getGuardedChildPN returns the page number of the ith child of an internal node at the
+// given level of a descent that walks pages directly, checking it with checkDescent first.
+func (table *BTreeIndex) getGuardedChildPN(node *InternalNode, depth int64, index int64) (int64, error) {
+	setDescent(node, depth, table.maxHeight, table.order)
+	pagenum, err := node.getChildPNAt(index)
+	if err != nil {
+		return 0, err
+	}
+	if err = node.checkDescent(pagenum); err != nil {
+		return 0, err
+	}
+	return pagenum, nil
+}
+
+// readDescent walks from the root down to a leaf, calling pick on each internal node on
+// the way for the index of the child to descend into, and then visit on the leaf. Each
+// child is checked with checkDescent first, as in getGuardedChildPN.
+// [CONCURRENCY] It crabs down with read latches, so that no node is read mid-split, and
+// holds the leaf's latch while visiting it. A frozen table has no writers, so it needs
+// no latches.
+func (table *BTreeIndex) readDescent(pick func(*InternalNode) int64, visit func(*LeafNode) error) error {
+	latch := !table.IsFrozen()
+	curPage, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return err
+	}
+	if latch {
+		curPage.RLock()
+	}
+	// Unpin only after unlocking, so that the page can't be evicted while we hold its lock.
+	release := func(page *pager.Page) {
+		if latch {
+			page.RUnlock()
+		}
+		page.Put()
+	}
+	for depth := int64(1); pageToNodeHeader(curPage).nodeType != LEAF_NODE; depth++ {
+		curNode := pageToInternalNode(curPage)
+		setDescent(curNode, depth, table.maxHeight, table.order)
+		childPN, err := table.getGuardedChildPN(curNode, depth, pick(curNode))
+		if err != nil {
+			release(curPage)
+			return err
+		}
+		childPage, err := table.pager.GetPage(childPN)
+		if err != nil {
+			release(curPage)
+			return err
+		}
+		if latch {
+			childPage.RLock()
+		}
+		release(curPage)
+		curPage = childPage
+	}
+	defer release(curPage)
+	leaf := pageToLeafNode(curPage)
+	leaf.order = table.order
+	return visit(leaf)
+}
+
+// snapshot returns a detached copy of the leaf, so that a cursor can keep reading it
+// after the leaf's latch is released; see Page.Clone.
+func (node *LeafNode) snapshot() *LeafNode {
+	clone := pageToLeafNode(node.page.Clone())
+	clone.order = node.order
+	return clone
+}
+
 // locks the super node and the root node.
 func lockRoot(page *pager.Page) {
 	SUPER_NODE.page.WLock()
@@ -391,8 +780,12 @@ func (node *InternalNode) initChild(child Node) {
 	switch castedChild := child.(type) {
 	case *InternalNode:
 		castedChild.parent = node
+		castedChild.scope = node.scope
+		castedChild.delta = node.delta
 	case *LeafNode:
 		castedChild.parent = node
+		castedChild.scope = node.scope
+		castedChild.delta = node.delta
 	}
 }
 
@@ -430,7 +823,7 @@ func (node *InternalNode) unlock() {
 // only checks if force == false
 func (node *LeafNode) unlockParent(force bool) error {
 	// If we could split and if we're not writing, don't unlock the parents.
-	if !force && node.numKeys == ENTRIES_PER_LEAF_NODE {
+	if !force && node.numKeys == node.capacity {
 		return nil
 	}
 	// Unlock the parents recursively, and remove parent pointers.
@@ -1,11 +1,16 @@
 package btree
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 
 	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
+// Number of entries a context-aware scan reads between checks for cancellation.
+var SCAN_CHECK_INTERVAL int64 = 256
+
 // Cursors are an abstration to represent locations in a table.
 type BTreeCursor struct {
 	table   *BTreeIndex // The table that this cursor point to.
@@ -17,28 +22,23 @@ type BTreeCursor struct {
 // TableStart returns a cursor pointing to the first entry of the table.
 func (table *BTreeIndex) TableStart() (utils.Cursor, error) {
 	cursor := BTreeCursor{table: table, cellnum: 0}
-	// Get the root page.
-	curPage, err := table.pager.GetPage(table.rootPN)
+	// Traverse the leftmost children until we reach a leaf node.
+	var leftmostNode *LeafNode
+	err := table.readDescent(func(node *InternalNode) int64 {
+		return 0
+	}, func(leaf *LeafNode) error {
+		leftmostNode = leaf.snapshot()
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer curPage.Put()
-	curHeader := pageToNodeHeader(curPage)
-	// Traverse the leftmost children until we reach a leaf node.
-	for curHeader.nodeType != LEAF_NODE {
-		curNode := pageToInternalNode(curPage)
-		leftmostPN := curNode.getPNAt(0)
-		curPage, err = table.pager.GetPage(leftmostPN)
-		if err != nil {
-			return nil, err
-		}
-		defer curPage.Put()
-		curHeader = pageToNodeHeader(curPage)
-	}
 	// Set the cursor to point to the first entry in the leftmost leaf node.
-	leftmostNode := pageToLeafNode(curPage)
 	cursor.isEnd = (leftmostNode.numKeys == 0)
 	cursor.curNode = leftmostNode
+	if err := cursor.skipTombstones(); err != nil {
+		return nil, err
+	}
 	return &cursor, nil
 }
 
@@ -47,26 +47,18 @@ func (table *BTreeIndex) TableStart() (utils.Cursor, error) {
 func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 	/* SOLUTION {{{ */
 	cursor := BTreeCursor{table: table, cellnum: 0}
-	// Get the root page.
-	curPage, err := table.pager.GetPage(table.rootPN)
+	// Traverse the rightmost children until we reach a leaf node.
+	var rightmostNode *LeafNode
+	err := table.readDescent(func(node *InternalNode) int64 {
+		return node.numKeys
+	}, func(leaf *LeafNode) error {
+		rightmostNode = leaf.snapshot()
+		return nil
+	})
 	if err != nil {
 		return &BTreeCursor{}, err
 	}
-	defer curPage.Put()
-	curHeader := pageToNodeHeader(curPage)
-	// Traverse the rightmost children until we reach a leaf node.
-	for curHeader.nodeType != LEAF_NODE {
-		curNode := pageToInternalNode(curPage)
-		rightmostPN := curNode.getPNAt(curHeader.numKeys)
-		curPage, err = table.pager.GetPage(rightmostPN)
-		if err != nil {
-			return &BTreeCursor{}, err
-		}
-		defer curPage.Put()
-		curHeader = pageToNodeHeader(curPage)
-	}
 	// Set the cursor to point to the last entry in the rightmost leaf node.
-	rightmostNode := pageToLeafNode(curPage)
 	cursor.isEnd = false
 	cursor.cellnum = rightmostNode.numKeys - 1
 	cursor.curNode = rightmostNode
@@ -80,28 +72,71 @@ func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 func (table *BTreeIndex) TableFind(key int64) (utils.Cursor, error) {
 	/* SOLUTION {{{ */
 	cursor := BTreeCursor{table: table}
-	// Get the root page.
-	rootPage, err := table.pager.GetPage(table.rootPN)
-	if err != nil {
-		return &BTreeCursor{}, err
-	}
-	defer rootPage.Put()
-	rootNode := pageToNode(rootPage)
 	// Find the leaf node and cellnum that this key belongs to.
-	leaf, cellnum, err := rootNode.keyToNodeEntry(key)
+	err := table.readDescent(func(node *InternalNode) int64 {
+		return node.search(key)
+	}, func(leaf *LeafNode) error {
+		var err error
+		cursor.curNode, cursor.cellnum, err = leaf.snapshot().keyToNodeEntry(key)
+		return err
+	})
 	if err != nil {
 		return &BTreeCursor{}, err
 	}
 	// Initialize cursor.
-	cursor.cellnum = cellnum
-	cursor.isEnd = (cellnum == leaf.numKeys)
-	cursor.curNode = leaf
+	cursor.isEnd = (cursor.cellnum == cursor.curNode.numKeys)
+	if err := cursor.skipTombstones(); err != nil {
+		return &BTreeCursor{}, err
+	}
 	return &cursor, nil
 	/* SOLUTION }}} */
 }
 
-// TableFindRange returns a slice of Entries with keys between the startKey and endKey.
+// CursorAt returns a cursor pointing to the entry at the given zero-based ordinal in key order.
+// Subtree counts let us descend directly to the right leaf.
+func (table *BTreeIndex) CursorAt(ordinal int64) (utils.Cursor, error) {
+	if ordinal < 0 {
+		return nil, errors.New("ordinal out of range")
+	}
+	var cursor *BTreeCursor
+	// Descend, skipping over the subtrees that lie entirely before the ordinal.
+	err := table.readDescent(func(node *InternalNode) int64 {
+		childIdx := int64(0)
+		for childIdx < node.numKeys && ordinal >= node.getCountAt(childIdx) {
+			ordinal -= node.getCountAt(childIdx)
+			childIdx++
+		}
+		return childIdx
+	}, func(leaf *LeafNode) error {
+		// Find the live entry at the remaining ordinal within the leaf, pointing the
+		// cursor at a snapshot of it so that the latch can be released right away.
+		for cellnum := int64(0); cellnum < leaf.numKeys; cellnum++ {
+			if leaf.getCell(cellnum).isTombstone() {
+				continue
+			}
+			if ordinal == 0 {
+				cursor = &BTreeCursor{table: table, cellnum: cellnum, curNode: leaf.snapshot()}
+				return nil
+			}
+			ordinal--
+		}
+		return errors.New("ordinal out of range")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// TableFindRange returns a slice of Entries with keys from the startKey up to but not
+// including the endKey, in the table's order. In a descending table, startKey should
+// therefore be the greater of the two.
 func (table *BTreeIndex) TableFindRange(startKey int64, endKey int64) ([]utils.Entry, error) {
+	return table.TableFindRangeCtx(context.Background(), startKey, endKey)
+}
+
+// TableFindRangeCtx is like TableFindRange, but gives up with ctx.Err() once ctx is cancelled.
+func (table *BTreeIndex) TableFindRangeCtx(ctx context.Context, startKey int64, endKey int64) ([]utils.Entry, error) {
 	/* SOLUTION {{{ */
 	// Initialize entries array, get starting cursor.
 	entries := make([]utils.Entry, 0)
@@ -110,45 +145,80 @@ func (table *BTreeIndex) TableFindRange(startKey int64, endKey int64) ([]utils.E
 		return entries, err
 	}
 	// Keep advancing the cursor and adding the current entry to the list of
-	// entries until reaching the end key.
-	curEntry, err := cursor.GetEntry()
-	if err != nil {
-		return entries, err
-	}
-	for endKey > curEntry.GetKey() && !cursor.IsEnd() {
-		entries = append(entries, curEntry)
-		cursor.StepForward()
-		curEntry, err = cursor.GetEntry()
-		if err != nil {
-			return entries, err
+	// entries until reaching the end key. The cursor may sit past the end of a
+	// leaf before moving on to the next one, so only read entries when it doesn't.
+	for n := int64(0); ; n++ {
+		// Periodically check whether the scan has been cancelled.
+		if n%SCAN_CHECK_INTERVAL == 0 {
+			if err = ctx.Err(); err != nil {
+				return entries, err
+			}
+		}
+		if !cursor.IsEnd() {
+			curEntry, err := cursor.GetEntry()
+			if err != nil {
+				return entries, err
+			}
+			if table.order.compare(curEntry.GetKey(), endKey) >= 0 {
+				break
+			}
+			entries = append(entries, curEntry)
+		}
+		if err = cursor.StepForward(); err != nil {
+			break
 		}
 	}
 	return entries, nil
 	/* SOLUTION }}} */
 }
 
-// stepForward moves the cursor ahead by one entry.
+// StepForward moves the cursor ahead by one entry, skipping deleted entries.
 func (cursor *BTreeCursor) StepForward() error {
+	if err := cursor.stepForward(); err != nil {
+		return err
+	}
+	return cursor.skipTombstones()
+}
+
+// skipTombstones moves the cursor past any deleted entries in the current node.
+func (cursor *BTreeCursor) skipTombstones() error {
+	for !cursor.isEnd && cursor.curNode.getCell(cursor.cellnum).isTombstone() {
+		if err := cursor.stepForward(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stepForward moves the cursor ahead by one cell.
+func (cursor *BTreeCursor) stepForward() error {
 	// If the cursor is at the end of the node, try visiting the next node.
 	if cursor.isEnd {
 		// Get the next node's page number.
-		nextPN := cursor.curNode.rightSiblingPN
-		if nextPN < 0 {
+		if !cursor.curNode.hasRightSibling() {
 			return errors.New("cannot advance the cursor further")
 		}
+		nextPN := cursor.curNode.rightSiblingPN
 		// Convert the page into a node.
 		nextPage, err := cursor.table.pager.GetPage(nextPN)
 		if err != nil {
 			return err
 		}
 		defer nextPage.Put()
-		nextNode := pageToLeafNode(nextPage)
+		// [CONCURRENCY] Snapshot the next node under a brief read latch, unless the table is frozen.
+		if !cursor.table.IsFrozen() {
+			nextPage.RLock()
+		}
+		nextNode := pageToLeafNode(nextPage.Clone())
+		if !cursor.table.IsFrozen() {
+			nextPage.RUnlock()
+		}
 		// Reinitialize the cursor.
 		cursor.cellnum = 0
 		cursor.isEnd = (cursor.cellnum == nextNode.numKeys)
 		cursor.curNode = nextNode
 		if cursor.isEnd {
-			return cursor.StepForward()
+			return cursor.stepForward()
 		}
 		return nil
 	}
@@ -174,3 +244,112 @@ func (cursor *BTreeCursor) GetEntry() (utils.Entry, error) {
 	entry := cursor.curNode.getCell(cursor.cellnum)
 	return entry, nil
 }
+
+// A RawIterator scans a table in order like a cursor, but yields each entry's key and
+// value as plain int64s rather than as a utils.Entry. Boxing an entry in the interface
+// allocates, so tight loops over many entries should prefer this; it only allocates
+// once per leaf, for the snapshot of the leaf that the cursor reads from.
+type RawIterator struct {
+	cursor  *BTreeCursor
+	started bool
+}
+
+// RawScan returns an iterator over the entries of the table, starting before the first.
+func (table *BTreeIndex) RawScan() (*RawIterator, error) {
+	cursor, err := table.TableStart()
+	if err != nil {
+		return nil, err
+	}
+	return &RawIterator{cursor: cursor.(*BTreeCursor)}, nil
+}
+
+// Next moves to the next entry and returns its key and value, or false once the
+// table has run out of entries.
+func (it *RawIterator) Next() (key int64, value int64, ok bool) {
+	if it.started {
+		if it.cursor.StepForward() != nil {
+			return 0, 0, false
+		}
+	}
+	it.started = true
+	// The cursor may sit past the end of a leaf before moving on to the next one.
+	for it.cursor.isEnd {
+		if it.cursor.StepForward() != nil {
+			return 0, 0, false
+		}
+	}
+	cell := it.cursor.curNode.getCell(it.cursor.cellnum)
+	return cell.key, cell.value, true
+}
+
+// Bookmark kinds, stored in the first byte of a bookmark.
+const (
+	BOOKMARK_AT    byte = 0 // Resume at the first key >= the bookmarked key.
+	BOOKMARK_AFTER byte = 1 // Resume at the first key > the bookmarked key.
+	BOOKMARK_END   byte = 2 // Resume at the end of the table.
+)
+
+// Bookmark serializes the cursor's position so that a scan can be resumed later with
+// ResumeFrom, without holding the cursor open in between.
+func (cursor *BTreeCursor) Bookmark() []byte {
+	if !cursor.isEnd {
+		return makeBookmark(BOOKMARK_AT, cursor.curNode.getKeyAt(cursor.cellnum))
+	}
+	// Past the end of a leaf, every later entry comes after the leaf's last key.
+	if cursor.curNode.numKeys > 0 {
+		return makeBookmark(BOOKMARK_AFTER, cursor.curNode.getKeyAt(cursor.curNode.numKeys-1))
+	}
+	// An empty leaf has no key to go by, so look ahead for the next entry.
+	next := *cursor
+	if next.StepForward() != nil || next.isEnd {
+		return []byte{BOOKMARK_END}
+	}
+	return makeBookmark(BOOKMARK_AT, next.curNode.getKeyAt(next.cellnum))
+}
+
+// makeBookmark encodes a bookmark of the given kind at the given key.
+func makeBookmark(kind byte, key int64) []byte {
+	bookmark := make([]byte, 1+binary.MaxVarintLen64)
+	bookmark[0] = kind
+	n := binary.PutVarint(bookmark[1:], key)
+	return bookmark[:1+n]
+}
+
+// ResumeFrom returns a cursor at the position saved by Bookmark. Since the table may
+// have changed in the meantime, the cursor points to the first key at or after the
+// bookmarked key in the table's order, whether or not that key still exists.
+func (table *BTreeIndex) ResumeFrom(bookmark []byte) (utils.Cursor, error) {
+	if len(bookmark) == 0 {
+		return nil, errors.New("empty bookmark")
+	}
+	kind := bookmark[0]
+	if kind == BOOKMARK_END {
+		return table.tableAfterEnd()
+	}
+	if kind != BOOKMARK_AT && kind != BOOKMARK_AFTER {
+		return nil, errors.New("malformed bookmark")
+	}
+	key, n := binary.Varint(bookmark[1:])
+	if n <= 0 || 1+n != len(bookmark) {
+		return nil, errors.New("malformed bookmark")
+	}
+	if kind == BOOKMARK_AFTER {
+		var ok bool
+		if key, ok = table.order.next(key); !ok {
+			return table.tableAfterEnd()
+		}
+	}
+	return table.TableFind(key)
+}
+
+// tableAfterEnd returns a cursor past the last entry of the table.
+func (table *BTreeIndex) tableAfterEnd() (utils.Cursor, error) {
+	c, err := table.TableEnd()
+	if err != nil {
+		return nil, err
+	}
+	cursor := c.(*BTreeCursor)
+	cursor.cellnum = cursor.curNode.numKeys
+	cursor.isEnd = true
+	return cursor, nil
+}
@@ -2,15 +2,32 @@ package btree
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 )
 
+// Entry layout constants.
+var ENTRY_KEY_OFFSET int64 = 0
+var ENTRY_KEY_SIZE int64 = binary.MaxVarintLen64
+var ENTRY_VALUE_OFFSET int64 = ENTRY_KEY_OFFSET + ENTRY_KEY_SIZE
+var ENTRY_VALUE_SIZE int64 = binary.MaxVarintLen64
+var ENTRY_FLAGS_OFFSET int64 = ENTRY_VALUE_OFFSET + ENTRY_VALUE_SIZE
+var ENTRY_FLAGS_SIZE int64 = 1
+
 // Global size for Entries.
-var ENTRYSIZE int64 = binary.MaxVarintLen64 * 2
+var ENTRYSIZE int64 = ENTRY_KEY_SIZE + ENTRY_VALUE_SIZE + ENTRY_FLAGS_SIZE
+
+// Entry flag bits.
+const (
+	TOMBSTONE_FLAG byte = 1 << 0 // The entry has been deleted but not yet vacuumed.
+	NULL_FLAG      byte = 1 << 1 // The entry's value is null; its value field holds 0.
+)
 
 // Entry is a struct of one unit of information in our table.
 type BTreeEntry struct {
 	key   int64
 	value int64
+	flags byte
 }
 
 // Get key.
@@ -28,29 +45,67 @@ func (entry *BTreeEntry) SetKey(key int64) {
 	entry.key = key
 }
 
-// Set value.
+// Set value. The entry is no longer null.
 func (entry *BTreeEntry) SetValue(value int64) {
 	entry.value = value
+	entry.flags &^= NULL_FLAG
+}
+
+// IsNull returns true if the entry's value is null.
+func (entry BTreeEntry) IsNull() bool {
+	return entry.flags&NULL_FLAG != 0
+}
+
+// SetNull makes the entry's value null, and its value 0.
+func (entry *BTreeEntry) SetNull() {
+	entry.value = 0
+	entry.flags |= NULL_FLAG
+}
+
+// isTombstone returns true if the entry has been deleted but not yet vacuumed.
+func (entry BTreeEntry) isTombstone() bool {
+	return entry.flags&TOMBSTONE_FLAG != 0
 }
 
 // Marshal serializes a given entry into a byte array.
 func (entry BTreeEntry) Marshal() []byte {
 	// Marshall the key field.
 	var newdata []byte
-	bin := make([]byte, binary.MaxVarintLen64)
+	bin := make([]byte, ENTRY_KEY_SIZE)
 	binary.PutVarint(bin, entry.GetKey())
 	newdata = bin
 	// Marshall the value field.
-	bin = make([]byte, binary.MaxVarintLen64)
+	bin = make([]byte, ENTRY_VALUE_SIZE)
 	binary.PutVarint(bin, entry.GetValue())
 	newdata = append(newdata, bin...)
+	// Marshall the flags field.
+	newdata = append(newdata, entry.flags)
 	// Return the combined byte array.
 	return newdata
 }
 
 // unmarshalEntry deserializes a byte array into an entry.
 func unmarshalEntry(data []byte) (entry BTreeEntry) {
-	k, _ := binary.Varint(data[:len(data)/2])
-	v, _ := binary.Varint(data[len(data)/2:])
-	return BTreeEntry{key: k, value: v}
+	k, _ := binary.Varint(data[ENTRY_KEY_OFFSET : ENTRY_KEY_OFFSET+ENTRY_KEY_SIZE])
+	v, _ := binary.Varint(data[ENTRY_VALUE_OFFSET : ENTRY_VALUE_OFFSET+ENTRY_VALUE_SIZE])
+	return BTreeEntry{key: k, value: v, flags: data[ENTRY_FLAGS_OFFSET]}
+}
+
+// Unmarshal deserializes a byte array produced by Marshal into this entry.
+// Every int64 fits in the binary.MaxVarintLen64 bytes reserved for each field,
+// so any entry survives a round trip; this errors only on malformed data.
+func (entry *BTreeEntry) Unmarshal(data []byte) error {
+	if int64(len(data)) != ENTRYSIZE {
+		return fmt.Errorf("entry must be %d bytes, got %d", ENTRYSIZE, len(data))
+	}
+	k, n := binary.Varint(data[ENTRY_KEY_OFFSET : ENTRY_KEY_OFFSET+ENTRY_KEY_SIZE])
+	if n <= 0 {
+		return errors.New("malformed entry key")
+	}
+	v, n := binary.Varint(data[ENTRY_VALUE_OFFSET : ENTRY_VALUE_OFFSET+ENTRY_VALUE_SIZE])
+	if n <= 0 {
+		return errors.New("malformed entry value")
+	}
+	*entry = BTreeEntry{key: k, value: v, flags: data[ENTRY_FLAGS_OFFSET]}
+	return nil
 }
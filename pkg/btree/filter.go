@@ -0,0 +1,80 @@
+package btree
+
+import (
+	hash "github.com/brown-csci1270/db/pkg/hash"
+)
+
+// Minimum number of bits in a table's bloom filter.
+var MIN_TABLE_FILTER_SIZE int64 = 1 << 16
+
+// Number of filter bits per entry when a table's bloom filter is built.
+var TABLE_FILTER_BITS_PER_KEY int64 = 16
+
+// MayContain reports whether the table may hold the given key, without descending the
+// tree. If it returns false, the key is definitely absent, so probes can skip Find.
+// Tables have no filter until RebuildFilter is called, and until then every key may be
+// present. Deleted keys stay in the filter until the next RebuildFilter.
+func (table *BTreeIndex) MayContain(key int64) bool {
+	table.filterMtx.RLock()
+	defer table.filterMtx.RUnlock()
+	if table.filter == nil {
+		return true
+	}
+	return table.filter.Contains(key)
+}
+
+// RebuildFilter builds a bloom filter over the keys currently in the table, sized to fit
+// them, and keeps it up to date with later inserts. The filter is only kept in memory,
+// so it must be rebuilt after the table is reopened.
+// [CONCURRENCY] The filter's lock is held throughout the scan, so inserts that finish
+// while it runs wait to add their keys to the new filter, rather than the old one.
+func (table *BTreeIndex) RebuildFilter() error {
+	table.filterMtx.Lock()
+	defer table.filterMtx.Unlock()
+	// Collect the keys before sizing the filter, since the count in the root isn't latched.
+	keys := make([]int64, 0)
+	cursor, err := table.TableStart()
+	if err != nil {
+		return err
+	}
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return err
+			}
+			keys = append(keys, entry.GetKey())
+		}
+		if err = cursor.StepForward(); err != nil {
+			break
+		}
+	}
+	size := TABLE_FILTER_BITS_PER_KEY * int64(len(keys))
+	if size < MIN_TABLE_FILTER_SIZE {
+		size = MIN_TABLE_FILTER_SIZE
+	}
+	filter := hash.CreateFilter(size)
+	for _, key := range keys {
+		filter.Insert(key)
+	}
+	table.filter = filter
+	return nil
+}
+
+// DropFilter stops keeping a bloom filter, so that MayContain always returns true.
+func (table *BTreeIndex) DropFilter() {
+	table.filterMtx.Lock()
+	defer table.filterMtx.Unlock()
+	table.filter = nil
+}
+
+// addToFilter records a newly inserted key in the bloom filter, if there is one.
+// [CONCURRENCY] It must be called once the insert has released every latch, since
+// RebuildFilter latches leaves while holding the filter's lock.
+func (table *BTreeIndex) addToFilter(key int64) {
+	table.filterMtx.Lock()
+	defer table.filterMtx.Unlock()
+	if table.filter != nil {
+		table.filter.Insert(key)
+	}
+}
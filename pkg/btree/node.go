@@ -12,20 +12,31 @@ import (
 
 // Split is a supporting data structure to propagate keys up our B+ tree.
 type Split struct {
-	isSplit bool  // A flag that's set if a split occurs.
-	key     int64 // The key to promote.
-	leftPN  int64 // The pagenumber for the left node.
-	rightPN int64 // The pagenumber for the right node.
-	err     error // Used to propagate errors upwards.
+	isSplit    bool  // A flag that's set if a split occurs.
+	key        int64 // The key to promote.
+	leftPN     int64 // The pagenumber for the left node.
+	rightPN    int64 // The pagenumber for the right node.
+	leftCount  int64 // The number of live entries under the left node.
+	rightCount int64 // The number of live entries under the right node.
+	err        error // Used to propagate errors upwards.
 }
 
+// InsertMode determines how an insert treats an existing entry with the same key.
+type InsertMode int
+
+const (
+	INSERT_ONLY InsertMode = 0 // Error if the key already exists.
+	UPDATE_ONLY InsertMode = 1 // Error if the key does not exist.
+	UPSERT      InsertMode = 2 // Insert if the key does not exist, else overwrite it.
+)
+
 // Node defines a common interface for leaf and internal nodes.
 type Node interface {
 	// Interface for main node functions.
 	search(int64) int64
-	insert(int64, int64, bool) Split
-	delete(int64)
-	get(int64) (int64, bool)
+	insert(int64, int64, InsertMode) Split
+	delete(int64, bool)
+	get(int64) (int64, bool, error)
 
 	// Interface for helper functions.
 	keyToNodeEntry(int64) (*LeafNode, int64, error)
@@ -38,7 +49,7 @@ type Node interface {
 ///////////////////////////// Leaf Node Methods /////////////////////////////
 /////////////////////////////////////////////////////////////////////////////
 
-// search returns the first index where key >= given key.
+// search returns the first index whose key is at or after the given key in the node's order.
 // If no key satisfies this condition, returns numKeys.
 func (node *LeafNode) search(key int64) int64 {
 	/* SOLUTION {{{ */
@@ -46,7 +57,7 @@ func (node *LeafNode) search(key int64) int64 {
 	minIndex := sort.Search(
 		int(node.numKeys),
 		func(idx int) bool {
-			return node.getKeyAt(int64(idx)) >= key
+			return node.order.compare(node.getKeyAt(int64(idx)), key) >= 0
 		},
 	)
 	return int64(minIndex)
@@ -54,8 +65,8 @@ func (node *LeafNode) search(key int64) int64 {
 }
 
 // insert finds the appropriate place in a leaf node to insert a new tuple.
-// if update is true, allow overwriting existing keys. else, error.
-func (node *LeafNode) insert(key int64, value int64, update bool) Split {
+// The mode determines whether existing keys may be, or must be, overwritten.
+func (node *LeafNode) insert(key int64, value int64, mode InsertMode) Split {
 	/* SOLUTION {{{ */
 	/* CONCURRENCY {{{ */
 	node.unlockParent(false)
@@ -68,15 +79,22 @@ func (node *LeafNode) insert(key int64, value int64, update bool) Split {
 		/* CONCURRENCY {{{ */
 		defer node.unlockParent(true)
 		/* CONCURRENCY }}} */
-		if update {
-			node.updateValueAt(insertPos, value)
+		if node.getCell(insertPos).isTombstone() {
+			// A deleted entry may be revived by an insert, but not updated.
+			if mode == UPDATE_ONLY {
+				return Split{err: errors.New("cannot update non-existent entry")}
+			}
+			node.modifyCell(insertPos, BTreeEntry{key: key, value: value})
 			return Split{}
-		} else {
+		}
+		if mode == INSERT_ONLY {
 			return Split{err: errors.New("cannot insert duplicate key")}
 		}
+		node.updateValueAt(insertPos, value)
+		return Split{}
 	}
 	// Return an error if we're updating a non-existent entry.
-	if update {
+	if mode == UPDATE_ONLY {
 		/* CONCURRENCY {{{ */
 		node.unlockParent(true)
 		/* CONCURRENCY }}} */
@@ -84,14 +102,13 @@ func (node *LeafNode) insert(key int64, value int64, update bool) Split {
 	}
 	// Shift entries to the right if needed.
 	for i := node.numKeys - 1; i >= insertPos; i-- {
-		node.updateKeyAt(i+1, node.getKeyAt(i))
-		node.updateValueAt(i+1, node.getValueAt(i))
+		node.modifyCell(i+1, node.getCell(i))
 	}
 	node.updateNumKeys(node.numKeys + 1)
 	// Modify the cell at this position.
 	node.modifyCell(insertPos, BTreeEntry{key: key, value: value})
 	// Check if we need to split the node.
-	if node.numKeys > ENTRIES_PER_LEAF_NODE {
+	if node.numKeys > node.capacity {
 		return node.split()
 	}
 	/* CONCURRENCY {{{ */
@@ -102,7 +119,9 @@ func (node *LeafNode) insert(key int64, value int64, update bool) Split {
 }
 
 // delete removes a given tuple from the leaf node, if the given key exists.
-func (node *LeafNode) delete(key int64) {
+// If tombstone is true, the entry is only marked as deleted and is left in
+// place until the next vacuum, so that cursors over this node stay valid.
+func (node *LeafNode) delete(key int64, tombstone bool) {
 	/* SOLUTION {{{ */
 	/* CONCURRENCY {{{ */
 	// Unlock parents, eventually unlock this node.
@@ -115,10 +134,16 @@ func (node *LeafNode) delete(key int64) {
 		// Thank you Mario! But our key is in another castle!
 		return
 	}
+	entry := node.getCell(deletePos)
+	// Mark the entry as deleted if we're in tombstone mode.
+	if tombstone {
+		entry.flags |= TOMBSTONE_FLAG
+		node.modifyCell(deletePos, entry)
+		return
+	}
 	// Shift entries to the left.
 	for i := deletePos; i < node.numKeys-1; i++ {
-		node.updateKeyAt(i, node.getKeyAt(i+1))
-		node.updateValueAt(i, node.getValueAt(i+1))
+		node.modifyCell(i, node.getCell(i+1))
 	}
 	node.updateNumKeys(node.numKeys - 1)
 	/* SOLUTION }}} */
@@ -127,34 +152,36 @@ func (node *LeafNode) delete(key int64) {
 // split is a helper function to split a leaf node, then propagate the split upwards.
 func (node *LeafNode) split() Split {
 	/* SOLUTION {{{ */
-	// Create a new leaf node to split our keys.
-	newNode, err := createLeafNode(node.page.GetPager())
+	// Create a new leaf node to split our keys, pinned until the split is over.
+	newNode, err := createLeafNode(node.page.GetPager(), node.scope)
 	if err != nil {
 		return Split{err: err}
 	}
-	defer newNode.getPage().Put()
+	defer putNodePage(newNode.getPage(), node.scope)
 	// Set the right sibling for our two nodes.
 	prevSiblingPN := node.setRightSibling(newNode.page.GetPageNum())
 	newNode.setRightSibling(prevSiblingPN)
+	newNode.setCapacity(node.capacity)
 	// Transfer entries to the new node (plus the new entry) accordingly.
 	midpoint := node.numKeys / 2
 	for i := midpoint; i < node.numKeys; i++ {
-		newNode.updateKeyAt(newNode.numKeys, node.getKeyAt(i))
-		newNode.updateValueAt(newNode.numKeys, node.getValueAt(i))
+		newNode.modifyCell(newNode.numKeys, node.getCell(i))
 		newNode.updateNumKeys(newNode.numKeys + 1)
 	}
 	node.updateNumKeys(midpoint)
 	return Split{
-		isSplit: true,
-		key:     newNode.getKeyAt(0), // Get the right node's first key
-		leftPN:  node.page.GetPageNum(),
-		rightPN: newNode.page.GetPageNum(),
+		isSplit:    true,
+		key:        newNode.getKeyAt(0), // Get the right node's first key
+		leftPN:     node.page.GetPageNum(),
+		rightPN:    newNode.page.GetPageNum(),
+		leftCount:  node.getLiveCount(),
+		rightCount: newNode.getLiveCount(),
 	}
 	/* SOLUTION }}} */
 }
 
 // get returns the value associated with a given key from the leaf node.
-func (node *LeafNode) get(key int64) (value int64, found bool) {
+func (node *LeafNode) get(key int64) (value int64, found bool, err error) {
 	// Unlock parents, eventually unlock this node.
 	node.unlockParent(true)
 	defer node.unlock()
@@ -162,10 +189,29 @@ func (node *LeafNode) get(key int64) (value int64, found bool) {
 	index := node.search(key)
 	if index >= node.numKeys || node.getKeyAt(index) != key {
 		// Thank you Mario! But our key is in another castle!
-		return 0, false
+		return 0, false, nil
 	}
 	entry := node.getCell(index)
-	return entry.GetValue(), true
+	if entry.isTombstone() {
+		return 0, false, nil
+	}
+	return entry.GetValue(), true, nil
+}
+
+// compact permanently removes all tombstoned entries from the leaf node.
+func (node *LeafNode) compact() {
+	live := int64(0)
+	for i := int64(0); i < node.numKeys; i++ {
+		entry := node.getCell(i)
+		if entry.isTombstone() {
+			continue
+		}
+		if live != i {
+			node.modifyCell(live, entry)
+		}
+		live++
+	}
+	node.updateNumKeys(live)
 }
 
 // keyToNodeEntry is a helper function to create cursors that point to a given index within a leaf node.
@@ -188,10 +234,14 @@ func (node *LeafNode) printNode(w io.Writer, firstPrefix string, prefix string)
 	// Print entries.
 	for cellnum := int64(0); cellnum < node.numKeys; cellnum++ {
 		entry := node.getCell(cellnum)
-		io.WriteString(w, fmt.Sprintf("%v |--> (%v, %v)\n",
-			prefix, entry.GetKey(), entry.GetValue()))
+		var deleted string
+		if entry.isTombstone() {
+			deleted = " (deleted)"
+		}
+		io.WriteString(w, fmt.Sprintf("%v |--> (%v, %v)%v\n",
+			prefix, entry.GetKey(), entry.GetValue(), deleted))
 	}
-	if node.rightSiblingPN > 0 {
+	if node.hasRightSibling() {
 		io.WriteString(w, fmt.Sprintf("%v |--+\n", prefix))
 		io.WriteString(w, fmt.Sprintf("%v    | right sibling @ [%v]\n",
 			prefix, node.rightSiblingPN))
@@ -203,7 +253,7 @@ func (node *LeafNode) printNode(w io.Writer, firstPrefix string, prefix string)
 /////////////////////////// Internal Node Methods ///////////////////////////
 /////////////////////////////////////////////////////////////////////////////
 
-// search returns the first index where key > given key.
+// search returns the first index whose key is after the given key in the node's order.
 // If no such index exists, it returns numKeys.
 func (node *InternalNode) search(key int64) int64 {
 	/* SOLUTION {{{ */
@@ -211,7 +261,7 @@ func (node *InternalNode) search(key int64) int64 {
 	minIndex := sort.Search(
 		int(node.numKeys),
 		func(idx int) bool {
-			return node.getKeyAt(int64(idx)) > key
+			return node.order.compare(node.getKeyAt(int64(idx)), key) > 0
 		},
 	)
 	return int64(minIndex)
@@ -219,7 +269,7 @@ func (node *InternalNode) search(key int64) int64 {
 }
 
 // insert finds the appropriate place in a leaf node to insert a new tuple.
-func (node *InternalNode) insert(key int64, value int64, update bool) Split {
+func (node *InternalNode) insert(key int64, value int64, mode InsertMode) Split {
 	/* SOLUTION {{{ */
 	/* CONCURRENCY {{{ */
 	node.unlockParent(false)
@@ -228,14 +278,19 @@ func (node *InternalNode) insert(key int64, value int64, update bool) Split {
 	childIdx := node.search(key)
 	child, err := node.getChildAt(childIdx, true)
 	if err != nil {
+		/* CONCURRENCY {{{ */
+		node.unlockParent(true)
+		node.unlock()
+		/* CONCURRENCY }}} */
 		return Split{err: err}
 	}
 	/* CONCURRENCY {{{ */
 	node.initChild(child)
 	/* CONCURRENCY }}} */
 	defer child.getPage().Put()
+	node.countChange(childIdx)
 	// Insert value into the child.
-	result := child.insert(key, value, update)
+	result := child.insert(key, value, mode)
 	// Insert a new key into our node if necessary.
 	if result.isSplit {
 		split := node.insertSplit(result)
@@ -260,14 +315,18 @@ func (node *InternalNode) insertSplit(split Split) Split {
 	for i := node.numKeys - 1; i >= insertPos; i-- {
 		node.updateKeyAt(i+1, node.getKeyAt(i))
 	}
-	// Shift children to the right.
+	// Shift children and their counts to the right.
 	for i := node.numKeys; i > insertPos; i-- {
 		node.updatePNAt(i+1, node.getPNAt(i))
+		node.updateCountAt(i+1, node.getCountAt(i))
 	}
 	// Insert the new key and pagenumber at this position.
 	node.updateKeyAt(insertPos, split.key)
 	node.updatePNAt(insertPos+1, split.rightPN)
 	node.updateNumKeys(node.numKeys + 1)
+	// Divide the split child's count between its two halves.
+	node.updateCountAt(insertPos, split.leftCount)
+	node.updateCountAt(insertPos+1, split.rightCount)
 	// Check if we need to split.
 	if node.numKeys > KEYS_PER_INTERNAL_NODE {
 		return node.split()
@@ -277,7 +336,7 @@ func (node *InternalNode) insertSplit(split Split) Split {
 }
 
 // delete removes a given tuple from the leaf node, if the given key exists.
-func (node *InternalNode) delete(key int64) {
+func (node *InternalNode) delete(key int64, tombstone bool) {
 	/* SOLUTION {{{ */
 	/* CONCURRENCY {{{ */
 	node.unlockParent(true)
@@ -286,31 +345,37 @@ func (node *InternalNode) delete(key int64) {
 	childIdx := node.search(key)
 	child, err := node.getChildAt(childIdx, true)
 	if err != nil {
+		/* CONCURRENCY {{{ */
+		node.unlockParent(true)
+		node.unlock()
+		/* CONCURRENCY }}} */
 		return
 	}
 	/* CONCURRENCY {{{ */
 	node.initChild(child)
 	/* CONCURRENCY }}} */
 	defer child.getPage().Put()
+	node.countChange(childIdx)
 	// Delete from child.
-	child.delete(key)
+	child.delete(key, tombstone)
 	/* SOLUTION }}} */
 }
 
 // split is a helper function that splits an internal node, then propagates the split upwards.
 func (node *InternalNode) split() Split {
 	/* SOLUTION {{{ */
-	// Create a new internal node to split our keys.
-	newNode, err := createInternalNode(node.page.GetPager())
+	// Create a new internal node to split our keys, pinned until the split is over.
+	newNode, err := createInternalNode(node.page.GetPager(), node.scope)
 	if err != nil {
 		return Split{err: err}
 	}
-	defer newNode.getPage().Put()
+	defer putNodePage(newNode.getPage(), node.scope)
 	// Compute the midpoint based on the number of children to move.
 	midpoint := (node.numKeys - 1) / 2
-	// Transfer the keys to the new node.
+	// Transfer the keys, children, and counts to the new node.
 	for i := midpoint; i <= node.numKeys; i++ {
 		newNode.updatePNAt(newNode.numKeys, node.getPNAt(i))
+		newNode.updateCountAt(newNode.numKeys, node.getCountAt(i))
 		if i < node.numKeys {
 			newNode.updateKeyAt(newNode.numKeys, node.getKeyAt(i))
 			newNode.updateNumKeys(newNode.numKeys + 1)
@@ -320,23 +385,27 @@ func (node *InternalNode) split() Split {
 	node.updateNumKeys(midpoint - 1)
 	// Propagate the split.
 	return Split{
-		isSplit: true,
-		key:     middleKey,
-		leftPN:  node.page.GetPageNum(),
-		rightPN: newNode.page.GetPageNum(),
+		isSplit:    true,
+		key:        middleKey,
+		leftPN:     node.page.GetPageNum(),
+		rightPN:    newNode.page.GetPageNum(),
+		leftCount:  node.getTotalCount(),
+		rightCount: newNode.getTotalCount(),
 	}
 	/* SOLUTION }}} */
 }
 
 // get returns the value associated with a given key from the leaf node.
-func (node *InternalNode) get(key int64) (value int64, found bool) {
+func (node *InternalNode) get(key int64) (value int64, found bool, err error) {
 	// [CONCURRENCY] Unlock parents.
 	node.unlockParent(true)
 	// Find the child.
 	childIdx := node.search(key)
 	child, err := node.getChildAt(childIdx, true)
 	if err != nil {
-		return 0, false
+		// [CONCURRENCY] The child would have unlocked us, so unlock ourselves.
+		node.unlock()
+		return 0, false, err
 	}
 	node.initChild(child)
 	defer child.getPage().Put()
@@ -2,37 +2,58 @@ package btree
 
 import (
 	"errors"
+	"math"
 )
 
+// IsBTree returns true if the keys in the table are correctly ordered, every subtree
+// count is accurate, and every leaf is as deep as the leftmost one, along with the first
+// and last keys in the table's order. Every page is pinned read-only, so the check cannot
+// modify the table.
 func IsBTree(index *BTreeIndex) (l int64, r int64, isbtree bool, err error) {
+	// Walk down the leftmost children first, reading only node headers, to learn how deep leaves are.
+	height, err := index.Height()
+	if err != nil {
+		return 0, 0, false, err
+	}
 	// Get the node from the page
-	rootPage, err := index.pager.GetPage(index.rootPN)
+	rootPage, err := index.pager.GetPageReadOnly(index.rootPN)
 	if err != nil {
 		return 0, 0, false, err
 	}
+	defer rootPage.Put()
 	n := pageToNode(rootPage)
-	return isBTree(n)
+	index.startDescent(n)
+	l, r, _, isbtree, err = isBTree(n, height)
+	return l, r, isbtree, err
 }
 
-func isBTree(n Node) (l int64, r int64, isbtree bool, err error) {
+// isBTree checks the subtree rooted at n, whose leaves should all be at the given depth,
+// returning its first and last keys and its number of live entries.
+func isBTree(n Node, height int64) (l int64, r int64, count int64, isbtree bool, err error) {
 	// Depending on the node type...
 	switch n := n.(type) {
 	case *InternalNode:
-		// Check that each key is less than the bounds of the node it goes around.
-		var lowest, highest int64
+		// Check that each key comes before the bounds of the node it goes around.
+		var lowest, highest, total int64
 		for i := int64(0); i < n.numKeys+1; i++ {
 			// Get child
-			c, err := n.getChildAt(i, false)
+			c, err := n.getChildReadOnly(i)
 			if err != nil {
-				return -1, -1, false, err
+				return -1, -1, 0, false, err
 			}
 			// Check if child is BTree
-			cl, cr, cisbtree, err := isBTree(c)
+			cl, cr, ccount, cisbtree, err := isBTree(c, height)
+			c.getPage().Put()
 			if err != nil {
-				return -1, -1, false, err
+				return -1, -1, 0, false, err
 			} else if !cisbtree {
-				return -1, -1, false, nil
+				return -1, -1, 0, false, nil
 			}
+			// Check that the child's subtree count is accurate.
+			if n.getCountAt(i) != ccount {
+				return -1, -1, 0, false, nil
+			}
+			total += ccount
 			// Set conditions.
 			if i == 0 {
 				lowest = cl
@@ -43,29 +64,83 @@ func isBTree(n Node) (l int64, r int64, isbtree bool, err error) {
 			// If it is, check that the key bounds work out.
 			if i-1 >= 0 {
 				k := n.getKeyAt(i - 1)
-				if k > cl {
-					return -1, -1, false, nil
+				if n.order.compare(k, cl) > 0 {
+					return -1, -1, 0, false, nil
 				}
 			}
 			if i < n.numKeys {
 				k := n.getKeyAt(i)
-				if k < cr {
-					return -1, -1, false, nil
+				if n.order.compare(k, cr) < 0 {
+					return -1, -1, 0, false, nil
 				}
 			}
 		}
 		// Return bounds.
-		return lowest, highest, true, nil
+		return lowest, highest, total, true, nil
 	case *LeafNode:
-		// Check that each key is less than the one after it.
+		if n.depth != height {
+			return -1, -1, 0, false, nil
+		}
+		// An empty leaf places no constraints on its neighbours.
+		if n.numKeys == 0 && n.order == DESCENDING {
+			return math.MinInt64, math.MaxInt64, 0, true, nil
+		} else if n.numKeys == 0 {
+			return math.MaxInt64, math.MinInt64, 0, true, nil
+		}
+		// Check that each key comes before the one after it.
 		for i := int64(0); i < n.numKeys-1; i++ {
-			if n.getKeyAt(i) > n.getKeyAt(i+1) {
-				return -1, -1, false, nil
+			if n.order.compare(n.getKeyAt(i), n.getKeyAt(i+1)) > 0 {
+				return -1, -1, 0, false, nil
 			}
 		}
 		// If good, return bounds.
-		return n.getKeyAt(0), n.getKeyAt(n.numKeys - 1), true, nil
+		return n.getKeyAt(0), n.getKeyAt(n.numKeys - 1), n.getLiveCount(), true, nil
 	default:
-		return -1, -1, false, errors.New("should not have gotten here")
+		return -1, -1, 0, false, errors.New("should not have gotten here")
+	}
+}
+
+// FindOrphanPages returns, in order, the pages of the table that can't be reached from
+// the root, e.g. those detached by a crash or a buggy split. The metadata page is never
+// an orphan. Every page is pinned read-only, so the search cannot modify the table.
+func (table *BTreeIndex) FindOrphanPages() ([]int64, error) {
+	reachable := map[int64]bool{META_PN: true}
+	if err := table.markReachable(table.rootPN, reachable); err != nil {
+		return nil, err
+	}
+	orphans := make([]int64, 0)
+	for pagenum := int64(0); pagenum < table.pager.GetNumPages(); pagenum++ {
+		if !reachable[pagenum] {
+			orphans = append(orphans, pagenum)
+		}
+	}
+	return orphans, nil
+}
+
+// markReachable marks the given page and every page below it as reachable.
+// Pages that are already marked aren't visited again, so a cycle can't loop forever.
+func (table *BTreeIndex) markReachable(pagenum int64, reachable map[int64]bool) error {
+	if reachable[pagenum] {
+		return nil
+	}
+	reachable[pagenum] = true
+	page, err := table.pager.GetPageReadOnly(pagenum)
+	if err != nil {
+		return err
+	}
+	defer page.Put()
+	node, ok := pageToNode(page).(*InternalNode)
+	if !ok {
+		return nil
+	}
+	for i := int64(0); i <= node.numKeys; i++ {
+		childPN, err := node.getChildPNAt(i)
+		if err != nil {
+			return err
+		}
+		if err = table.markReachable(childPN, reachable); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -32,51 +32,116 @@ func (r *Resource) GetResourceKey() int64 {
 // Lock manager handles transaction-level locks over database resources.
 type LockManager struct {
 	lmMtx sync.Mutex
-	locks map[Resource]*sync.RWMutex
+	locks map[Resource]*resourceLock
+}
+
+// A readers-writer lock on a resource. Unlike sync.RWMutex, it counts its readers, so
+// that a sole reader can upgrade to a writer without letting go of the resource.
+type resourceLock struct {
+	mtx            sync.Mutex
+	cond           *sync.Cond
+	readers        int  // Number of readers holding the lock.
+	writer         bool // Set while a writer holds the lock.
+	waitingWriters int  // Number of writers waiting; new readers wait behind them.
+}
+
+// Construct a new, unheld resource lock.
+func newResourceLock() *resourceLock {
+	lock := &resourceLock{}
+	lock.cond = sync.NewCond(&lock.mtx)
+	return lock
 }
 
 // Construct a new lock manager.
 func NewLockManager() *LockManager {
 	return &LockManager{
-		locks: make(map[Resource]*sync.RWMutex),
+		locks: make(map[Resource]*resourceLock),
 	}
 }
 
-// Lock a resource.
-func (lm *LockManager) Lock(r Resource, lType LockType) error {
-	// Safely acquire the lock itself, initializing it if needed.
+// Get the lock on the given resource, initializing it if needed.
+func (lm *LockManager) getLock(r Resource) *resourceLock {
 	lm.lmMtx.Lock()
+	defer lm.lmMtx.Unlock()
 	lock, found := lm.locks[r]
 	if !found {
-		lm.locks[r] = &sync.RWMutex{}
-		lock = lm.locks[r]
+		lock = newResourceLock()
+		lm.locks[r] = lock
 	}
-	lm.lmMtx.Unlock()
-	// Lock accordingly.
+	return lock
+}
+
+// Lock a resource.
+func (lm *LockManager) Lock(r Resource, lType LockType) error {
+	lock := lm.getLock(r)
+	lock.mtx.Lock()
+	defer lock.mtx.Unlock()
+	// Lock accordingly; like sync.RWMutex, waiting writers hold off new readers.
 	switch lType {
 	case R_LOCK:
-		lock.RLock()
+		for lock.writer || lock.waitingWriters > 0 {
+			lock.cond.Wait()
+		}
+		lock.readers++
 	case W_LOCK:
-		lock.Lock()
+		lock.waitingWriters++
+		for lock.writer || lock.readers > 0 {
+			lock.cond.Wait()
+		}
+		lock.waitingWriters--
+		lock.writer = true
 	}
 	return nil
 }
 
+// Upgrade turns the caller's read lock on a resource into a write lock in place, so that
+// no other writer can take the resource in between. The caller must hold a read lock on
+// it. If anyone else holds a read lock on it too, the read lock is kept and ErrConflict
+// is returned instead, since waiting for them could deadlock if they try to upgrade too.
+func (lm *LockManager) Upgrade(r Resource) error {
+	lm.lmMtx.Lock()
+	lock, found := lm.locks[r]
+	lm.lmMtx.Unlock()
+	if !found {
+		return errors.New("tried to upgrade nonexistent resource")
+	}
+	lock.mtx.Lock()
+	defer lock.mtx.Unlock()
+	if lock.writer || lock.readers == 0 {
+		return errors.New("tried to upgrade a resource that isn't read locked")
+	}
+	if lock.readers > 1 {
+		return ErrConflict
+	}
+	lock.readers = 0
+	lock.writer = true
+	return nil
+}
+
 // Unlock a resource.
 func (lm *LockManager) Unlock(r Resource, lType LockType) error {
 	// Safely acquire the lock itself.
 	lm.lmMtx.Lock()
 	lock, found := lm.locks[r]
+	lm.lmMtx.Unlock()
 	if !found {
 		return errors.New("tried to unlock nonexistent resource")
 	}
-	lm.lmMtx.Unlock()
+	lock.mtx.Lock()
+	defer lock.mtx.Unlock()
 	// Unlock accordingly.
 	switch lType {
 	case R_LOCK:
-		lock.RUnlock()
+		if lock.readers == 0 {
+			return errors.New("tried to unlock a resource that isn't read locked")
+		}
+		lock.readers--
 	case W_LOCK:
-		lock.Unlock()
+		if !lock.writer {
+			return errors.New("tried to unlock a resource that isn't write locked")
+		}
+		lock.writer = false
 	}
+	lock.cond.Broadcast()
 	return nil
 }
@@ -5,12 +5,37 @@ import (
 	"sync"
 
 	db "github.com/brown-csci1270/db/pkg/db"
+	utils "github.com/brown-csci1270/db/pkg/utils"
 	uuid "github.com/google/uuid"
 )
 
+// Returned by Lock when taking a lock would deadlock; the transaction should be rolled back.
+var ErrDeadlock = errors.New("deadlock detected")
+
+// Returned by Lock when a transaction can't upgrade its read lock on a key to a write lock
+// because another transaction reads the key too. The read lock is kept; like ErrDeadlock,
+// the transaction may succeed if it is rolled back and rerun.
+var ErrConflict = errors.New("transaction conflict")
+
+// Indicates how long a transaction holds the read locks it takes.
+type IsolationLevel int
+
+const (
+	// Read locks are released as soon as each read is done, so every read sees the
+	// latest committed value, but reading the same key twice may give different answers.
+	READ_COMMITTED IsolationLevel = 0
+	// Read locks are held until commit, so repeated reads of a key always agree.
+	REPEATABLE_READ IsolationLevel = 1
+	// Every lock is held until commit (strict two-phase locking). Since locks are taken
+	// per key and selects take none, this currently locks exactly like REPEATABLE_READ
+	// and does not prevent phantoms.
+	SERIALIZABLE IsolationLevel = 2
+)
+
 // Each client can have a transaction running. Each transaction has a list of locked resources.
 type Transaction struct {
 	clientId  uuid.UUID
+	isolation IsolationLevel
 	resources map[Resource]LockType
 	lock      sync.RWMutex
 }
@@ -40,6 +65,11 @@ func (t *Transaction) GetClientID() uuid.UUID {
 	return t.clientId
 }
 
+// Get the transaction's isolation level.
+func (t *Transaction) GetIsolationLevel() IsolationLevel {
+	return t.isolation
+}
+
 // Get the transaction's resources.
 func (t *Transaction) GetResources() map[Resource]LockType {
 	return t.resources
@@ -76,19 +106,57 @@ func (tm *TransactionManager) GetTransaction(clientId uuid.UUID) (*Transaction,
 	return t, found
 }
 
-// Begin a transaction for the given client; error if already began.
+// Begin a SERIALIZABLE transaction for the given client; error if already began.
 func (tm *TransactionManager) Begin(clientId uuid.UUID) error {
+	return tm.BeginWithIsolation(clientId, SERIALIZABLE)
+}
+
+// Begin a transaction at the given isolation level for the given client; error if already began.
+func (tm *TransactionManager) BeginWithIsolation(clientId uuid.UUID, level IsolationLevel) error {
+	if level != READ_COMMITTED && level != REPEATABLE_READ && level != SERIALIZABLE {
+		return errors.New("invalid isolation level")
+	}
 	tm.tmMtx.Lock()
 	defer tm.tmMtx.Unlock()
 	_, found := tm.transactions[clientId]
 	if found {
 		return errors.New("transaction already began")
 	}
-	tm.transactions[clientId] = &Transaction{clientId: clientId, resources: make(map[Resource]LockType)}
+	tm.transactions[clientId] = &Transaction{
+		clientId:  clientId,
+		isolation: level,
+		resources: make(map[Resource]LockType),
+	}
 	return nil
 }
 
-// Locks the given resource. Will return an error if deadlock is created.
+// Find reads the given key on behalf of the given client's transaction, holding a
+// read lock on it for as long as the transaction's isolation level requires.
+func (tm *TransactionManager) Find(clientId uuid.UUID, table db.Index, key int64) (utils.Entry, error) {
+	t, found := tm.GetTransaction(clientId)
+	if !found {
+		return nil, errors.New("transaction not found")
+	}
+	// Check whether we already hold a lock that must outlive this read.
+	resource := Resource{tableName: table.GetName(), resourceKey: key}
+	t.RLock()
+	_, held := t.resources[resource]
+	t.RUnlock()
+	if err := tm.Lock(clientId, table, key, R_LOCK); err != nil {
+		return nil, err
+	}
+	entry, err := table.Find(key)
+	// Under READ_COMMITTED, give back a read lock taken just for this read.
+	if t.isolation == READ_COMMITTED && !held {
+		if unlockErr := tm.Unlock(clientId, table, key, R_LOCK); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}
+	return entry, err
+}
+
+// Locks the given resource. Will return an error if deadlock is created, or if the
+// transaction holds a read lock that it can't upgrade.
 func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceKey int64, lType LockType) error {
 	/* SOLUTION {{{ */
 	// Get the transaction we want, and construct the resource.
@@ -102,13 +170,21 @@ func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceK
 	// Check if we already have rights to the resource
 	t.RLock()
 	if curLockType, ok := t.resources[resource]; ok {
-		tm.tmMtx.RUnlock()
 		if curLockType == W_LOCK || curLockType == lType {
+			tm.tmMtx.RUnlock()
 			t.RUnlock()
 			return nil
 		}
 		t.RUnlock()
-		return errors.New("cannot upgrade to write lock in the middle of transaction")
+		tm.tmMtx.RUnlock()
+		// Upgrade the read lock in place, keeping it if another transaction reads the key.
+		if err := tm.lm.Upgrade(resource); err != nil {
+			return err
+		}
+		t.WLock()
+		defer t.WUnlock()
+		t.resources[resource] = W_LOCK
+		return nil
 	}
 	t.RUnlock()
 	// Create a precedence graph, see if we create a cycle by locking this resource.
@@ -122,7 +198,7 @@ func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceK
 	// If a deadlock, unlock and error.
 	if tm.pGraph.DetectCycle() {
 		tm.tmMtx.RUnlock()
-		return errors.New("deadlock detected")
+		return ErrDeadlock
 	}
 	// Else, lock the resource.
 	tm.tmMtx.RUnlock()
@@ -134,6 +210,38 @@ func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceK
 	/* SOLUTION }}} */
 }
 
+// LockTable write-locks every key in the given table, and every key of it that another
+// transaction holds a lock on, so that no other running transaction is using the table
+// once it returns. Will return an error if deadlock is created.
+func (tm *TransactionManager) LockTable(clientId uuid.UUID, table db.Index) error {
+	entries, err := table.Select()
+	if err != nil {
+		return err
+	}
+	keys := make(map[int64]bool)
+	for _, entry := range entries {
+		keys[entry.GetKey()] = true
+	}
+	// Include keys that other transactions have locked but not (or no longer) stored.
+	tm.tmMtx.RLock()
+	for _, t := range tm.transactions {
+		t.RLock()
+		for r := range t.resources {
+			if r.tableName == table.GetName() {
+				keys[r.resourceKey] = true
+			}
+		}
+		t.RUnlock()
+	}
+	tm.tmMtx.RUnlock()
+	for key := range keys {
+		if err := tm.Lock(clientId, table, key, W_LOCK); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Unlocks the given resource.
 func (tm *TransactionManager) Unlock(clientId uuid.UUID, table db.Index, resourceKey int64, lType LockType) error {
 	/* SOLUTION {{{ */
@@ -150,10 +258,10 @@ func (tm *TransactionManager) Unlock(clientId uuid.UUID, table db.Index, resourc
 	defer t.WUnlock()
 	removed := false
 	for r, storedType := range t.resources {
-		if storedType != lType {
-			return errors.New("incorrect unlock type")
-		}
 		if r == resource {
+			if storedType != lType {
+				return errors.New("incorrect unlock type")
+			}
 			removed = true
 			delete(t.resources, r)
 			break
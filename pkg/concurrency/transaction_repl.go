@@ -17,6 +17,7 @@ import (
 // Transaction REPL.
 func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 	r := repl.NewRepl()
+	r.SetName("concurrency")
 	r.AddCommand("create", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCreateTable(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Create a table. usage: create table <table>")
@@ -40,7 +41,7 @@ func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 	}, "Joins two tables. usage: join <table1> <key/val for table1> on <table2> <key/val for table2>")
 	r.AddCommand("transaction", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleTransaction(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Handle transactions. usage: transaction <begin|commit>")
+	}, "Handle transactions. usage: transaction <begin [read_committed|repeatable_read|serializable]|commit>")
 	r.AddCommand("lock", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleLock(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Grabs a write lock on a resource. usage: lock <table> <key>")
@@ -54,14 +55,30 @@ func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 func HandleTransaction(d *db.Database, tm *TransactionManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: create <type> table <table>
-	if numFields != 2 || (fields[1] != "begin" && fields[1] != "commit") {
-		return errors.New("usage: transaction <begin|commit>")
+	// Usage: transaction <begin [level]|commit>
+	usage := errors.New("usage: transaction <begin [read_committed|repeatable_read|serializable]|commit>")
+	if numFields < 2 || (fields[1] != "begin" && fields[1] != "commit") {
+		return usage
 	}
 	switch fields[1] {
 	case "begin":
-		return tm.Begin(clientId)
+		if numFields == 2 {
+			return tm.Begin(clientId)
+		}
+		levels := map[string]IsolationLevel{
+			"read_committed":  READ_COMMITTED,
+			"repeatable_read": REPEATABLE_READ,
+			"serializable":    SERIALIZABLE,
+		}
+		level, ok := levels[fields[2]]
+		if numFields != 3 || !ok {
+			return usage
+		}
+		return tm.BeginWithIsolation(clientId, level)
 	case "commit":
+		if numFields != 2 {
+			return usage
+		}
 		return tm.Commit(clientId)
 	default:
 		return errors.New("internal error in create table handler")
@@ -89,13 +106,16 @@ func HandleFind(d *db.Database, tm *TransactionManager, payload string, w io.Wri
 	if table, err = d.GetTable(fields[3]); err != nil {
 		return fmt.Errorf("find error: %v", err)
 	}
-	// Get the transaction, run the find, release lock and rollback if error.
-	if err = tm.Lock(clientId, table, int64(key), R_LOCK); err != nil {
-		return fmt.Errorf("find error: %v", err)
+	// Run the find under the transaction, which decides how long to keep the read lock.
+	entry, err := tm.Find(clientId, table, int64(key))
+	if err != nil {
+		return fmt.Errorf("find error: %w", err)
 	}
-	if err = db.HandleFind(d, payload, w); err != nil {
-		return fmt.Errorf("find error: %v", err)
+	if entry == nil {
+		return fmt.Errorf("find error: key %d not found", key)
 	}
+	io.WriteString(w, fmt.Sprintf("found entry: (%d, %d)\n",
+		entry.GetKey(), entry.GetValue()))
 	return nil
 }
 
@@ -117,7 +137,7 @@ func HandleInsert(d *db.Database, tm *TransactionManager, payload string, client
 	}
 	// Get the transaction, run the find, release lock and rollback if error.
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	if err = db.HandleInsert(d, payload); err != nil {
 		return fmt.Errorf("insert error: %v", err)
@@ -143,7 +163,7 @@ func HandleUpdate(d *db.Database, tm *TransactionManager, payload string, client
 	}
 	// Get the transaction, run the find, release lock and rollback if error.
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	if err = db.HandleUpdate(d, payload); err != nil {
 		return fmt.Errorf("update error: %v", err)
@@ -169,7 +189,7 @@ func HandleDelete(d *db.Database, tm *TransactionManager, payload string, client
 	}
 	// Get the transaction, run the find, release lock and rollback if error.
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	if err = db.HandleDelete(d, payload); err != nil {
 		return fmt.Errorf("delete error: %v", err)
@@ -222,7 +242,7 @@ func HandleLock(d *db.Database, tm *TransactionManager, payload string, w io.Wri
 		return fmt.Errorf("lock error: %v", err)
 	}
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
-		return fmt.Errorf("lock error: %v", err)
+		return fmt.Errorf("lock error: %w", err)
 	}
 	return nil
 }
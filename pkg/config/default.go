@@ -13,6 +13,12 @@ const NumPages = 32
 // Name of log file.
 const LogFileName = "./db.log"
 
+// Name of the REPL history file, kept in the DB folder.
+const HistoryFileName = ".db_history"
+
+// Number of commands kept in the REPL history file.
+const HistoryLimit = 1000
+
 // Return prompt if requested, else "".
 func GetPrompt(flag bool) string {
 	if flag {
@@ -2,11 +2,14 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
 	btree "github.com/brown-csci1270/db/pkg/btree"
 	hash "github.com/brown-csci1270/db/pkg/hash"
@@ -18,6 +21,8 @@ import (
 type Database struct {
 	basepath string
 	tables   map[string]Index
+	typed    map[string]*TypedTable // Open typed tables, whose indexes are also in tables.
+	mtx      sync.Mutex             // Guards tables and typed.
 }
 
 // Index interface.
@@ -58,17 +63,26 @@ func Open(folder string) (*Database, error) {
 	return &Database{
 		basepath: folder,
 		tables:   make(map[string]Index),
+		typed:    make(map[string]*TypedTable),
 	}, nil
 }
 
 // Close each table in the database, then close the database.
 func (db *Database) Close() (err error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
 	for _, table := range db.tables {
 		curErr := table.Close()
 		if err == nil {
 			err = curErr
 		}
 	}
+	for _, table := range db.typed {
+		curErr := table.tuples.close()
+		if err == nil {
+			err = curErr
+		}
+	}
 	return err
 }
 
@@ -91,32 +105,63 @@ func (db *Database) createTable(name string, indexType IndexType) (index Index,
 	if alphanumeric.MatchString(name) {
 		return nil, errors.New("table name must be alphanumeric")
 	}
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
 	// Create the file, if not exists.
 	path := filepath.Join(db.basepath, name)
 	if _, err := os.Stat(path); err == nil {
 		return nil, errors.New("table already exists")
 	}
 	// Open the right type of index.
-	switch indexType {
-	case BTreeIndexType:
-		index, err = btree.OpenTable(path)
-		if err != nil {
-			return nil, err
-		}
-	case HashIndexType:
-		index, err = hash.OpenTable(path)
-		if err != nil {
-			return nil, err
-		}
-	default:
-		return nil, errors.New("invalid index type")
+	index, err = OpenIndex(path, indexType)
+	if err != nil {
+		return nil, err
 	}
 	db.tables[name] = index
 	return index, nil
 }
 
+// Drop a table, closing it if it is open and removing its files.
+func (db *Database) DropTable(name string) error {
+	// Ensure the db name is alphanumeric, so that only tables can be removed.
+	alphanumeric, _ := regexp.Compile(`\W`)
+	if alphanumeric.MatchString(name) {
+		return errors.New("table name must be alphanumeric")
+	}
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	path := filepath.Join(db.basepath, name)
+	if index, ok := db.tables[name]; ok {
+		delete(db.tables, name)
+		if err := index.Close(); err != nil {
+			return err
+		}
+	} else if _, err := os.Stat(path); err != nil {
+		return errors.New("table not found")
+	}
+	if typed, ok := db.typed[name]; ok {
+		delete(db.typed, name)
+		if err := typed.tuples.close(); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	// Only hash indexes have a meta file, only typed tables have schema and tuple files,
+	// and only analyzed tables have a stats file.
+	for _, suffix := range []string{".meta", SCHEMA_SUFFIX, TUPLES_SUFFIX, STATS_SUFFIX} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 // Get a table by its name, either from existing tables, or by creating a new one.
 func (db *Database) GetTable(name string) (index Index, err error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
 	// Check existing set of tables.
 	if idx, ok := db.tables[name]; ok {
 		return idx, nil
@@ -144,12 +189,84 @@ func (db *Database) GetTable(name string) (index Index, err error) {
 	return index, nil
 }
 
-// Get a database's tables.
+// Get a snapshot of a database's open tables, which stays the same as tables are
+// opened and dropped.
 func (db *Database) GetTables() map[string]Index {
-	return db.tables
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	tables := make(map[string]Index, len(db.tables))
+	for name, table := range db.tables {
+		tables[name] = table
+	}
+	return tables
+}
+
+// sortedTableNames returns the names of the given tables in sorted order.
+func sortedTableNames(tables map[string]Index) []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IndexTypeName returns the name that create uses for the given index's type.
+func IndexTypeName(index Index) string {
+	switch index.(type) {
+	case *btree.BTreeIndex:
+		return "btree"
+	case *hash.HashIndex:
+		return "hash"
+	default:
+		return "unknown"
+	}
 }
 
 // Returns the basepath of the database.
 func (db *Database) GetBasePath() string {
 	return db.basepath
 }
+
+// Verify runs the structural checker over every open table, returning an error
+// that names each inconsistent table. Pages do not carry checksums, so the check
+// is purely structural. Verify does not modify any table, but should only be run
+// while no other operations are in flight.
+func Verify(d *Database) error {
+	failures := make([]string, 0)
+	tables := d.GetTables()
+	for _, name := range sortedTableNames(tables) {
+		if err := VerifyTable(tables[name]); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("verify failed: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// VerifyTable runs the structural checker matching the given table's index type.
+func VerifyTable(index Index) error {
+	switch index := index.(type) {
+	case *btree.BTreeIndex:
+		_, _, ok, err := btree.IsBTree(index)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("keys are out of order")
+		}
+	case *hash.HashIndex:
+		ok, err := hash.IsHash(index)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("entry found in the wrong bucket")
+		}
+	default:
+		return errors.New("unknown index type")
+	}
+	return nil
+}
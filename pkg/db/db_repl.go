@@ -1,12 +1,19 @@
 package db
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strconv"
 	"strings"
 
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	pager "github.com/brown-csci1270/db/pkg/pager"
 	repl "github.com/brown-csci1270/db/pkg/repl"
 	utils "github.com/brown-csci1270/db/pkg/utils"
 )
@@ -14,9 +21,13 @@ import (
 // Creates a DB Repl for the given index.
 func DatabaseRepl(db *Database) *repl.REPL {
 	r := repl.NewRepl()
+	r.SetName("db")
 	r.AddCommand("create", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCreateTable(db, payload, replConfig.GetWriter())
 	}, "Create a table. usage: create table <table>")
+	r.AddCommand("drop", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleDropTable(db, payload, replConfig.GetWriter())
+	}, "Drop a table and delete its files. usage: drop table <table>")
 	r.AddCommand("find", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleFind(db, payload, replConfig.GetWriter())
 	}, "Find an element. usage: find <key> from <table>")
@@ -24,11 +35,38 @@ func DatabaseRepl(db *Database) *repl.REPL {
 	r.AddCommand("update", func(payload string, replConfig *repl.REPLConfig) error { return HandleUpdate(db, payload) }, "Update en element. usage: update <table> <key> <value>")
 	r.AddCommand("delete", func(payload string, replConfig *repl.REPLConfig) error { return HandleDelete(db, payload) }, "Delete an element. usage: delete <key> from <table>")
 	r.AddCommand("select", func(payload string, replConfig *repl.REPLConfig) error {
-		return HandleSelect(db, payload, replConfig.GetWriter())
+		return HandleSelectCtx(replConfig.GetContext(), db, payload, replConfig.GetWriter())
 	}, "Select elements from a table. usage: select from <table>")
+	r.AddCommand("typed_create", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleTypedCreate(db, payload, replConfig.GetWriter())
+	}, "Create a table of typed rows; the first column is the int primary key. usage: typed_create <table> <column>:<int|string|bool>...")
+	r.AddCommand("typed_insert", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleTypedInsert(db, payload)
+	}, "Insert a row into a typed table. usage: typed_insert <table> <value>...")
+	r.AddCommand("typed_select", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleTypedSelect(db, payload, replConfig.GetWriter())
+	}, "Select the rows of a typed table. usage: typed_select <table>")
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(db, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
+	r.AddCommand("export", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleExport(db, payload, replConfig.GetWriter())
+	}, "Export a table as key,value CSV lines. usage: export <table> <path>")
+	r.AddCommand("import", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleImport(db, payload, replConfig.GetWriter())
+	}, "Import key,value CSV lines into a table. usage: import <table> <path>")
+	r.AddCommand("analyze", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleAnalyze(db, payload, replConfig.GetWriter())
+	}, "Compute and store the planner statistics of a table, then print them. usage: analyze <table>")
+	r.AddCommand("verify", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleVerify(db, payload, replConfig.GetWriter())
+	}, "Check the structure of every open table. usage: verify")
+	r.AddCommand("page_dump", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandlePageDump(db, payload, replConfig.GetWriter())
+	}, "Print a page's header fields and raw bytes. usage: page_dump <table> <pagenum>")
+	r.AddCommand(".tables", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleTables(db, payload, replConfig.GetWriter())
+	}, "List the open tables with their types and page counts. usage: .tables")
 	return r
 }
 
@@ -58,6 +96,22 @@ func HandleCreateTable(d *Database, payload string, w io.Writer) (err error) {
 	return nil
 }
 
+// Handle drop table.
+func HandleDropTable(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: drop table <table>
+	if numFields != 3 || fields[1] != "table" {
+		return fmt.Errorf("usage: drop table <table>")
+	}
+	tableName := fields[2]
+	if err = d.DropTable(tableName); err != nil {
+		return fmt.Errorf("drop error: %v", err)
+	}
+	io.WriteString(w, fmt.Sprintf("table %s dropped.\n", tableName))
+	return nil
+}
+
 // Handle find.
 func HandleFind(d *Database, payload string, w io.Writer) (err error) {
 	fields := strings.Fields(payload)
@@ -76,9 +130,12 @@ func HandleFind(d *Database, payload string, w io.Writer) (err error) {
 		return fmt.Errorf("find error: %v", err)
 	}
 	entry, err := table.Find(int64(key))
-	if err != nil || entry == nil {
+	if err != nil {
 		return fmt.Errorf("find error: %v", err)
 	}
+	if entry == nil {
+		return fmt.Errorf("find error: key %d not found", key)
+	}
 	io.WriteString(w, fmt.Sprintf("found entry: (%d, %d)\n",
 		entry.GetKey(), entry.GetValue()))
 	return nil
@@ -168,6 +225,16 @@ func HandleDelete(d *Database, payload string) (err error) {
 
 // Handle select.
 func HandleSelect(d *Database, payload string, w io.Writer) (err error) {
+	return HandleSelectCtx(context.Background(), d, payload, w)
+}
+
+// An index whose full scans can be cancelled.
+type ctxSelector interface {
+	SelectCtx(ctx context.Context) ([]utils.Entry, error)
+}
+
+// HandleSelectCtx handles select, stopping the scan early if the context is cancelled.
+func HandleSelectCtx(ctx context.Context, d *Database, payload string, w io.Writer) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
 	// Usage: select from <table>
@@ -180,13 +247,81 @@ func HandleSelect(d *Database, payload string, w io.Writer) (err error) {
 		return fmt.Errorf("select error: %v", err)
 	}
 	var results []utils.Entry
-	if results, err = table.Select(); err != nil {
+	if selector, ok := table.(ctxSelector); ok {
+		results, err = selector.SelectCtx(ctx)
+	} else {
+		results, err = table.Select()
+	}
+	if err != nil {
 		return err
 	}
 	printResults(results, w)
 	return nil
 }
 
+// Handle typed create.
+func HandleTypedCreate(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: typed_create <table> <column>:<type>...
+	if numFields < 3 {
+		return fmt.Errorf("usage: typed_create <table> <column>:<int|string|bool>...")
+	}
+	schema, err := ParseSchema(strings.Join(fields[2:], " "))
+	if err != nil {
+		return fmt.Errorf("typed_create error: %v", err)
+	}
+	if _, err = d.CreateTypedTable(fields[1], schema); err != nil {
+		return fmt.Errorf("typed_create error: %v", err)
+	}
+	io.WriteString(w, fmt.Sprintf("typed table %s created.\n", fields[1]))
+	return nil
+}
+
+// Handle typed insert.
+func HandleTypedInsert(d *Database, payload string) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: typed_insert <table> <value>...
+	if numFields < 3 {
+		return fmt.Errorf("usage: typed_insert <table> <value>...")
+	}
+	table, err := d.GetTypedTable(fields[1])
+	if err != nil {
+		return fmt.Errorf("typed_insert error: %v", err)
+	}
+	row, err := table.GetSchema().ParseRow(fields[2:])
+	if err != nil {
+		return fmt.Errorf("typed_insert error: %v", err)
+	}
+	if err = table.Insert(row); err != nil {
+		return fmt.Errorf("typed_insert error: %v", err)
+	}
+	return nil
+}
+
+// Handle typed select.
+func HandleTypedSelect(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: typed_select <table>
+	if numFields != 2 {
+		return fmt.Errorf("usage: typed_select <table>")
+	}
+	table, err := d.GetTypedTable(fields[1])
+	if err != nil {
+		return fmt.Errorf("typed_select error: %v", err)
+	}
+	rows, err := table.Select()
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		io.WriteString(w, table.GetSchema().FormatRow(row)+"\n")
+	}
+	return nil
+}
+
 // Handle pretty printing.
 func HandlePretty(d *Database, payload string, w io.Writer) (err error) {
 	fields := strings.Fields(payload)
@@ -216,6 +351,244 @@ func HandlePretty(d *Database, payload string, w io.Writer) (err error) {
 	return nil
 }
 
+// Handle export.
+func HandleExport(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: export <table> <path>
+	if numFields != 3 {
+		return fmt.Errorf("usage: export <table> <path>")
+	}
+	tableName := fields[1]
+	table, err := d.GetTable(tableName)
+	if err != nil {
+		return fmt.Errorf("export error: %v", err)
+	}
+	file, err := os.Create(fields[2])
+	if err != nil {
+		return fmt.Errorf("export error: %v", err)
+	}
+	defer file.Close()
+	// Stream the table out through a cursor.
+	writer := bufio.NewWriter(file)
+	cursor, err := table.TableStart()
+	if err != nil {
+		return fmt.Errorf("export error: %v", err)
+	}
+	count := 0
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return fmt.Errorf("export error: %v", err)
+			}
+			fmt.Fprintf(writer, "%d,%d\n", entry.GetKey(), entry.GetValue())
+			count++
+		}
+		if err := cursor.StepForward(); err != nil {
+			break
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		return fmt.Errorf("export error: %v", err)
+	}
+	io.WriteString(w, fmt.Sprintf("exported %d entries from %s.\n", count, tableName))
+	return nil
+}
+
+// Handle import.
+func HandleImport(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: import <table> <path>
+	if numFields != 3 {
+		return fmt.Errorf("usage: import <table> <path>")
+	}
+	tableName := fields[1]
+	if _, err = d.GetTable(tableName); err != nil {
+		return fmt.Errorf("import error: %v", err)
+	}
+	file, err := os.Open(fields[2])
+	if err != nil {
+		return fmt.Errorf("import error: %v", err)
+	}
+	defer file.Close()
+	// Insert each line, collecting errors rather than stopping at the first one.
+	scanner := bufio.NewScanner(file)
+	count, lineNum := 0, 0
+	lineErrs := make([]string, 0)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := importLine(d, tableName, line); err != nil {
+			lineErrs = append(lineErrs, fmt.Sprintf("line %d: %v", lineNum, err))
+			continue
+		}
+		count++
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("import error: %v", err)
+	}
+	io.WriteString(w, fmt.Sprintf("imported %d entries into %s.\n", count, tableName))
+	for _, lineErr := range lineErrs {
+		io.WriteString(w, lineErr+"\n")
+	}
+	if len(lineErrs) > 0 {
+		return fmt.Errorf("import error: %d lines could not be imported", len(lineErrs))
+	}
+	return nil
+}
+
+// importLine parses a single key,value line and inserts it into the given table.
+func importLine(d *Database, tableName string, line string) error {
+	parts := strings.Split(line, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("expected key,value but got %q", line)
+	}
+	key, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed key: %v", err)
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed value: %v", err)
+	}
+	return HandleInsert(d, fmt.Sprintf("insert %d %d into %s", key, value, tableName))
+}
+
+// Handle verify.
+func HandleVerify(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: verify
+	if numFields != 1 {
+		return fmt.Errorf("usage: verify")
+	}
+	failed := 0
+	tables := d.GetTables()
+	for _, name := range sortedTableNames(tables) {
+		if tableErr := VerifyTable(tables[name]); tableErr != nil {
+			io.WriteString(w, fmt.Sprintf("%s: %v\n", name, tableErr))
+			failed++
+		} else {
+			io.WriteString(w, fmt.Sprintf("%s: ok\n", name))
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("verify error: %d of %d tables are inconsistent", failed, len(tables))
+	}
+	return nil
+}
+
+// Handle analyze.
+func HandleAnalyze(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: analyze <table>
+	if numFields != 2 {
+		return fmt.Errorf("usage: analyze <table>")
+	}
+	stats, err := Analyze(d, fields[1])
+	if err != nil {
+		return fmt.Errorf("analyze error: %v", err)
+	}
+	io.WriteString(w, stats.String())
+	return nil
+}
+
+// Handle page dump.
+func HandlePageDump(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: page_dump <table> <pagenum>
+	if numFields != 3 {
+		return fmt.Errorf("usage: page_dump <table> <pagenum>")
+	}
+	table, err := d.GetTable(fields[1])
+	if err != nil {
+		return fmt.Errorf("page_dump error: %v", err)
+	}
+	pagenum, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("page_dump error: %v", err)
+	}
+	numPages := table.GetPager().GetNumPages()
+	if pagenum < 0 || pagenum >= numPages {
+		return fmt.Errorf("page_dump error: page %d is out of range; %s has %d pages", pagenum, fields[1], numPages)
+	}
+	page, err := table.GetPager().GetPage(pagenum)
+	if err != nil {
+		return fmt.Errorf("page_dump error: %v", err)
+	}
+	defer page.Put()
+	page.RLock()
+	defer page.RUnlock()
+	switch table.(type) {
+	case *btree.BTreeIndex:
+		io.WriteString(w, btree.DescribePage(page))
+	case *hash.HashIndex:
+		io.WriteString(w, hash.DescribePage(page))
+	}
+	writeHexDump(w, page.CopyData(0, pager.PAGESIZE))
+	return nil
+}
+
+// writeHexDump writes the data as lines of 16 bytes in hex and ASCII, each prefixed with
+// its offset. Like hexdump, runs of repeated lines are written once, followed by a *.
+func writeHexDump(w io.Writer, data []byte) {
+	const width = 16
+	var prev []byte
+	skipping := false
+	for offset := 0; offset < len(data); offset += width {
+		end := offset + width
+		if end > len(data) {
+			end = len(data)
+		}
+		line := data[offset:end]
+		if prev != nil && bytes.Equal(line, prev) {
+			if !skipping {
+				io.WriteString(w, "*\n")
+				skipping = true
+			}
+			continue
+		}
+		prev, skipping = line, false
+		ascii := make([]byte, len(line))
+		for i, b := range line {
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			ascii[i] = b
+		}
+		io.WriteString(w, fmt.Sprintf("%08x  %-47s  |%s|\n", offset, fmt.Sprintf("% x", line), ascii))
+	}
+	io.WriteString(w, fmt.Sprintf("%08x\n", len(data)))
+}
+
+// Handle tables.
+func HandleTables(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: .tables
+	if numFields != 1 {
+		return fmt.Errorf("usage: .tables")
+	}
+	tables := d.GetTables()
+	names := sortedTableNames(tables)
+	if len(names) == 0 {
+		io.WriteString(w, "no open tables\n")
+		return nil
+	}
+	for _, name := range names {
+		table := tables[name]
+		io.WriteString(w, fmt.Sprintf("%s: %s, %d pages\n", name, IndexTypeName(table), table.GetPager().GetNumPages()))
+	}
+	return nil
+}
+
 // printResults prints all given entries in a standard format.
 func printResults(entries []utils.Entry, w io.Writer) {
 	for _, entry := range entries {
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+)
+
+// A table to open at startup.
+type ManifestEntry struct {
+	Name string    // The name the table is opened under.
+	Type IndexType // The type of index stored in the file.
+	File string    // The table's file; relative paths are relative to the database folder.
+}
+
+// Opens the index of the given type stored at the given path.
+type TableOpener func(path string, indexType IndexType) (Index, error)
+
+// ReadManifest reads the manifest in the given file. See ParseManifest for the format.
+func ReadManifest(filename string) ([]ManifestEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest: %v", err)
+	}
+	defer file.Close()
+	entries, err := ParseManifest(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return entries, nil
+}
+
+// ParseManifest parses a manifest of tables, with one table per line in the form
+// `<name> <btree|hash> <file>`. Blank lines and lines starting with # are ignored.
+func ParseManifest(r io.Reader) ([]ManifestEntry, error) {
+	alphanumeric := regexp.MustCompile(`^\w+$`)
+	entries := make([]ManifestEntry, 0)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected <name> <btree|hash> <file>, got %q", lineNum, line)
+		}
+		entry := ManifestEntry{Name: fields[0], File: fields[2]}
+		if !alphanumeric.MatchString(entry.Name) {
+			return nil, fmt.Errorf("line %d: table name must be alphanumeric", lineNum)
+		}
+		if seen[entry.Name] {
+			return nil, fmt.Errorf("line %d: table %s is listed more than once", lineNum, entry.Name)
+		}
+		seen[entry.Name] = true
+		switch fields[1] {
+		case "btree":
+			entry.Type = BTreeIndexType
+		case "hash":
+			entry.Type = HashIndexType
+		default:
+			return nil, fmt.Errorf("line %d: unknown table type %q", lineNum, fields[1])
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// OpenIndex opens the index of the given type stored at the given path, creating it if needed.
+func OpenIndex(path string, indexType IndexType) (index Index, err error) {
+	switch indexType {
+	case BTreeIndexType:
+		index, err = btree.OpenTable(path)
+	case HashIndexType:
+		index, err = hash.OpenTable(path)
+	default:
+		return nil, fmt.Errorf("invalid index type %d", indexType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// OpenManifest opens each table in the manifest with the given opener and adds it
+// to the database under its name. It stops at the first table that fails to open;
+// tables opened before it stay open, and are closed with the database.
+func (db *Database) OpenManifest(entries []ManifestEntry, open TableOpener) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	for _, entry := range entries {
+		if _, ok := db.tables[entry.Name]; ok {
+			return fmt.Errorf("table %s is already open", entry.Name)
+		}
+		path := entry.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(db.basepath, path)
+		}
+		index, err := open(path, entry.Type)
+		if err != nil {
+			return fmt.Errorf("could not open table %s: %v", entry.Name, err)
+		}
+		db.tables[entry.Name] = index
+	}
+	return nil
+}
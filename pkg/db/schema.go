@@ -0,0 +1,243 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The type of a column in a typed table.
+type ColumnType int
+
+const (
+	INT_COLUMN    ColumnType = 0 // An int64.
+	STRING_COLUMN ColumnType = 1 // A string of any length.
+	BOOL_COLUMN   ColumnType = 2 // A bool.
+)
+
+// String returns the name that schemas use for the column type.
+func (columnType ColumnType) String() string {
+	switch columnType {
+	case INT_COLUMN:
+		return "int"
+	case STRING_COLUMN:
+		return "string"
+	case BOOL_COLUMN:
+		return "bool"
+	default:
+		return fmt.Sprintf("ColumnType(%d)", int(columnType))
+	}
+}
+
+// ParseColumnType returns the column type with the given name.
+func ParseColumnType(name string) (ColumnType, error) {
+	switch name {
+	case "int":
+		return INT_COLUMN, nil
+	case "string":
+		return STRING_COLUMN, nil
+	case "bool":
+		return BOOL_COLUMN, nil
+	default:
+		return 0, fmt.Errorf("unknown column type %q", name)
+	}
+}
+
+// A named, typed column.
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// A Schema describes the columns of a typed table. The first column is the primary
+// key, and must be an int; it is stored as the key of the underlying index.
+type Schema struct {
+	columns []Column
+}
+
+// A Row holds one value for each column of a schema, in order: an int64 for
+// int columns, a string for string columns, and a bool for bool columns.
+type Row []interface{}
+
+// NewSchema returns a schema with the given columns. Column names must be
+// alphanumeric and distinct, and the first column must be an int.
+func NewSchema(columns []Column) (*Schema, error) {
+	if len(columns) == 0 {
+		return nil, errors.New("a schema needs at least one column")
+	}
+	if columns[0].Type != INT_COLUMN {
+		return nil, fmt.Errorf("primary key %s must be an int column", columns[0].Name)
+	}
+	alphanumeric := regexp.MustCompile(`^\w+$`)
+	seen := make(map[string]bool)
+	for _, column := range columns {
+		if !alphanumeric.MatchString(column.Name) {
+			return nil, fmt.Errorf("column name %q must be alphanumeric", column.Name)
+		}
+		if seen[column.Name] {
+			return nil, fmt.Errorf("column %s is listed more than once", column.Name)
+		}
+		seen[column.Name] = true
+		switch column.Type {
+		case INT_COLUMN, STRING_COLUMN, BOOL_COLUMN:
+		default:
+			return nil, fmt.Errorf("column %s has unknown type %v", column.Name, column.Type)
+		}
+	}
+	return &Schema{columns: append([]Column(nil), columns...)}, nil
+}
+
+// ParseSchema parses a schema written as space-separated `<name>:<type>` columns,
+// such as `id:int name:string active:bool`.
+func ParseSchema(s string) (*Schema, error) {
+	columns := make([]Column, 0)
+	for _, field := range strings.Fields(s) {
+		parts := strings.Split(field, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected <name>:<type>, got %q", field)
+		}
+		columnType, err := ParseColumnType(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, Column{Name: parts[0], Type: columnType})
+	}
+	return NewSchema(columns)
+}
+
+// String returns the schema in the form read by ParseSchema.
+func (schema *Schema) String() string {
+	fields := make([]string, 0, len(schema.columns))
+	for _, column := range schema.columns {
+		fields = append(fields, fmt.Sprintf("%s:%s", column.Name, column.Type))
+	}
+	return strings.Join(fields, " ")
+}
+
+// GetColumns returns the schema's columns.
+func (schema *Schema) GetColumns() []Column {
+	return append([]Column(nil), schema.columns...)
+}
+
+// ParseRow parses a row from the text of each of its values, in column order.
+func (schema *Schema) ParseRow(values []string) (Row, error) {
+	if len(values) != len(schema.columns) {
+		return nil, fmt.Errorf("expected %d values, got %d", len(schema.columns), len(values))
+	}
+	row := make(Row, len(values))
+	for i, column := range schema.columns {
+		var err error
+		switch column.Type {
+		case INT_COLUMN:
+			row[i], err = strconv.ParseInt(values[i], 10, 64)
+		case STRING_COLUMN:
+			row[i] = values[i]
+		case BOOL_COLUMN:
+			row[i], err = strconv.ParseBool(values[i])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", column.Name, err)
+		}
+	}
+	return row, nil
+}
+
+// FormatRow returns the row's values in the same form as select prints entries.
+func (schema *Schema) FormatRow(row Row) string {
+	values := make([]string, len(row))
+	for i, value := range row {
+		values[i] = fmt.Sprint(value)
+	}
+	return fmt.Sprintf("(%s)", strings.Join(values, ", "))
+}
+
+// Encode checks the row against the schema, and returns its primary key along
+// with a tuple encoding the rest of its columns.
+func (schema *Schema) Encode(row Row) (key int64, tuple []byte, err error) {
+	if len(row) != len(schema.columns) {
+		return 0, nil, fmt.Errorf("expected %d values, got %d", len(schema.columns), len(row))
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	for i, column := range schema.columns {
+		switch column.Type {
+		case INT_COLUMN:
+			value, ok := row[i].(int64)
+			if !ok {
+				return 0, nil, fmt.Errorf("column %s expects an int, got %T", column.Name, row[i])
+			}
+			if i == 0 {
+				key = value
+				continue
+			}
+			tuple = append(tuple, buf[:binary.PutVarint(buf, value)]...)
+		case STRING_COLUMN:
+			value, ok := row[i].(string)
+			if !ok {
+				return 0, nil, fmt.Errorf("column %s expects a string, got %T", column.Name, row[i])
+			}
+			tuple = append(tuple, buf[:binary.PutUvarint(buf, uint64(len(value)))]...)
+			tuple = append(tuple, value...)
+		case BOOL_COLUMN:
+			value, ok := row[i].(bool)
+			if !ok {
+				return 0, nil, fmt.Errorf("column %s expects a bool, got %T", column.Name, row[i])
+			}
+			if value {
+				tuple = append(tuple, 1)
+			} else {
+				tuple = append(tuple, 0)
+			}
+		}
+	}
+	return key, tuple, nil
+}
+
+// Decode rebuilds the row with the given primary key from its encoded tuple.
+func (schema *Schema) Decode(key int64, tuple []byte) (Row, error) {
+	row := make(Row, len(schema.columns))
+	row[0] = key
+	corrupt := errors.New("tuple is too short for the schema")
+	for i, column := range schema.columns[1:] {
+		switch column.Type {
+		case INT_COLUMN:
+			value, n := binary.Varint(tuple)
+			if n <= 0 {
+				return nil, corrupt
+			}
+			row[i+1], tuple = value, tuple[n:]
+		case STRING_COLUMN:
+			length, n := binary.Uvarint(tuple)
+			if n <= 0 || uint64(len(tuple)-n) < length {
+				return nil, corrupt
+			}
+			row[i+1], tuple = string(tuple[n:n+int(length)]), tuple[n+int(length):]
+		case BOOL_COLUMN:
+			if len(tuple) < 1 {
+				return nil, corrupt
+			}
+			row[i+1], tuple = tuple[0] == 1, tuple[1:]
+		}
+	}
+	if len(tuple) != 0 {
+		return nil, errors.New("tuple is longer than the schema")
+	}
+	return row, nil
+}
+
+// readSchema reads the schema stored in the given file.
+func readSchema(filename string) (*Schema, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchema(string(data))
+}
+
+// writeSchema stores the schema in the given file.
+func writeSchema(filename string, schema *Schema) error {
+	return ioutil.WriteFile(filename, []byte(schema.String()+"\n"), 0666)
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"fmt"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// SelectMatching returns the entries of the table that match the predicate, in key order.
+func SelectMatching(src Index, predicate func(utils.Entry) bool) ([]utils.Entry, error) {
+	entries, err := src.Select()
+	if err != nil {
+		return nil, err
+	}
+	matching := make([]utils.Entry, 0)
+	for _, entry := range entries {
+		if predicate(entry) {
+			matching = append(matching, entry)
+		}
+	}
+	// Inserting in key order keeps each insert at the right edge of the new B+ tree.
+	utils.SortEntries(matching)
+	return matching, nil
+}
+
+// SelectInto creates a B+ tree table named dst and fills it with the entries of src
+// that match the predicate. It is an error for dst to exist already. The copy is not
+// logged; recovery.RecoveryManager.SelectInto makes one as part of a transaction.
+func (db *Database) SelectInto(src Index, dst string, predicate func(utils.Entry) bool) error {
+	if _, err := db.GetTable(dst); err == nil {
+		return fmt.Errorf("table %s already exists", dst)
+	}
+	// Read the source before creating anything, so that a failed scan leaves no table behind.
+	entries, err := SelectMatching(src, predicate)
+	if err != nil {
+		return err
+	}
+	table, err := db.createTable(dst, BTreeIndexType)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = table.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Suffix of the file that Analyze stores a table's statistics in.
+const STATS_SUFFIX = ".stats"
+
+// Number of buckets in the key histograms that Analyze builds.
+var STATS_HISTOGRAM_BUCKETS = 16
+
+// Returned by GetStats for tables that have not been analyzed.
+var ErrNoStats = errors.New("table has not been analyzed")
+
+// TableStats are the statistics that the query planner estimates cardinalities with.
+// They are computed by Analyze and go stale as the table changes, until it is analyzed again.
+type TableStats struct {
+	Count          int64             // Number of entries.
+	DistinctValues int64             // Number of distinct values; keys are always distinct.
+	MinKey         int64             // Smallest key; 0 if the table is empty.
+	MaxKey         int64             // Largest key; 0 if the table is empty.
+	Histogram      []HistogramBucket // Equi-depth histogram of the keys, in key order.
+}
+
+// A HistogramBucket counts the keys between its bounds, inclusive.
+type HistogramBucket struct {
+	Lo    int64
+	Hi    int64
+	Count int64
+}
+
+// Analyze computes the statistics of the named table, and stores them alongside the
+// table, replacing those of any earlier Analyze. Keys are streamed rather than gathered:
+// a B+ tree is scanned once in key order, while other tables are scanned twice, once to
+// sample where the histogram buckets should start and once to fill them.
+func Analyze(d *Database, name string) (*TableStats, error) {
+	index, err := d.GetTable(name)
+	if err != nil {
+		return nil, err
+	}
+	var stats *TableStats
+	if tree, ok := index.(*btree.BTreeIndex); ok {
+		stats, err = analyzeOrdered(tree)
+	} else {
+		stats, err = analyzeSampled(index)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = writeStats(filepath.Join(d.basepath, name)+STATS_SUFFIX, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Number of keys that Analyze samples from tables it can't scan in key order, to decide
+// where their histogram buckets start.
+var STATS_SAMPLE_SIZE = 4096
+
+// analyzeOrdered computes the statistics of a B+ tree. Its keys come in order and its
+// count is known up front, so each key's histogram bucket follows from its position.
+func analyzeOrdered(tree *btree.BTreeIndex) (*TableStats, error) {
+	n, err := tree.Count()
+	if err != nil {
+		return nil, err
+	}
+	numBuckets := int64(STATS_HISTOGRAM_BUCKETS)
+	if n < numBuckets {
+		numBuckets = n
+	}
+	histogram := make([]HistogramBucket, numBuckets)
+	descending := tree.GetOrder() == btree.DESCENDING
+	values := make(map[int64]bool)
+	count := int64(0)
+	err = scanEntries(tree, func(entry utils.Entry) {
+		// Find the key's position in ascending order; writes since Count may push it past either end.
+		pos := count
+		if descending {
+			pos = n - 1 - count
+		}
+		if numBuckets > 0 {
+			b := pos * numBuckets / n
+			if b < 0 {
+				b = 0
+			} else if b >= numBuckets {
+				b = numBuckets - 1
+			}
+			histogram[b].add(entry.GetKey())
+		}
+		values[entry.GetValue()] = true
+		count++
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newTableStats(count, int64(len(values)), histogram), nil
+}
+
+// analyzeSampled computes the statistics of a table whose keys come in no particular
+// order. The first scan counts the table and samples its keys; bucket boundaries are
+// spread evenly over the sorted sample, and the second scan counts the keys in each bucket.
+func analyzeSampled(index Index) (*TableStats, error) {
+	sample := make([]int64, 0)
+	values := make(map[int64]bool)
+	n := int64(0)
+	err := scanEntries(index, func(entry utils.Entry) {
+		// Reservoir sampling keeps each key with equal probability.
+		if len(sample) < STATS_SAMPLE_SIZE {
+			sample = append(sample, entry.GetKey())
+		} else if i := rand.Int63n(n + 1); i < int64(STATS_SAMPLE_SIZE) {
+			sample[i] = entry.GetKey()
+		}
+		values[entry.GetValue()] = true
+		n++
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sample, func(i, j int) bool { return sample[i] < sample[j] })
+	numBuckets := STATS_HISTOGRAM_BUCKETS
+	if len(sample) < numBuckets {
+		numBuckets = len(sample)
+	}
+	// Bucket b holds the keys from starts[b] up to but not including starts[b+1].
+	starts := make([]int64, numBuckets)
+	for b := range starts {
+		starts[b] = sample[b*len(sample)/numBuckets]
+	}
+	histogram := make([]HistogramBucket, numBuckets)
+	count := int64(0)
+	err = scanEntries(index, func(entry utils.Entry) {
+		key := entry.GetKey()
+		b := sort.Search(numBuckets, func(b int) bool { return starts[b] > key }) - 1
+		if b < 0 {
+			b = 0
+		}
+		histogram[b].add(key)
+		count++
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newTableStats(count, int64(len(values)), histogram), nil
+}
+
+// add counts the key in the bucket, widening its bounds to include it.
+func (bucket *HistogramBucket) add(key int64) {
+	if bucket.Count == 0 || key < bucket.Lo {
+		bucket.Lo = key
+	}
+	if bucket.Count == 0 || key > bucket.Hi {
+		bucket.Hi = key
+	}
+	bucket.Count++
+}
+
+// newTableStats returns the statistics of a table with the given histogram, leaving out
+// its empty buckets.
+func newTableStats(count int64, distinctValues int64, histogram []HistogramBucket) *TableStats {
+	stats := &TableStats{Count: count, DistinctValues: distinctValues}
+	for _, bucket := range histogram {
+		if bucket.Count > 0 {
+			stats.Histogram = append(stats.Histogram, bucket)
+		}
+	}
+	if len(stats.Histogram) > 0 {
+		stats.MinKey, stats.MaxKey = stats.Histogram[0].Lo, stats.Histogram[len(stats.Histogram)-1].Hi
+	}
+	return stats
+}
+
+// scanEntries calls f on every entry of the index, in the order its cursor visits them.
+func scanEntries(index Index, f func(utils.Entry)) error {
+	cursor, err := index.TableStart()
+	if err != nil {
+		return err
+	}
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return err
+			}
+			f(entry)
+		}
+		if err = cursor.StepForward(); err != nil {
+			return nil
+		}
+	}
+}
+
+// GetStats returns the statistics stored by the last Analyze of the named table, or
+// ErrNoStats if it hasn't been analyzed.
+func (db *Database) GetStats(name string) (*TableStats, error) {
+	stats, err := readStats(filepath.Join(db.basepath, name) + STATS_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil, ErrNoStats
+	}
+	return stats, err
+}
+
+// EstimateRange estimates the number of keys in [lo, hi), assuming that keys are spread
+// evenly within each histogram bucket.
+func (stats *TableStats) EstimateRange(lo int64, hi int64) int64 {
+	estimate := 0.0
+	for _, bucket := range stats.Histogram {
+		if hi <= bucket.Lo || lo > bucket.Hi {
+			continue
+		}
+		if lo <= bucket.Lo && hi > bucket.Hi {
+			estimate += float64(bucket.Count)
+			continue
+		}
+		// Widths are taken as floats, so that buckets spanning most of the int64 range can't overflow.
+		from, to := float64(bucket.Lo), float64(bucket.Hi)+1
+		if float64(lo) > from {
+			from = float64(lo)
+		}
+		if float64(hi) < to {
+			to = float64(hi)
+		}
+		estimate += float64(bucket.Count) * (to - from) / (float64(bucket.Hi) + 1 - float64(bucket.Lo))
+	}
+	return int64(estimate + 0.5)
+}
+
+// EstimateCardinality estimates how many entries of the named table have keys in
+// [lo, hi), for the query planner. Analyzed tables are estimated from their stored
+// statistics, without touching the table. Otherwise, B+ trees are estimated with
+// EstimateRangeCount, and other tables are counted with a scan.
+func EstimateCardinality(d *Database, name string, lo int64, hi int64) (int64, error) {
+	stats, err := d.GetStats(name)
+	if err == nil {
+		return stats.EstimateRange(lo, hi), nil
+	} else if err != ErrNoStats {
+		return 0, err
+	}
+	index, err := d.GetTable(name)
+	if err != nil {
+		return 0, err
+	}
+	if tree, ok := index.(*btree.BTreeIndex); ok {
+		return estimateTreeRange(tree, lo, hi)
+	}
+	entries, err := index.Select()
+	if err != nil {
+		return 0, err
+	}
+	count := int64(0)
+	for _, entry := range entries {
+		if entry.GetKey() >= lo && entry.GetKey() < hi {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// estimateTreeRange returns the number of entries of the B+ tree with keys in [lo, hi).
+// EstimateRangeCount takes its bounds in the tree's order, so in a descending tree the
+// range runs from hi-1 down to lo-1 instead.
+func estimateTreeRange(tree *btree.BTreeIndex, lo int64, hi int64) (int64, error) {
+	if tree.GetOrder() != btree.DESCENDING {
+		return tree.EstimateRangeCount(lo, hi)
+	}
+	if lo >= hi {
+		return 0, nil
+	}
+	if lo > math.MinInt64 {
+		return tree.EstimateRangeCount(hi-1, lo-1)
+	}
+	// No key comes after the range, so it runs to the end of the tree.
+	count, err := tree.Count()
+	if err != nil {
+		return 0, err
+	}
+	rank, err := tree.Rank(hi - 1)
+	if err != nil {
+		return 0, err
+	}
+	return count - rank, nil
+}
+
+// String formats the statistics as they are stored: a line per field, then a line per
+// histogram bucket in the form `bucket <lo> <hi> <count>`.
+func (stats *TableStats) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("count %d\n", stats.Count))
+	sb.WriteString(fmt.Sprintf("distinct_values %d\n", stats.DistinctValues))
+	sb.WriteString(fmt.Sprintf("min_key %d\n", stats.MinKey))
+	sb.WriteString(fmt.Sprintf("max_key %d\n", stats.MaxKey))
+	for _, bucket := range stats.Histogram {
+		sb.WriteString(fmt.Sprintf("bucket %d %d %d\n", bucket.Lo, bucket.Hi, bucket.Count))
+	}
+	return sb.String()
+}
+
+// ParseStats parses statistics formatted by TableStats.String.
+func ParseStats(s string) (*TableStats, error) {
+	stats := &TableStats{}
+	fields := map[string]*int64{
+		"count":           &stats.Count,
+		"distinct_values": &stats.DistinctValues,
+		"min_key":         &stats.MinKey,
+		"max_key":         &stats.MaxKey,
+	}
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var name string
+		var bucket HistogramBucket
+		if n, _ := fmt.Sscanf(line, "bucket %d %d %d", &bucket.Lo, &bucket.Hi, &bucket.Count); n == 3 {
+			stats.Histogram = append(stats.Histogram, bucket)
+			continue
+		}
+		var value int64
+		if n, _ := fmt.Sscanf(line, "%s %d", &name, &value); n != 2 || fields[name] == nil {
+			return nil, fmt.Errorf("line %d: malformed statistic %q", lineNum, line)
+		}
+		*fields[name] = value
+	}
+	return stats, nil
+}
+
+// readStats reads the statistics stored in the given file.
+func readStats(filename string) (*TableStats, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := ParseStats(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return stats, nil
+}
+
+// writeStats stores the statistics in the given file.
+func writeStats(filename string, stats *TableStats) error {
+	return ioutil.WriteFile(filename, []byte(stats.String()), 0666)
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+)
+
+// Size of the length written before each tuple.
+const TUPLE_LENGTH_SIZE = 4
+
+// A tupleStore holds the encoded tuples of a typed table in their own file, so that
+// rows of any size can sit behind the int64 values of the table's index. Tuples are
+// appended one after another and may span pages; a tuple is addressed by the byte
+// offset of its length. The first page only holds the offset where the next tuple goes.
+type tupleStore struct {
+	pager *pager.Pager
+	end   int64      // Offset of the next tuple.
+	mtx   sync.Mutex // Serializes appends.
+}
+
+// openTupleStore opens the tuple store in the given file, creating it if needed.
+func openTupleStore(filename string) (*tupleStore, error) {
+	store := &tupleStore{pager: pager.NewPager()}
+	if err := store.pager.Open(filename); err != nil {
+		return nil, err
+	}
+	if store.pager.GetNumPages() == 0 {
+		page, err := store.pager.AllocatePage()
+		if err != nil {
+			store.pager.Close()
+			return nil, err
+		}
+		page.Put()
+		store.end = pager.PAGESIZE
+		if err = store.writeAt(0, store.encodeEnd()); err != nil {
+			store.pager.Close()
+			return nil, err
+		}
+		return store, nil
+	}
+	header, err := store.readAt(0, binary.MaxVarintLen64)
+	if err != nil {
+		store.pager.Close()
+		return nil, err
+	}
+	store.end, _ = binary.Varint(header)
+	return store, nil
+}
+
+// encodeEnd encodes the offset of the next tuple for the first page.
+func (store *tupleStore) encodeEnd() []byte {
+	header := make([]byte, binary.MaxVarintLen64)
+	binary.PutVarint(header, store.end)
+	return header
+}
+
+// append stores the tuple, first calling link with the offset it will be stored at.
+// Nothing is written unless link succeeds, and no other tuple can take the offset
+// meanwhile, so link can publish it, e.g. by inserting it into an index.
+func (store *tupleStore) append(tuple []byte, link func(offset int64) error) error {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	offset := store.end
+	if err := link(offset); err != nil {
+		return err
+	}
+	record := make([]byte, TUPLE_LENGTH_SIZE+len(tuple))
+	binary.LittleEndian.PutUint32(record, uint32(len(tuple)))
+	copy(record[TUPLE_LENGTH_SIZE:], tuple)
+	if err := store.writeAt(offset, record); err != nil {
+		return err
+	}
+	store.end += int64(len(record))
+	return store.writeAt(0, store.encodeEnd())
+}
+
+// get returns the tuple stored at the given offset.
+func (store *tupleStore) get(offset int64) ([]byte, error) {
+	if offset < pager.PAGESIZE || offset+TUPLE_LENGTH_SIZE > store.end {
+		return nil, fmt.Errorf("no tuple at offset %d", offset)
+	}
+	length, err := store.readAt(offset, TUPLE_LENGTH_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	return store.readAt(offset+TUPLE_LENGTH_SIZE, int64(binary.LittleEndian.Uint32(length)))
+}
+
+// writeAt writes the data at the given offset, allocating pages as needed.
+func (store *tupleStore) writeAt(offset int64, data []byte) error {
+	for len(data) > 0 {
+		pagenum := offset / pager.PAGESIZE
+		for store.pager.GetNumPages() <= pagenum {
+			page, err := store.pager.AllocatePage()
+			if err != nil {
+				return err
+			}
+			page.Put()
+		}
+		page, err := store.pager.GetPage(pagenum)
+		if err != nil {
+			return err
+		}
+		start := offset % pager.PAGESIZE
+		n := pager.PAGESIZE - start
+		if int64(len(data)) < n {
+			n = int64(len(data))
+		}
+		page.WLock()
+		page.Update(data[:n], start, n)
+		page.WUnlock()
+		page.Put()
+		data, offset = data[n:], offset+n
+	}
+	return nil
+}
+
+// readAt reads size bytes starting at the given offset.
+func (store *tupleStore) readAt(offset int64, size int64) ([]byte, error) {
+	data := make([]byte, 0, size)
+	for int64(len(data)) < size {
+		page, err := store.pager.GetPage(offset / pager.PAGESIZE)
+		if err != nil {
+			return nil, err
+		}
+		start := offset % pager.PAGESIZE
+		n := pager.PAGESIZE - start
+		if size-int64(len(data)) < n {
+			n = size - int64(len(data))
+		}
+		page.RLock()
+		data = append(data, (*page.GetData())[start:start+n]...)
+		page.RUnlock()
+		page.Put()
+		offset += n
+	}
+	return data, nil
+}
+
+// close flushes and closes the store's file.
+func (store *tupleStore) close() error {
+	return store.pager.Close()
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Suffixes of the files a typed table keeps next to its index.
+const (
+	SCHEMA_SUFFIX = ".schema"
+	TUPLES_SUFFIX = ".tuples"
+)
+
+// A TypedTable stores rows of a schema on top of a B+ tree index. The index maps
+// each row's primary key to the offset of the rest of the row, which is encoded
+// and kept in a separate tuple file. Typed tables are not logged for recovery.
+type TypedTable struct {
+	schema *Schema
+	index  Index
+	tuples *tupleStore
+}
+
+// GetSchema returns the table's schema.
+func (table *TypedTable) GetSchema() *Schema {
+	return table.schema
+}
+
+// GetIndex returns the index that maps the table's primary keys to their tuples.
+func (table *TypedTable) GetIndex() Index {
+	return table.index
+}
+
+// Insert adds the row to the table. It is an error for the primary key to exist already.
+// The key goes into the index before the tuple is written, so that the index rejects a
+// duplicate key atomically, and a rejected row leaves nothing in the tuple file.
+func (table *TypedTable) Insert(row Row) error {
+	key, tuple, err := table.schema.Encode(row)
+	if err != nil {
+		return err
+	}
+	linked := false
+	err = table.tuples.append(tuple, func(offset int64) error {
+		if _, err := table.index.Find(key); err == nil {
+			return errors.New("key already exists")
+		}
+		if err := table.index.Insert(key, offset); err != nil {
+			return err
+		}
+		linked = true
+		return nil
+	})
+	// Don't leave the key pointing at a tuple that couldn't be written.
+	if err != nil && linked {
+		if delErr := table.index.Delete(key); delErr != nil {
+			return fmt.Errorf("%v; removing the key also failed: %v", err, delErr)
+		}
+	}
+	return err
+}
+
+// Find returns the row with the given primary key.
+func (table *TypedTable) Find(key int64) (Row, error) {
+	entry, err := table.index.Find(key)
+	if err != nil {
+		return nil, err
+	}
+	return table.decode(entry)
+}
+
+// Select returns every row in the table, in primary key order.
+func (table *TypedTable) Select() ([]Row, error) {
+	entries, err := table.index.Select()
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]Row, 0, len(entries))
+	for _, entry := range entries {
+		row, err := table.decode(entry)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// decode reads the row that the given index entry points to.
+func (table *TypedTable) decode(entry utils.Entry) (Row, error) {
+	tuple, err := table.tuples.get(entry.GetValue())
+	if err != nil {
+		return nil, fmt.Errorf("key %d: %v", entry.GetKey(), err)
+	}
+	return table.schema.Decode(entry.GetKey(), tuple)
+}
+
+// CreateTypedTable creates a typed table with the given schema, storing the schema
+// alongside the table's index.
+func (db *Database) CreateTypedTable(name string, schema *Schema) (*TypedTable, error) {
+	index, err := db.createTable(name, BTreeIndexType)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(db.basepath, name)
+	if err = writeSchema(path+SCHEMA_SUFFIX, schema); err != nil {
+		return nil, err
+	}
+	return db.openTypedTable(name, index, schema)
+}
+
+// GetTypedTable returns the typed table with the given name, opening it if needed.
+func (db *Database) GetTypedTable(name string) (*TypedTable, error) {
+	db.mtx.Lock()
+	table, ok := db.typed[name]
+	db.mtx.Unlock()
+	if ok {
+		return table, nil
+	}
+	index, err := db.GetTable(name)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := readSchema(filepath.Join(db.basepath, name) + SCHEMA_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("table %s has no schema", name)
+	} else if err != nil {
+		return nil, err
+	}
+	return db.openTypedTable(name, index, schema)
+}
+
+// openTypedTable opens the tuple file of the table with the given index and schema.
+func (db *Database) openTypedTable(name string, index Index, schema *Schema) (*TypedTable, error) {
+	tuples, err := openTupleStore(filepath.Join(db.basepath, name) + TUPLES_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+	table := &TypedTable{schema: schema, index: index, tuples: tuples}
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	db.typed[name] = table
+	return table, nil
+}
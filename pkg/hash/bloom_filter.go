@@ -0,0 +1,123 @@
+package hash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	bitset "github.com/bits-and-blooms/bitset"
+	xxhash "github.com/cespare/xxhash"
+	murmur3 "github.com/spaolacci/murmur3"
+)
+
+type BloomFilter struct {
+	size int64
+	k    int64  // Number of bits set per key.
+	seed uint64 // Mixed into every hash; 0 hashes keys unseeded.
+	bits *bitset.BitSet
+}
+
+// CreateFilter initializes a BloomFilter with the given size, which sets two bits per key.
+func CreateFilter(size int64) *BloomFilter {
+	return CreateFilterSeeded(size, 2, 0)
+}
+
+// CreateFilterSeeded initializes a BloomFilter with the given size that sets k bits per
+// key, with hashes that depend on the seed. Filters with the same seed always agree on
+// which keys they contain, while filters with different seeds have independent false
+// positives. A k below 1 is treated as 1.
+func CreateFilterSeeded(size int64, k int64, seed uint64) *BloomFilter {
+	/* SOLUTION {{{ */
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{
+		size: size,
+		k:    k,
+		seed: seed,
+		bits: bitset.New(uint(size)),
+	}
+	/* SOLUTION }}} */
+}
+
+// hashPair returns the key's xxHash and MurmurHash3 hashes, with the seed appended to the hashed bytes.
+func (filter *BloomFilter) hashPair(key int64) (uint64, uint64) {
+	buf := make([]byte, binary.MaxVarintLen64+8)
+	binary.PutVarint(buf, key)
+	data := buf[:binary.MaxVarintLen64]
+	if filter.seed != 0 {
+		binary.LittleEndian.PutUint64(buf[binary.MaxVarintLen64:], filter.seed)
+		data = buf
+	}
+	return xxhash.Sum64(data), murmur3.Sum64(data)
+}
+
+// bitAt returns the i-th of the key's k bits, given its hash pair. The first two are the
+// hashes themselves, as in XxHasher and MurmurHasher; the rest are derived by double hashing.
+func (filter *BloomFilter) bitAt(i int64, h1 uint64, h2 uint64) uint {
+	switch i {
+	case 0:
+		return uint(h1 % uint64(filter.size))
+	case 1:
+		return uint(h2 % uint64(filter.size))
+	default:
+		return uint((h1 + uint64(i)*h2) % uint64(filter.size))
+	}
+}
+
+// Insert adds an element into the bloom filter.
+func (filter *BloomFilter) Insert(key int64) {
+	/* SOLUTION {{{ */
+	h1, h2 := filter.hashPair(key)
+	for i := int64(0); i < filter.k; i++ {
+		filter.bits.Set(filter.bitAt(i, h1, h2))
+	}
+	/* SOLUTION }}} */
+}
+
+// Contains checks if the given key can be found in the bloom filter/
+func (filter *BloomFilter) Contains(key int64) bool {
+	/* SOLUTION {{{ */
+	h1, h2 := filter.hashPair(key)
+	for i := int64(0); i < filter.k; i++ {
+		if !filter.bits.Test(filter.bitAt(i, h1, h2)) {
+			return false
+		}
+	}
+	return true
+	/* SOLUTION }}} */
+}
+
+// Intersect returns a new filter whose bits are set where both filters' bits are set.
+// It contains a key exactly when both filters do, so it may report keys that are in
+// only one of the underlying sets, but never misses a key that is in both.
+// The filters must have the same size, number of hashes, and seed.
+func (filter *BloomFilter) Intersect(other *BloomFilter) (*BloomFilter, error) {
+	if err := filter.checkCompatible(other); err != nil {
+		return nil, err
+	}
+	return &BloomFilter{size: filter.size, k: filter.k, seed: filter.seed, bits: filter.bits.Intersection(other.bits)}, nil
+}
+
+// Union returns a new filter whose bits are set where either filter's bits are set.
+// It contains every key that either filter contains.
+func (filter *BloomFilter) Union(other *BloomFilter) (*BloomFilter, error) {
+	if err := filter.checkCompatible(other); err != nil {
+		return nil, err
+	}
+	return &BloomFilter{size: filter.size, k: filter.k, seed: filter.seed, bits: filter.bits.Union(other.bits)}, nil
+}
+
+// checkCompatible returns an error if the filters can't be combined bit by bit.
+func (filter *BloomFilter) checkCompatible(other *BloomFilter) error {
+	if other == nil {
+		return errors.New("cannot combine with a nil filter")
+	}
+	if filter.size != other.size {
+		return fmt.Errorf("cannot combine filters of sizes %d and %d", filter.size, other.size)
+	}
+	if filter.k != other.k || filter.seed != other.seed {
+		return errors.New("cannot combine filters that hash keys differently")
+	}
+	return nil
+}
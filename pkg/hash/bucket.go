@@ -11,20 +11,23 @@ import (
 
 // HashBucket.
 type HashBucket struct {
-	depth   int64
-	numKeys int64
-	page    *pager.Page
+	depth          int64
+	numKeys        int64
+	maxKeys        int64 // Number of entries at which this bucket must split.
+	nextOverflowPN int64 // Page number of the next bucket in the overflow chain.
+	page           *pager.Page
 }
 
-// Construct a new HashBucket.
-func NewHashBucket(pager *pager.Pager, depth int64) (*HashBucket, error) {
-	newPN := pager.GetFreePN()
-	newPage, err := pager.GetPage(newPN)
+// Construct a new HashBucket that splits once it holds maxKeys entries.
+func NewHashBucket(pager *pager.Pager, depth int64, maxKeys int64) (*HashBucket, error) {
+	newPage, err := pager.AllocatePage()
 	if err != nil {
 		return nil, err
 	}
-	bucket := &HashBucket{depth: depth, numKeys: 0, page: newPage}
+	bucket := &HashBucket{depth: depth, numKeys: 0, maxKeys: maxKeys, page: newPage}
 	bucket.updateDepth(depth)
+	bucket.updateNumKeys(0)
+	bucket.updateNextOverflowPN(NO_OVERFLOW_PN)
 	return bucket, nil
 }
 
@@ -33,29 +36,71 @@ func (bucket *HashBucket) GetDepth() int64 {
 	return bucket.depth
 }
 
+// Get the page number of the next bucket in the overflow chain, or NO_OVERFLOW_PN.
+func (bucket *HashBucket) GetNextOverflowPN() int64 {
+	return bucket.nextOverflowPN
+}
+
 // Get a bucket's page.
 func (bucket *HashBucket) GetPage() *pager.Page {
 	return bucket.page
 }
 
-// Finds the entry with the given key.
+// Finds the entry with the given key. A corrupted bucket holds no entries; use FindEntry
+// to tell it apart from a missing key.
 func (bucket *HashBucket) Find(key int64) (utils.Entry, bool) {
+	entry, found, err := bucket.FindEntry(key)
+	if err != nil {
+		return nil, false
+	}
+	return entry, found
+}
+
+// FindEntry finds the entry with the given key, returning an error if the bucket is corrupted.
+func (bucket *HashBucket) FindEntry(key int64) (utils.Entry, bool, error) {
 	/* SOLUTION {{{ */
+	index, err := bucket.indexOf(key)
+	if err != nil || index == -1 {
+		return nil, false, err
+	}
+	entry, err := bucket.getCell(index)
+	if err != nil {
+		return nil, false, err
+	}
+	return entry, true, nil
+	/* SOLUTION }}} */
+}
+
+// Returns the index of the given key, or -1 if the key is not in this bucket.
+func (bucket *HashBucket) indexOf(key int64) (int64, error) {
+	if err := bucket.checkNumKeys(); err != nil {
+		return -1, err
+	}
 	for i := int64(0); i < bucket.numKeys; i++ {
-		if bucket.getKeyAt(i) == key {
-			return bucket.getCell(i), true
+		k, err := bucket.getKeyAt(i)
+		if err != nil {
+			return -1, err
+		}
+		if k == key {
+			return i, nil
 		}
 	}
-	return nil, false
-	/* SOLUTION }}} */
+	return -1, nil
 }
 
 // Inserts the given key-value pair, splits if necessary.
 func (bucket *HashBucket) Insert(key int64, value int64) (bool, error) {
 	/* SOLUTION {{{ */
+	// Buckets split or chain as soon as they reach maxKeys, which is at most BUCKETSIZE,
+	// so a bucket that is already full has no cell left on its page for another entry.
+	if bucket.numKeys >= BUCKETSIZE {
+		return false, fmt.Errorf("bucket on page %d is full", bucket.page.GetPageNum())
+	}
+	// Write the cell before bumping numKeys, so that the new entry only becomes
+	// visible once the whole cell is in place.
 	bucket.modifyCell(bucket.numKeys, HashEntry{key: key, value: value})
 	bucket.updateNumKeys(bucket.numKeys + 1)
-	return bucket.numKeys >= BUCKETSIZE, nil
+	return bucket.numKeys >= bucket.maxKeys, nil
 	/* SOLUTION }}} */
 }
 
@@ -63,19 +108,15 @@ func (bucket *HashBucket) Insert(key int64, value int64) (bool, error) {
 func (bucket *HashBucket) Update(key int64, value int64) error {
 	/* SOLUTION {{{ */
 	// Get the index to update.
-	index := int64(-1)
-	for i := int64(0); i < bucket.numKeys; i++ {
-		if bucket.getKeyAt(i) == key {
-			index = i
-			break
-		}
+	index, err := bucket.indexOf(key)
+	if err != nil {
+		return err
 	}
 	if index == -1 {
 		return errors.New("key not found, update aborted")
 	}
 	// Update the value.
-	bucket.updateValueAt(index, value)
-	return nil
+	return bucket.updateValueAt(index, value)
 	/* SOLUTION }}} */
 }
 
@@ -83,19 +124,20 @@ func (bucket *HashBucket) Update(key int64, value int64) error {
 func (bucket *HashBucket) Delete(key int64) error {
 	/* SOLUTION {{{ */
 	// Get the index to delete.
-	index := int64(-1)
-	for i := int64(0); i < bucket.numKeys; i++ {
-		if bucket.getKeyAt(i) == key {
-			index = i
-			break
-		}
+	index, err := bucket.indexOf(key)
+	if err != nil {
+		return err
 	}
 	if index == -1 {
 		return errors.New("key not found, delete aborted")
 	}
 	// Move all other keys left by one.
-	for i := index; i < bucket.numKeys; i++ {
-		bucket.modifyCell(i, bucket.getCell(i+1))
+	for i := index; i < bucket.numKeys-1; i++ {
+		entry, err := bucket.getCell(i + 1)
+		if err != nil {
+			return err
+		}
+		bucket.modifyCell(i, entry)
 	}
 	bucket.updateNumKeys(bucket.numKeys - 1)
 	return nil
@@ -105,31 +147,61 @@ func (bucket *HashBucket) Delete(key int64) error {
 // Select all entries in this bucket.
 func (bucket *HashBucket) Select() ([]utils.Entry, error) {
 	/* SOLUTION {{{ */
+	if err := bucket.checkNumKeys(); err != nil {
+		return nil, err
+	}
 	ret := make([]utils.Entry, 0)
 	for i := int64(0); i < bucket.numKeys; i++ {
-		ret = append(ret, bucket.getCell(i))
+		entry, err := bucket.getCell(i)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, entry)
 	}
 	return ret, nil
 	/* SOLUTION }}} */
 }
 
+// selectProject appends the projected field of every entry in this bucket to ret.
+func (bucket *HashBucket) selectProject(fields utils.Projection, ret []int64) ([]int64, error) {
+	if err := bucket.checkNumKeys(); err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < bucket.numKeys; i++ {
+		entry, err := bucket.getCell(i)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, fields.Project(entry.key, entry.value))
+	}
+	return ret, nil
+}
+
 // Pretty-print this bucket.
 func (bucket *HashBucket) Print(w io.Writer) {
 	io.WriteString(w, fmt.Sprintf("bucket depth: %d\n", bucket.depth))
 	io.WriteString(w, "entries:")
 	for i := int64(0); i < bucket.numKeys; i++ {
-		bucket.getCell(i).Print(w)
+		entry, err := bucket.getCell(i)
+		if err != nil {
+			io.WriteString(w, fmt.Sprintf(" <%v>", err))
+			break
+		}
+		entry.Print(w)
 	}
 	io.WriteString(w, "\n")
 }
 
 // [CONCURRENCY] Grab a write lock on the hash table index
+// The bucket's version stamp is odd while it is held, so that optimistic readers retry.
 func (bucket *HashBucket) WLock() {
 	bucket.page.WLock()
+	bucket.bumpVersion()
 }
 
 // [CONCURRENCY] Release a write lock on the hash table index
 func (bucket *HashBucket) WUnlock() {
+	bucket.bumpVersion()
 	bucket.page.WUnlock()
 }
 
@@ -0,0 +1,281 @@
+package hash
+
+import (
+	"fmt"
+	"sync"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+)
+
+// freeList holds the pages of overflow buckets that were unlinked from their chains,
+// so that later overflow buckets can reuse them instead of growing the file.
+type freeList struct {
+	mtx sync.Mutex
+	pns []int64
+}
+
+// push adds a page to the free list.
+func (list *freeList) push(pn int64) {
+	list.mtx.Lock()
+	defer list.mtx.Unlock()
+	list.pns = append(list.pns, pn)
+}
+
+// pop takes a page off the free list, or returns false if it is empty.
+func (list *freeList) pop() (int64, bool) {
+	list.mtx.Lock()
+	defer list.mtx.Unlock()
+	if len(list.pns) == 0 {
+		return 0, false
+	}
+	pn := list.pns[len(list.pns)-1]
+	list.pns = list.pns[:len(list.pns)-1]
+	return pn, true
+}
+
+// len returns the number of pages on the free list.
+func (list *freeList) len() int {
+	list.mtx.Lock()
+	defer list.mtx.Unlock()
+	return len(list.pns)
+}
+
+// findFreePages returns a free list of every page of the pager that is neither one of the
+// given buckets nor in one of their overflow chains, i.e. that was freed before the table
+// was last closed.
+func findFreePages(p *pager.Pager, maxKeys int64, heads []int64) (*freeList, error) {
+	used := make(map[int64]bool)
+	for _, pn := range heads {
+		if used[pn] {
+			continue
+		}
+		used[pn] = true
+		bucket, err := getBucketByPN(p, pn, maxKeys, NO_LOCK)
+		if err != nil {
+			return nil, err
+		}
+		err = walkChain(p, maxKeys, bucket, func(cur *HashBucket) (bool, error) {
+			used[cur.page.GetPageNum()] = true
+			return false, nil
+		})
+		bucket.page.Put()
+		if err != nil {
+			return nil, err
+		}
+	}
+	free := &freeList{}
+	for pn := int64(0); pn < p.GetNumPages(); pn++ {
+		if !used[pn] {
+			free.push(pn)
+		}
+	}
+	return free, nil
+}
+
+// Calls f on the given bucket and on each bucket in its overflow chain until f returns true.
+// Overflow buckets are not locked; they are protected by the lock on the first bucket.
+// If the first bucket is read-only, so are the overflow buckets.
+func walkChain(p *pager.Pager, maxKeys int64, bucket *HashBucket, f func(*HashBucket) (bool, error)) error {
+	cur := bucket
+	// A chain never holds more buckets than there are pages; any longer and it loops.
+	for n := int64(0); ; n++ {
+		done, err := f(cur)
+		if err != nil || done || cur.nextOverflowPN == NO_OVERFLOW_PN {
+			if cur != bucket {
+				cur.page.Put()
+			}
+			return err
+		}
+		nextPN := cur.nextOverflowPN
+		if nextPN < 0 || nextPN >= p.GetNumPages() || n >= p.GetNumPages() {
+			if cur != bucket {
+				cur.page.Put()
+			}
+			return fmt.Errorf("bucket on page %d is corrupted: invalid overflow pagenum %d", cur.page.GetPageNum(), nextPN)
+		}
+		var next *HashBucket
+		if bucket.page.IsReadOnly() {
+			var page *pager.Page
+			if page, err = p.GetPageReadOnly(nextPN); err == nil {
+				next = pageToBucket(page, maxKeys)
+			}
+		} else {
+			next, err = getBucketByPN(p, nextPN, maxKeys, NO_LOCK)
+		}
+		if cur != bucket {
+			cur.page.Put()
+		}
+		if err != nil {
+			return err
+		}
+		cur = next
+	}
+}
+
+// allocateBucket returns a new, empty bucket, reusing a freed page if there is one.
+// Nodes created with this function must be `Put()` accordingly after use.
+func allocateBucket(p *pager.Pager, free *freeList, depth int64, maxKeys int64) (*HashBucket, error) {
+	pn, ok := free.pop()
+	if !ok {
+		return NewHashBucket(p, depth, maxKeys)
+	}
+	bucket, err := getBucketByPN(p, pn, maxKeys, NO_LOCK)
+	if err != nil {
+		free.push(pn)
+		return nil, err
+	}
+	bucket.updateDepth(depth)
+	bucket.updateNumKeys(0)
+	bucket.updateNextOverflowPN(NO_OVERFLOW_PN)
+	return bucket, nil
+}
+
+// freeOverflowBucket empties the given overflow bucket, which must already be unlinked
+// from its chain, and puts its page on the free list.
+func freeOverflowBucket(free *freeList, bucket *HashBucket) {
+	bucket.updateNumKeys(0)
+	bucket.updateNextOverflowPN(NO_OVERFLOW_PN)
+	free.push(bucket.page.GetPageNum())
+}
+
+// chainEntries returns the entries of the given bucket and of its whole overflow chain.
+func chainEntries(p *pager.Pager, maxKeys int64, bucket *HashBucket) ([]HashEntry, error) {
+	entries := make([]HashEntry, 0, bucket.numKeys)
+	err := walkChain(p, maxKeys, bucket, func(cur *HashBucket) (bool, error) {
+		if err := cur.checkNumKeys(); err != nil {
+			return true, err
+		}
+		for i := int64(0); i < cur.numKeys; i++ {
+			entry, err := cur.getCell(i)
+			if err != nil {
+				return true, err
+			}
+			entries = append(entries, entry)
+		}
+		return false, nil
+	})
+	return entries, err
+}
+
+// releaseChain unlinks every overflow bucket from the given bucket's chain and frees them.
+// [CONCURRENCY] Note: the bucket should be write locked before entry
+func releaseChain(p *pager.Pager, free *freeList, maxKeys int64, bucket *HashBucket) error {
+	pn := bucket.nextOverflowPN
+	bucket.updateNextOverflowPN(NO_OVERFLOW_PN)
+	for pn != NO_OVERFLOW_PN {
+		if pn < 0 || pn >= p.GetNumPages() {
+			return fmt.Errorf("invalid overflow pagenum %d", pn)
+		}
+		cur, err := getBucketByPN(p, pn, maxKeys, NO_LOCK)
+		if err != nil {
+			return err
+		}
+		pn = cur.nextOverflowPN
+		freeOverflowBucket(free, cur)
+		cur.page.Put()
+	}
+	return nil
+}
+
+// writeChain replaces the contents of the given bucket and of its overflow chain with the
+// given entries. Each bucket is filled to one short of maxKeys, so that none of them is
+// full, and overflow buckets are appended for the rest.
+// [CONCURRENCY] Note: the bucket should be write locked before entry
+func writeChain(p *pager.Pager, free *freeList, maxKeys int64, bucket *HashBucket, entries []HashEntry) error {
+	if err := releaseChain(p, free, maxKeys, bucket); err != nil {
+		return err
+	}
+	cur := bucket
+	defer func() {
+		if cur != bucket {
+			cur.page.Put()
+		}
+	}()
+	for {
+		n := int64(len(entries))
+		if n > maxKeys-1 {
+			n = maxKeys - 1
+		}
+		for i := int64(0); i < n; i++ {
+			cur.modifyCell(i, entries[i])
+		}
+		cur.updateNumKeys(n)
+		entries = entries[n:]
+		if len(entries) == 0 {
+			return nil
+		}
+		next, err := allocateBucket(p, free, cur.depth, maxKeys)
+		if err != nil {
+			return err
+		}
+		cur.updateNextOverflowPN(next.page.GetPageNum())
+		if cur != bucket {
+			cur.page.Put()
+		}
+		cur = next
+	}
+}
+
+// Inserts the given key-value pair into the first bucket in the chain with room,
+// appending a new overflow bucket if the whole chain is full. Returns whether the
+// bucket that took the entry is now full, as HashBucket.Insert does.
+// [CONCURRENCY] Note: the bucket should be write locked before entry
+func insertIntoChain(p *pager.Pager, free *freeList, maxKeys int64, bucket *HashBucket, key int64, value int64) (bool, error) {
+	var full bool
+	err := walkChain(p, maxKeys, bucket, func(cur *HashBucket) (bool, error) {
+		var err error
+		if cur.numKeys < maxKeys {
+			full, err = cur.Insert(key, value)
+			return true, err
+		}
+		if cur.nextOverflowPN != NO_OVERFLOW_PN {
+			return false, nil
+		}
+		overflowBucket, err := allocateBucket(p, free, cur.depth, maxKeys)
+		if err != nil {
+			return true, err
+		}
+		defer overflowBucket.page.Put()
+		cur.updateNextOverflowPN(overflowBucket.page.GetPageNum())
+		full, err = overflowBucket.Insert(key, value)
+		return true, err
+	})
+	return full, err
+}
+
+// Deletes the given key from the first bucket in the chain that holds it. An overflow
+// bucket left empty is unlinked from the chain and freed. Returns whether the key was found.
+// [CONCURRENCY] Note: the bucket should be write locked before entry
+func deleteFromChain(p *pager.Pager, free *freeList, maxKeys int64, bucket *HashBucket, key int64) (bool, error) {
+	// The previous bucket stays pinned past walkChain's Put, so that an emptied bucket can be
+	// unlinked from it.
+	prev := bucket
+	defer func() {
+		if prev != bucket {
+			prev.page.Put()
+		}
+	}()
+	deleted := false
+	err := walkChain(p, maxKeys, bucket, func(cur *HashBucket) (bool, error) {
+		if _, found, err := cur.FindEntry(key); err != nil || !found {
+			if cur != bucket {
+				if prev != bucket {
+					prev.page.Put()
+				}
+				cur.page.Get()
+				prev = cur
+			}
+			return err != nil, err
+		}
+		deleted = true
+		if err := cur.Delete(key); err != nil {
+			return true, err
+		}
+		if cur != bucket && cur.numKeys == 0 {
+			prev.updateNextOverflowPN(cur.nextOverflowPN)
+			freeOverflowBucket(free, cur)
+		}
+		return true, nil
+	})
+	return deleted, err
+}
@@ -23,7 +23,7 @@ func (table *HashIndex) TableStart() (utils.Cursor, error) {
 		return nil, err
 	}
 	defer curPage.Put()
-	cursor.curBucket = pageToBucket(curPage)
+	cursor.curBucket = pageToBucket(curPage, table.table.bucketSize)
 	cursor.isEnd = (cursor.curBucket.numKeys == 0)
 	return &cursor, nil
 }
@@ -43,7 +43,7 @@ func (cursor *HashCursor) StepForward() error {
 			return err
 		}
 		defer nextPage.Put()
-		nextBucket := pageToBucket(nextPage)
+		nextBucket := pageToBucket(nextPage, cursor.table.table.bucketSize)
 		// Reinitialize the cursor.
 		cursor.cellnum = 0
 		cursor.isEnd = (cursor.cellnum == nextBucket.numKeys)
@@ -71,6 +71,5 @@ func (cursor *HashCursor) GetEntry() (utils.Entry, error) {
 	if cursor.isEnd {
 		return HashEntry{}, errors.New("getEntry: entry is non-existent")
 	}
-	entry := cursor.curBucket.getCell(cursor.cellnum)
-	return entry, nil
+	return cursor.curBucket.getCell(cursor.cellnum)
 }
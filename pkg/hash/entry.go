@@ -2,14 +2,28 @@ package hash
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// Entry layout constants.
+var ENTRY_KEY_OFFSET int64 = 0
+var ENTRY_KEY_SIZE int64 = binary.MaxVarintLen64
+var ENTRY_VALUE_OFFSET int64 = ENTRY_KEY_OFFSET + ENTRY_KEY_SIZE
+var ENTRY_VALUE_SIZE int64 = binary.MaxVarintLen64
+var ENTRY_FLAGS_OFFSET int64 = ENTRY_VALUE_OFFSET + ENTRY_VALUE_SIZE
+
+// Entry flag bits.
+const (
+	NULL_FLAG byte = 1 << 0 // The entry's value is null; its value field holds 0.
+)
+
 // HashEntry is a single entry in a hashtable. Implements utils.Entry.
 type HashEntry struct {
 	key   int64
 	value int64
+	flags byte
 }
 
 // Get key.
@@ -27,9 +41,21 @@ func (entry *HashEntry) SetKey(key int64) {
 	entry.key = key
 }
 
-// Set value.
+// Set value. The entry is no longer null.
 func (entry *HashEntry) SetValue(value int64) {
 	entry.value = value
+	entry.flags &^= NULL_FLAG
+}
+
+// IsNull returns true if the entry's value is null.
+func (entry HashEntry) IsNull() bool {
+	return entry.flags&NULL_FLAG != 0
+}
+
+// SetNull makes the entry's value null, and its value 0.
+func (entry *HashEntry) SetNull() {
+	entry.value = 0
+	entry.flags |= NULL_FLAG
 }
 
 // marshal serializes a given entry into a byte array.
@@ -43,19 +69,44 @@ func (entry HashEntry) Marshal() []byte {
 	bin = make([]byte, binary.MaxVarintLen64)
 	binary.PutVarint(bin, entry.GetValue())
 	newdata = append(newdata, bin...)
+	// Marshall the flags field.
+	newdata = append(newdata, entry.flags)
 	// Return the combined byte array.
 	return newdata
 }
 
 // unmarshalEntry deserializes a byte array into an entry.
 func unmarshalEntry(data []byte) (entry HashEntry) {
-	k, _ := binary.Varint(data[:len(data)/2])
-	v, _ := binary.Varint(data[len(data)/2:])
-	return HashEntry{key: k, value: v}
+	k, _ := binary.Varint(data[ENTRY_KEY_OFFSET : ENTRY_KEY_OFFSET+ENTRY_KEY_SIZE])
+	v, _ := binary.Varint(data[ENTRY_VALUE_OFFSET : ENTRY_VALUE_OFFSET+ENTRY_VALUE_SIZE])
+	return HashEntry{key: k, value: v, flags: data[ENTRY_FLAGS_OFFSET]}
+}
+
+// Unmarshal deserializes a byte array produced by Marshal into this entry.
+// Every int64 fits in the binary.MaxVarintLen64 bytes reserved for each field,
+// so any entry survives a round trip; this errors only on malformed data.
+func (entry *HashEntry) Unmarshal(data []byte) error {
+	if int64(len(data)) != ENTRYSIZE {
+		return fmt.Errorf("entry must be %d bytes, got %d", ENTRYSIZE, len(data))
+	}
+	k, n := binary.Varint(data[ENTRY_KEY_OFFSET : ENTRY_KEY_OFFSET+ENTRY_KEY_SIZE])
+	if n <= 0 {
+		return errors.New("malformed entry key")
+	}
+	v, n := binary.Varint(data[ENTRY_VALUE_OFFSET : ENTRY_VALUE_OFFSET+ENTRY_VALUE_SIZE])
+	if n <= 0 {
+		return errors.New("malformed entry value")
+	}
+	*entry = HashEntry{key: k, value: v, flags: data[ENTRY_FLAGS_OFFSET]}
+	return nil
 }
 
 // Print this entry.
 func (entry HashEntry) Print(w io.Writer) {
+	if entry.IsNull() {
+		io.WriteString(w, fmt.Sprintf("(%d, null), ", entry.GetKey()))
+		return
+	}
 	io.WriteString(w, fmt.Sprintf("(%d, %d), ",
 		entry.GetKey(), entry.GetValue()))
 }
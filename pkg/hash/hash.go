@@ -1,6 +1,7 @@
 package hash
 
 import (
+	"context"
 	"io"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
@@ -15,6 +16,19 @@ type HashIndex struct {
 
 // Opens the pager with the given table name.
 func OpenTable(filename string) (*HashIndex, error) {
+	return OpenTableWithBucketSize(filename, BUCKETSIZE)
+}
+
+// Opens the pager with the given table name. If the table is new, its buckets
+// split once they hold bucketSize entries; existing tables keep their stored size.
+func OpenTableWithBucketSize(filename string, bucketSize int64) (*HashIndex, error) {
+	return OpenTableWithPartition(filename, bucketSize, nil)
+}
+
+// Opens the pager with the given table name, placing keys into buckets by the given
+// partition function rather than by hash. The function is not stored in the table, so
+// a table must always be opened with the function it was created with.
+func OpenTableWithPartition(filename string, bucketSize int64, partition PartitionFunc) (*HashIndex, error) {
 	// Create a pager for the table.
 	pager := pager.NewPager()
 	err := pager.Open(filename)
@@ -24,13 +38,15 @@ func OpenTable(filename string) (*HashIndex, error) {
 	// Return index.
 	var table *HashTable
 	if pager.GetNumPages() == 0 {
-		table, err = NewHashTable(pager)
+		table, err = NewHashTableWithPartition(pager, bucketSize, partition)
 	} else {
 		table, err = ReadHashTable(pager)
 	}
 	if err != nil {
+		pager.Close()
 		return nil, err
 	}
+	table.partition = partition
 	return &HashIndex{table: table, pager: pager}, nil
 }
 
@@ -59,6 +75,16 @@ func (index *HashIndex) Find(key int64) (utils.Entry, error) {
 	return index.table.Find(key)
 }
 
+// Check whether the given key is present, using the table's bloom filter.
+func (index *HashIndex) Contains(key int64) bool {
+	return index.table.Contains(key)
+}
+
+// Rebuild the table's bloom filter to drop deleted keys.
+func (index *HashIndex) RebuildFilter() error {
+	return index.table.RebuildFilter()
+}
+
 // Insert given element.
 func (index *HashIndex) Insert(key int64, value int64) error {
 	return index.table.Insert(key, value)
@@ -74,11 +100,51 @@ func (index *HashIndex) Delete(key int64) error {
 	return index.table.Delete(key)
 }
 
+// Shrink the table's directory if it was extended without splitting; see HashTable.TryShrink.
+func (index *HashIndex) TryShrink() (bool, error) {
+	return index.table.TryShrink()
+}
+
+// Freeze makes the index immutable; see HashTable.Freeze.
+func (index *HashIndex) Freeze() {
+	index.table.Freeze()
+}
+
+// Count returns the number of elements, without scanning the table.
+func (index *HashIndex) Count() (int64, error) {
+	return index.table.Count(), nil
+}
+
+// RecomputeCount rescans the table to reset its cached element count.
+func (index *HashIndex) RecomputeCount() error {
+	return index.table.RecomputeCount()
+}
+
 // Select all elements.
 func (index *HashIndex) Select() ([]utils.Entry, error) {
 	return index.table.Select()
 }
 
+// Select all elements, giving up once ctx is cancelled.
+func (index *HashIndex) SelectCtx(ctx context.Context) ([]utils.Entry, error) {
+	return index.table.SelectCtx(ctx)
+}
+
+// Select up to limit elements, without scanning the whole table.
+func (index *HashIndex) SelectLimit(limit int64) ([]utils.Entry, error) {
+	return index.table.SelectLimit(limit)
+}
+
+// Select just the keys or just the values of all elements.
+func (index *HashIndex) SelectProject(fields utils.Projection) ([]int64, error) {
+	return index.table.SelectProject(fields)
+}
+
+// Select all elements in key order.
+func (index *HashIndex) SelectSorted() ([]utils.Entry, error) {
+	return index.table.SelectSorted()
+}
+
 // Print all elements.
 func (index *HashIndex) Print(w io.Writer) {
 	index.table.Print(w)
@@ -2,8 +2,10 @@ package hash
 
 import (
 	"encoding/binary"
+	"fmt"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
 	xxhash "github.com/cespare/xxhash"
 	murmur3 "github.com/spaolacci/murmur3"
 )
@@ -11,14 +13,52 @@ import (
 // Hash table variables
 var ROOT_PN int64 = 0
 var PAGESIZE int64 = pager.PAGESIZE
-var DIRECTORY_HEADER_SIZE int64 = binary.MaxVarintLen64 * 2 // Must store global depth and next pointer
+var DIRECTORY_HEADER_SIZE int64 = binary.MaxVarintLen64*5 + 1 + int64(len(META_MAGIC)) // Must store global depth, bucket size, overflow mode, entry count, format version, magic, and hasher
 var DEPTH_OFFSET int64 = 0
 var DEPTH_SIZE int64 = binary.MaxVarintLen64
 var NUM_KEYS_OFFSET int64 = DEPTH_OFFSET + DEPTH_SIZE
 var NUM_KEYS_SIZE int64 = binary.MaxVarintLen64
-var BUCKET_HEADER_SIZE int64 = DEPTH_SIZE + NUM_KEYS_SIZE
-var ENTRYSIZE int64 = binary.MaxVarintLen64 * 2                    // int64 key, int64 value
-var BUCKETSIZE int64 = (PAGESIZE - BUCKET_HEADER_SIZE) / ENTRYSIZE // num entries
+var NEXT_OVERFLOW_PN_OFFSET int64 = NUM_KEYS_OFFSET + NUM_KEYS_SIZE
+var NEXT_OVERFLOW_PN_SIZE int64 = binary.MaxVarintLen64
+var BUCKET_HEADER_SIZE int64 = DEPTH_SIZE + NUM_KEYS_SIZE + NEXT_OVERFLOW_PN_SIZE
+var ENTRYSIZE int64 = binary.MaxVarintLen64*2 + 1                  // int64 key, int64 value, flags
+var BUCKETSIZE int64 = (PAGESIZE - BUCKET_HEADER_SIZE) / ENTRYSIZE // num entries that fit on a page, with no spare cell
+
+// Meta file variables
+var META_BUCKETSIZE_OFFSET int64 = DEPTH_OFFSET + DEPTH_SIZE
+var META_BUCKETSIZE_SIZE int64 = binary.MaxVarintLen64
+var META_OVERFLOW_OFFSET int64 = META_BUCKETSIZE_OFFSET + META_BUCKETSIZE_SIZE
+var META_OVERFLOW_SIZE int64 = binary.MaxVarintLen64
+var META_COUNT_OFFSET int64 = META_OVERFLOW_OFFSET + META_OVERFLOW_SIZE
+var META_COUNT_SIZE int64 = binary.MaxVarintLen64
+var META_VERSION_OFFSET int64 = META_COUNT_OFFSET + META_COUNT_SIZE
+var META_VERSION_SIZE int64 = 1
+var META_MAGIC_OFFSET int64 = META_VERSION_OFFSET + META_VERSION_SIZE
+var META_MAGIC_SIZE int64 = int64(len(META_MAGIC))
+var META_HASHER_OFFSET int64 = META_MAGIC_OFFSET + META_MAGIC_SIZE
+var META_HASHER_SIZE int64 = binary.MaxVarintLen64
+
+// Magic bytes in the header of every meta file. Meta files written before the header existed
+// hold the directory right after the global depth instead, so they lack it and are refused.
+const META_MAGIC = "DBHASH\x00\x00"
+
+// Version of the meta file layout. Bump it whenever the layout of the meta file or buckets changes.
+var FORMAT_VERSION byte = 6
+
+// HasherID identifies the hash function a table places its keys by. It is stored in the
+// table's header, so that a table keeps the hasher it was created with, and tables whose
+// hasher we don't have are refused rather than read with the wrong one.
+type HasherID int64
+
+const (
+	XX_HASHER HasherID = 1 // xxHash read as an unsigned integer; see Hasher.
+)
+
+// Hasher that new tables are created with.
+var DEFAULT_HASHER HasherID = XX_HASHER
+
+// Page number marking the end of an overflow chain.
+var NO_OVERFLOW_PN int64 = -1
 
 // Lock Types
 type BucketLockType int
@@ -30,14 +70,11 @@ const (
 )
 
 // getHash returns the hash of a key, given a hashing function.
+// The hash is treated as unsigned so that the result always lies in [0, size).
 func getHash(hasher func(b []byte) uint64, key int64, size int64) uint {
 	buf := make([]byte, binary.MaxVarintLen64)
 	binary.PutVarint(buf, key)
-	hash := int64(hasher(buf))
-	if hash < 0 {
-		hash *= -1
-	}
-	return uint(hash % size)
+	return uint(hasher(buf) % uint64(size))
 }
 
 // XxHasher returns the xxHash hash of the given key, bounded by size.
@@ -50,9 +87,37 @@ func MurmurHasher(key int64, size int64) uint {
 	return getHash(murmur3.Sum64, key, size)
 }
 
-// Hasher returns the hash of a key, modded by 2^depth.
+// A PartitionFunc maps a key to a code whose low bits pick the key's bucket, so keys
+// with the same code always share a bucket, and codes that differ in their low d bits
+// are separated once buckets have depth d.
+type PartitionFunc func(key int64) uint64
+
+// XxPartition is the default PartitionFunc, the xxHash hash of the key.
+func XxPartition(key int64) uint64 {
+	buf := make([]byte, binary.MaxVarintLen64)
+	binary.PutVarint(buf, key)
+	return xxhash.Sum64(buf)
+}
+
+// maskPartition masks a partition code to its low depth bits.
+func maskPartition(code uint64, depth int64) int64 {
+	mask := uint64(1)<<uint64(depth) - 1
+	return int64(code & mask)
+}
+
+// Hasher returns the hash of a key, masked to its low depth bits.
+// The result always lies in [0, 2^depth), including for negative keys.
 func Hasher(key int64, depth int64) int64 {
-	return int64(XxHasher(key, powInt(2, depth)))
+	return maskPartition(XxPartition(key), depth)
+}
+
+// hash returns the directory index of a key at the given depth, using the table's
+// partition function if it has one, and its hasher otherwise.
+func (table *HashTable) hash(key int64, depth int64) int64 {
+	if table.partition != nil {
+		return maskPartition(table.partition(key), depth)
+	}
+	return Hasher(key, depth)
 }
 
 // Get the byte-position of the cell with the given index.
@@ -68,34 +133,62 @@ func (bucket *HashBucket) modifyCell(index int64, entry HashEntry) {
 }
 
 // Get the entry at the given index.
-func (bucket *HashBucket) getCell(index int64) HashEntry {
+// Errors if the index lies outside of the bucket's page, e.g. due to a corrupted key count.
+func (bucket *HashBucket) getCell(index int64) (HashEntry, error) {
+	if index < 0 || index >= BUCKETSIZE {
+		return HashEntry{}, fmt.Errorf("cell index %d out of bounds for bucket on page %d", index, bucket.page.GetPageNum())
+	}
 	startPos := cellPos(index)
 	entry := unmarshalEntry((*bucket.page.GetData())[startPos : startPos+ENTRYSIZE])
-	return entry
+	return entry, nil
 }
 
 // Get the key at the given index.
-func (bucket *HashBucket) getKeyAt(index int64) int64 {
-	return bucket.getCell(index).GetKey()
+func (bucket *HashBucket) getKeyAt(index int64) (int64, error) {
+	entry, err := bucket.getCell(index)
+	if err != nil {
+		return 0, err
+	}
+	return entry.GetKey(), nil
 }
 
 // Update the key at the given index.
-func (bucket *HashBucket) updateKeyAt(index int64, key int64) {
-	entry := bucket.getCell(index)
+func (bucket *HashBucket) updateKeyAt(index int64, key int64) error {
+	entry, err := bucket.getCell(index)
+	if err != nil {
+		return err
+	}
 	entry.SetKey(key)
 	bucket.modifyCell(index, entry)
+	return nil
 }
 
 // Get the value at the given index.
-func (bucket *HashBucket) getValueAt(index int64) int64 {
-	return bucket.getCell(index).GetValue()
+func (bucket *HashBucket) getValueAt(index int64) (int64, error) {
+	entry, err := bucket.getCell(index)
+	if err != nil {
+		return 0, err
+	}
+	return entry.GetValue(), nil
 }
 
 // Update the value at the given index.
-func (bucket *HashBucket) updateValueAt(index int64, value int64) {
-	entry := bucket.getCell(index)
+func (bucket *HashBucket) updateValueAt(index int64, value int64) error {
+	entry, err := bucket.getCell(index)
+	if err != nil {
+		return err
+	}
 	entry.SetValue(value)
 	bucket.modifyCell(index, entry)
+	return nil
+}
+
+// Check that this bucket's key count fits within its page.
+func (bucket *HashBucket) checkNumKeys() error {
+	if bucket.numKeys < 0 || bucket.numKeys > BUCKETSIZE {
+		return fmt.Errorf("bucket on page %d is corrupted: invalid key count %d", bucket.page.GetPageNum(), bucket.numKeys)
+	}
+	return nil
 }
 
 // Update this bucket's depth.
@@ -114,24 +207,68 @@ func (bucket *HashBucket) updateNumKeys(nKeys int64) {
 	bucket.page.Update(nKeysData, NUM_KEYS_OFFSET, NUM_KEYS_SIZE)
 }
 
-// Convert a page into a bucket.
-func pageToBucket(page *pager.Page) *HashBucket {
+// Update the page number of the next bucket in this bucket's overflow chain.
+func (bucket *HashBucket) updateNextOverflowPN(pn int64) {
+	bucket.nextOverflowPN = pn
+	pnData := make([]byte, NEXT_OVERFLOW_PN_SIZE)
+	binary.PutVarint(pnData, pn)
+	bucket.page.Update(pnData, NEXT_OVERFLOW_PN_OFFSET, NEXT_OVERFLOW_PN_SIZE)
+}
+
+// Bump this bucket's version stamp. It is odd while the bucket is write locked.
+// The stamp is kept on the page's frame, so it is never written to disk.
+func (bucket *HashBucket) bumpVersion() {
+	bucket.page.BumpVersion()
+}
+
+// DescribePage returns the bucket header fields of the given pinned page, one per line
+// with the offset they are stored at, for dumps of its raw bytes. Every page of a hash
+// table's pager is a bucket or an overflow page; the directory is kept in the meta file.
+func DescribePage(page *pager.Page) string {
+	bucket := pageToBucket(page, BUCKETSIZE)
+	return fmt.Sprintf("hash bucket\n"+
+		"depth: %d (offset %d)\n"+
+		"numKeys: %d (offset %d)\n"+
+		"next overflow: %d (offset %d)\n",
+		bucket.depth, DEPTH_OFFSET, bucket.numKeys, NUM_KEYS_OFFSET,
+		bucket.nextOverflowPN, NEXT_OVERFLOW_PN_OFFSET)
+}
+
+// Convert a page into a bucket that splits once it holds maxKeys entries.
+func pageToBucket(page *pager.Page, maxKeys int64) *HashBucket {
 	depth, _ := binary.Varint(
 		(*page.GetData())[DEPTH_OFFSET : DEPTH_OFFSET+DEPTH_SIZE],
 	)
 	numKeys, _ := binary.Varint(
 		(*page.GetData())[NUM_KEYS_OFFSET : NUM_KEYS_OFFSET+NUM_KEYS_SIZE],
 	)
+	nextOverflowPN, _ := binary.Varint(
+		(*page.GetData())[NEXT_OVERFLOW_PN_OFFSET : NEXT_OVERFLOW_PN_OFFSET+NEXT_OVERFLOW_PN_SIZE],
+	)
 	return &HashBucket{
-		depth:   depth,
-		numKeys: numKeys,
-		page:    page,
+		depth:          depth,
+		numKeys:        numKeys,
+		maxKeys:        maxKeys,
+		nextOverflowPN: nextOverflowPN,
+		page:           page,
 	}
 }
 
+// Calls f on the given bucket and on each bucket in its overflow chain until f returns true.
+// Overflow buckets are not locked; they are protected by the lock on the first bucket.
+// If the first bucket is read-only, so are the overflow buckets.
+func (table *HashTable) walkChain(bucket *HashBucket, f func(*HashBucket) (bool, error)) error {
+	return walkChain(table.pager, table.bucketSize, bucket, f)
+}
+
 // Returns the bucket in the hash table using its page number, and increments the bucket ref count.
 func (table *HashTable) GetBucketByPN(pn int64, lock BucketLockType) (*HashBucket, error) {
-	page, err := table.pager.GetPage(pn)
+	return getBucketByPN(table.pager, pn, table.bucketSize, lock)
+}
+
+// Returns the bucket on the given page of the pager, locked as asked, and increments the bucket ref count.
+func getBucketByPN(p *pager.Pager, pn int64, maxKeys int64, lock BucketLockType) (*HashBucket, error) {
+	page, err := p.GetPage(pn)
 	if err != nil {
 		return nil, err
 	}
@@ -141,7 +278,20 @@ func (table *HashTable) GetBucketByPN(pn int64, lock BucketLockType) (*HashBucke
 	if lock == WRITE_LOCK {
 		page.WLock()
 	}
-	return pageToBucket(page), nil
+	bucket := pageToBucket(page, maxKeys)
+	if lock == WRITE_LOCK {
+		bucket.bumpVersion()
+	}
+	return bucket, nil
+}
+
+// Returns the bucket in the hash table using its page number, pinned read-only.
+func (table *HashTable) getBucketReadOnly(pn int64) (*HashBucket, error) {
+	page, err := table.pager.GetPageReadOnly(pn)
+	if err != nil {
+		return nil, err
+	}
+	return pageToBucket(page, table.bucketSize), nil
 }
 
 // Returns the bucket in the hash table, and increments the bucket ref count.
@@ -154,6 +304,22 @@ func (table *HashTable) GetBucket(hash int64, lock BucketLockType) (*HashBucket,
 	return bucket, nil
 }
 
+// Returns the bucket that the given key hashes to at the table's current depth,
+// along with the directory index it was resolved through, and increments the bucket ref count.
+// [CONCURRENCY] Note: the index should be locked before entry, so that the depth
+// and directory don't change underneath us.
+func (table *HashTable) GetBucketResolved(key int64, lock BucketLockType) (*HashBucket, int64, error) {
+	hash := table.hash(key, table.depth)
+	if hash < 0 || int(hash) >= len(table.buckets) {
+		return nil, -1, fmt.Errorf("directory index %d out of range for depth %d", hash, table.depth)
+	}
+	bucket, err := table.GetBucket(hash, lock)
+	if err != nil {
+		return nil, -1, err
+	}
+	return bucket, hash, nil
+}
+
 // Read hash table in from memory.
 func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 	indexPager := pager.NewPager()
@@ -166,9 +332,49 @@ func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Check the magic and format version before trusting anything else in the file.
+	if string((*page.GetData())[META_MAGIC_OFFSET:META_MAGIC_OFFSET+META_MAGIC_SIZE]) != META_MAGIC {
+		page.Put()
+		indexPager.Close()
+		return nil, fmt.Errorf("%w: no hash table header; the file was written before format versions were stored", utils.ErrUnsupportedVersion)
+	}
+	if version := (*page.GetData())[META_VERSION_OFFSET]; version != FORMAT_VERSION {
+		page.Put()
+		indexPager.Close()
+		return nil, fmt.Errorf("%w: file has version %d, expected %d", utils.ErrUnsupportedVersion, version, FORMAT_VERSION)
+	}
 	// Read the gobal depth
 	depth, _ := binary.Varint((*page.GetData())[:DEPTH_SIZE])
-	bytesRead := DEPTH_SIZE
+	// Read the bucket size
+	bucketSize, _ := binary.Varint(
+		(*page.GetData())[META_BUCKETSIZE_OFFSET : META_BUCKETSIZE_OFFSET+META_BUCKETSIZE_SIZE],
+	)
+	if bucketSize < 2 || bucketSize > BUCKETSIZE {
+		page.Put()
+		indexPager.Close()
+		return nil, fmt.Errorf("invalid bucket size %d", bucketSize)
+	}
+	// Read the overflow mode
+	overflow, _ := binary.Varint(
+		(*page.GetData())[META_OVERFLOW_OFFSET : META_OVERFLOW_OFFSET+META_OVERFLOW_SIZE],
+	)
+	// Read the cached entry count, which is only a hint; see below
+	count, _ := binary.Varint(
+		(*page.GetData())[META_COUNT_OFFSET : META_COUNT_OFFSET+META_COUNT_SIZE],
+	)
+	if count < 0 || count > bucketPager.GetNumPages()*bucketSize {
+		count = 0
+	}
+	// Read the hasher, which must be one we still have
+	hasher, _ := binary.Varint(
+		(*page.GetData())[META_HASHER_OFFSET : META_HASHER_OFFSET+META_HASHER_SIZE],
+	)
+	if HasherID(hasher) != XX_HASHER {
+		page.Put()
+		indexPager.Close()
+		return nil, fmt.Errorf("unknown hasher %d", hasher)
+	}
+	bytesRead := DIRECTORY_HEADER_SIZE
 	// Read the bucket index
 	pnSize := int64(binary.MaxVarintLen64)
 	numHashes := powInt(2, depth)
@@ -189,7 +395,34 @@ func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 	}
 	page.Put()
 	indexPager.Close()
-	return &HashTable{depth: depth, buckets: buckets, pager: bucketPager}, nil
+	table := &HashTable{
+		depth:      depth,
+		bucketSize: bucketSize,
+		overflow:   overflow == 1,
+		count:      count,
+		buckets:    buckets,
+		pager:      bucketPager,
+		hasher:     HasherID(hasher),
+	}
+	// Free pages aren't persisted either; they are the ones no bucket or chain reaches.
+	if table.free, err = findFreePages(bucketPager, bucketSize, buckets); err != nil {
+		return nil, err
+	}
+	// The bloom filter isn't persisted, so build it from the buckets. That reads every
+	// entry anyway, so count them too, rather than trust a count that a crash left stale.
+	if table.count, err = table.rebuildFilter(count); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// getOrAllocatePage returns the page with the given pagenum, allocating it if
+// it is the next page past the end of the file.
+func getOrAllocatePage(p *pager.Pager, pagenum int64) (*pager.Page, error) {
+	if pagenum < p.GetNumPages() {
+		return p.GetPage(pagenum)
+	}
+	return p.AllocatePage()
 }
 
 // Write hash table out to memory.
@@ -200,8 +433,9 @@ func WriteHashTable(bucketPager *pager.Pager, table *HashTable) error {
 		if err != nil {
 			return err
 		}
-		metaPN := indexPager.GetFreePN()
-		page, err := indexPager.GetPage(metaPN)
+		// Overwrite the directory in place, starting from the first page.
+		metaPN := int64(0)
+		page, err := getOrAllocatePage(indexPager, metaPN)
 		if err != nil {
 			return err
 		}
@@ -210,15 +444,36 @@ func WriteHashTable(bucketPager *pager.Pager, table *HashTable) error {
 		depthData := make([]byte, DEPTH_SIZE)
 		binary.PutVarint(depthData, table.depth)
 		page.Update(depthData, DEPTH_OFFSET, DEPTH_SIZE)
-		bytesWritten := DEPTH_SIZE
+		// Write bucket size to meta file
+		sizeData := make([]byte, META_BUCKETSIZE_SIZE)
+		binary.PutVarint(sizeData, table.bucketSize)
+		page.Update(sizeData, META_BUCKETSIZE_OFFSET, META_BUCKETSIZE_SIZE)
+		// Write overflow mode to meta file
+		overflowData := make([]byte, META_OVERFLOW_SIZE)
+		if table.overflow {
+			binary.PutVarint(overflowData, 1)
+		}
+		page.Update(overflowData, META_OVERFLOW_OFFSET, META_OVERFLOW_SIZE)
+		// Write cached entry count to meta file
+		countData := make([]byte, META_COUNT_SIZE)
+		binary.PutVarint(countData, table.Count())
+		page.Update(countData, META_COUNT_OFFSET, META_COUNT_SIZE)
+		// Write format version and magic to meta file
+		page.Update([]byte{FORMAT_VERSION}, META_VERSION_OFFSET, META_VERSION_SIZE)
+		page.Update([]byte(META_MAGIC), META_MAGIC_OFFSET, META_MAGIC_SIZE)
+		// Write hasher to meta file
+		hasherData := make([]byte, META_HASHER_SIZE)
+		binary.PutVarint(hasherData, int64(table.hasher))
+		page.Update(hasherData, META_HASHER_OFFSET, META_HASHER_SIZE)
+		bytesWritten := DIRECTORY_HEADER_SIZE
 		// Write bucket index to meta file
 		pnSize := int64(binary.MaxVarintLen64)
 		pnData := make([]byte, pnSize)
 		for _, pn := range table.buckets {
 			if bytesWritten+pnSize > PAGESIZE {
 				page.Put()
-				metaPN = indexPager.GetFreePN()
-				page, err = indexPager.GetPage(metaPN)
+				metaPN++
+				page, err = getOrAllocatePage(indexPager, metaPN)
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,412 @@
+package hash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Ring meta file variables
+var RING_META_BUCKETSIZE_OFFSET int64 = 0
+var RING_META_COUNT_OFFSET int64 = RING_META_BUCKETSIZE_OFFSET + binary.MaxVarintLen64
+var RING_META_NUM_SEGMENTS_OFFSET int64 = RING_META_COUNT_OFFSET + binary.MaxVarintLen64
+var RING_META_VERSION_OFFSET int64 = RING_META_NUM_SEGMENTS_OFFSET + binary.MaxVarintLen64
+var RING_META_HEADER_SIZE int64 = RING_META_VERSION_OFFSET + 1
+var RING_SEGMENT_SIZE int64 = 8 + binary.MaxVarintLen64 // uint64 start, int64 page number
+
+// Version of the ring meta file layout.
+var RING_FORMAT_VERSION byte = 1
+
+// A segment of the hash ring. Each segment runs from its start up to the start of the
+// next one, and the last runs up to the end of the ring.
+type ringSegment struct {
+	start uint64 // The first hash in the segment.
+	pn    int64  // Page number of the bucket that owns the segment.
+}
+
+// RingTable is a hash table whose buckets each own a segment of a ring of hashes, rather
+// than slots in a directory. Splitting a bucket only cuts its segment in two, so the ring
+// grows by one segment per split instead of doubling like an extendible hashing directory.
+// A bucket whose entries all share a hash can't be split, so it grows an overflow chain
+// like a HashTable bucket does.
+type RingTable struct {
+	bucketSize int64         // Number of entries at which a bucket splits
+	count      int64         // Number of entries, updated atomically
+	segments   []ringSegment // Segments of the ring, in order of their start
+	pager      *pager.Pager
+	free       *freeList    // Pages of freed overflow buckets
+	rwlock     sync.RWMutex // Lock on the ring
+}
+
+// Returns a new RingTable whose buckets split once they hold bucketSize entries.
+// The table starts out with a single bucket owning the whole ring.
+func NewRingTable(pager *pager.Pager, bucketSize int64) (*RingTable, error) {
+	if bucketSize < 2 || bucketSize > BUCKETSIZE {
+		return nil, fmt.Errorf("bucket size must be between 2 and %d", BUCKETSIZE)
+	}
+	bucket, err := NewHashBucket(pager, 0, bucketSize)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.page.Put()
+	return &RingTable{
+		bucketSize: bucketSize,
+		segments:   []ringSegment{{start: 0, pn: bucket.page.GetPageNum()}},
+		pager:      pager,
+		free:       &freeList{},
+	}, nil
+}
+
+// Opens the ring table stored in the given file, creating it with the given bucket size if it is new.
+func OpenRingTable(filename string, bucketSize int64) (*RingTable, error) {
+	pager := pager.NewPager()
+	if err := pager.Open(filename); err != nil {
+		return nil, err
+	}
+	if pager.GetNumPages() == 0 {
+		return NewRingTable(pager, bucketSize)
+	}
+	return ReadRingTable(pager)
+}
+
+// Closes the table, writing the ring out to its meta file.
+func (table *RingTable) Close() error {
+	return WriteRingTable(table.pager, table)
+}
+
+// Get the pager.
+func (table *RingTable) GetPager() *pager.Pager {
+	return table.pager
+}
+
+// Get the number of entries at which a bucket splits.
+func (table *RingTable) GetBucketSize() int64 {
+	return table.bucketSize
+}
+
+// Count returns the number of entries in the table.
+func (table *RingTable) Count() int64 {
+	return atomic.LoadInt64(&table.count)
+}
+
+// GetBuckets returns the page numbers of the buckets in ring order, one per segment.
+func (table *RingTable) GetBuckets() []int64 {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
+	buckets := make([]int64, len(table.segments))
+	for i, segment := range table.segments {
+		buckets[i] = segment.pn
+	}
+	return buckets
+}
+
+// segmentOf returns the index of the segment holding the given hash.
+func (table *RingTable) segmentOf(hash uint64) int {
+	return sort.Search(len(table.segments), func(i int) bool {
+		return table.segments[i].start > hash
+	}) - 1
+}
+
+// getBucket returns the bucket owning the given key along with the index of its segment,
+// and increments the bucket ref count.
+// [CONCURRENCY] Note: the ring should be locked before entry.
+func (table *RingTable) getBucket(key int64, lock BucketLockType) (*HashBucket, int, error) {
+	seg := table.segmentOf(XxPartition(key))
+	bucket, err := getBucketByPN(table.pager, table.segments[seg].pn, table.bucketSize, lock)
+	if err != nil {
+		return nil, -1, err
+	}
+	return bucket, seg, nil
+}
+
+// Finds the entry with the given key.
+func (table *RingTable) Find(key int64) (utils.Entry, error) {
+	table.rwlock.RLock()
+	bucket, _, err := table.getBucket(key, READ_LOCK)
+	if err != nil {
+		table.rwlock.RUnlock()
+		return nil, err
+	}
+	defer bucket.page.Put()
+	defer bucket.RUnlock()
+	table.rwlock.RUnlock()
+	var entry utils.Entry
+	err = walkChain(table.pager, table.bucketSize, bucket, func(cur *HashBucket) (bool, error) {
+		var found bool
+		var err error
+		entry, found, err = cur.FindEntry(key)
+		return found, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, utils.ErrNotFound
+	}
+	return entry, nil
+}
+
+// Inserts the given key-value pair, splitting the bucket's segment if it fills up.
+func (table *RingTable) Insert(key int64, value int64) error {
+	table.rwlock.Lock()
+	defer table.rwlock.Unlock()
+	bucket, seg, err := table.getBucket(key, WRITE_LOCK)
+	if err != nil {
+		return err
+	}
+	defer bucket.page.Put()
+	defer bucket.WUnlock()
+	// Only a bucket whose entries all share a hash has a chain, so extend it.
+	var split bool
+	if bucket.nextOverflowPN != NO_OVERFLOW_PN {
+		split, err = insertIntoChain(table.pager, table.free, table.bucketSize, bucket, key, value)
+	} else {
+		split, err = bucket.Insert(key, value)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&table.count, 1)
+	if !split {
+		return nil
+	}
+	return table.split(bucket, seg)
+}
+
+// split cuts the given bucket's segment in two at the median hash of its entries,
+// moving the entries in the upper half to a new bucket that owns it. The entries of the
+// bucket's whole overflow chain are split along with it. If they all share a hash, the
+// bucket is chained instead; a bucket that is chained already is left as it is.
+// [CONCURRENCY] Note: the ring & bucket should be write locked before entry.
+func (table *RingTable) split(bucket *HashBucket, seg int) error {
+	entries, err := chainEntries(table.pager, table.bucketSize, bucket)
+	if err != nil {
+		return err
+	}
+	hashes := make([]uint64, len(entries))
+	for i, entry := range entries {
+		hashes[i] = XxPartition(entry.GetKey())
+	}
+	sorted := append([]uint64(nil), hashes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// The new segment must start past the smallest hash, so that neither half is empty.
+	mid := sorted[len(sorted)/2]
+	if mid == sorted[0] {
+		i := sort.Search(len(sorted), func(i int) bool { return sorted[i] > sorted[0] })
+		if i == len(sorted) {
+			if bucket.nextOverflowPN != NO_OVERFLOW_PN {
+				return nil
+			}
+			return writeChain(table.pager, table.free, table.bucketSize, bucket, entries)
+		}
+		mid = sorted[i]
+	}
+	newBucket, err := allocateBucket(table.pager, table.free, 0, table.bucketSize)
+	if err != nil {
+		return err
+	}
+	defer newBucket.page.Put()
+	// [CONCURRENCY] Note: newBucket doesn't have to be locked because we
+	// hold a write lock on the ring, so no other user can discover it.
+	oldEntries := make([]HashEntry, 0, len(entries))
+	newEntries := make([]HashEntry, 0, len(entries))
+	for i, entry := range entries {
+		if hashes[i] >= mid {
+			newEntries = append(newEntries, entry)
+		} else {
+			oldEntries = append(oldEntries, entry)
+		}
+	}
+	// Either half may still hold more than a bucket's worth of entries if the chain was
+	// long, in which case it is chained until the next insert into it splits it again.
+	if err = writeChain(table.pager, table.free, table.bucketSize, bucket, oldEntries); err != nil {
+		return err
+	}
+	if err = writeChain(table.pager, table.free, table.bucketSize, newBucket, newEntries); err != nil {
+		return err
+	}
+	// Hand the upper part of the segment over to the new bucket.
+	table.segments = append(table.segments, ringSegment{})
+	copy(table.segments[seg+2:], table.segments[seg+1:])
+	table.segments[seg+1] = ringSegment{start: mid, pn: newBucket.page.GetPageNum()}
+	return nil
+}
+
+// Update the given key-value pair.
+func (table *RingTable) Update(key int64, value int64) error {
+	table.rwlock.RLock()
+	bucket, _, err := table.getBucket(key, WRITE_LOCK)
+	if err != nil {
+		table.rwlock.RUnlock()
+		return err
+	}
+	defer bucket.page.Put()
+	defer bucket.WUnlock()
+	table.rwlock.RUnlock()
+	// Update the first bucket in the chain that holds the key.
+	updated := false
+	err = walkChain(table.pager, table.bucketSize, bucket, func(cur *HashBucket) (bool, error) {
+		if _, found, err := cur.FindEntry(key); err != nil || !found {
+			return err != nil, err
+		}
+		updated = true
+		return true, cur.Update(key, value)
+	})
+	if err == nil && !updated {
+		return errors.New("key not found, update aborted")
+	}
+	return err
+}
+
+// Delete the given key-value pair, does not merge segments.
+func (table *RingTable) Delete(key int64) error {
+	table.rwlock.RLock()
+	bucket, _, err := table.getBucket(key, WRITE_LOCK)
+	if err != nil {
+		table.rwlock.RUnlock()
+		return err
+	}
+	defer bucket.page.Put()
+	defer bucket.WUnlock()
+	table.rwlock.RUnlock()
+	deleted, err := deleteFromChain(table.pager, table.free, table.bucketSize, bucket, key)
+	if err == nil && !deleted {
+		return errors.New("key not found, delete aborted")
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&table.count, -1)
+	return nil
+}
+
+// Select all entries in this table, in ring order.
+func (table *RingTable) Select() ([]utils.Entry, error) {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
+	ret := make([]utils.Entry, 0)
+	for _, segment := range table.segments {
+		bucket, err := getBucketByPN(table.pager, segment.pn, table.bucketSize, READ_LOCK)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := chainEntries(table.pager, table.bucketSize, bucket)
+		bucket.RUnlock()
+		bucket.page.Put()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ret = append(ret, entry)
+		}
+	}
+	return ret, nil
+}
+
+// Read a ring table in from its meta file.
+func ReadRingTable(bucketPager *pager.Pager) (*RingTable, error) {
+	indexPager := pager.NewPager()
+	err := indexPager.Open(bucketPager.GetFileName() + ".meta")
+	if err != nil {
+		return nil, err
+	}
+	defer indexPager.Close()
+	metaPN := int64(0)
+	page, err := indexPager.GetPage(metaPN)
+	if err != nil {
+		return nil, err
+	}
+	data := *page.GetData()
+	if version := data[RING_META_VERSION_OFFSET]; version != RING_FORMAT_VERSION {
+		page.Put()
+		return nil, fmt.Errorf("%w: file has version %d, expected %d", utils.ErrUnsupportedVersion, version, RING_FORMAT_VERSION)
+	}
+	bucketSize, _ := binary.Varint(data[RING_META_BUCKETSIZE_OFFSET:])
+	count, _ := binary.Varint(data[RING_META_COUNT_OFFSET:])
+	numSegments, _ := binary.Varint(data[RING_META_NUM_SEGMENTS_OFFSET:])
+	bytesRead := RING_META_HEADER_SIZE
+	// Read the segments
+	segments := make([]ringSegment, numSegments)
+	for i := range segments {
+		if bytesRead+RING_SEGMENT_SIZE > PAGESIZE {
+			page.Put()
+			metaPN++
+			if page, err = indexPager.GetPage(metaPN); err != nil {
+				return nil, err
+			}
+			bytesRead = 0
+		}
+		data = *page.GetData()
+		segments[i].start = binary.BigEndian.Uint64(data[bytesRead : bytesRead+8])
+		segments[i].pn, _ = binary.Varint(data[bytesRead+8 : bytesRead+RING_SEGMENT_SIZE])
+		bytesRead += RING_SEGMENT_SIZE
+	}
+	page.Put()
+	if numSegments < 1 || segments[0].start != 0 {
+		return nil, errors.New("ring meta file is corrupted: the ring must start at 0")
+	}
+	// The free list isn't stored, so rebuild it from the pages no segment's chain reaches.
+	heads := make([]int64, len(segments))
+	for i, segment := range segments {
+		heads[i] = segment.pn
+	}
+	free, err := findFreePages(bucketPager, bucketSize, heads)
+	if err != nil {
+		return nil, err
+	}
+	return &RingTable{
+		bucketSize: bucketSize,
+		count:      count,
+		segments:   segments,
+		pager:      bucketPager,
+		free:       free,
+	}, nil
+}
+
+// Write a ring table out to its meta file, then close its pager.
+func WriteRingTable(bucketPager *pager.Pager, table *RingTable) error {
+	if bucketPager.HasFile() {
+		indexPager := pager.NewPager()
+		err := indexPager.Open(bucketPager.GetFileName() + ".meta")
+		if err != nil {
+			return err
+		}
+		metaPN := int64(0)
+		page, err := getOrAllocatePage(indexPager, metaPN)
+		if err != nil {
+			return err
+		}
+		header := make([]byte, RING_META_HEADER_SIZE)
+		binary.PutVarint(header[RING_META_BUCKETSIZE_OFFSET:], table.bucketSize)
+		binary.PutVarint(header[RING_META_COUNT_OFFSET:], table.Count())
+		binary.PutVarint(header[RING_META_NUM_SEGMENTS_OFFSET:], int64(len(table.segments)))
+		header[RING_META_VERSION_OFFSET] = RING_FORMAT_VERSION
+		page.Update(header, 0, RING_META_HEADER_SIZE)
+		bytesWritten := RING_META_HEADER_SIZE
+		// Write the segments
+		segmentData := make([]byte, RING_SEGMENT_SIZE)
+		for _, segment := range table.segments {
+			if bytesWritten+RING_SEGMENT_SIZE > PAGESIZE {
+				page.Put()
+				metaPN++
+				if page, err = getOrAllocatePage(indexPager, metaPN); err != nil {
+					return err
+				}
+				bytesWritten = 0
+			}
+			binary.BigEndian.PutUint64(segmentData[:8], segment.start)
+			binary.PutVarint(segmentData[8:], segment.pn)
+			page.Update(segmentData, bytesWritten, RING_SEGMENT_SIZE)
+			bytesWritten += RING_SEGMENT_SIZE
+		}
+		page.Put()
+		indexPager.Close()
+	}
+	return bucketPager.Close()
+}
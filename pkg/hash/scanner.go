@@ -0,0 +1,102 @@
+package hash
+
+import (
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// HashScanner walks a hash table one bucket at a time without holding the index lock
+// across the whole scan, so writers can make progress between calls to Next.
+// Every entry that is in the table for the whole scan is returned exactly once;
+// entries inserted or deleted during the scan may or may not be returned.
+type HashScanner struct {
+	table   *HashTable
+	pending []scanRange   // Key ranges still to be read, as a stack.
+	buf     []utils.Entry // Entries of the last bucket read, not yet returned.
+}
+
+// scanRange covers every key whose hash has the given value in its low depth bits.
+type scanRange struct {
+	hash  int64
+	depth int64
+}
+
+// Scanner returns a scanner over the table. The directory is snapshotted under a
+// brief read lock on the index; buckets are read lazily as the scanner advances.
+func (table *HashTable) Scanner() *HashScanner {
+	// [CONCURRENCY] Lock the index just long enough to copy the directory
+	table.RLock()
+	depth := table.depth
+	buckets := make([]int64, len(table.buckets))
+	copy(buckets, table.buckets)
+	table.RUnlock()
+	// A bucket of local depth d is pointed to by 2^(depth-d) slots, the first of which
+	// is the bucket's hash; recover each distinct bucket's range from its slot count.
+	slots := make(map[int64]int64)
+	for _, pn := range buckets {
+		slots[pn]++
+	}
+	scanner := &HashScanner{table: table, pending: make([]scanRange, 0, len(slots))}
+	// Queue in reverse so that the stack pops buckets in directory order.
+	for i := int64(len(buckets)) - 1; i >= 0; i-- {
+		pn := buckets[i]
+		// Only the bucket's first slot lies below 2^localDepth.
+		if i >= int64(len(buckets))/slots[pn] {
+			continue
+		}
+		localDepth := depth
+		for n := slots[pn]; n > 1; n /= 2 {
+			localDepth--
+		}
+		scanner.pending = append(scanner.pending, scanRange{hash: i, depth: localDepth})
+	}
+	return scanner
+}
+
+// Next returns the next entry in the scan. Once the scan is over, it returns false.
+func (scanner *HashScanner) Next() (utils.Entry, bool, error) {
+	for len(scanner.buf) == 0 {
+		if len(scanner.pending) == 0 {
+			return nil, false, nil
+		}
+		if err := scanner.readNext(); err != nil {
+			return nil, false, err
+		}
+	}
+	entry := scanner.buf[0]
+	scanner.buf = scanner.buf[1:]
+	return entry, true, nil
+}
+
+// readNext reads the next pending range into the buffer.
+func (scanner *HashScanner) readNext() error {
+	table := scanner.table
+	r := scanner.pending[len(scanner.pending)-1]
+	scanner.pending = scanner.pending[:len(scanner.pending)-1]
+	// [CONCURRENCY] Lock the bucket before releasing the index, so it can't split
+	// between being resolved and being read.
+	table.RLock()
+	bucket, err := table.GetBucket(r.hash, READ_LOCK)
+	table.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer bucket.GetPage().Put()
+	defer bucket.RUnlock()
+	// If the bucket has split since the range was queued, its keys are now spread
+	// over more than one bucket; read each half of the range separately.
+	if bucket.depth > r.depth {
+		scanner.pending = append(scanner.pending,
+			scanRange{hash: r.hash + powInt(2, r.depth), depth: r.depth + 1},
+			scanRange{hash: r.hash, depth: r.depth + 1},
+		)
+		return nil
+	}
+	return table.walkChain(bucket, func(b *HashBucket) (bool, error) {
+		entries, err := b.Select()
+		if err != nil {
+			return true, err
+		}
+		scanner.buf = append(scanner.buf, entries...)
+		return false, nil
+	})
+}
@@ -1,11 +1,14 @@
 package hash
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"runtime"
 	"sync"
+	"sync/atomic"
 
 	pager "github.com/brown-csci1270/db/pkg/pager"
 	utils "github.com/brown-csci1270/db/pkg/utils"
@@ -13,25 +16,73 @@ import (
 
 // HashTable definitions.
 type HashTable struct {
-	depth   int64
-	buckets []int64 // Array of bucket page numbers
-	pager   *pager.Pager
-	rwlock  sync.RWMutex // Lock on the hash table index
+	depth      int64
+	bucketSize int64   // Number of entries at which a bucket splits
+	overflow   bool    // Whether full buckets chain to overflow buckets instead of splitting
+	count      int64   // Cached number of entries, updated atomically
+	buckets    []int64 // Array of bucket page numbers
+	pager      *pager.Pager
+	rwlock     sync.RWMutex  // Lock on the hash table index
+	filter     *BloomFilter  // Filter over every key inserted since the last rebuild
+	filterMtx  sync.RWMutex  // Guards filter
+	partition  PartitionFunc // Picks each key's bucket; the hasher is used if nil
+	hasher     HasherID      // Hash function that places keys when there is no partition function
+	frozen     int32         // 1 once the table has been frozen, set atomically; see Freeze
+	free       *freeList     // Pages of overflow buckets unlinked from their chains
 }
 
+// Minimum number of bits in a table's bloom filter.
+var DEFAULT_TABLE_FILTER_SIZE int64 = 1 << 16
+
+// Number of filter bits per entry when a table's bloom filter is rebuilt.
+var TABLE_FILTER_BITS_PER_KEY int64 = 16
+
+// Most times Find reads a bucket optimistically before it gives up on writers leaving
+// the bucket alone for long enough, and takes the bucket's readers lock instead.
+var MAX_OPTIMISTIC_READS = 4
+
+// Most bits of hash that splits may add to a bucket's depth to separate its entries.
+// Past that, the entries may never separate, so the bucket chains instead.
+var MAX_SPLIT_BITS int64 = 8
+
 // Returns a new HashTable.
 func NewHashTable(pager *pager.Pager) (*HashTable, error) {
+	return NewHashTableWithBucketSize(pager, BUCKETSIZE)
+}
+
+// Returns a new HashTable whose buckets split once they hold bucketSize entries.
+func NewHashTableWithBucketSize(pager *pager.Pager, bucketSize int64) (*HashTable, error) {
+	return NewHashTableWithPartition(pager, bucketSize, nil)
+}
+
+// Returns a new HashTable whose buckets split once they hold bucketSize entries, and
+// which places keys into buckets by the given partition function rather than by hash.
+// A nil function places keys by Hasher. The function is not stored with the table;
+// see OpenTableWithPartition.
+func NewHashTableWithPartition(pager *pager.Pager, bucketSize int64, partition PartitionFunc) (*HashTable, error) {
+	if bucketSize < 2 || bucketSize > BUCKETSIZE {
+		return nil, fmt.Errorf("bucket size must be between 2 and %d", BUCKETSIZE)
+	}
 	depth := int64(2)
 	buckets := make([]int64, powInt(2, depth))
 	for i := range buckets {
-		bucket, err := NewHashBucket(pager, depth)
+		bucket, err := NewHashBucket(pager, depth, bucketSize)
 		if err != nil {
 			return nil, err
 		}
 		buckets[i] = bucket.page.GetPageNum()
 		bucket.page.Put()
 	}
-	return &HashTable{depth: depth, buckets: buckets, pager: pager}, nil
+	return &HashTable{
+		depth:      depth,
+		bucketSize: bucketSize,
+		buckets:    buckets,
+		pager:      pager,
+		filter:     CreateFilter(DEFAULT_TABLE_FILTER_SIZE),
+		partition:  partition,
+		hasher:     DEFAULT_HASHER,
+		free:       &freeList{},
+	}, nil
 }
 
 // [CONCURRENCY] Grab a write lock on the hash table index
@@ -59,57 +110,361 @@ func (table *HashTable) GetDepth() int64 {
 	return table.depth
 }
 
+// Get bucket size.
+func (table *HashTable) GetBucketSize() int64 {
+	return table.bucketSize
+}
+
+// Get whether full buckets chain to overflow buckets instead of splitting.
+func (table *HashTable) GetOverflowMode() bool {
+	return table.overflow
+}
+
+// Set whether full buckets chain to overflow buckets instead of splitting.
+// Existing overflow chains remain reachable regardless of the mode.
+func (table *HashTable) SetOverflowMode(overflow bool) {
+	table.WLock()
+	defer table.WUnlock()
+	table.overflow = overflow
+}
+
+// Freeze makes the table immutable, e.g. to serve it from a read replica: from then on,
+// Insert, Update, Delete and Split fail with utils.ErrImmutable. Unlike opening the file
+// read-only, this is a promise by the caller, who must only freeze a table once all writes
+// to it are done and must not write to its file behind its back. In return, Find and
+// Select on a frozen table take no locks. Freezing can't be undone short of reopening.
+func (table *HashTable) Freeze() {
+	table.WLock()
+	defer table.WUnlock()
+	atomic.StoreInt32(&table.frozen, 1)
+}
+
+// IsFrozen returns true if the table has been frozen.
+func (table *HashTable) IsFrozen() bool {
+	return atomic.LoadInt32(&table.frozen) == 1
+}
+
+// Count returns the cached number of entries in the table.
+func (table *HashTable) Count() int64 {
+	return atomic.LoadInt64(&table.count)
+}
+
+// RecomputeCount rescans every bucket to reset the cached entry count. It must be
+// called after changes that bypass Insert and Delete, e.g. replaying logs after a
+// crash, when the persisted count may be stale. Should only be run while no other
+// operations are in flight.
+func (table *HashTable) RecomputeCount() error {
+	table.WLock()
+	defer table.WUnlock()
+	count := int64(0)
+	for i := int64(0); i < table.pager.GetNumPages(); i++ {
+		bucket, err := table.GetBucketByPN(i, NO_LOCK)
+		if err != nil {
+			return err
+		}
+		err = bucket.checkNumKeys()
+		count += bucket.numKeys
+		bucket.page.Put()
+		if err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&table.count, count)
+	return nil
+}
+
 // Get bucket page numbers.
 func (table *HashTable) GetBuckets() []int64 {
 	return table.buckets
 }
 
+// Get the hasher that places keys when the table has no partition function.
+func (table *HashTable) GetHasher() HasherID {
+	return table.hasher
+}
+
 // Get pager.
 func (table *HashTable) GetPager() *pager.Pager {
 	return table.pager
 }
 
-// Finds the entry with the given key.
+// Contains reports whether the table holds the given key. Keys that were never
+// inserted are usually ruled out by the bloom filter without touching any bucket.
+// Deleted keys stay in the filter until RebuildFilter, so they cost a bucket scan.
+func (table *HashTable) Contains(key int64) bool {
+	table.filterMtx.RLock()
+	maybe := table.filter.Contains(key)
+	table.filterMtx.RUnlock()
+	if !maybe {
+		return false
+	}
+	_, err := table.Find(key)
+	return err == nil
+}
+
+// addToFilter records a newly inserted key in the bloom filter.
+// [CONCURRENCY] The key's bucket should be write locked, so that RebuildFilter
+// either sees the key in its bucket or waits until it has been added here.
+func (table *HashTable) addToFilter(key int64) {
+	table.filterMtx.Lock()
+	defer table.filterMtx.Unlock()
+	table.filter.Insert(key)
+}
+
+// RebuildFilter rebuilds the bloom filter from the keys currently in the table,
+// dropping deleted keys and resizing it to fit the number of entries.
+func (table *HashTable) RebuildFilter() error {
+	table.WLock()
+	defer table.WUnlock()
+	_, err := table.rebuildFilter(table.Count())
+	return err
+}
+
+// rebuildFilter replaces the bloom filter with one sized for the given number of entries,
+// built from the keys currently in the table. Returns the number of entries it found.
+// [CONCURRENCY] Note: the index should be write locked before entry
+func (table *HashTable) rebuildFilter(sizeHint int64) (int64, error) {
+	size := TABLE_FILTER_BITS_PER_KEY * sizeHint
+	if size < DEFAULT_TABLE_FILTER_SIZE {
+		size = DEFAULT_TABLE_FILTER_SIZE
+	}
+	filter := CreateFilter(size)
+	count := int64(0)
+	err := table.forEachChain(false, func(bucket *HashBucket) (bool, error) {
+		return false, table.walkChain(bucket, func(cur *HashBucket) (bool, error) {
+			if err := cur.checkNumKeys(); err != nil {
+				return true, err
+			}
+			for i := int64(0); i < cur.numKeys; i++ {
+				key, err := cur.getKeyAt(i)
+				if err != nil {
+					return true, err
+				}
+				filter.Insert(key)
+			}
+			count += cur.numKeys
+			return false, nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	table.filterMtx.Lock()
+	defer table.filterMtx.Unlock()
+	table.filter = filter
+	return count, nil
+}
+
+// Finds the entry with the given key. Reads don't latch the bucket unless it is busy; see findOptimistic.
 func (table *HashTable) Find(key int64) (utils.Entry, error) {
 	/* SOLUTION {{{ */
+	if table.IsFrozen() {
+		return table.findFrozen(key)
+	}
+	// Read optimistically, without latching the bucket, unless writers keep changing it.
+	for i := 0; i < MAX_OPTIMISTIC_READS; i++ {
+		entry, ok, err := table.findOptimistic(key)
+		if ok {
+			return entry, err
+		}
+		runtime.Gosched()
+	}
 	// [CONCURRENCY] Lock the index
 	table.RLock()
-	// Hash the key.
-	hash := Hasher(key, table.depth)
-	if hash < 0 || int(hash) >= len(table.buckets) {
-		// [CONCURRENCY] Unlock the index on the error path
-		table.RUnlock()
-		return nil, errors.New("not found")
-	}
-	// Get and lock the corresponding bucket.
-	bucket, err := table.GetBucket(hash, READ_LOCK)
+	// Get and lock the bucket the key hashes to.
+	bucket, _, err := table.GetBucketResolved(key, READ_LOCK)
 	if err != nil {
 		// [CONCURRENCY] Unlock the index on the error path
 		table.RUnlock()
 		return nil, err
 	}
-	defer bucket.RUnlock()
+	// Unpin only after unlocking, so that the page can't be evicted while we hold its lock.
 	defer bucket.page.Put()
+	defer bucket.RUnlock()
 	table.RUnlock()
-	// Find the entry.
-	entry, found := bucket.Find(key)
-	if !found {
-		return nil, errors.New("not found")
+	// Find the entry, walking the overflow chain. The read lock on the first bucket is held
+	// until the whole chain has been scanned, so that writers can't change it underneath us.
+	var entry utils.Entry
+	err = table.walkChain(bucket, func(cur *HashBucket) (bool, error) {
+		var found bool
+		var err error
+		entry, found, err = cur.FindEntry(key)
+		return found, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, utils.ErrNotFound
 	}
 	return entry, nil
 	/* SOLUTION }}} */
 }
 
+// findOptimistic finds the entry with the given key without taking the bucket's latch.
+// It reads the bucket's version stamp, copies the bucket and its overflow chain, and
+// then checks the stamp again; it returns false if a writer held or took the bucket's
+// write lock meanwhile, in which case what it read can't be trusted.
+func (table *HashTable) findOptimistic(key int64) (utils.Entry, bool, error) {
+	// [CONCURRENCY] Lock the index just long enough to read the version, so that the
+	// bucket can't be split between resolving it and stamping the read.
+	table.RLock()
+	hash := table.hash(key, table.depth)
+	if hash < 0 || int(hash) >= len(table.buckets) {
+		table.RUnlock()
+		return nil, true, fmt.Errorf("directory index %d out of range for depth %d", hash, table.depth)
+	}
+	page, err := table.pager.GetPage(table.buckets[hash])
+	if err != nil {
+		table.RUnlock()
+		return nil, true, err
+	}
+	defer page.Put()
+	version := page.GetVersion()
+	table.RUnlock()
+	if version%2 != 0 {
+		return nil, false, nil
+	}
+	// Find the entry in copies of the buckets, so that writers never wait for us.
+	bucket := pageToBucket(page.Clone(), table.bucketSize)
+	var entry utils.Entry
+	for {
+		var found bool
+		entry, found, err = bucket.FindEntry(key)
+		if err != nil || found || bucket.nextOverflowPN == NO_OVERFLOW_PN {
+			break
+		}
+		var next *pager.Page
+		if next, err = table.pager.GetPage(bucket.nextOverflowPN); err != nil {
+			break
+		}
+		bucket = pageToBucket(next.Clone(), table.bucketSize)
+		next.Put()
+	}
+	// A torn read may have led us astray, so check the version before trusting errors too.
+	if page.GetVersion() != version {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	if entry == nil {
+		return nil, true, utils.ErrNotFound
+	}
+	return entry, true, nil
+}
+
+// findFrozen finds the entry with the given key in a frozen table. No writers can be
+// running, so it takes no locks, and pins the buckets read-only to keep it that way.
+func (table *HashTable) findFrozen(key int64) (utils.Entry, error) {
+	bucket, err := table.getBucketReadOnly(table.buckets[table.hash(key, table.depth)])
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.page.Put()
+	var entry utils.Entry
+	err = table.walkChain(bucket, func(cur *HashBucket) (bool, error) {
+		var found bool
+		var err error
+		entry, found, err = cur.FindEntry(key)
+		return found, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, utils.ErrNotFound
+	}
+	return entry, nil
+}
+
 // ExtendTable increases the global depth of the table by 1.
 func (table *HashTable) ExtendTable() {
 	table.depth = table.depth + 1
 	table.buckets = append(table.buckets, table.buckets...)
 }
 
+// TryShrink halves the directory, lowering the global depth, for as long as its top half
+// merely mirrors its bottom half, as it does after ExtendTable grows it without a split.
+// That is the case exactly when no bucket's local depth has reached the global depth.
+// It returns whether the directory shrank.
+func (table *HashTable) TryShrink() (bool, error) {
+	if table.IsFrozen() {
+		return false, utils.ErrImmutable
+	}
+	// [CONCURRENCY] Lock the index, so that no split can deepen a bucket meanwhile
+	table.WLock()
+	defer table.WUnlock()
+	maxDepth := int64(0)
+	seen := make(map[int64]bool)
+	for _, pn := range table.buckets {
+		if seen[pn] {
+			continue
+		}
+		seen[pn] = true
+		bucket, err := table.GetBucketByPN(pn, READ_LOCK)
+		if err != nil {
+			return false, err
+		}
+		if bucket.depth > maxDepth {
+			maxDepth = bucket.depth
+		}
+		bucket.RUnlock()
+		bucket.page.Put()
+	}
+	shrunk := false
+	for table.depth > maxDepth {
+		half := len(table.buckets) / 2
+		for i := 0; i < half; i++ {
+			if table.buckets[i] != table.buckets[i+half] {
+				return shrunk, fmt.Errorf("directory entries %d and %d differ below global depth %d", i, i+half, table.depth)
+			}
+		}
+		table.buckets = append([]int64(nil), table.buckets[:half]...)
+		table.depth--
+		shrunk = true
+	}
+	return shrunk, nil
+}
+
 // Split the given bucket into two, extending the table if necessary.
+// The entries of the bucket's whole overflow chain are split along with it.
 func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 	/* SOLUTION {{{ */
 	// [CONCURRENCY] Note: the index & bucket should be locked before entry
+	if table.IsFrozen() {
+		return utils.ErrImmutable
+	}
+	entries, err := chainEntries(table.pager, table.bucketSize, bucket)
+	if err != nil {
+		return err
+	}
+	// Splitting only separates entries once their hashes differ in the bits it uses; keys
+	// that collide in every bit would deepen the directory forever. If the entries won't
+	// separate within the next MAX_SPLIT_BITS bits, chain the bucket instead. A bucket
+	// that is chained already is left as it is; the next insert extends its chain.
+	if !table.separates(entries, bucket.depth+MAX_SPLIT_BITS) {
+		if bucket.nextOverflowPN != NO_OVERFLOW_PN {
+			return nil
+		}
+		return writeChain(table.pager, table.free, table.bucketSize, bucket, entries)
+	}
+	// The entries are all in hand, so free the chain before allocating new buckets.
+	if err = releaseChain(table.pager, table.free, table.bucketSize, bucket); err != nil {
+		return err
+	}
+	return table.split(bucket, hash, entries)
+	/* SOLUTION }}} */
+}
+
+// split moves the given entries into the given bucket and a new one, splitting
+// further while either holds too many entries, and chaining the entries that
+// won't separate.
+// [CONCURRENCY] Note: the index & bucket should be write locked before entry
+func (table *HashTable) split(bucket *HashBucket, hash int64, entries []HashEntry) error {
+	if !table.separates(entries, bucket.depth+MAX_SPLIT_BITS) {
+		return writeChain(table.pager, table.free, table.bucketSize, bucket, entries)
+	}
 	// Figure out where the new pointer should live.
 	oldHash := (hash % powInt(2, bucket.depth))
 	newHash := oldHash + powInt(2, bucket.depth)
@@ -119,7 +474,7 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 	}
 	// Next, make a new bucket.
 	bucket.updateDepth(bucket.depth + 1)
-	newBucket, err := NewHashBucket(table.pager, bucket.depth)
+	newBucket, err := allocateBucket(table.pager, table.free, bucket.depth, table.bucketSize)
 	if err != nil {
 		return err
 	}
@@ -127,25 +482,16 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 	// [CONCURRENCY] Note: newBucket doesn't have to be locked because we
 	// currently hold a write lock on the index, so no other user can
 	// discover this new bucket
-	// Move entries over to it.
-	tmpEntries := make([]HashEntry, bucket.numKeys)
-	for i := int64(0); i < bucket.numKeys; i++ {
-		tmpEntries[i] = bucket.getCell(i)
-	}
-	oldNKeys := int64(0)
-	newNKeys := int64(0)
-	for _, entry := range tmpEntries {
-		if Hasher(entry.GetKey(), bucket.depth) == newHash {
-			newBucket.modifyCell(newNKeys, entry)
-			newNKeys++
+	// Divide the entries between the buckets.
+	oldEntries := make([]HashEntry, 0, len(entries))
+	newEntries := make([]HashEntry, 0, len(entries))
+	for _, entry := range entries {
+		if table.hash(entry.GetKey(), bucket.depth) == newHash {
+			newEntries = append(newEntries, entry)
 		} else {
-			bucket.modifyCell(oldNKeys, entry)
-			oldNKeys++
+			oldEntries = append(oldEntries, entry)
 		}
 	}
-	// Initialize bucket attributes.
-	bucket.updateNumKeys(oldNKeys)
-	newBucket.updateNumKeys(newNKeys)
 	power := bucket.depth
 	// Point the rest of the buckets to the new page.
 	for i := newHash; i < powInt(2, table.depth); {
@@ -153,33 +499,65 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 		i += powInt(2, power)
 	}
 	// Check if recursive splitting is required
-	if oldNKeys >= BUCKETSIZE {
-		return table.Split(bucket, oldHash)
+	if int64(len(oldEntries)) >= table.bucketSize {
+		err = table.split(bucket, oldHash, oldEntries)
+	} else {
+		err = writeChain(table.pager, table.free, table.bucketSize, bucket, oldEntries)
 	}
-	if newNKeys >= BUCKETSIZE {
-		return table.Split(newBucket, newHash)
+	if err != nil {
+		return err
 	}
-	return nil
-	/* SOLUTION }}} */
+	if int64(len(newEntries)) >= table.bucketSize {
+		return table.split(newBucket, newHash, newEntries)
+	}
+	return writeChain(table.pager, table.free, table.bucketSize, newBucket, newEntries)
+}
+
+// separates returns true if the entries don't all hash to the same value at the given depth.
+func (table *HashTable) separates(entries []HashEntry, depth int64) bool {
+	for i := 1; i < len(entries); i++ {
+		if table.hash(entries[i].GetKey(), depth) != table.hash(entries[0].GetKey(), depth) {
+			return true
+		}
+	}
+	return false
 }
 
 // Inserts the given key-value pair, splits if necessary.
 func (table *HashTable) Insert(key int64, value int64) error {
 	/* SOLUTION {{{ */
+	if table.IsFrozen() {
+		return utils.ErrImmutable
+	}
 	// [CONCURRENCY] Lock the index
 	table.WLock()
 
-	hash := Hasher(key, table.depth)
-	bucket, err := table.GetBucket(hash, WRITE_LOCK)
+	bucket, hash, err := table.GetBucketResolved(key, WRITE_LOCK)
 	if err != nil {
 		// [CONCURRENCY] Unlock the index on the error path
 		table.WUnlock()
 		return err
 	}
-	defer bucket.WUnlock()
 	defer bucket.page.Put()
+	defer bucket.WUnlock()
+	// Chain instead of splitting if in overflow mode, or if a chain already exists.
+	if table.overflow || bucket.nextOverflowPN != NO_OVERFLOW_PN {
+		defer table.WUnlock()
+		split, err := insertIntoChain(table.pager, table.free, table.bucketSize, bucket, key, value)
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&table.count, 1)
+		table.addToFilter(key)
+		// A chain off a bucket that filled up splits like the bucket would have, in case
+		// its keys now separate; in overflow mode, chains only ever grow.
+		if !split || table.overflow {
+			return nil
+		}
+		return table.Split(bucket, hash)
+	}
 	// Release the lock on the index if it's not necessary
-	if bucket.numKeys < BUCKETSIZE-1 {
+	if bucket.numKeys < table.bucketSize-1 {
 		table.WUnlock()
 	} else {
 		defer table.WUnlock()
@@ -189,6 +567,8 @@ func (table *HashTable) Insert(key int64, value int64) error {
 	if err != nil {
 		return err
 	}
+	atomic.AddInt64(&table.count, 1)
+	table.addToFilter(key)
 	if !split {
 		return nil
 	}
@@ -199,65 +579,207 @@ func (table *HashTable) Insert(key int64, value int64) error {
 // Update the given key-value pair.
 func (table *HashTable) Update(key int64, value int64) error {
 	/* SOLUTION {{{ */
+	if table.IsFrozen() {
+		return utils.ErrImmutable
+	}
 	// [CONCURRENCY] Lock the index
 	table.RLock()
-	hash := Hasher(key, table.depth)
-
-	bucket, err := table.GetBucket(hash, WRITE_LOCK)
+	bucket, _, err := table.GetBucketResolved(key, WRITE_LOCK)
 	if err != nil {
 		// [CONCURRENCY] Unlock the index on the error path
 		table.RUnlock()
 		return err
 	}
-	defer bucket.WUnlock()
 	defer bucket.page.Put()
+	defer bucket.WUnlock()
 	table.RUnlock()
-	return bucket.Update(key, value)
+	// Update the first bucket in the chain that holds the key.
+	updated := false
+	err = table.walkChain(bucket, func(cur *HashBucket) (bool, error) {
+		if _, found, err := cur.FindEntry(key); err != nil || !found {
+			return err != nil, err
+		}
+		updated = true
+		return true, cur.Update(key, value)
+	})
+	if err == nil && !updated {
+		return errors.New("key not found, update aborted")
+	}
+	return err
 	/* SOLUTION }}} */
 }
 
 // Delete the given key-value pair, does not coalesce.
 func (table *HashTable) Delete(key int64) error {
 	/* SOLUTION {{{ */
+	if table.IsFrozen() {
+		return utils.ErrImmutable
+	}
 	// [CONCURRENCY] Lock the index
 	table.RLock()
-	hash := Hasher(key, table.depth)
-	bucket, err := table.GetBucket(hash, WRITE_LOCK)
+	bucket, _, err := table.GetBucketResolved(key, WRITE_LOCK)
 	if err != nil {
 		// [CONCURRENCY] Unlock the index on the error path
 		table.RUnlock()
 		return err
 	}
-	defer bucket.WUnlock()
 	defer bucket.page.Put()
+	defer bucket.WUnlock()
 	table.RUnlock()
-	return bucket.Delete(key)
+	// Delete from the first bucket in the chain that holds the key, freeing the
+	// overflow bucket that held it if that leaves it empty.
+	deleted, err := deleteFromChain(table.pager, table.free, table.bucketSize, bucket, key)
+	if err == nil && !deleted {
+		return errors.New("key not found, delete aborted")
+	}
+	if err == nil {
+		atomic.AddInt64(&table.count, -1)
+	}
+	return err
 	/* SOLUTION }}} */
 }
 
+// forEachChain calls f on each distinct bucket in the directory, in directory order, until
+// f returns true. Each bucket stays read locked until f returns, so that f can walk its
+// overflow chain, which writers change while holding only the first bucket's lock. If the
+// table is frozen, the buckets are pinned read-only instead, with no locks.
+// [CONCURRENCY] Note: the index should be locked before entry, unless the table is frozen
+func (table *HashTable) forEachChain(frozen bool, f func(*HashBucket) (bool, error)) error {
+	seen := make(map[int64]bool)
+	for _, pn := range table.buckets {
+		if seen[pn] {
+			continue
+		}
+		seen[pn] = true
+		var bucket *HashBucket
+		var err error
+		if frozen {
+			bucket, err = table.getBucketReadOnly(pn)
+		} else {
+			bucket, err = table.GetBucketByPN(pn, READ_LOCK)
+		}
+		if err != nil {
+			return err
+		}
+		done, err := f(bucket)
+		if !frozen {
+			bucket.RUnlock()
+		}
+		bucket.page.Put()
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// SelectBucket returns all entries in the given bucket and in its overflow chain.
+// [CONCURRENCY] Note: the bucket should be locked before entry, unless no writers are running
+func (table *HashTable) SelectBucket(bucket *HashBucket) ([]utils.Entry, error) {
+	entries, err := chainEntries(table.pager, table.bucketSize, bucket)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]utils.Entry, len(entries))
+	for i, entry := range entries {
+		ret[i] = entry
+	}
+	return ret, nil
+}
+
 // Select all entries in this table.
 func (table *HashTable) Select() ([]utils.Entry, error) {
+	return table.SelectCtx(context.Background())
+}
+
+// SelectCtx is like Select, but gives up with ctx.Err() once ctx is cancelled.
+// Cancellation is checked before each bucket is read.
+func (table *HashTable) SelectCtx(ctx context.Context) ([]utils.Entry, error) {
 	/* SOLUTION {{{ */
+	// [CONCURRENCY] Lock the index, unless it is frozen and so needs no locks
+	frozen := table.IsFrozen()
+	if !frozen {
+		table.RLock()
+		defer table.RUnlock()
+	}
+	// Go over all of the buckets in the directory, with their overflow chains.
+	ret := make([]utils.Entry, 0)
+	err := table.forEachChain(frozen, func(bucket *HashBucket) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		entries, err := table.SelectBucket(bucket)
+		ret = append(ret, entries...)
+		return false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+	/* SOLUTION }}} */
+}
+
+// SelectLimit returns up to limit entries of this table, stopping as soon as it has
+// them rather than reading every bucket. The entries are the first ones Select would
+// return, so which entries make up the sample depends on bucket order; it isn't uniform.
+func (table *HashTable) SelectLimit(limit int64) ([]utils.Entry, error) {
+	if limit < 0 {
+		return nil, errors.New("limit must not be negative")
+	}
 	// [CONCURRENCY] Lock the index
 	table.RLock()
 	defer table.RUnlock()
-	// Go over all of the pages.
 	ret := make([]utils.Entry, 0)
-	for i := int64(0); i < table.pager.GetNumPages(); i++ {
-		bucket, err := table.GetBucketByPN(i, READ_LOCK)
-		if err != nil {
-			return nil, err
-		}
-		entries, err := bucket.Select()
-		bucket.RUnlock()
-		bucket.GetPage().Put()
-		if err != nil {
-			return nil, err
-		}
+	if limit == 0 {
+		return ret, nil
+	}
+	err := table.forEachChain(false, func(bucket *HashBucket) (bool, error) {
+		entries, err := table.SelectBucket(bucket)
 		ret = append(ret, entries...)
+		return int64(len(ret)) >= limit, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(ret)) > limit {
+		ret = ret[:limit]
 	}
 	return ret, nil
-	/* SOLUTION }}} */
+}
+
+// SelectProject returns just the keys or just the values of all entries in this
+// table, in the same order as Select, without building an Entry for each.
+func (table *HashTable) SelectProject(fields utils.Projection) ([]int64, error) {
+	if !fields.Valid() {
+		return nil, errors.New("invalid projection")
+	}
+	// [CONCURRENCY] Lock the index
+	table.RLock()
+	defer table.RUnlock()
+	ret := make([]int64, 0, table.Count())
+	err := table.forEachChain(false, func(bucket *HashBucket) (bool, error) {
+		return false, table.walkChain(bucket, func(cur *HashBucket) (bool, error) {
+			var err error
+			ret, err = cur.selectProject(fields, ret)
+			return err != nil, err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// SelectSorted returns all entries in this table in key order, breaking ties by value,
+// which, unlike the order of Select, is stable across splits. It scans every bucket and
+// then sorts, so it costs O(n log n) time and O(n) memory on top of a Select.
+func (table *HashTable) SelectSorted() ([]utils.Entry, error) {
+	entries, err := table.Select()
+	if err != nil {
+		return nil, err
+	}
+	utils.SortEntries(entries)
+	return entries, nil
 }
 
 // Print out each bucket.
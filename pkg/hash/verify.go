@@ -1,27 +1,36 @@
 package hash
 
+// IsHash returns true if every entry in the table, including those in overflow
+// buckets, lives in the bucket that its key hashes to under the table's partition function.
+// Every page is pinned read-only, so the check cannot modify the table.
 func IsHash(index *HashIndex) (bool, error) {
 	table := index.GetTable()
 	buckets := table.GetBuckets()
 	for _, pn := range buckets {
 		// Get bucket
-		bucket, err := table.GetBucketByPN(pn, NO_LOCK)
-		d := bucket.GetDepth()
-		if err != nil {
-			return false, err
-		}
-		// Get all entries
-		entries, err := bucket.Select()
+		bucket, err := table.getBucketReadOnly(pn)
 		if err != nil {
 			return false, err
 		}
-		// Check that all entries should hash to this bucket.
-		for _, e := range entries {
-			key := e.GetKey()
-			hash := Hasher(key, d)
-			if pn != table.buckets[hash] {
-				return false, nil
+		d := bucket.GetDepth()
+		// Check that all entries in the chain should hash to this bucket.
+		isHash := true
+		err = table.walkChain(bucket, func(cur *HashBucket) (bool, error) {
+			entries, err := cur.Select()
+			if err != nil {
+				return true, err
+			}
+			for _, e := range entries {
+				if pn != table.buckets[table.hash(e.GetKey(), d)] {
+					isHash = false
+					return true, nil
+				}
 			}
+			return false, nil
+		})
+		bucket.GetPage().Put()
+		if err != nil || !isHash {
+			return false, err
 		}
 	}
 	return true, nil
@@ -13,6 +13,7 @@ import (
 type List struct {
 	head *Link
 	tail *Link
+	size int
 }
 
 // Create a new list.
@@ -36,6 +37,11 @@ func (list *List) PeekTail() *Link {
 	/* SOLUTION }}} */
 }
 
+// Get the number of links in the list.
+func (list *List) Len() int {
+	return list.size
+}
+
 // Add an element to the start of the list. Returns the added link.
 func (list *List) PushHead(value interface{}) *Link {
 	/* SOLUTION {{{ */
@@ -51,6 +57,7 @@ func (list *List) PushHead(value interface{}) *Link {
 		list.head.prev = newLink
 	}
 	list.head = newLink
+	list.size++
 	return newLink
 	/* SOLUTION }}} */
 }
@@ -70,35 +77,46 @@ func (list *List) PushTail(value interface{}) *Link {
 		list.tail.next = newLink
 	}
 	list.tail = newLink
+	list.size++
 	return newLink
 	/* SOLUTION }}} */
 }
 
 // Find an element in a list given a boolean function, f, that evaluates to true on the desired element.
+// f may pop the link it is passed, in which case the search carries on from the link that followed it.
 func (list *List) Find(f func(*Link) bool) *Link {
 	/* SOLUTION {{{ */
 	for link := list.head; link != nil; {
+		next := link.next
 		if f(link) {
 			return link
 		}
-		if link == list.tail { // Break on last entry
-			break
+		if !link.removed() {
+			if link == list.tail { // Break on last entry
+				break
+			}
+			next = link.next
 		}
-		link = link.next
+		link = next
 	}
 	return nil
 	/* SOLUTION }}} */
 }
 
 // Apply a function to every element in the list. f should alter Link in place.
+// f may pop the link it is passed, in which case the walk carries on from the link that followed it.
 func (list *List) Map(f func(*Link)) {
 	/* SOLUTION {{{ */
 	for link := list.head; link != nil; {
+		next := link.next
 		f(link)
-		if link == list.tail { // Break on last entry
-			break
+		if !link.removed() {
+			if link == list.tail { // Break on last entry
+				break
+			}
+			next = link.next
 		}
-		link = link.next
+		link = next
 	}
 	/* SOLUTION }}} */
 }
@@ -150,6 +168,10 @@ func (link *Link) GetNext() *Link {
 func (link *Link) PopSelf() {
 	/* SOLUTION {{{ */
 	list := link.list
+	// Links that have already been removed are left alone.
+	if link.removed() {
+		return
+	}
 	newPrev := link.prev
 	newNext := link.next
 	if newPrev != nil {
@@ -166,13 +188,68 @@ func (link *Link) PopSelf() {
 	if list.tail == link {
 		list.tail = newPrev
 	}
+	list.size--
 	/* SOLUTION }}} */
 }
 
+// removed checks if this link has been popped from its list.
+func (link *Link) removed() bool {
+	return link.prev == nil && link.next == nil && link.list.head != link
+}
+
+// Add an element directly after this link. Returns the added link, or nil if this
+// link has been popped from its list, since it has no place in the list to insert at.
+func (link *Link) InsertAfter(value interface{}) *Link {
+	if link.removed() {
+		return nil
+	}
+	list := link.list
+	newLink := &Link{
+		list:  list,
+		prev:  link,
+		next:  link.next,
+		value: value,
+	}
+	if link.next != nil {
+		link.next.prev = newLink
+	}
+	link.next = newLink
+	if list.tail == link {
+		list.tail = newLink
+	}
+	list.size++
+	return newLink
+}
+
+// Add an element directly before this link. Returns the added link, or nil if this
+// link has been popped from its list, since it has no place in the list to insert at.
+func (link *Link) InsertBefore(value interface{}) *Link {
+	if link.removed() {
+		return nil
+	}
+	list := link.list
+	newLink := &Link{
+		list:  list,
+		prev:  link.prev,
+		next:  link,
+		value: value,
+	}
+	if link.prev != nil {
+		link.prev.next = newLink
+	}
+	link.prev = newLink
+	if list.head == link {
+		list.head = newLink
+	}
+	list.size++
+	return newLink
+}
+
 // List REPL.
 func ListRepl(list *List) *repl.REPL {
 	/* SOLUTION {{{ */
 	r := repl.NewRepl()
+	r.SetName("list")
 	r.AddCommand("list_print", func(_ string, replConfig *repl.REPLConfig) error {
 		list.Map(func(l *Link) {
 			io.WriteString(replConfig.GetWriter(), fmt.Sprintf("%v, ", l.GetKey()))
@@ -225,6 +302,27 @@ func ListRepl(list *List) *repl.REPL {
 		}
 		return nil
 	}, "Checks if an element exists in the list. usage: list_contains <elt>")
+	r.AddCommand("list_find_prefix", func(payload string, replConfig *repl.REPLConfig) error {
+		fields := strings.Fields(payload)
+		numFields := len(fields)
+		if numFields != 2 {
+			return errors.New("usage: list_find_prefix <prefix>")
+		}
+		matches := make([]string, 0)
+		list.Map(func(l *Link) {
+			if value := fmt.Sprintf("%v", l.GetKey()); strings.HasPrefix(value, fields[1]) {
+				matches = append(matches, value)
+			}
+		})
+		if len(matches) == 0 {
+			io.WriteString(replConfig.GetWriter(), "not found\n")
+			return nil
+		}
+		for _, match := range matches {
+			io.WriteString(replConfig.GetWriter(), match+"\n")
+		}
+		return nil
+	}, "Prints each element that starts with the given prefix, one per line. usage: list_find_prefix <prefix>")
 	return r
 	/* SOLUTION }}} */
 }
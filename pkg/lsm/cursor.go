@@ -0,0 +1,45 @@
+package lsm
+
+import (
+	"errors"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// LSMCursor points to a spot in a snapshot of the index taken when the cursor was created.
+// Since the memtable and runs may change underneath it, the cursor does not see later writes.
+type LSMCursor struct {
+	entries []utils.Entry
+	pos     int
+}
+
+// TableStart returns a cursor to the first entry in the index.
+func (index *LSMIndex) TableStart() (utils.Cursor, error) {
+	entries, err := index.Select()
+	if err != nil {
+		return nil, err
+	}
+	return &LSMCursor{entries: entries}, nil
+}
+
+// StepForward moves the cursor ahead by one entry.
+func (cursor *LSMCursor) StepForward() error {
+	if cursor.IsEnd() {
+		return errors.New("cannot advance the cursor further")
+	}
+	cursor.pos++
+	return nil
+}
+
+// IsEnd returns true if at end.
+func (cursor *LSMCursor) IsEnd() bool {
+	return cursor.pos >= len(cursor.entries)
+}
+
+// GetEntry returns the entry currently pointed to by the cursor.
+func (cursor *LSMCursor) GetEntry() (utils.Entry, error) {
+	if cursor.IsEnd() {
+		return nil, errors.New("getEntry: entry is non-existent")
+	}
+	return cursor.entries[cursor.pos], nil
+}
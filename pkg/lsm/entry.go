@@ -0,0 +1,80 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Entry layout constants.
+var ENTRY_KEY_OFFSET int64 = 0
+var ENTRY_KEY_SIZE int64 = binary.MaxVarintLen64
+var ENTRY_VALUE_OFFSET int64 = ENTRY_KEY_OFFSET + ENTRY_KEY_SIZE
+var ENTRY_VALUE_SIZE int64 = binary.MaxVarintLen64
+var ENTRY_FLAGS_OFFSET int64 = ENTRY_VALUE_OFFSET + ENTRY_VALUE_SIZE
+var ENTRY_FLAGS_SIZE int64 = 1
+
+// Global size for Entries.
+var ENTRYSIZE int64 = ENTRY_KEY_SIZE + ENTRY_VALUE_SIZE + ENTRY_FLAGS_SIZE
+
+// Entry flag bits.
+const (
+	TOMBSTONE_FLAG byte = 1 << 0 // The entry shadows older versions of its key as deleted.
+	NULL_FLAG      byte = 1 << 1 // The entry's value is null; its value field holds 0.
+)
+
+// LSMEntry is a single key-value pair, or a deletion marker, in an LSM index.
+type LSMEntry struct {
+	key   int64
+	value int64
+	flags byte
+}
+
+// Get key.
+func (entry LSMEntry) GetKey() int64 {
+	return entry.key
+}
+
+// Get value.
+func (entry LSMEntry) GetValue() int64 {
+	return entry.value
+}
+
+// IsNull returns true if the entry's value is null.
+func (entry LSMEntry) IsNull() bool {
+	return entry.flags&NULL_FLAG != 0
+}
+
+// isTombstone returns true if the entry marks its key as deleted.
+func (entry LSMEntry) isTombstone() bool {
+	return entry.flags&TOMBSTONE_FLAG != 0
+}
+
+// Marshal serializes a given entry into a byte array.
+func (entry LSMEntry) Marshal() []byte {
+	data := make([]byte, ENTRYSIZE)
+	binary.PutVarint(data[ENTRY_KEY_OFFSET:ENTRY_KEY_OFFSET+ENTRY_KEY_SIZE], entry.key)
+	binary.PutVarint(data[ENTRY_VALUE_OFFSET:ENTRY_VALUE_OFFSET+ENTRY_VALUE_SIZE], entry.value)
+	data[ENTRY_FLAGS_OFFSET] = entry.flags
+	return data
+}
+
+// unmarshalEntry deserializes a byte array into an entry.
+func unmarshalEntry(data []byte) LSMEntry {
+	key, _ := binary.Varint(data[ENTRY_KEY_OFFSET : ENTRY_KEY_OFFSET+ENTRY_KEY_SIZE])
+	value, _ := binary.Varint(data[ENTRY_VALUE_OFFSET : ENTRY_VALUE_OFFSET+ENTRY_VALUE_SIZE])
+	return LSMEntry{key: key, value: value, flags: data[ENTRY_FLAGS_OFFSET]}
+}
+
+// Print this entry.
+func (entry LSMEntry) Print(w io.Writer) {
+	if entry.isTombstone() {
+		io.WriteString(w, fmt.Sprintf("(%d, deleted), ", entry.key))
+		return
+	}
+	if entry.IsNull() {
+		io.WriteString(w, fmt.Sprintf("(%d, null), ", entry.key))
+		return
+	}
+	io.WriteString(w, fmt.Sprintf("(%d, %d), ", entry.key, entry.value))
+}
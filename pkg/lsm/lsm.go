@@ -0,0 +1,442 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Number of entries the memtable buffers before being flushed to a run.
+var DEFAULT_MEMTABLE_SIZE int64 = 1024
+
+// Number of runs at which a background merge is started.
+var MERGE_THRESHOLD int = 4
+
+// Manifest page layout: the number of runs, the next run number, then each run's number, oldest first.
+var MANIFEST_PN int64 = 0
+var MANIFEST_NUM_RUNS_OFFSET int64 = 0
+var MANIFEST_NUM_RUNS_SIZE int64 = binary.MaxVarintLen64
+var MANIFEST_NEXT_RUN_ID_OFFSET int64 = MANIFEST_NUM_RUNS_OFFSET + MANIFEST_NUM_RUNS_SIZE
+var MANIFEST_NEXT_RUN_ID_SIZE int64 = binary.MaxVarintLen64
+var MANIFEST_HEADER_SIZE int64 = MANIFEST_NUM_RUNS_SIZE + MANIFEST_NEXT_RUN_ID_SIZE
+var MANIFEST_RUN_ID_SIZE int64 = binary.MaxVarintLen64
+var MANIFEST_MAX_RUNS int64 = (PAGESIZE - MANIFEST_HEADER_SIZE) / MANIFEST_RUN_ID_SIZE
+
+// LSMIndex is a log-structured merge index. Implements db.Index.
+// Writes are buffered in an in-memory memtable, which is flushed to an immutable
+// sorted run once full; runs are merged together in the background. Reads check
+// the memtable, then each run from newest to oldest.
+type LSMIndex struct {
+	filename     string             // The path of the manifest; runs are stored alongside it.
+	pager        *pager.Pager       // The pager for the manifest.
+	memtable     map[int64]LSMEntry // Buffered writes, including tombstones for deletes.
+	memtableSize int64              // The number of entries at which the memtable is flushed.
+	runs         []*run             // On-disk runs, oldest first.
+	nextRunID    int64              // The number of the next run to be written.
+	merging      bool               // Whether a background merge is running.
+	mergeErr     error              // The error from the last failed background merge, if any.
+	rwlock       sync.RWMutex       // Lock on the memtable and the run list.
+	mergeMtx     sync.Mutex         // Serializes merges.
+	mergeWg      sync.WaitGroup     // Tracks the background merge.
+}
+
+// OpenTable returns an LSM index associated with the given filename.
+func OpenTable(filename string) (*LSMIndex, error) {
+	return OpenTableWithMemtableSize(filename, DEFAULT_MEMTABLE_SIZE)
+}
+
+// OpenTableWithMemtableSize returns an LSM index associated with the given filename
+// whose memtable is flushed to a run once it holds memtableSize entries.
+func OpenTableWithMemtableSize(filename string, memtableSize int64) (*LSMIndex, error) {
+	if memtableSize < 1 {
+		return nil, errors.New("memtable size must be positive")
+	}
+	// Create a pager for the manifest.
+	pager := pager.NewPager()
+	err := pager.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	index := &LSMIndex{
+		filename:     filename,
+		pager:        pager,
+		memtable:     make(map[int64]LSMEntry),
+		memtableSize: memtableSize,
+		runs:         make([]*run, 0),
+	}
+	// Initialize the manifest if it's new.
+	if pager.GetNumPages() == 0 {
+		page, err := pager.AllocatePage()
+		if err != nil {
+			return nil, err
+		}
+		page.Put()
+		if err = index.writeManifest(); err != nil {
+			return nil, err
+		}
+		return index, nil
+	}
+	// Else, read the manifest back in and open each run.
+	page, err := pager.GetPage(MANIFEST_PN)
+	if err != nil {
+		return nil, err
+	}
+	defer page.Put()
+	numRuns := readManifestField(page, MANIFEST_NUM_RUNS_OFFSET, MANIFEST_NUM_RUNS_SIZE)
+	if numRuns < 0 || numRuns > MANIFEST_MAX_RUNS {
+		return nil, fmt.Errorf("manifest is corrupted: invalid run count %d", numRuns)
+	}
+	index.nextRunID = readManifestField(page, MANIFEST_NEXT_RUN_ID_OFFSET, MANIFEST_NEXT_RUN_ID_SIZE)
+	for i := int64(0); i < numRuns; i++ {
+		id := readManifestField(page, MANIFEST_HEADER_SIZE+i*MANIFEST_RUN_ID_SIZE, MANIFEST_RUN_ID_SIZE)
+		r, err := openRun(filename, id)
+		if err != nil {
+			return nil, err
+		}
+		index.runs = append(index.runs, r)
+	}
+	return index, nil
+}
+
+// readManifestField reads a varint from the given position of the manifest page.
+func readManifestField(page *pager.Page, offset int64, size int64) int64 {
+	value, _ := binary.Varint((*page.GetData())[offset : offset+size])
+	return value
+}
+
+// writeManifest records the current list of runs and forces it to disk, so that
+// the manifest never refers to a run that has been merged away.
+// [CONCURRENCY] Note: the index should be write locked before entry
+func (index *LSMIndex) writeManifest() error {
+	if int64(len(index.runs)) > MANIFEST_MAX_RUNS {
+		return fmt.Errorf("too many runs: manifest holds at most %d", MANIFEST_MAX_RUNS)
+	}
+	page, err := index.pager.GetPage(MANIFEST_PN)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, MANIFEST_RUN_ID_SIZE)
+	binary.PutVarint(data, int64(len(index.runs)))
+	page.Update(data, MANIFEST_NUM_RUNS_OFFSET, MANIFEST_NUM_RUNS_SIZE)
+	binary.PutVarint(data, index.nextRunID)
+	page.Update(data, MANIFEST_NEXT_RUN_ID_OFFSET, MANIFEST_NEXT_RUN_ID_SIZE)
+	for i, r := range index.runs {
+		binary.PutVarint(data, r.id)
+		page.Update(data, MANIFEST_HEADER_SIZE+int64(i)*MANIFEST_RUN_ID_SIZE, MANIFEST_RUN_ID_SIZE)
+	}
+	page.Put()
+	return index.pager.Sync()
+}
+
+// Get name.
+func (index *LSMIndex) GetName() string {
+	return index.pager.GetFileName()
+}
+
+// Get pager.
+func (index *LSMIndex) GetPager() *pager.Pager {
+	return index.pager
+}
+
+// Get the number of on-disk runs.
+func (index *LSMIndex) GetNumRuns() int {
+	index.rwlock.RLock()
+	defer index.rwlock.RUnlock()
+	return len(index.runs)
+}
+
+// Closes the index, flushing the memtable and waiting for any background merge.
+func (index *LSMIndex) Close() (err error) {
+	index.rwlock.Lock()
+	err = index.flush()
+	index.rwlock.Unlock()
+	index.mergeWg.Wait()
+	if err == nil {
+		err = index.mergeErr
+	}
+	for _, r := range index.runs {
+		if curErr := r.pager.Close(); err == nil {
+			err = curErr
+		}
+	}
+	if curErr := index.pager.Close(); err == nil {
+		err = curErr
+	}
+	return err
+}
+
+// get returns the newest entry for the given key, which may be a tombstone.
+// [CONCURRENCY] Note: the index should be locked before entry
+func (index *LSMIndex) get(key int64) (LSMEntry, bool, error) {
+	if entry, ok := index.memtable[key]; ok {
+		return entry, true, nil
+	}
+	for i := len(index.runs) - 1; i >= 0; i-- {
+		entry, found, err := index.runs[i].find(key)
+		if err != nil || found {
+			return entry, found, err
+		}
+	}
+	return LSMEntry{}, false, nil
+}
+
+// Find element by key.
+func (index *LSMIndex) Find(key int64) (utils.Entry, error) {
+	index.rwlock.RLock()
+	defer index.rwlock.RUnlock()
+	entry, found, err := index.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found || entry.isTombstone() {
+		return nil, utils.ErrNotFound
+	}
+	return entry, nil
+}
+
+// put buffers the given entry in the memtable, flushing it if full.
+// [CONCURRENCY] Note: the index should be write locked before entry
+func (index *LSMIndex) put(entry LSMEntry) error {
+	index.memtable[entry.key] = entry
+	if int64(len(index.memtable)) >= index.memtableSize {
+		return index.flush()
+	}
+	return nil
+}
+
+// Insert given element.
+func (index *LSMIndex) Insert(key int64, value int64) error {
+	index.rwlock.Lock()
+	defer index.rwlock.Unlock()
+	entry, found, err := index.get(key)
+	if err != nil {
+		return err
+	}
+	if found && !entry.isTombstone() {
+		return errors.New("cannot insert duplicate key")
+	}
+	return index.put(LSMEntry{key: key, value: value})
+}
+
+// Update given element.
+func (index *LSMIndex) Update(key int64, value int64) error {
+	index.rwlock.Lock()
+	defer index.rwlock.Unlock()
+	entry, found, err := index.get(key)
+	if err != nil {
+		return err
+	}
+	if !found || entry.isTombstone() {
+		return errors.New("cannot update non-existent entry")
+	}
+	return index.put(LSMEntry{key: key, value: value})
+}
+
+// Delete given element.
+func (index *LSMIndex) Delete(key int64) error {
+	index.rwlock.Lock()
+	defer index.rwlock.Unlock()
+	entry, found, err := index.get(key)
+	if err != nil {
+		return err
+	}
+	if !found || entry.isTombstone() {
+		return errors.New("cannot delete non-existent entry")
+	}
+	return index.put(LSMEntry{key: key, flags: TOMBSTONE_FLAG})
+}
+
+// Flush writes the memtable out to a new run.
+func (index *LSMIndex) Flush() error {
+	index.rwlock.Lock()
+	defer index.rwlock.Unlock()
+	return index.flush()
+}
+
+// flush writes the memtable out to a new run, starting a background merge if
+// there are enough runs.
+// [CONCURRENCY] Note: the index should be write locked before entry
+func (index *LSMIndex) flush() error {
+	if len(index.memtable) == 0 {
+		return nil
+	}
+	w, err := newRunWriter(index.filename, index.nextRunID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range index.sortedMemtable() {
+		if err = w.add(entry); err != nil {
+			w.abort(index.filename)
+			return err
+		}
+	}
+	r, err := w.finish()
+	if err != nil {
+		w.abort(index.filename)
+		return err
+	}
+	index.nextRunID++
+	index.runs = append(index.runs, r)
+	index.memtable = make(map[int64]LSMEntry)
+	if err = index.writeManifest(); err != nil {
+		return err
+	}
+	if len(index.runs) >= MERGE_THRESHOLD && !index.merging {
+		index.merging = true
+		index.mergeWg.Add(1)
+		go index.mergeInBackground()
+	}
+	return nil
+}
+
+// sortedMemtable returns the entries in the memtable in key order.
+// [CONCURRENCY] Note: the index should be locked before entry
+func (index *LSMIndex) sortedMemtable() []LSMEntry {
+	entries := make([]LSMEntry, 0, len(index.memtable))
+	for _, entry := range index.memtable {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries
+}
+
+// Merge merges all of the on-disk runs into one.
+func (index *LSMIndex) Merge() error {
+	index.mergeMtx.Lock()
+	defer index.mergeMtx.Unlock()
+	return index.merge()
+}
+
+// mergeInBackground merges runs until there are fewer than MERGE_THRESHOLD of them.
+func (index *LSMIndex) mergeInBackground() {
+	defer index.mergeWg.Done()
+	index.mergeMtx.Lock()
+	defer index.mergeMtx.Unlock()
+	for {
+		index.rwlock.Lock()
+		if len(index.runs) < MERGE_THRESHOLD {
+			index.merging = false
+			index.rwlock.Unlock()
+			return
+		}
+		index.rwlock.Unlock()
+		if err := index.merge(); err != nil {
+			index.rwlock.Lock()
+			index.merging = false
+			index.mergeErr = err
+			index.rwlock.Unlock()
+			return
+		}
+	}
+}
+
+// merge replaces the current runs with a single merged run. Since runs are
+// immutable, the merge itself runs without holding the index lock; runs flushed
+// in the meantime are kept after the merged run.
+// [CONCURRENCY] Note: mergeMtx should be held before entry
+func (index *LSMIndex) merge() error {
+	index.rwlock.Lock()
+	if len(index.runs) < 2 {
+		index.rwlock.Unlock()
+		return nil
+	}
+	runs := append([]*run{}, index.runs...)
+	id := index.nextRunID
+	index.nextRunID++
+	index.rwlock.Unlock()
+	merged, err := mergeRuns(index.filename, id, runs)
+	if err != nil {
+		return err
+	}
+	// Swap in the merged run.
+	index.rwlock.Lock()
+	index.runs = append([]*run{merged}, index.runs[len(runs):]...)
+	err = index.writeManifest()
+	index.rwlock.Unlock()
+	if err != nil {
+		return err
+	}
+	// No reader can still be using the old runs, since reads hold the index lock.
+	for _, r := range runs {
+		if err = r.destroy(index.filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Select all elements.
+func (index *LSMIndex) Select() ([]utils.Entry, error) {
+	index.rwlock.RLock()
+	defer index.rwlock.RUnlock()
+	iters := make([]iterator, 0, len(index.runs)+1)
+	for _, r := range index.runs {
+		it, err := newRunIterator(r)
+		if err != nil {
+			return nil, err
+		}
+		iters = append(iters, it)
+	}
+	iters = append(iters, &sliceIterator{entries: index.sortedMemtable()})
+	ret := make([]utils.Entry, 0)
+	err := mergeIterators(iters, func(entry LSMEntry) error {
+		if !entry.isTombstone() {
+			ret = append(ret, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Print all elements.
+func (index *LSMIndex) Print(w io.Writer) {
+	index.rwlock.RLock()
+	defer index.rwlock.RUnlock()
+	io.WriteString(w, "====\nmemtable\nentries:")
+	for _, entry := range index.sortedMemtable() {
+		entry.Print(w)
+	}
+	io.WriteString(w, "\n")
+	for i := range index.runs {
+		index.printRun(i, w)
+	}
+	io.WriteString(w, "====\n")
+}
+
+// Print the run at the given position, oldest first.
+func (index *LSMIndex) PrintPN(pn int, w io.Writer) {
+	index.rwlock.RLock()
+	defer index.rwlock.RUnlock()
+	if pn < 0 || pn >= len(index.runs) {
+		fmt.Println("out of bounds")
+		return
+	}
+	index.printRun(pn, w)
+}
+
+// printRun prints the entries of the run at the given position.
+// [CONCURRENCY] Note: the index should be locked before entry
+func (index *LSMIndex) printRun(i int, w io.Writer) {
+	r := index.runs[i]
+	io.WriteString(w, fmt.Sprintf("====\nrun %d (file %d)\nentries:", i, r.id))
+	for pn := int64(0); pn < r.pager.GetNumPages(); pn++ {
+		entries, err := r.readRunPage(pn)
+		if err != nil {
+			io.WriteString(w, fmt.Sprintf(" <%v>", err))
+			break
+		}
+		for _, entry := range entries {
+			entry.Print(w)
+		}
+	}
+	io.WriteString(w, "\n")
+}
@@ -0,0 +1,139 @@
+package lsm
+
+// An iterator walks over a sorted sequence of entries.
+type iterator interface {
+	isEnd() bool
+	entry() LSMEntry
+	next() error
+}
+
+// sliceIterator walks over an in-memory slice of entries.
+type sliceIterator struct {
+	entries []LSMEntry
+	pos     int
+}
+
+func (it *sliceIterator) isEnd() bool {
+	return it.pos >= len(it.entries)
+}
+
+func (it *sliceIterator) entry() LSMEntry {
+	return it.entries[it.pos]
+}
+
+func (it *sliceIterator) next() error {
+	it.pos++
+	return nil
+}
+
+// runIterator walks over a run one page at a time.
+type runIterator struct {
+	run     *run
+	pn      int64
+	entries []LSMEntry // The entries on the current page.
+	pos     int
+}
+
+// newRunIterator returns an iterator positioned at the first entry of the run.
+func newRunIterator(r *run) (*runIterator, error) {
+	it := &runIterator{run: r, pn: -1}
+	if err := it.nextPage(); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// nextPage loads the next non-empty page of the run, if any.
+func (it *runIterator) nextPage() error {
+	it.entries, it.pos = nil, 0
+	for len(it.entries) == 0 && it.pn+1 < it.run.pager.GetNumPages() {
+		it.pn++
+		entries, err := it.run.readRunPage(it.pn)
+		if err != nil {
+			return err
+		}
+		it.entries = entries
+	}
+	return nil
+}
+
+func (it *runIterator) isEnd() bool {
+	return it.pos >= len(it.entries)
+}
+
+func (it *runIterator) entry() LSMEntry {
+	return it.entries[it.pos]
+}
+
+func (it *runIterator) next() error {
+	it.pos++
+	if it.pos >= len(it.entries) {
+		return it.nextPage()
+	}
+	return nil
+}
+
+// mergeIterators calls emit on each distinct key across the given iterators in key order.
+// Iterators are ordered oldest to newest; when several hold the same key, the newest wins.
+func mergeIterators(iters []iterator, emit func(LSMEntry) error) error {
+	for {
+		// Find the smallest key, preferring the newest iterator on ties.
+		winner := -1
+		for i, it := range iters {
+			if it.isEnd() {
+				continue
+			}
+			if winner == -1 || it.entry().key <= iters[winner].entry().key {
+				winner = i
+			}
+		}
+		if winner == -1 {
+			return nil
+		}
+		entry := iters[winner].entry()
+		if err := emit(entry); err != nil {
+			return err
+		}
+		// Skip over the older versions of this key.
+		for _, it := range iters {
+			if !it.isEnd() && it.entry().key == entry.key {
+				if err := it.next(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// mergeRuns merges the given runs, oldest first, into a single new run.
+// Since the runs include the oldest data in the index, tombstones are dropped.
+func mergeRuns(filename string, id int64, runs []*run) (*run, error) {
+	iters := make([]iterator, len(runs))
+	for i, r := range runs {
+		it, err := newRunIterator(r)
+		if err != nil {
+			return nil, err
+		}
+		iters[i] = it
+	}
+	w, err := newRunWriter(filename, id)
+	if err != nil {
+		return nil, err
+	}
+	err = mergeIterators(iters, func(entry LSMEntry) error {
+		if entry.isTombstone() {
+			return nil
+		}
+		return w.add(entry)
+	})
+	if err != nil {
+		w.abort(filename)
+		return nil, err
+	}
+	merged, err := w.finish()
+	if err != nil {
+		w.abort(filename)
+		return nil, err
+	}
+	return merged, nil
+}
@@ -0,0 +1,176 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+)
+
+// Run page layout: the number of entries on the page, followed by the entries in key order.
+var PAGESIZE int64 = pager.PAGESIZE
+var RUN_NUM_ENTRIES_OFFSET int64 = 0
+var RUN_NUM_ENTRIES_SIZE int64 = binary.MaxVarintLen64
+var RUN_HEADER_SIZE int64 = RUN_NUM_ENTRIES_SIZE
+var ENTRIES_PER_RUN_PAGE int64 = (PAGESIZE - RUN_HEADER_SIZE) / ENTRYSIZE
+
+// A run is an immutable, sorted file of entries. Runs are never modified once
+// written, so they can be read without locks; they are only replaced by merging.
+type run struct {
+	id     int64        // The run's number, which determines its file name.
+	pager  *pager.Pager // The pager for the run's file.
+	fences []int64      // The first key on each page.
+}
+
+// runFileName returns the name of the file holding the given run of the given index.
+func runFileName(filename string, id int64) string {
+	return fmt.Sprintf("%s.run%d", filename, id)
+}
+
+// openRun opens an existing run, reading in the first key of each page.
+func openRun(filename string, id int64) (*run, error) {
+	p := pager.NewPager()
+	if err := p.Open(runFileName(filename, id)); err != nil {
+		return nil, err
+	}
+	r := &run{id: id, pager: p, fences: make([]int64, 0, p.GetNumPages())}
+	for pn := int64(0); pn < p.GetNumPages(); pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		r.fences = append(r.fences, getRunCell(page, 0).key)
+		page.Put()
+	}
+	return r, nil
+}
+
+// getRunCount returns the number of entries on the given run page.
+func getRunCount(page *pager.Page) int64 {
+	count, _ := binary.Varint(
+		(*page.GetData())[RUN_NUM_ENTRIES_OFFSET : RUN_NUM_ENTRIES_OFFSET+RUN_NUM_ENTRIES_SIZE],
+	)
+	return count
+}
+
+// getRunCell returns the entry at the given index of the given run page.
+func getRunCell(page *pager.Page, index int64) LSMEntry {
+	startPos := RUN_HEADER_SIZE + index*ENTRYSIZE
+	return unmarshalEntry((*page.GetData())[startPos : startPos+ENTRYSIZE])
+}
+
+// readRunPage returns all of the entries on the given page of the run.
+func (r *run) readRunPage(pn int64) ([]LSMEntry, error) {
+	page, err := r.pager.GetPage(pn)
+	if err != nil {
+		return nil, err
+	}
+	defer page.Put()
+	count := getRunCount(page)
+	if count < 0 || count > ENTRIES_PER_RUN_PAGE {
+		return nil, fmt.Errorf("run %d is corrupted: invalid entry count %d on page %d", r.id, count, pn)
+	}
+	entries := make([]LSMEntry, count)
+	for i := int64(0); i < count; i++ {
+		entries[i] = getRunCell(page, i)
+	}
+	return entries, nil
+}
+
+// find returns the run's entry for the given key, which may be a tombstone.
+func (r *run) find(key int64) (LSMEntry, bool, error) {
+	// Find the last page whose first key is at most the given key.
+	pn := int64(sort.Search(len(r.fences), func(i int) bool { return r.fences[i] > key })) - 1
+	if pn < 0 {
+		return LSMEntry{}, false, nil
+	}
+	page, err := r.pager.GetPage(pn)
+	if err != nil {
+		return LSMEntry{}, false, err
+	}
+	defer page.Put()
+	count := getRunCount(page)
+	index := int64(sort.Search(int(count), func(i int) bool {
+		return getRunCell(page, int64(i)).key >= key
+	}))
+	if index < count {
+		if entry := getRunCell(page, index); entry.key == key {
+			return entry, true, nil
+		}
+	}
+	return LSMEntry{}, false, nil
+}
+
+// destroy closes the run and removes its file.
+func (r *run) destroy(filename string) error {
+	if err := r.pager.Close(); err != nil {
+		return err
+	}
+	return os.Remove(runFileName(filename, r.id))
+}
+
+// runWriter writes entries, which must arrive in key order, to a new run.
+type runWriter struct {
+	run *run
+	buf []LSMEntry // Entries waiting to be written to the next page.
+}
+
+// newRunWriter creates the file for a new run.
+func newRunWriter(filename string, id int64) (*runWriter, error) {
+	p := pager.NewPager()
+	if err := p.Open(runFileName(filename, id)); err != nil {
+		return nil, err
+	}
+	return &runWriter{
+		run: &run{id: id, pager: p, fences: make([]int64, 0)},
+		buf: make([]LSMEntry, 0, ENTRIES_PER_RUN_PAGE),
+	}, nil
+}
+
+// add appends an entry to the run.
+func (w *runWriter) add(entry LSMEntry) error {
+	w.buf = append(w.buf, entry)
+	if int64(len(w.buf)) == ENTRIES_PER_RUN_PAGE {
+		return w.writePage()
+	}
+	return nil
+}
+
+// writePage writes the buffered entries out to the next page of the run.
+func (w *runWriter) writePage() error {
+	page, err := w.run.pager.AllocatePage()
+	if err != nil {
+		return err
+	}
+	defer page.Put()
+	countData := make([]byte, RUN_NUM_ENTRIES_SIZE)
+	binary.PutVarint(countData, int64(len(w.buf)))
+	page.Update(countData, RUN_NUM_ENTRIES_OFFSET, RUN_NUM_ENTRIES_SIZE)
+	for i, entry := range w.buf {
+		page.Update(entry.Marshal(), RUN_HEADER_SIZE+int64(i)*ENTRYSIZE, ENTRYSIZE)
+	}
+	w.run.fences = append(w.run.fences, w.buf[0].key)
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// finish writes out any remaining entries and forces the run to disk.
+func (w *runWriter) finish() (*run, error) {
+	if len(w.buf) > 0 {
+		if err := w.writePage(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.run.pager.Sync(); err != nil {
+		return nil, err
+	}
+	return w.run, nil
+}
+
+// abort discards a partially written run.
+func (w *runWriter) abort(filename string) {
+	w.run.destroy(filename)
+}
@@ -0,0 +1,132 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// An AccessLog counts how often a pager handed out each page. Saved when a database
+// shuts down, it lets the pager that next opens the file warm its buffer pool with the
+// pages that were hot, rather than paying a miss on each of them in the first queries.
+type AccessLog struct {
+	mtx    sync.Mutex
+	counts map[int64]int64 // Number of times each page was gotten.
+}
+
+// Construct a new, empty AccessLog.
+func NewAccessLog() *AccessLog {
+	return &AccessLog{counts: make(map[int64]int64)}
+}
+
+// record counts an access to the given page.
+func (log *AccessLog) record(pagenum int64) {
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+	log.counts[pagenum]++
+}
+
+// GetCount returns the number of recorded accesses to the given page.
+func (log *AccessLog) GetCount(pagenum int64) int64 {
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+	return log.counts[pagenum]
+}
+
+// GetHotPages returns the numbers of the recorded pages, most accessed first.
+// Pages accessed equally often are ordered by page number.
+func (log *AccessLog) GetHotPages() []int64 {
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+	pagenums := make([]int64, 0, len(log.counts))
+	for pagenum := range log.counts {
+		pagenums = append(pagenums, pagenum)
+	}
+	sort.Slice(pagenums, func(i, j int) bool {
+		ci, cj := log.counts[pagenums[i]], log.counts[pagenums[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		return pagenums[i] < pagenums[j]
+	})
+	return pagenums
+}
+
+// Save writes the log to the given file, as a varint page number and count per page.
+func (log *AccessLog) Save(filename string) error {
+	pagenums := log.GetHotPages()
+	log.mtx.Lock()
+	defer log.mtx.Unlock()
+	buf := make([]byte, 0, len(pagenums)*2*binary.MaxVarintLen64)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	for _, pagenum := range pagenums {
+		n := binary.PutVarint(scratch, pagenum)
+		buf = append(buf, scratch[:n]...)
+		n = binary.PutVarint(scratch, log.counts[pagenum])
+		buf = append(buf, scratch[:n]...)
+	}
+	return ioutil.WriteFile(filename, buf, 0666)
+}
+
+// LoadAccessLog reads a log written by Save.
+func LoadAccessLog(filename string) (*AccessLog, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	log := NewAccessLog()
+	for len(buf) > 0 {
+		pagenum, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, errors.New("access log is corrupted")
+		}
+		count, m := binary.Varint(buf[n:])
+		if m <= 0 || pagenum < 0 {
+			return nil, errors.New("access log is corrupted")
+		}
+		log.counts[pagenum] += count
+		buf = buf[n+m:]
+	}
+	return log, nil
+}
+
+// SetAccessLog starts recording every page gotten with GetPage in the given log.
+// Passing nil stops recording, which is the default.
+func (pager *Pager) SetAccessLog(log *AccessLog) {
+	pager.accessLog.Store(log)
+}
+
+// getAccessLog returns the log that accesses are being recorded in, if any. It is called
+// on every GetPage, so it loads the log atomically rather than taking a lock.
+func (pager *Pager) getAccessLog() *AccessLog {
+	log, _ := pager.accessLog.Load().(*AccessLog)
+	return log
+}
+
+// WarmCache reads the hottest pages of the given log into the buffer pool, and returns
+// how many it read. Like a prefetcher, it only fills free frames and never evicts, so it
+// stops once the buffer pool is full. Pages the file doesn't have are skipped, and
+// pages read this way are not recorded or counted as misses.
+func (pager *Pager) WarmCache(log *AccessLog) (int, error) {
+	loaded := 0
+	for _, pagenum := range log.GetHotPages() {
+		if pagenum >= pager.GetNumPages() {
+			continue
+		}
+		if _, ok := pager.lookup(pagenum); ok {
+			continue
+		}
+		page, ok, err := pager.TryGetPage(pagenum)
+		if err != nil {
+			return loaded, err
+		}
+		if !ok {
+			break
+		}
+		page.Put()
+		loaded++
+	}
+	return loaded, nil
+}
@@ -0,0 +1,229 @@
+package pager
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// Magic bytes at the start of the files of compressed pagers.
+const COMPRESSED_MAGIC = "DBPAGEZ\x00"
+
+// Version of the compressed file layout; files written in other versions can't be opened.
+var COMPRESSED_FORMAT_VERSION byte = 1
+
+// How hard pages are compressed; speed matters more than size, since it is paid on every miss.
+var COMPRESSION_LEVEL = flate.BestSpeed
+
+// Layout of the header at the start of the files of compressed pagers. Pages and the offset
+// map are stored after it, wherever there was room for them when they were written.
+const (
+	CHEADER_INT_SIZE       = 8
+	CHEADER_MAGIC_OFFSET   = 0
+	CHEADER_MAGIC_SIZE     = int64(len(COMPRESSED_MAGIC))
+	CHEADER_VERSION_OFFSET = CHEADER_MAGIC_OFFSET + CHEADER_MAGIC_SIZE
+	CHEADER_NPAGES_OFFSET  = CHEADER_VERSION_OFFSET + CHEADER_INT_SIZE
+	CHEADER_MAP_OFFSET     = CHEADER_NPAGES_OFFSET + CHEADER_INT_SIZE // Where the offset map starts.
+	CHEADER_MAP_LENGTH     = CHEADER_MAP_OFFSET + CHEADER_INT_SIZE    // How long the offset map is.
+	CHEADER_MAP_CAPACITY   = CHEADER_MAP_LENGTH + CHEADER_INT_SIZE    // How long the offset map may grow in place.
+	COMPRESSED_HEADER_SIZE = CHEADER_MAP_CAPACITY + CHEADER_INT_SIZE
+)
+
+// A diskSlot is where a compressed page, or the offset map, is stored in the file.
+// A page rewritten with a longer compressed length than its slot's capacity is moved
+// to a new slot at the end of the file; its old slot is not reused.
+type diskSlot struct {
+	offset   int64 // Where the slot starts.
+	length   int64 // Number of bytes in use; 0 if the page was never written.
+	capacity int64 // Number of bytes the slot can hold.
+}
+
+// SetCompression sets whether the pager compresses pages as it writes them back to its
+// file, and decompresses them as it reads them in. Pages are only ever compressed on
+// disk, so the pages that are hot enough to stay in the buffer pool cost nothing extra.
+// Compressed files are laid out differently, so the setting must match how the file
+// was created, and can only be changed before the pager is opened. Off by default.
+func (pager *Pager) SetCompression(compressed bool) error {
+	if pager.IsMem() {
+		return errors.New("in-memory pagers cannot be compressed")
+	}
+	if pager.HasFile() {
+		return errors.New("compression must be set before the pager is opened")
+	}
+	pager.compressed = compressed
+	return nil
+}
+
+// IsCompressed checks if the pager compresses its pages on disk.
+func (pager *Pager) IsCompressed() bool {
+	return pager.compressed
+}
+
+// openCompressed opens or creates the compressed file, reading in its offset map.
+// Since pages no longer sit at fixed offsets, the file is not opened for direct I/O.
+func (pager *Pager) openCompressed(filename string) (err error) {
+	if pager.file, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		return err
+	}
+	info, err := pager.file.Stat()
+	if err != nil {
+		return err
+	}
+	pager.slots = make([]diskSlot, 0)
+	pager.mapSlot = diskSlot{}
+	if info.Size() == 0 {
+		pager.nPages = 0
+		pager.fileEnd = COMPRESSED_HEADER_SIZE
+		return pager.writeCompressedHeader()
+	}
+	pager.fileEnd = info.Size()
+	header := make([]byte, COMPRESSED_HEADER_SIZE)
+	if _, err = pager.file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("open: reading compressed header: %v", err)
+	}
+	if string(header[CHEADER_MAGIC_OFFSET:CHEADER_MAGIC_OFFSET+CHEADER_MAGIC_SIZE]) != COMPRESSED_MAGIC {
+		return errors.New("open: not a compressed DB file")
+	}
+	if version := header[CHEADER_VERSION_OFFSET]; version != COMPRESSED_FORMAT_VERSION {
+		return fmt.Errorf("%w: file has version %d, expected %d", utils.ErrUnsupportedVersion, version, COMPRESSED_FORMAT_VERSION)
+	}
+	readInt := func(offset int64) int64 {
+		return int64(binary.LittleEndian.Uint64(header[offset : offset+CHEADER_INT_SIZE]))
+	}
+	pager.nPages = readInt(CHEADER_NPAGES_OFFSET)
+	pager.mapSlot = diskSlot{
+		offset:   readInt(CHEADER_MAP_OFFSET),
+		length:   readInt(CHEADER_MAP_LENGTH),
+		capacity: readInt(CHEADER_MAP_CAPACITY),
+	}
+	if pager.mapSlot.length == 0 {
+		return nil
+	}
+	data := make([]byte, pager.mapSlot.length)
+	if _, err = pager.file.ReadAt(data, pager.mapSlot.offset); err != nil {
+		return fmt.Errorf("open: reading page offset map: %v", err)
+	}
+	for len(data) > 0 {
+		var fields [3]int64
+		for i := range fields {
+			value, n := binary.Varint(data)
+			if n <= 0 {
+				return errors.New("open: page offset map is corrupted")
+			}
+			fields[i] = value
+			data = data[n:]
+		}
+		pager.slots = append(pager.slots, diskSlot{offset: fields[0], length: fields[1], capacity: fields[2]})
+	}
+	return nil
+}
+
+// writeCompressedHeader writes the header, pointing at the last offset map saved.
+func (pager *Pager) writeCompressedHeader() error {
+	header := make([]byte, COMPRESSED_HEADER_SIZE)
+	copy(header[CHEADER_MAGIC_OFFSET:], COMPRESSED_MAGIC)
+	header[CHEADER_VERSION_OFFSET] = COMPRESSED_FORMAT_VERSION
+	writeInt := func(offset int64, value int64) {
+		binary.LittleEndian.PutUint64(header[offset:offset+CHEADER_INT_SIZE], uint64(value))
+	}
+	writeInt(CHEADER_NPAGES_OFFSET, pager.nPages)
+	writeInt(CHEADER_MAP_OFFSET, pager.mapSlot.offset)
+	writeInt(CHEADER_MAP_LENGTH, pager.mapSlot.length)
+	writeInt(CHEADER_MAP_CAPACITY, pager.mapSlot.capacity)
+	_, err := pager.file.WriteAt(header, 0)
+	return err
+}
+
+// saveOffsetMap writes the offset map, as a varint offset, length and capacity per page,
+// then points the header at it. Pages written since the map was last saved can't be found
+// again once the pager is reopened, so it is saved whenever all dirty pages are flushed.
+// [RECOVERY] The map is saved in place if it still fits, so a crash while saving it can
+// corrupt the file; compression is meant for read-mostly indices.
+// The ptMtx should be locked on entry.
+func (pager *Pager) saveOffsetMap() error {
+	if !pager.mapDirty {
+		return nil
+	}
+	data := make([]byte, 0, len(pager.slots)*3*binary.MaxVarintLen64)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	for _, slot := range pager.slots {
+		for _, value := range []int64{slot.offset, slot.length, slot.capacity} {
+			n := binary.PutVarint(scratch, value)
+			data = append(data, scratch[:n]...)
+		}
+	}
+	pager.mapSlot = pager.place(pager.mapSlot, int64(len(data)))
+	if _, err := pager.file.WriteAt(data, pager.mapSlot.offset); err != nil {
+		return err
+	}
+	if err := pager.writeCompressedHeader(); err != nil {
+		return err
+	}
+	pager.mapDirty = false
+	return nil
+}
+
+// place returns the slot that length bytes last stored in the given slot should be
+// written to: the same slot if they fit, or else a new one at the end of the file.
+func (pager *Pager) place(slot diskSlot, length int64) diskSlot {
+	if length > slot.capacity {
+		slot = diskSlot{offset: pager.fileEnd, capacity: length}
+		pager.fileEnd += length
+	}
+	slot.length = length
+	return slot
+}
+
+// writeCompressedPage compresses the page and writes it back to its slot.
+// The ptMtx should be locked on entry.
+func (pager *Pager) writeCompressedPage(page *Page) error {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, COMPRESSION_LEVEL)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(*page.data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	for int64(len(pager.slots)) <= page.pagenum {
+		pager.slots = append(pager.slots, diskSlot{})
+	}
+	slot := pager.place(pager.slots[page.pagenum], int64(buf.Len()))
+	if _, err = pager.file.WriteAt(buf.Bytes(), slot.offset); err != nil {
+		return err
+	}
+	atomic.AddInt64(&pager.numWrites, 1)
+	pager.slots[page.pagenum] = slot
+	pager.mapDirty = true
+	return nil
+}
+
+// readCompressedPage reads the given page from its slot and decompresses it into data.
+// Pages that were never written are zeroed. The ptMtx should be locked on entry.
+func (pager *Pager) readCompressedPage(pagenum int64, data []byte) error {
+	if pagenum >= int64(len(pager.slots)) || pager.slots[pagenum].length == 0 {
+		copy(data, make([]byte, PAGESIZE))
+		return nil
+	}
+	slot := pager.slots[pagenum]
+	buf := make([]byte, slot.length)
+	if _, err := pager.file.ReadAt(buf, slot.offset); err != nil {
+		return err
+	}
+	r := flate.NewReader(bytes.NewReader(buf))
+	defer r.Close()
+	if _, err := io.ReadFull(r, data[:PAGESIZE]); err != nil {
+		return fmt.Errorf("page %d is corrupted: %v", pagenum, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package pager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	directio "github.com/ncw/directio"
+)
+
+// Whether pagers open their files for buffered I/O even where direct I/O is supported,
+// as they do when it isn't. Only meant for testing the fallback, and must be set before
+// the pagers are opened.
+var FORCE_BUFFERED_IO = false
+
+// openDBFile opens or creates the database file for direct I/O. Filesystems that don't
+// support direct I/O, such as tmpfs, reject the open, so the file is opened for buffered
+// I/O instead, and buffered is set. Frames are aligned and pages are read and written
+// whole at multiples of PAGESIZE either way, so the file's layout doesn't depend on which
+// was used.
+func openDBFile(filename string) (file *os.File, buffered bool, err error) {
+	if !FORCE_BUFFERED_IO {
+		file, err = directio.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+		if err == nil || !errors.Is(err, syscall.EINVAL) {
+			return file, false, err
+		}
+		fmt.Printf("WARNING: direct I/O is not supported for %s (%v); falling back to buffered I/O\n", filename, err)
+	}
+	file, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	return file, true, err
+}
+
+// readPageHeaderBuffered reads the first len(header) bytes of the given page straight from
+// a file opened for buffered I/O. Bytes past the end of the file read as zeroes.
+func (pager *Pager) readPageHeaderBuffered(pagenum int64, header []byte) error {
+	n, err := pager.file.ReadAt(header, pagenum*PAGESIZE)
+	if err == io.EOF {
+		for i := n; i < len(header); i++ {
+			header[i] = 0
+		}
+		return nil
+	}
+	return err
+}
+
+// fileFor returns the handle to write with under the given hint: the buffered handle for
+// RANDOM_WRITES, if the file was opened for direct I/O, and the file itself otherwise.
+// Writes that go through the page cache are counted.
+func (pager *Pager) fileFor(hint WriteHint) *os.File {
+	if hint == RANDOM_WRITES && pager.cacheFile != nil {
+		atomic.AddInt64(&pager.numCached, 1)
+		return pager.cacheFile
+	}
+	if pager.buffered {
+		atomic.AddInt64(&pager.numCached, 1)
+	}
+	return pager.file
+}
@@ -14,10 +14,13 @@ type Page struct {
 	pager      *Pager       // Pointer to the pager that this page belongs to.
 	pagenum    int64        // Position of the page in the file.
 	pinCount   int64        // The number of active references to this page.
+	referenced int32        // Set when the page is pinned; cleared by the eviction clock.
 	dirty      bool         // Flag on whether data has to be written back.
 	rwlock     sync.RWMutex // Readers-writers lock on the page itself
-	updateLock sync.Mutex   // Mutex for updating data in a page
+	updateLock sync.RWMutex // Mutex for updating data in a page; readers lock it to copy data out
 	data       *[]byte      // Serialized data.
+	frame      *Page        // For read-only pages, the pinned page they were made from.
+	version    int64        // Version stamp for optimistic readers; kept in memory only, never written back.
 }
 
 // Get the pager.
@@ -32,12 +35,15 @@ func (page *Page) GetPageNum() int64 {
 
 // Is dirty?
 func (page *Page) IsDirty() bool {
-	return page.dirty
+	return page.base().dirty
 }
 
-// Set dirty.
+// Set dirty. Panics if marking a read-only page dirty.
 func (page *Page) SetDirty(dirty bool) {
-	page.dirty = dirty
+	if dirty {
+		page.checkWritable()
+	}
+	page.base().dirty = dirty
 }
 
 // Get data.
@@ -47,37 +53,108 @@ func (page *Page) GetData() *[]byte {
 
 // Increment the pincount.
 func (page *Page) Get() {
+	page = page.base()
 	atomic.AddInt64(&page.pinCount, 1)
+	if page.pager != nil {
+		page.pager.addPin()
+		page.pager.notePin(page)
+	}
+}
+
+// GetPinCount returns the number of active references to the page.
+func (page *Page) GetPinCount() int {
+	return int(atomic.LoadInt64(&page.base().pinCount))
 }
 
-// Release a reference to the page.
+// Release a reference to the page. Does nothing for detached pages.
 func (page *Page) Put() {
-	pager := page.pager
-	pager.ptMtx.Lock()
-	ret := atomic.AddInt64(&page.pinCount, -1)
-	// Check if we can unpin this page; if so, move from pinned to unpinned list.
-	if ret == 0 {
-		link := pager.pageTable[page.pagenum]
-		link.PopSelf()
-		newLink := pager.unpinnedList.PushTail(page)
-		pager.pageTable[page.pagenum] = newLink
+	page = page.base()
+	if page.pager == nil {
+		return
 	}
-	page.pager.ptMtx.Unlock()
+	// Forget the pin while it is still held, since the page may be evicted and pinned again
+	// as soon as it is unpinned; see Pager.evict.
+	page.pager.noteUnpin(page, atomic.LoadInt64(&page.pinCount)-1)
+	ret := atomic.AddInt64(&page.pinCount, -1)
 	if ret < 0 {
 		fmt.Println("ERROR: pinCount for page is < 0")
 	}
+	page.pager.releasePin()
 }
 
 // Update the target page with `size` bytes of the the given data.
+// Panics if the page is read-only.
 func (page *Page) Update(data []byte, offset int64, size int64) {
+	page.checkWritable()
 	page.updateLock.Lock()
 	defer page.updateLock.Unlock()
 	page.dirty = true
+	if page.pager != nil {
+		if hook := page.pager.getUpdateHook(); hook != nil {
+			before := make([]byte, size)
+			copy(before, (*page.data)[offset:offset+size])
+			hook(page.pagenum, offset, before)
+		}
+	}
 	copy((*page.data)[offset:offset+size], data)
 }
 
-// [CONCURRENCY] Grab a writers lock on the page.
+// Clone returns a detached copy of the page, so that a reader can keep using the
+// page's contents after releasing its latch while a writer modifies the original.
+// The copy does not belong to the pager: it takes no frame from the buffer pool, is
+// never written back, and is simply garbage collected; Put on it does nothing.
+// [CONCURRENCY] Hold at least a readers lock on the page while cloning it, so that
+// the copy doesn't catch a writer partway through a multi-step change, unless the
+// caller can tell such a copy apart some other way, e.g. by a version stamp.
+func (page *Page) Clone() *Page {
+	page = page.base()
+	page.updateLock.RLock()
+	defer page.updateLock.RUnlock()
+	data := make([]byte, len(*page.data))
+	copy(data, *page.data)
+	return &Page{pager: nil, pagenum: page.pagenum, data: &data}
+}
+
+// CopyData returns a copy of size bytes of the page's data, starting at offset. Like
+// Clone, it only waits for a single Update to finish, not for the page's writers lock.
+func (page *Page) CopyData(offset int64, size int64) []byte {
+	page = page.base()
+	page.updateLock.RLock()
+	defer page.updateLock.RUnlock()
+	data := make([]byte, size)
+	copy(data, (*page.data)[offset:offset+size])
+	return data
+}
+
+// IsDetached returns true if the page is a clone that doesn't belong to a pager.
+func (page *Page) IsDetached() bool {
+	return page.pager == nil
+}
+
+// IsReadOnly returns true if the page was pinned with GetPageReadOnly.
+func (page *Page) IsReadOnly() bool {
+	return page.frame != nil
+}
+
+// base returns the page that holds this page's state: the pinned page
+// for a read-only page, and the page itself otherwise.
+func (page *Page) base() *Page {
+	if page.frame != nil {
+		return page.frame
+	}
+	return page
+}
+
+// checkWritable panics if the page is read-only.
+func (page *Page) checkWritable() {
+	if page.frame != nil {
+		panic(fmt.Sprintf("page %d is pinned read-only and cannot be written", page.pagenum))
+	}
+}
+
+// [CONCURRENCY] Grab a writers lock on the page. Panics if the page is read-only.
 func (page *Page) WLock() {
+	page.checkWritable()
 	page.rwlock.Lock()
 }
 
@@ -88,20 +165,33 @@ func (page *Page) WUnlock() {
 
 // [CONCURRENCY] Grab a readers lock on the page.
 func (page *Page) RLock() {
-	page.rwlock.RLock()
+	page.base().rwlock.RLock()
 }
 
 // [CONCURRENCY] Release a readers lock.
 func (page *Page) RUnlock() {
-	page.rwlock.RUnlock()
+	page.base().rwlock.RUnlock()
+}
+
+// BumpVersion increments the page's version stamp and returns the new value. Writers
+// bump it when they take and release the page's writers lock, so that it is odd while
+// they hold it. The stamp lives in the frame, not in the page's data, so bumping it
+// doesn't dirty the page, and a page read back in from disk always starts out even.
+func (page *Page) BumpVersion() int64 {
+	return atomic.AddInt64(&page.base().version, 1)
+}
+
+// GetVersion returns the page's version stamp; see BumpVersion.
+func (page *Page) GetVersion() int64 {
+	return atomic.LoadInt64(&page.base().version)
 }
 
 // [RECOVERY] Grab the update lock.
 func (page *Page) LockUpdates() {
-	page.updateLock.Lock()
+	page.base().updateLock.Lock()
 }
 
 // [RECOVERY] Release the update lock.
 func (page *Page) UnlockUpdates() {
-	page.updateLock.Unlock()
+	page.base().updateLock.Unlock()
 }
@@ -6,8 +6,11 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	config "github.com/brown-csci1270/db/pkg/config"
 	list "github.com/brown-csci1270/db/pkg/list"
@@ -21,27 +24,141 @@ const PAGESIZE = int64(directio.BlockSize)
 // Number of pages.
 const NUMPAGES = config.NumPages
 
+// Most adjacent dirty pages that FlushAllPages writes with a single call.
+const MAX_FLUSH_RUN = 64
+
+// A WriteHint tells FlushAllPagesWithHint what kind of flush it is doing, so that it
+// can pick how to write the dirty pages back.
+type WriteHint int
+
+const (
+	SEQUENTIAL_WRITES WriteHint = 0 // Many pages, e.g. a checkpoint: adjacent pages are written at once, with direct I/O. The default.
+	RANDOM_WRITES     WriteHint = 1 // A few scattered pages: each is written on its own through the page cache, without sorting or copying.
+)
+
+// Number of shards the page table is split into.
+const NUM_PT_SHARDS = 16
+
+// Returned by calls that would pin a page once the pager has started closing.
+var ErrClosed = errors.New("pager is closed")
+
+// Longest Close waits for outstanding pins to be put before giving up with ErrPinned.
+var CLOSE_TIMEOUT = 5 * time.Second
+
+// Returned by Close, wrapped with a list of the pinned pages, when pages are still pinned
+// after CLOSE_TIMEOUT.
+var ErrPinned = errors.New("pages are still pinned on close")
+
+// Returned by ReadPageHeader when the pager's backend can only read whole pages.
+var ErrPartialReadUnsupported = errors.New("partial page reads are not supported by directio files")
+
 // Pagers manage pages of data read from a file.
+// [CONCURRENCY] Pinning a resident page only takes its page table shard's readers lock.
+// Reading a page in, which may evict another, additionally holds ptMtx throughout;
+// ptMtx is always taken before any shard lock. ptMtx is not reentrant, so nothing done
+// while holding it may get a page that isn't resident: eviction writes its victim back
+// with flushPageLocked, which expects ptMtx to be held, rather than going through GetPage.
 type Pager struct {
-	file         *os.File             // File descriptor.
-	nPages       int64                // The number of pages used by this database.
-	ptMtx        sync.Mutex           // Page table mutex.
-	freeList     *list.List           // Free page list.
-	unpinnedList *list.List           // Unpinned page list.
-	pinnedList   *list.List           // Pinned page list.
-	pageTable    map[int64]*list.Link // Page table.
+	file       *os.File               // File descriptor.
+	mem        map[int64][]byte       // Page contents, for in-memory pagers that have no file.
+	name       string                 // File name, for in-memory pagers.
+	nPages     int64                  // The number of pages used by this database.
+	ptMtx      sync.Mutex             // Mutex for reading pages in and for the fields below.
+	freeList   *list.List             // Free page list.
+	frames     []*Page                // Every frame in the buffer pool.
+	clockHand  int                    // The next frame the eviction clock will look at.
+	shards     [NUM_PT_SHARDS]ptShard // Page table, mapping page numbers to resident pages.
+	hookMtx    sync.RWMutex           // Mutex for the update hook.
+	updateHook UpdateHook             // Called by Page.Update before it overwrites data.
+	accessLog  atomic.Value           // Holds the *AccessLog recording the pages gotten, if set.
+	pins       pinTracker             // Stacks of outstanding pins, if DEBUG_PIN_STACKS is set.
+	numWrites  int64                  // The number of writes made to the file, updated atomically.
+	numHits    int64                  // The number of GetPage calls that found the page resident, updated atomically.
+	numMisses  int64                  // The number of GetPage calls that read the page in, updated atomically.
+	buffered   bool                   // Whether the file was opened for buffered rather than direct I/O.
+	cacheFile  *os.File               // A second, buffered handle on a direct I/O file, for RANDOM_WRITES.
+	numCached  int64                  // The number of writes made through the page cache, updated atomically.
+	compressed bool                   // Whether pages are compressed on disk.
+	slots      []diskSlot             // Where each page is stored, for compressed pagers.
+	mapSlot    diskSlot               // Where the offset map is stored, for compressed pagers.
+	mapDirty   bool                   // Whether slots has changed since the offset map was saved.
+	fileEnd    int64                  // The end of the file, for compressed pagers.
+	closing    int32                  // Set once Close has begun, after which pages can't be pinned; accessed atomically.
+	numPins    int64                  // The number of outstanding pins on all frames, updated atomically.
+	pinMtx     sync.Mutex             // Mutex for allPut.
+	allPut     *sync.Cond             // Signalled when the last outstanding pin is put while closing.
+}
+
+// A shard of the page table.
+type ptShard struct {
+	mtx   sync.RWMutex
+	pages map[int64]*Page
+}
+
+// shardFor returns the page table shard holding the given page.
+func (pager *Pager) shardFor(pagenum int64) *ptShard {
+	return &pager.shards[pagenum%NUM_PT_SHARDS]
+}
+
+// An UpdateHook is passed the bytes that Page.Update is about to overwrite,
+// along with the page number and offset they start at.
+type UpdateHook func(pagenum int64, offset int64, before []byte)
+
+// SetUpdateHook registers a hook to be called on every update to one of the pager's
+// pages, while the page's update lock is held. Passing nil removes the hook.
+// LockAllUpdates takes the update locks while holding ptMtx, so the hook must not
+// get pages from the pager.
+func (pager *Pager) SetUpdateHook(hook UpdateHook) {
+	pager.hookMtx.Lock()
+	defer pager.hookMtx.Unlock()
+	pager.updateHook = hook
+}
+
+// getUpdateHook returns the registered update hook, if any.
+func (pager *Pager) getUpdateHook() UpdateHook {
+	pager.hookMtx.RLock()
+	defer pager.hookMtx.RUnlock()
+	return pager.updateHook
 }
 
 // Construct a new Pager.
 func NewPager() *Pager {
+	pager, _ := NewPagerWithFrames(NUMPAGES)
+	return pager
+}
+
+// Construct a new Pager whose buffer pool holds n frames.
+func NewPagerWithFrames(n int) (*Pager, error) {
+	if n < 1 {
+		return nil, errors.New("pager must have at least one frame")
+	}
 	var pager *Pager = &Pager{}
-	pager.pageTable = make(map[int64]*list.Link)
+	pager.allPut = sync.NewCond(&pager.pinMtx)
+	for i := range pager.shards {
+		pager.shards[i].pages = make(map[int64]*Page)
+	}
 	pager.freeList = list.NewList()
-	pager.unpinnedList = list.NewList()
-	pager.pinnedList = list.NewList()
-	frames := directio.AlignedBlock(int(PAGESIZE * NUMPAGES))
-	for i := 0; i < NUMPAGES; i++ {
-		frame := frames[i*int(PAGESIZE) : (i+1)*int(PAGESIZE)]
+	pager.addFrames(n)
+	return pager, nil
+}
+
+// Construct a new Pager that keeps pages in memory rather than in a file.
+// Pages evicted from the buffer pool are copied into an in-memory slab, so the
+// pager can hold more pages than it has frames; its contents are lost once it is dropped.
+func NewMemPager() *Pager {
+	pager := NewPager()
+	pager.mem = make(map[int64][]byte)
+	return pager
+}
+
+// Allocate n more frames and push them onto the free list.
+// the ptMtx should be locked on entry, unless the pager is still being constructed
+func (pager *Pager) addFrames(n int) {
+	frames := directio.AlignedBlock(int(PAGESIZE) * n)
+	for i := 0; i < n; i++ {
+		// Cap each frame at its own page, so that a write past its end panics rather
+		// than landing in the next frame.
+		frame := frames[i*int(PAGESIZE) : (i+1)*int(PAGESIZE) : (i+1)*int(PAGESIZE)]
 		page := Page{
 			pager:    pager,
 			pagenum:  NOPAGE,
@@ -50,8 +167,29 @@ func NewPager() *Pager {
 			data:     &frame,
 		}
 		pager.freeList.PushTail(&page)
+		pager.frames = append(pager.frames, &page)
 	}
-	return pager
+}
+
+// GetNumFrames returns the number of frames in the buffer pool.
+func (pager *Pager) GetNumFrames() int {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	return len(pager.frames)
+}
+
+// Resize grows the buffer pool to n frames while the pager is open.
+// Shrinking the buffer pool is not supported.
+func (pager *Pager) Resize(n int) error {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if n < len(pager.frames) {
+		return fmt.Errorf("cannot shrink buffer pool from %d to %d frames", len(pager.frames), n)
+	}
+	if n > len(pager.frames) {
+		pager.addFrames(n - len(pager.frames))
+	}
+	return nil
 }
 
 // HasFile checks if the pager is backed by disk.
@@ -59,8 +197,16 @@ func (pager *Pager) HasFile() bool {
 	return pager.file != nil
 }
 
+// IsMem checks if the pager keeps its pages in memory.
+func (pager *Pager) IsMem() bool {
+	return pager.mem != nil
+}
+
 // GetFileName returns the file name.
 func (pager *Pager) GetFileName() string {
+	if pager.file == nil {
+		return pager.name
+	}
 	return filepath.Base(pager.file.Name())
 }
 
@@ -69,14 +215,44 @@ func (pager *Pager) GetNumPages() int64 {
 	return pager.nPages
 }
 
+// GetNumWrites returns the number of writes the pager has made to its file, each of
+// which may cover several pages.
+func (pager *Pager) GetNumWrites() int64 {
+	return atomic.LoadInt64(&pager.numWrites)
+}
+
+// GetNumBufferedWrites returns how many of the pager's writes went through the page
+// cache rather than direct I/O, either because of a RANDOM_WRITES hint or because the
+// file doesn't support direct I/O.
+func (pager *Pager) GetNumBufferedWrites() int64 {
+	return atomic.LoadInt64(&pager.numCached)
+}
+
+// GetNumHits returns the number of times GetPage found the page it was asked for in the buffer pool.
+func (pager *Pager) GetNumHits() int64 {
+	return atomic.LoadInt64(&pager.numHits)
+}
+
+// GetNumMisses returns the number of times GetPage had to read the page it was asked for in.
+func (pager *Pager) GetNumMisses() int64 {
+	return atomic.LoadInt64(&pager.numMisses)
+}
+
 // GetFreePN returns the next available page number.
+// Pages should be created with AllocatePage, which assigns this number atomically.
 func (pager *Pager) GetFreePN() int64 {
 	// Assign the first page number beyond the end of the file.
 	return pager.nPages
 }
 
 // Open initializes our page with a given database file.
+// In-memory pagers only take the name; no file is created.
 func (pager *Pager) Open(filename string) (err error) {
+	atomic.StoreInt32(&pager.closing, 0)
+	if pager.IsMem() {
+		pager.name = filepath.Base(filename)
+		return nil
+	}
 	// Create the necessary prerequisite directories.
 	if idx := strings.LastIndex(filename, "/"); idx != -1 {
 		err = os.MkdirAll(filename[:idx], 0775)
@@ -84,11 +260,20 @@ func (pager *Pager) Open(filename string) (err error) {
 			return err
 		}
 	}
+	if pager.compressed {
+		return pager.openCompressed(filename)
+	}
 	// Open or create the db file.
-	pager.file, err = directio.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	pager.file, pager.buffered, err = openDBFile(filename)
 	if err != nil {
 		return err
 	}
+	if !pager.buffered {
+		if pager.cacheFile, err = os.OpenFile(filename, os.O_RDWR, 0666); err != nil {
+			pager.file.Close()
+			return err
+		}
+	}
 	// Get info about the size of the pager.
 	var info os.FileInfo
 	var len int64
@@ -103,26 +288,137 @@ func (pager *Pager) Open(filename string) (err error) {
 	return nil
 }
 
-// Close signals our pager to flush all dirty pages to disk.
+// Close signals our pager to flush all dirty pages to disk. It first stops pages from
+// being pinned, so that new GetPage calls fail with ErrClosed, then waits up to
+// CLOSE_TIMEOUT for the pins already taken to be put, so that no page is flushed while an
+// operation is partway through updating it. If pages are still pinned after that, Close
+// fails with ErrPinned, wrapped with a list of the pinned pages, leaving the pager
+// unflushed and open, but still refusing new pins, so that it can be closed again once
+// they are put.
+// [CONCURRENCY] Pins are waited for without holding ptMtx, since an operation may need to
+// read another page in before it can put the ones it holds; it is then refused, and
+// should put its pins on the way out.
 func (pager *Pager) Close() (err error) {
 	// Prevent new data from being paged in.
-	pager.ptMtx.Lock()
-	// Check if all refcounts are 0.
-	curLink := pager.pinnedList.PeekHead()
-	if curLink != nil {
-		fmt.Println("ERROR: pages are still pinned on close")
+	atomic.StoreInt32(&pager.closing, 1)
+	deadline := time.Now().Add(CLOSE_TIMEOUT)
+	for {
+		if !pager.waitForPins(time.Until(deadline)) {
+			var dump strings.Builder
+			pager.ptMtx.Lock()
+			pager.dumpPinnedPages(&dump)
+			pager.ptMtx.Unlock()
+			return fmt.Errorf("%w:\n%s", ErrPinned, dump.String())
+		}
+		// AllocatePage checks for closing and pins its page under ptMtx, so once we hold
+		// it, a page allocated before closing started has its pin counted.
+		pager.ptMtx.Lock()
+		if atomic.LoadInt64(&pager.numPins) == 0 {
+			break
+		}
+		pager.ptMtx.Unlock()
 	}
 	// Cleanup.
 	pager.FlushAllPages()
+	if pager.cacheFile != nil {
+		err = pager.cacheFile.Close()
+	}
 	if pager.file != nil {
-		err = pager.file.Close()
+		if closeErr := pager.file.Close(); err == nil {
+			err = closeErr
+		}
 	}
 	pager.ptMtx.Unlock()
 	return err
 }
 
+// IsClosing checks if the pager has started closing, and so refuses to pin pages.
+func (pager *Pager) IsClosing() bool {
+	return atomic.LoadInt32(&pager.closing) == 1
+}
+
+// waitForPins waits until no frame is pinned, and returns whether that happened before
+// the timeout. A pin is counted before its page is checked for closing, so once the
+// pager is closing, pins that aren't counted yet will be refused.
+func (pager *Pager) waitForPins(timeout time.Duration) bool {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		pager.pinMtx.Lock()
+		defer pager.pinMtx.Unlock()
+		timedOut = true
+		pager.allPut.Broadcast()
+	})
+	defer timer.Stop()
+	pager.pinMtx.Lock()
+	defer pager.pinMtx.Unlock()
+	for atomic.LoadInt64(&pager.numPins) > 0 && !timedOut {
+		pager.allPut.Wait()
+	}
+	return atomic.LoadInt64(&pager.numPins) == 0
+}
+
+// addPin counts a pin just taken on one of the pager's frames.
+func (pager *Pager) addPin() {
+	atomic.AddInt64(&pager.numPins, 1)
+}
+
+// releasePin counts a pin just put, waking Close if it was the last one.
+// [CONCURRENCY] The count is dropped before checking for closing, and Close checks the
+// count after starting to close, so either Close sees the pin gone or this sees Close.
+func (pager *Pager) releasePin() {
+	if atomic.AddInt64(&pager.numPins, -1) == 0 && pager.IsClosing() {
+		pager.pinMtx.Lock()
+		defer pager.pinMtx.Unlock()
+		pager.allPut.Broadcast()
+	}
+}
+
+// refuseIfClosing puts a page just pinned by GetPage or TryGetPage if the pager started
+// closing meanwhile, since Close may have already checked for pins without seeing it.
+// Any error from reading the page in is also reported as ErrClosed, since the file may
+// have been closed under the read.
+func (pager *Pager) refuseIfClosing(page *Page, err error) (*Page, error) {
+	if !pager.IsClosing() {
+		return page, err
+	}
+	if page != nil {
+		page.Put()
+	}
+	return nil, ErrClosed
+}
+
+// Sync flushes all dirty pages and forces the file's contents to stable storage
+// without closing it.
+func (pager *Pager) Sync() (err error) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	pager.FlushAllPages()
+	return pager.SyncFile()
+}
+
+// SyncFile forces the pages already written to the file to stable storage, without
+// flushing any dirty pages. Like FlushAllPages, it doesn't lock the ptMtx.
+func (pager *Pager) SyncFile() error {
+	if pager.file == nil {
+		return nil
+	}
+	// Syncing either handle syncs the whole file, including what was written through the other.
+	return pager.file.Sync()
+}
+
 // Populate a page's data field, given a pagenumber.
 func (pager *Pager) ReadPageFromDisk(page *Page, pagenum int64) error {
+	if pager.IsMem() {
+		if data, ok := pager.mem[pagenum]; ok {
+			copy(*page.data, data)
+		} else {
+			copy(*page.data, make([]byte, PAGESIZE))
+		}
+		return nil
+	}
+	if pager.compressed {
+		return pager.readCompressedPage(pagenum, *page.data)
+	}
 	if _, err := pager.file.Seek(pagenum*PAGESIZE, 0); err != nil {
 		return err
 	}
@@ -132,8 +428,72 @@ func (pager *Pager) ReadPageFromDisk(page *Page, pagenum int64) error {
 	return nil
 }
 
-// NewPage returns an unused buffer from the free or unpinned list
-// the ptMtx should be locked on entry
+// ReadPageHeader returns a copy of the first size bytes of a page, for structural checks
+// that only need a node's header. Resident pages are read from their frame; otherwise
+// the bytes are read from the in-memory slab, or from a file opened for buffered I/O,
+// without taking a frame or evicting anything. Compressed pagers decompress the page into
+// a scratch buffer. Files opened for direct I/O can only read whole aligned blocks, so
+// they return ErrPartialReadUnsupported for non-resident pages and callers should fall
+// back to GetPage.
+func (pager *Pager) ReadPageHeader(pagenum int64, size int64) ([]byte, error) {
+	if pagenum < 0 {
+		return nil, errors.New("invalid pagenum")
+	}
+	if size <= 0 || size > PAGESIZE {
+		return nil, fmt.Errorf("invalid header size %d", size)
+	}
+	header := make([]byte, size)
+	if page, ok := pager.pinResident(pagenum); ok {
+		return copyHeader(page, header), nil
+	}
+	pager.ptMtx.Lock()
+	if pagenum >= pager.nPages {
+		pager.ptMtx.Unlock()
+		return nil, fmt.Errorf("pagenum %d has not been allocated", pagenum)
+	}
+	// Someone else may have read the page in while we waited; its frame is current.
+	if page, ok := pager.pinResident(pagenum); ok {
+		pager.ptMtx.Unlock()
+		return copyHeader(page, header), nil
+	}
+	defer pager.ptMtx.Unlock()
+	if pager.compressed {
+		data := make([]byte, PAGESIZE)
+		if err := pager.readCompressedPage(pagenum, data); err != nil {
+			return nil, err
+		}
+		copy(header, data)
+		return header, nil
+	}
+	if pager.buffered {
+		if err := pager.readPageHeaderBuffered(pagenum, header); err != nil {
+			return nil, err
+		}
+		return header, nil
+	}
+	if !pager.IsMem() {
+		return nil, ErrPartialReadUnsupported
+	}
+	// Pages that were never flushed to the slab are still zeroed.
+	if data, ok := pager.mem[pagenum]; ok {
+		copy(header, data)
+	}
+	return header, nil
+}
+
+// copyHeader fills header from the start of a pinned page's data, then unpins it.
+func copyHeader(page *Page, header []byte) []byte {
+	defer page.Put()
+	page.RLock()
+	defer page.RUnlock()
+	copy(header, *page.data)
+	return header
+}
+
+// NewPage returns an unused buffer from the free list, or evicts an unpinned page.
+// The ptMtx should be locked on entry; NewPage never locks it itself, so that GetPage,
+// TryGetPage and AllocatePage can hold it from checking the page table until the new
+// page has been inserted into it.
 func (pager *Pager) NewPage(pagenum int64) (*Page, error) {
 	/* SOLUTION {{{ */
 	var newPage *Page
@@ -141,110 +501,385 @@ func (pager *Pager) NewPage(pagenum int64) (*Page, error) {
 		// Check the free list first
 		freeLink.PopSelf()
 		newPage = freeLink.GetKey().(*Page)
-	} else if unpinLink := pager.unpinnedList.PeekHead(); pager.HasFile() && unpinLink != nil {
-		// If no page was found, evict a page from the unpinned list.
-		// But skip this if our pager isn't backed by disk.
-		unpinLink.PopSelf()
-		newPage = unpinLink.GetKey().(*Page)
-		pager.FlushPage(newPage)
-		delete(pager.pageTable, newPage.pagenum)
+	} else if pager.HasFile() || pager.IsMem() {
+		// If no page was found, evict an unpinned page.
+		// But skip this if our pager has nowhere to write the page back to.
+		var err error
+		if newPage, err = pager.evict(); err != nil {
+			return nil, err
+		}
 	} else {
 		// If still no page is found, error.
 		return nil, errors.New("no available pages")
 	}
 	newPage.pagenum = pagenum
 	newPage.dirty = false
-	newPage.pinCount = 1
+	atomic.StoreInt64(&newPage.version, 0)
+	atomic.StoreInt64(&newPage.pinCount, 1)
+	atomic.StoreInt32(&newPage.referenced, 1)
+	pager.addPin()
+	pager.notePin(newPage)
 	return newPage, nil
 	/* SOLUTION }}} */
 }
 
-// getPage returns the page corresponding to the given pagenum.
-func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
+// evict picks an unpinned frame with the clock algorithm, removes its page from the
+// page table, and writes it back. The ptMtx should be locked on entry.
+func (pager *Pager) evict() (*Page, error) {
+	// Referenced frames get a second chance for two sweeps; after that, any unpinned
+	// frame will do, so that a stream of hits can't hold off eviction forever.
+	for i := 0; i < 3*len(pager.frames); i++ {
+		page := pager.frames[pager.clockHand]
+		pager.clockHand = (pager.clockHand + 1) % len(pager.frames)
+		if page.pagenum == NOPAGE || atomic.LoadInt64(&page.pinCount) > 0 {
+			continue
+		}
+		if i < 2*len(pager.frames) && atomic.SwapInt32(&page.referenced, 0) == 1 {
+			continue
+		}
+		// [CONCURRENCY] Pins are only taken under the shard's lock, so once the page
+		// is seen unpinned under the writers lock, no one else can reach it.
+		shard := pager.shardFor(page.pagenum)
+		shard.mtx.Lock()
+		if atomic.LoadInt64(&page.pinCount) > 0 {
+			shard.mtx.Unlock()
+			continue
+		}
+		delete(shard.pages, page.pagenum)
+		shard.mtx.Unlock()
+		pager.flushPageLocked(page, SEQUENTIAL_WRITES)
+		return page, nil
+	}
+	return nil, errors.New("no available pages")
+}
+
+// GetPage returns the page corresponding to the given pagenum, pinned.
+// The page must already exist; new pages are created with AllocatePage.
+// Returns ErrClosed once the pager has started closing.
+func (pager *Pager) GetPage(pagenum int64) (*Page, error) {
+	if pager.IsClosing() {
+		return nil, ErrClosed
+	}
+	return pager.refuseIfClosing(pager.getPage(pagenum))
+}
+
+// getPage is GetPage without the checks for a closing pager.
+func (pager *Pager) getPage(pagenum int64) (page *Page, err error) {
 	/* SOLUTION {{{ */
 	// Input checking.
 	if pagenum < 0 {
 		return nil, errors.New("invalid pagenum")
 	}
+	if log := pager.getAccessLog(); log != nil {
+		log.record(pagenum)
+	}
 	// Try to get from page table.
-	var newLink *list.Link
+	if page, ok := pager.pinResident(pagenum); ok {
+		atomic.AddInt64(&pager.numHits, 1)
+		return page, nil
+	}
 	pager.ptMtx.Lock()
 	defer pager.ptMtx.Unlock()
-	link, ok := pager.pageTable[pagenum]
-	if ok {
-		page = link.GetKey().(*Page)
-		// Move the page to the pinned list if needed.
-		if link.GetList() == pager.unpinnedList {
-			link.PopSelf()
-			newLink = pager.pinnedList.PushTail(page)
-			pager.pageTable[pagenum] = newLink
-		}
-		page.Get()
+	if pagenum >= pager.nPages {
+		return nil, fmt.Errorf("pagenum %d has not been allocated", pagenum)
+	}
+	// Someone else may have read the page in while we waited.
+	if page, ok := pager.pinResident(pagenum); ok {
+		atomic.AddInt64(&pager.numHits, 1)
 		return page, nil
 	}
-	// Else, create a buffer to hold the new page in.
-	page, err = pager.NewPage(pagenum)
+	// Else, read it into a new buffer.
+	atomic.AddInt64(&pager.numMisses, 1)
+	return pager.readIn(pagenum)
+	/* SOLUTION }}} */
+}
+
+// TryGetPage gets the page like GetPage if it is already resident or there is a free
+// frame to read it into. If reading it in would mean evicting another page, it returns
+// false without pinning anything, so that best-effort readers like prefetchers never
+// compete with foreground work for frames.
+func (pager *Pager) TryGetPage(pagenum int64) (*Page, bool, error) {
+	if pager.IsClosing() {
+		return nil, false, ErrClosed
+	}
+	page, ok, err := pager.tryGetPage(pagenum)
+	if page, err = pager.refuseIfClosing(page, err); err != nil {
+		return nil, false, err
+	}
+	return page, ok, nil
+}
+
+// tryGetPage is TryGetPage without the checks for a closing pager.
+func (pager *Pager) tryGetPage(pagenum int64) (*Page, bool, error) {
+	if pagenum < 0 {
+		return nil, false, errors.New("invalid pagenum")
+	}
+	if page, ok := pager.pinResident(pagenum); ok {
+		return page, true, nil
+	}
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if pagenum >= pager.nPages {
+		return nil, false, fmt.Errorf("pagenum %d has not been allocated", pagenum)
+	}
+	if page, ok := pager.pinResident(pagenum); ok {
+		return page, true, nil
+	}
+	if pager.freeList.PeekHead() == nil {
+		return nil, false, nil
+	}
+	page, err := pager.readIn(pagenum)
+	if err != nil {
+		return nil, false, err
+	}
+	return page, true, nil
+}
+
+// lookup returns the page if it is resident, without pinning it.
+func (pager *Pager) lookup(pagenum int64) (*Page, bool) {
+	shard := pager.shardFor(pagenum)
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	page, ok := shard.pages[pagenum]
+	return page, ok
+}
+
+// pinResident pins and returns the page if it is in the page table.
+func (pager *Pager) pinResident(pagenum int64) (*Page, bool) {
+	shard := pager.shardFor(pagenum)
+	shard.mtx.RLock()
+	defer shard.mtx.RUnlock()
+	page, ok := shard.pages[pagenum]
+	if !ok {
+		return nil, false
+	}
+	atomic.AddInt64(&page.pinCount, 1)
+	atomic.StoreInt32(&page.referenced, 1)
+	pager.addPin()
+	pager.notePin(page)
+	return page, true
+}
+
+// insert adds a newly pinned page to the page table.
+func (pager *Pager) insert(page *Page) {
+	shard := pager.shardFor(page.pagenum)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
+	shard.pages[page.pagenum] = page
+}
+
+// readIn reads the page into a new buffer, evicting another page if needed, and pins it.
+// The ptMtx should be locked on entry.
+func (pager *Pager) readIn(pagenum int64) (*Page, error) {
+	page, err := pager.NewPage(pagenum)
+	if err != nil {
+		return nil, err
+	}
+	// Read the existing page in.
+	page.dirty = false
+	err = pager.ReadPageFromDisk(page, pagenum)
+	if err != nil {
+		page.pagenum = NOPAGE
+		atomic.StoreInt64(&page.pinCount, 0)
+		pager.releasePin()
+		pager.noteUnpin(page, 0)
+		pager.freeList.PushTail(page)
+		return nil, err
+	}
+	// Insert the page into our page table.
+	pager.insert(page)
+	return page, nil
+}
+
+// GetPageReadOnly gets the page like GetPage, so that it stays pinned until it is Put,
+// but returns a read-only handle to it: calling Update, SetDirty(true) or WLock on the
+// handle panics. Other users of the page are unaffected.
+func (pager *Pager) GetPageReadOnly(pagenum int64) (*Page, error) {
+	page, err := pager.GetPage(pagenum)
 	if err != nil {
 		return nil, err
 	}
+	return &Page{pager: pager, pagenum: page.pagenum, data: page.data, frame: page}, nil
+}
 
-	// Check if we need to create a new page.
-	if pagenum >= pager.nPages {
-		pager.nPages++
-		page.dirty = true
-	} else {
-		// Read an existing page in.
-		page.dirty = false
-		err = pager.ReadPageFromDisk(page, pagenum)
-		if err != nil {
-			pager.freeList.PushTail(page)
-			return nil, err
-		}
+// AllocatePage creates a new, zeroed page at the end of the file and returns it.
+// Pages created with this function must be `Put()` accordingly after use.
+func (pager *Pager) AllocatePage() (*Page, error) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	// Close checks the pin count again under ptMtx once it is closing, so it either sees
+	// this page's pin or makes us see that it is closing.
+	if pager.IsClosing() {
+		return nil, ErrClosed
+	}
+	pagenum := pager.nPages
+	page, err := pager.NewPage(pagenum)
+	if err != nil {
+		return nil, err
 	}
-	// Insert the page into our list of pages.
-	newLink = pager.pinnedList.PushTail(page)
-	pager.pageTable[pagenum] = newLink
+	pager.nPages++
+	// The frame may still hold the data of an evicted page.
+	copy(*page.data, make([]byte, PAGESIZE))
+	page.dirty = true
+	pager.insert(page)
 	return page, nil
-	/* SOLUTION }}} */
 }
 
 // Flush a particular page to disk.
 func (pager *Pager) FlushPage(page *Page) {
+	pager.FlushPageWithHint(page, SEQUENTIAL_WRITES)
+}
+
+// FlushPageWithHint flushes a particular page to disk like FlushPage, writing it with
+// direct I/O or through the page cache as the hint suggests.
+func (pager *Pager) FlushPageWithHint(page *Page, hint WriteHint) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	pager.flushPageLocked(page, hint)
+}
+
+// flushPageLocked is FlushPageWithHint without the locking. The ptMtx should be locked on entry.
+func (pager *Pager) flushPageLocked(page *Page, hint WriteHint) {
 	/* SOLUTION {{{ */
-	if pager.HasFile() && page.IsDirty() {
-		pager.file.WriteAt(
+	if pager.IsMem() && page.IsDirty() {
+		data, ok := pager.mem[page.pagenum]
+		if !ok {
+			data = make([]byte, PAGESIZE)
+			pager.mem[page.pagenum] = data
+		}
+		copy(data, *page.data)
+		page.SetDirty(false)
+	}
+	if pager.compressed && page.IsDirty() {
+		if err := pager.writeCompressedPage(page); err == nil {
+			page.SetDirty(false)
+		}
+	} else if pager.HasFile() && page.IsDirty() {
+		pager.fileFor(hint).WriteAt(
 			*page.data,
 			page.pagenum*PAGESIZE,
 		)
+		atomic.AddInt64(&pager.numWrites, 1)
 		page.SetDirty(false)
 	}
 	/* SOLUTION }}} */
 }
 
-// Flushes all dirty pages.
+// Flushes all dirty pages. Pages are written in page number order, so that the
+// writes are sequential, and each run of adjacent pages is written at once.
+// Unlike FlushPage, it doesn't lock the ptMtx; callers usually hold it through LockAllUpdates.
 func (pager *Pager) FlushAllPages() {
+	pager.FlushAllPagesWithHint(SEQUENTIAL_WRITES)
+}
+
+// FlushAllPagesWithHint flushes all dirty pages like FlushAllPages, writing them as the
+// hint suggests. Coalescing runs of adjacent pages and writing them with direct I/O pays
+// off when many pages are dirty, but costs a sort and a copy of every page in a run,
+// which is wasted when few are; those are instead written one by one through the page
+// cache, which can absorb small scattered writes. Like FlushAllPages, it doesn't lock the ptMtx.
+func (pager *Pager) FlushAllPagesWithHint(hint WriteHint) {
 	/* SOLUTION {{{ */
-	writer := func(link *list.Link) {
-		page := link.GetKey().(*Page)
-		pager.FlushPage(page)
+	dirty := make([]*Page, 0)
+	for _, page := range pager.frames {
+		if page.pagenum != NOPAGE && page.IsDirty() {
+			dirty = append(dirty, page)
+		}
+	}
+	if !pager.HasFile() || pager.compressed || hint == RANDOM_WRITES {
+		for _, page := range dirty {
+			pager.flushPageLocked(page, hint)
+		}
+		if pager.compressed {
+			pager.saveOffsetMap()
+		}
+		return
+	}
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].pagenum < dirty[j].pagenum
+	})
+	// Runs are copied into one buffer, which must be aligned since the file is opened for direct I/O.
+	var buf []byte
+	for start := 0; start < len(dirty); {
+		end := start + 1
+		for end < len(dirty) && end-start < MAX_FLUSH_RUN && dirty[end].pagenum == dirty[end-1].pagenum+1 {
+			end++
+		}
+		if end-start == 1 {
+			pager.flushPageLocked(dirty[start], hint)
+			start = end
+			continue
+		}
+		if buf == nil {
+			buf = directio.AlignedBlock(int(PAGESIZE) * MAX_FLUSH_RUN)
+		}
+		run := buf[:int64(end-start)*PAGESIZE]
+		for i, page := range dirty[start:end] {
+			copy(run[int64(i)*PAGESIZE:], *page.data)
+		}
+		pager.fileFor(hint).WriteAt(run, dirty[start].pagenum*PAGESIZE)
+		atomic.AddInt64(&pager.numWrites, 1)
+		for _, page := range dirty[start:end] {
+			page.SetDirty(false)
+		}
+		start = end
 	}
-	pager.pinnedList.Map(writer)
-	pager.unpinnedList.Map(writer)
 	/* SOLUTION }}} */
 }
 
+// [RECOVERY] GetDirtyPages returns the numbers of the resident pages that are dirty, in order.
+func (pager *Pager) GetDirtyPages() []int64 {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	dirty := make([]int64, 0)
+	for _, page := range pager.frames {
+		if page.pagenum == NOPAGE {
+			continue
+		}
+		page.LockUpdates()
+		if page.dirty {
+			dirty = append(dirty, page.pagenum)
+		}
+		page.UnlockUpdates()
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i] < dirty[j] })
+	return dirty
+}
+
+// [RECOVERY] Flush the given pages, skipping any that have since been evicted. Each page
+// is written under its own update lock, so updates are only blocked on the page being written.
+func (pager *Pager) FlushPages(pagenums []int64) {
+	for _, pagenum := range pagenums {
+		pager.ptMtx.Lock()
+		if page, ok := pager.lookup(pagenum); ok {
+			page.LockUpdates()
+			pager.flushPageLocked(page, SEQUENTIAL_WRITES)
+			page.UnlockUpdates()
+		}
+		pager.ptMtx.Unlock()
+	}
+	if pager.compressed {
+		pager.ptMtx.Lock()
+		pager.saveOffsetMap()
+		pager.ptMtx.Unlock()
+	}
+}
+
 // [RECOVERY] Block all updates.
 func (pager *Pager) LockAllUpdates() {
 	pager.ptMtx.Lock()
-	for _, page := range pager.pageTable {
-		page.GetKey().(*Page).LockUpdates()
+	for _, page := range pager.frames {
+		if page.pagenum != NOPAGE {
+			page.LockUpdates()
+		}
 	}
 }
 
 // [RECOVERY] Enable updates.
 func (pager *Pager) UnlockAllUpdates() {
-	for _, page := range pager.pageTable {
-		page.GetKey().(*Page).UnlockUpdates()
+	for _, page := range pager.frames {
+		if page.pagenum != NOPAGE {
+			page.UnlockUpdates()
+		}
 	}
 	pager.ptMtx.Unlock()
 }
@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	list "github.com/brown-csci1270/db/pkg/list"
 	repl "github.com/brown-csci1270/db/pkg/repl"
@@ -21,6 +23,7 @@ func PagerRepl() (*repl.REPL, error) {
 	}
 	// Initialize repl.
 	r := repl.NewRepl()
+	r.SetName("pager")
 	r.AddCommand("pager_print", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePagerPrint(p, payload, replConfig.GetWriter())
 	}, "Print out the state of the pager. usage: pager_print")
@@ -59,24 +62,33 @@ func HandlePagerPrint(p *Pager, payload string, w io.Writer) (err error) {
 	if numFields != 1 {
 		return fmt.Errorf("usage: pager_print")
 	}
-	// Print nPages, freeList, unpinnedList, pinnedList, pageTable.
+	// Print nPages, freeList, unpinned and pinned frames, pageTable.
+	p.ptMtx.Lock()
+	defer p.ptMtx.Unlock()
 	io.WriteString(w, fmt.Sprintf("nPages: %v\n", p.nPages))
 	io.WriteString(w, "freeList: ")
 	p.freeList.Map(func(l *list.Link) {
 		io.WriteString(w, fmt.Sprintf("(pagenum: %v), ", l.GetKey().(*Page).GetPageNum()))
 	})
-	io.WriteString(w, "\nunpinnedList: ")
-	p.unpinnedList.Map(func(l *list.Link) {
-		page := l.GetKey().(*Page)
-		io.WriteString(w, fmt.Sprintf("(pagenum: %v, pincount: %v), ", page.GetPageNum(), page.pinCount))
-	})
-	io.WriteString(w, "\npinnedList: ")
-	p.pinnedList.Map(func(l *list.Link) {
-		page := l.GetKey().(*Page)
-		io.WriteString(w, fmt.Sprintf("(pagenum: %v, pincount: %v), ", page.GetPageNum(), page.pinCount))
-	})
+	pageNums := make([]int64, 0)
+	for _, pinned := range []bool{false, true} {
+		if pinned {
+			io.WriteString(w, "\npinned: ")
+		} else {
+			io.WriteString(w, "\nunpinned: ")
+		}
+		for _, page := range p.frames {
+			pinCount := atomic.LoadInt64(&page.pinCount)
+			if page.pagenum == NOPAGE || (pinCount > 0) != pinned {
+				continue
+			}
+			io.WriteString(w, fmt.Sprintf("(pagenum: %v, pincount: %v), ", page.GetPageNum(), pinCount))
+			pageNums = append(pageNums, page.pagenum)
+		}
+	}
 	io.WriteString(w, "\npageTable: ")
-	for pNum := range p.pageTable {
+	sort.Slice(pageNums, func(i, j int) bool { return pageNums[i] < pageNums[j] })
+	for _, pNum := range pageNums {
 		io.WriteString(w, fmt.Sprintf("%v, ", pNum))
 	}
 	io.WriteString(w, "\n")
@@ -112,7 +124,11 @@ func HandlePagerNew(p *Pager, payload string, w io.Writer) (err error) {
 	if numFields != 1 {
 		return fmt.Errorf("usage: pager_new")
 	}
-	p.GetPage(int64(p.nPages))
+	page, err := p.AllocatePage()
+	if err != nil {
+		return err
+	}
+	defer page.Put()
 	return nil
 }
 
@@ -130,13 +146,11 @@ func HandlePagerWrite(p *Pager, payload string, w io.Writer) (err error) {
 		return err
 	}
 	// Check that this page is in our pageTable
-	link, found := p.pageTable[int64(pNum)]
+	page, found := p.pinResident(int64(pNum))
 	if !found {
 		return errors.New("page not found; did you pager_get it first?")
 	}
-	// Cast and write.
-	page := link.GetKey().(*Page)
-	page.Get()
+	// Write.
 	data := []byte(fields[2])
 	page.Update(data, 0, int64(len(data)))
 	page.Put()
@@ -157,13 +171,11 @@ func HandlePagerRead(p *Pager, payload string, w io.Writer) (err error) {
 		return err
 	}
 	// Check that this page is in our pageTable
-	link, found := p.pageTable[int64(pNum)]
+	page, found := p.pinResident(int64(pNum))
 	if !found {
 		return errors.New("page not found; did you pager_get it first?")
 	}
 	// Print.
-	page := link.GetKey().(*Page)
-	page.Get()
 	io.WriteString(w, string(*page.GetData()))
 	io.WriteString(w, "\n")
 	page.Put()
@@ -183,19 +195,10 @@ func HandlePagerPin(p *Pager, payload string, w io.Writer) (err error) {
 	if pNum, err = strconv.Atoi(fields[1]); err != nil {
 		return err
 	}
-	// Check that this page is in our pageTable
-	link, found := p.pageTable[int64(pNum)]
-	if !found {
+	// Check that this page is in our pageTable, and pin it.
+	if _, found := p.pinResident(int64(pNum)); !found {
 		return errors.New("page not found; did you pager_get it first?")
 	}
-	// Pin.
-	if link.GetList() == p.unpinnedList {
-		link.PopSelf()
-		newLink := p.pinnedList.PushHead(link.GetKey())
-		p.pageTable[int64(pNum)] = newLink
-	}
-	page := link.GetKey().(*Page)
-	page.Get()
 	return nil
 }
 
@@ -213,12 +216,11 @@ func HandlePagerUnpin(p *Pager, payload string, w io.Writer) (err error) {
 		return err
 	}
 	// Check that this page is in our pageTable
-	link, found := p.pageTable[int64(pNum)]
+	page, found := p.lookup(int64(pNum))
 	if !found {
 		return errors.New("page not found; did you pager_get it first?")
 	}
 	// Unpin.
-	page := link.GetKey().(*Page)
 	page.Put()
 	return nil
 }
@@ -239,12 +241,11 @@ func HandlePagerFlush(p *Pager, payload string, w io.Writer) (err error) {
 		return err
 	}
 	// Check that this page is in our pageTable
-	link, found := p.pageTable[int64(pNum)]
+	page, found := p.lookup(int64(pNum))
 	if !found {
 		return errors.New("page not found; did you pager_get it first?")
 	}
 	// Flush.
-	page := link.GetKey().(*Page)
 	p.FlushPage(page)
 	return nil
 }
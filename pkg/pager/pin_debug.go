@@ -0,0 +1,103 @@
+package pager
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Whether pagers record the stack that took each pin, so that DumpPinnedPages can show
+// where leaked pins came from. Capturing stacks is slow, so this should only be set while
+// debugging, and before any pages are pinned.
+var DEBUG_PIN_STACKS = false
+
+// Most stack frames recorded for each pin.
+const MAX_PIN_STACK_DEPTH = 32
+
+// Stacks of the outstanding pins on each frame, kept while DEBUG_PIN_STACKS is set.
+type pinTracker struct {
+	mtx    sync.Mutex
+	stacks map[*Page][]string
+}
+
+// notePin records the stack of a pin just taken on the given frame.
+func (pager *Pager) notePin(page *Page) {
+	if !DEBUG_PIN_STACKS {
+		return
+	}
+	stack := pinStack()
+	pager.pins.mtx.Lock()
+	defer pager.pins.mtx.Unlock()
+	if pager.pins.stacks == nil {
+		pager.pins.stacks = make(map[*Page][]string)
+	}
+	pager.pins.stacks[page] = append(pager.pins.stacks[page], stack)
+}
+
+// noteUnpin forgets a pin on the given frame, which has remaining pins left.
+// Puts can't be matched to the Get they release, so the most recent pin is forgotten;
+// the stacks left behind by a leak are those of the oldest outstanding pins.
+func (pager *Pager) noteUnpin(page *Page, remaining int64) {
+	if !DEBUG_PIN_STACKS {
+		return
+	}
+	pager.pins.mtx.Lock()
+	defer pager.pins.mtx.Unlock()
+	stacks := pager.pins.stacks[page]
+	if remaining <= 0 || len(stacks) <= 1 {
+		delete(pager.pins.stacks, page)
+		return
+	}
+	pager.pins.stacks[page] = stacks[:len(stacks)-1]
+}
+
+// pinStack formats the stack of the caller that is taking a pin, skipping the pager's
+// own bookkeeping frames.
+func pinStack() string {
+	pcs := make([]uintptr, MAX_PIN_STACK_DEPTH)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var sb strings.Builder
+	for {
+		frame, more := frames.Next()
+		sb.WriteString(fmt.Sprintf("%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line))
+		if !more {
+			break
+		}
+	}
+	return sb.String()
+}
+
+// DumpPinnedPages writes the page number and pin count of every pinned page, in page
+// number order. If DEBUG_PIN_STACKS is set, the stack that took each pin is written too.
+func (pager *Pager) DumpPinnedPages(w io.Writer) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	pager.dumpPinnedPages(w)
+}
+
+// dumpPinnedPages is DumpPinnedPages without the locking. The ptMtx should be locked on entry.
+func (pager *Pager) dumpPinnedPages(w io.Writer) {
+	pinned := make([]*Page, 0)
+	for _, page := range pager.frames {
+		if page.pagenum != NOPAGE && atomic.LoadInt64(&page.pinCount) > 0 {
+			pinned = append(pinned, page)
+		}
+	}
+	sort.Slice(pinned, func(i, j int) bool { return pinned[i].pagenum < pinned[j].pagenum })
+	pager.pins.mtx.Lock()
+	defer pager.pins.mtx.Unlock()
+	for _, page := range pinned {
+		io.WriteString(w, fmt.Sprintf("pagenum %v: pincount %v\n", page.pagenum, atomic.LoadInt64(&page.pinCount)))
+		for _, stack := range pager.pins.stacks[page] {
+			io.WriteString(w, "  pinned at:\n")
+			for _, line := range strings.Split(strings.TrimSuffix(stack, "\n"), "\n") {
+				io.WriteString(w, "    "+line+"\n")
+			}
+		}
+	}
+}
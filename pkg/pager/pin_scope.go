@@ -0,0 +1,68 @@
+package pager
+
+// A PinScope pins the pages of an operation that touches several of them at once,
+// e.g. a B+ tree split, and unpins them all when the operation is over. Pinned pages
+// are never evicted, so no member of a scope is evicted before the scope is released,
+// however small the buffer pool. Steps of a long operation should Put the pages they
+// are done with, so that the scope doesn't hold a frame for every page the operation
+// ever touched. A scope is meant to be used by one goroutine.
+type PinScope struct {
+	pager *Pager
+	pages []*Page // Every pin the scope holds, in the order it was taken.
+}
+
+// PinSet returns an empty pin scope over this pager.
+func (pager *Pager) PinSet() *PinScope {
+	return &PinScope{pager: pager, pages: make([]*Page, 0)}
+}
+
+// Get pins the given page for the life of the scope. Getting a page more than once
+// takes a pin each time; all of them are released together.
+func (scope *PinScope) Get(pagenum int64) (*Page, error) {
+	page, err := scope.pager.GetPage(pagenum)
+	if err != nil {
+		return nil, err
+	}
+	scope.pages = append(scope.pages, page)
+	return page, nil
+}
+
+// Allocate allocates a new page, pinned for the life of the scope.
+func (scope *PinScope) Allocate() (*Page, error) {
+	page, err := scope.pager.AllocatePage()
+	if err != nil {
+		return nil, err
+	}
+	scope.pages = append(scope.pages, page)
+	return page, nil
+}
+
+// Add hands the pin of a page the caller already holds over to the scope.
+func (scope *PinScope) Add(page *Page) {
+	scope.pages = append(scope.pages, page)
+}
+
+// Put releases one of the scope's pins on the given page before the scope is released.
+// Pages the scope doesn't hold a pin on are left alone.
+func (scope *PinScope) Put(page *Page) {
+	for i := len(scope.pages) - 1; i >= 0; i-- {
+		if scope.pages[i] == page {
+			scope.pages = append(scope.pages[:i], scope.pages[i+1:]...)
+			page.Put()
+			return
+		}
+	}
+}
+
+// Len returns the number of pins the scope holds.
+func (scope *PinScope) Len() int {
+	return len(scope.pages)
+}
+
+// Release unpins every page in the scope, leaving it empty and ready for reuse.
+func (scope *PinScope) Release() {
+	for _, page := range scope.pages {
+		page.Put()
+	}
+	scope.pages = scope.pages[:0]
+}
@@ -1,37 +1,18 @@
 package query
 
 import (
-	bitset "github.com/bits-and-blooms/bitset"
 	hash "github.com/brown-csci1270/db/pkg/hash"
 )
 
-type BloomFilter struct {
-	size int64
-	bits *bitset.BitSet
-}
+// BloomFilter is shared with the hash package, which keeps one per table.
+type BloomFilter = hash.BloomFilter
 
 // CreateFilter initializes a BloomFilter with the given size.
 func CreateFilter(size int64) *BloomFilter {
-	/* SOLUTION {{{ */
-	return &BloomFilter{
-		size: size,
-		bits: bitset.New(uint(size)),
-	}
-	/* SOLUTION }}} */
-}
-
-// Insert adds an element into the bloom filter.
-func (filter *BloomFilter) Insert(key int64) {
-	/* SOLUTION {{{ */
-	filter.bits.Set(hash.XxHasher(key, filter.size))
-	filter.bits.Set(hash.MurmurHasher(key, filter.size))
-	/* SOLUTION }}} */
+	return hash.CreateFilter(size)
 }
 
-// Contains checks if the given key can be found in the bloom filter/
-func (filter *BloomFilter) Contains(key int64) bool {
-	/* SOLUTION {{{ */
-	return (filter.bits.Test(hash.XxHasher(key, filter.size)) &&
-		filter.bits.Test(hash.MurmurHasher(key, filter.size)))
-	/* SOLUTION }}} */
+// CreateFilterSeeded initializes a BloomFilter with the given size, number of hashes, and seed.
+func CreateFilterSeeded(size int64, k int64, seed uint64) *BloomFilter {
+	return hash.CreateFilterSeeded(size, k, seed)
 }
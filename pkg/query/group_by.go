@@ -0,0 +1,85 @@
+package query
+
+import (
+	"context"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// GroupBy scans the index once, folding the value of each entry into the accumulator
+// of the group that keyFn puts it in. Each group's accumulator starts at init, and
+// aggFn(acc, value) returns its next value; for example, summing with init 0 and
+// aggFn acc+val, or counting with init 0 and aggFn acc+1. Entries are streamed off
+// a cursor, so only the accumulators are held in memory.
+func GroupBy(
+	index db.Index,
+	keyFn func(utils.Entry) int64,
+	aggFn func(acc, val int64) int64,
+	init int64,
+) (map[int64]int64, error) {
+	groups := make(map[int64]int64)
+	cursor, err := index.TableStart()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return nil, err
+			}
+			group := keyFn(entry)
+			acc, ok := groups[group]
+			if !ok {
+				acc = init
+			}
+			groups[group] = aggFn(acc, entry.GetValue())
+		}
+		if err = cursor.StepForward(); err != nil {
+			break
+		}
+	}
+	return groups, nil
+}
+
+// AggregateJoin joins leftTable on rightTable like Join, folding each pair into the
+// accumulator of the group that groupBy puts it in as it arrives, rather than collecting
+// the pairs first. Each group's accumulator starts at 0, and agg(acc, pair) returns its
+// next value; for example, counting matches per left key with groupBy returning the left
+// key and agg acc+1. The join's temporary tables are removed once it is over.
+func AggregateJoin(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	distinctLeft bool,
+	groupBy func(EntryPair) int64,
+	agg func(acc int64, pair EntryPair) int64,
+) (map[int64]int64, error) {
+	resultsChan, _, group, cleanupCallback, err := JoinWithProgress(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, distinctLeft, nil)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Fold pairs off the channel until it is closed, so that no probe blocks on a send.
+	groups := make(map[int64]int64)
+	done := make(chan bool)
+	go func() {
+		for pair := range resultsChan {
+			key := groupBy(pair)
+			groups[key] = agg(groups[key], pair)
+		}
+		done <- true
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
@@ -2,7 +2,13 @@ package query
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	db "github.com/brown-csci1270/db/pkg/db"
 	hash "github.com/brown-csci1270/db/pkg/hash"
@@ -13,22 +19,136 @@ import (
 
 var DEFAULT_FILTER_SIZE int64 = 1024
 
+// Number of partitions used by JoinWithPartitions by default.
+var DEFAULT_NUM_PARTITIONS int64 = 16
+
+// How often JoinWithProgress reports progress while probing.
+var DEFAULT_PROGRESS_INTERVAL = 100 * time.Millisecond
+
 // Entry pair struct - output of a join.
 type EntryPair struct {
 	l utils.Entry
 	r utils.Entry
 }
 
+// GetLeft returns the entry from the left table.
+func (pair EntryPair) GetLeft() utils.Entry {
+	return pair.l
+}
+
+// GetRight returns the entry from the right table.
+func (pair EntryPair) GetRight() utils.Entry {
+	return pair.r
+}
+
+// String formats the pair as {{left key left value} {right key right value}}, with null
+// values written as null.
+func (pair EntryPair) String() string {
+	return fmt.Sprintf("{{%d %s} {%d %s}}",
+		pair.l.GetKey(), formatValue(pair.l), pair.r.GetKey(), formatValue(pair.r))
+}
+
+// formatValue returns the entry's value as a string, or null if it is null.
+func formatValue(entry utils.Entry) string {
+	if entry.IsNull() {
+		return "null"
+	}
+	return fmt.Sprint(entry.GetValue())
+}
+
 // Int pair struct - to keep track of seen bucket pairs.
 type pair struct {
 	l int64
 	r int64
 }
 
+// Set of left keys already emitted by a distinct join, shared by all probing goroutines.
+type seenSet struct {
+	mtx  sync.Mutex
+	keys map[int64]bool
+}
+
+// newSeenSet creates an empty seenSet.
+func newSeenSet() *seenSet {
+	return &seenSet{keys: make(map[int64]bool)}
+}
+
+// add marks the given key as seen, returning false if it had already been seen.
+func (s *seenSet) add(key int64) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.keys[key] {
+		return false
+	}
+	s.keys[key] = true
+	return true
+}
+
+// JoinProgress is a snapshot of how far a join's probe phase has gotten.
+type JoinProgress struct {
+	BucketsProcessed int64 // Bucket pairs that have been fully probed.
+	TotalBuckets     int64 // Bucket pairs to be probed.
+	PairsEmitted     int64 // Results sent to the results channel.
+	FilterHits       int64 // Left entries that passed their bucket's bloom filter.
+	FilterMisses     int64 // Left entries that the bloom filter ruled out.
+}
+
+// FilterHitRatio returns the fraction of left entries that passed the bloom filter.
+func (progress JoinProgress) FilterHitRatio() float64 {
+	if progress.FilterHits+progress.FilterMisses == 0 {
+		return 0
+	}
+	return float64(progress.FilterHits) / float64(progress.FilterHits+progress.FilterMisses)
+}
+
+// A ProgressFunc is passed periodic snapshots of a join's progress.
+type ProgressFunc func(progress JoinProgress)
+
+// Counters updated by the probing goroutines of a join.
+type joinStats struct {
+	bucketsProcessed int64
+	totalBuckets     int64
+	pairsEmitted     int64
+	filterHits       int64
+	filterMisses     int64
+}
+
+// snapshot reads the current value of every counter.
+func (stats *joinStats) snapshot() JoinProgress {
+	return JoinProgress{
+		BucketsProcessed: atomic.LoadInt64(&stats.bucketsProcessed),
+		TotalBuckets:     atomic.LoadInt64(&stats.totalBuckets),
+		PairsEmitted:     atomic.LoadInt64(&stats.pairsEmitted),
+		FilterHits:       atomic.LoadInt64(&stats.filterHits),
+		FilterMisses:     atomic.LoadInt64(&stats.filterMisses),
+	}
+}
+
+// reportProgress calls progress with a snapshot of stats every DEFAULT_PROGRESS_INTERVAL
+// until probesDone is closed, then once more with the final counts. The callback is only
+// ever called from this goroutine, so it need not be safe for concurrent use.
+func reportProgress(ctx context.Context, stats *joinStats, progress ProgressFunc, probesDone chan bool) error {
+	ticker := time.NewTicker(DEFAULT_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-probesDone:
+			progress(stats.snapshot())
+			return nil
+		case <-ticker.C:
+			progress(stats.snapshot())
+		}
+	}
+}
+
 // buildHashIndex constructs a temporary hash table for all the entries in the given sourceTable.
+// Entries are placed by the given partition function, or by hash if it is nil.
 func buildHashIndex(
 	sourceTable db.Index,
 	useKey bool,
+	partition hash.PartitionFunc,
 ) (tempIndex *hash.HashIndex, dbName string, err error) {
 	// Get a temporary db file.
 	dbName, err = db.GetTempDB()
@@ -36,7 +156,7 @@ func buildHashIndex(
 		return nil, "", err
 	}
 	// Init the temporary hash table.
-	tempIndex, err = hash.OpenTable(dbName)
+	tempIndex, err = hash.OpenTableWithPartition(dbName, hash.BUCKETSIZE, partition)
 	if err != nil {
 		return nil, "", err
 	}
@@ -70,54 +190,97 @@ func buildHashIndex(
 }
 
 // sendResult attempts to send a single join result to the resultsChan channel as long as the errgroup hasn't been cancelled.
+// If seen is non-nil, results whose left entry has already been sent are dropped.
+// If stats is non-nil, results that are sent are counted in it.
 func sendResult(
 	ctx context.Context,
 	resultsChan chan EntryPair,
 	result EntryPair,
+	seen *seenSet,
+	stats *joinStats,
 ) error {
+	if seen != nil && !seen.add(result.l.GetKey()) {
+		return nil
+	}
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case resultsChan <- result:
+		if stats != nil {
+			atomic.AddInt64(&stats.pairsEmitted, 1)
+		}
 		return nil
 	}
 }
 
-// See which entries in rBucket have a match in lBucket.
+// See which entries in rBucket have a match in lBucket, counting the pair as processed in stats if it is non-nil.
+// The buckets' overflow chains are probed along with them.
 func probeBuckets(
 	ctx context.Context,
 	resultsChan chan EntryPair,
+	leftHashTable *hash.HashTable,
+	rightHashTable *hash.HashTable,
 	lBucket *hash.HashBucket,
 	rBucket *hash.HashBucket,
 	joinOnLeftKey bool,
 	joinOnRightKey bool,
+	seen *seenSet,
+	stats *joinStats,
 ) error {
 	defer lBucket.GetPage().Put()
 	defer rBucket.GetPage().Put()
 	// Probe buckets.
 	/* SOLUTION {{{ */
 	// Get bucket entries.
-	lBucketEntries, err := lBucket.Select()
+	lBucketEntries, err := leftHashTable.SelectBucket(lBucket)
 	if err != nil {
 		return err
 	}
-	rBucketEntries, err := rBucket.Select()
+	rBucketEntries, err := rightHashTable.SelectBucket(rBucket)
 	if err != nil {
 		return err
 	}
+	err = probeEntries(ctx, resultsChan, lBucketEntries, rBucketEntries, joinOnLeftKey, joinOnRightKey, seen, stats)
+	if err != nil {
+		return err
+	}
+	if stats != nil {
+		atomic.AddInt64(&stats.bucketsProcessed, 1)
+	}
+	return nil
+	/* SOLUTION }}} */
+}
+
+// See which entries in rEntries have a match in lEntries.
+func probeEntries(
+	ctx context.Context,
+	resultsChan chan EntryPair,
+	lEntries []utils.Entry,
+	rEntries []utils.Entry,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	seen *seenSet,
+	stats *joinStats,
+) error {
 	// Set up the bloom filter.
 	filter := CreateFilter(DEFAULT_FILTER_SIZE)
-	for _, rEntry := range rBucketEntries {
+	for _, rEntry := range rEntries {
 		filter.Insert(rEntry.GetKey())
 	}
-	for _, lEntry := range lBucketEntries {
+	for _, lEntry := range lEntries {
 		lMatchKey := lEntry.GetKey()
 		// Check the bloom filter first.
 		if !filter.Contains(lMatchKey) {
+			if stats != nil {
+				atomic.AddInt64(&stats.filterMisses, 1)
+			}
 			continue
 		}
+		if stats != nil {
+			atomic.AddInt64(&stats.filterHits, 1)
+		}
 		// Check all entries if the key is in the filter.
-		for _, rEntry := range rBucketEntries {
+		for _, rEntry := range rEntries {
 			rMatchKey := rEntry.GetKey()
 			if lMatchKey == rMatchKey {
 				// Swap keys and values as needed.
@@ -136,7 +299,7 @@ func probeBuckets(
 					rResult.SetKey(rEntry.GetValue())
 					rResult.SetValue(rEntry.GetKey())
 				}
-				err = sendResult(ctx, resultsChan, EntryPair{l: lResult, r: rResult})
+				err := sendResult(ctx, resultsChan, EntryPair{l: lResult, r: rResult}, seen, stats)
 				if err != nil {
 					return err
 				}
@@ -144,36 +307,43 @@ func probeBuckets(
 		}
 	}
 	return nil
-	/* SOLUTION }}} */
 }
 
-// Join leftTable on rightTable using Grace Hash Join.
-func Join(
-	ctx context.Context,
+// buildJoinTables builds hash indices over both tables, extends them to the same
+// global depth, and returns the distinct pairs of buckets that must be probed; there are
+// none if either table is empty. Both indices place entries by the given partition
+// function, or by hash if it is nil. Once both indices are built, the cleanup callback
+// that removes them is returned even if it fails.
+func buildJoinTables(
 	leftTable db.Index,
 	rightTable db.Index,
 	joinOnLeftKey bool,
 	joinOnRightKey bool,
-) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
-	leftHashIndex, leftDbName, err := buildHashIndex(leftTable, joinOnLeftKey)
+	partition hash.PartitionFunc,
+) (leftHashTable *hash.HashTable, rightHashTable *hash.HashTable, bucketPairs []pair, cleanupCallback func(), err error) {
+	leftHashIndex, leftDbName, err := buildHashIndex(leftTable, joinOnLeftKey, partition)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
-	rightHashIndex, rightDbName, err := buildHashIndex(rightTable, joinOnRightKey)
+	rightHashIndex, rightDbName, err := buildHashIndex(rightTable, joinOnRightKey, partition)
 	if err != nil {
 		os.Remove(leftDbName)
 		os.Remove(leftDbName + ".meta")
 		return nil, nil, nil, nil, err
 	}
-	cleanupCallback := func() {
+	cleanupCallback = func() {
 		os.Remove(leftDbName)
 		os.Remove(leftDbName + ".meta")
 		os.Remove(rightDbName)
 		os.Remove(rightDbName + ".meta")
 	}
 	// Make both hash indices the same global size.
-	leftHashTable := leftHashIndex.GetTable()
-	rightHashTable := rightHashIndex.GetTable()
+	leftHashTable = leftHashIndex.GetTable()
+	rightHashTable = rightHashIndex.GetTable()
+	// Nothing matches an empty table, so there are no buckets worth probing.
+	if leftHashTable.Count() == 0 || rightHashTable.Count() == 0 {
+		return leftHashTable, rightHashTable, []pair{}, cleanupCallback, nil
+	}
 	for leftHashTable.GetDepth() != rightHashTable.GetDepth() {
 		if leftHashTable.GetDepth() < rightHashTable.GetDepth() {
 			// Split the left table
@@ -183,32 +353,265 @@ func Join(
 			rightHashTable.ExtendTable()
 		}
 	}
-	// Probe phase: match buckets to buckets and emit entries that match.
-	group, ctx := errgroup.WithContext(ctx)
-	resultsChan := make(chan EntryPair, 1024)
 	// Iterate through hash buckets, keeping track of pairs we've seen before.
 	leftBuckets := leftHashTable.GetBuckets()
 	rightBuckets := rightHashTable.GetBuckets()
+	if len(leftBuckets) != len(rightBuckets) {
+		return nil, nil, nil, cleanupCallback, fmt.Errorf(
+			"join: directories have %d and %d buckets at depth %d", len(leftBuckets), len(rightBuckets), leftHashTable.GetDepth())
+	}
 	seenList := make(map[pair]bool)
+	bucketPairs = make([]pair, 0, len(leftBuckets))
 	for i, lBucketPN := range leftBuckets {
-		rBucketPN := rightBuckets[i]
-		bucketPair := pair{l: lBucketPN, r: rBucketPN}
+		bucketPair := pair{l: lBucketPN, r: rightBuckets[i]}
 		if _, seen := seenList[bucketPair]; seen {
 			continue
 		}
 		seenList[bucketPair] = true
+		bucketPairs = append(bucketPairs, bucketPair)
+	}
+	return leftHashTable, rightHashTable, bucketPairs, cleanupCallback, nil
+}
+
+// getBucketPair fetches both buckets of the given pair.
+func getBucketPair(
+	leftHashTable *hash.HashTable,
+	rightHashTable *hash.HashTable,
+	bucketPair pair,
+) (*hash.HashBucket, *hash.HashBucket, error) {
+	lBucket, err := leftHashTable.GetBucketByPN(bucketPair.l, hash.NO_LOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	rBucket, err := rightHashTable.GetBucketByPN(bucketPair.r, hash.NO_LOCK)
+	if err != nil {
+		lBucket.GetPage().Put()
+		return nil, nil, err
+	}
+	return lBucket, rBucket, nil
+}
+
+// Join leftTable on rightTable using Grace Hash Join.
+func Join(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
+	return JoinWithProgress(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, false, nil)
+}
 
-		lBucket, err := leftHashTable.GetBucketByPN(lBucketPN, hash.NO_LOCK)
+// JoinOrdered joins leftTable on rightTable like Join, but emits the results in a fixed
+// order: by left key, then left value, then right key, then right value. Since the buckets
+// are probed concurrently, this means holding every result until all of them have been
+// found, so nothing is emitted until the probe phase is over. If distinctLeft is set, each
+// left entry is emitted with the first of its matches in that order, rather than with
+// whichever match happened to be probed first.
+func JoinOrdered(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	distinctLeft bool,
+) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
+	probeChan, _, probeGroup, cleanupCallback, err := Join(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey)
+	if err != nil {
+		return nil, nil, nil, cleanupCallback, err
+	}
+	group, ctx := errgroup.WithContext(ctx)
+	resultsChan := make(chan EntryPair, 1024)
+	group.Go(func() error {
+		// Collect every result before emitting any.
+		collected := make(chan []EntryPair)
+		go func() {
+			pairs := make([]EntryPair, 0)
+			for pair := range probeChan {
+				pairs = append(pairs, pair)
+			}
+			collected <- pairs
+		}()
+		err := probeGroup.Wait()
+		close(probeChan)
+		pairs := <-collected
+		if err != nil {
+			return err
+		}
+		sortPairs(pairs)
+		var seen *seenSet
+		if distinctLeft {
+			seen = newSeenSet()
+		}
+		for _, pair := range pairs {
+			if err := sendResult(ctx, resultsChan, pair, seen, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return resultsChan, ctx, group, cleanupCallback, nil
+}
+
+// sortPairs sorts join results by left key, then left value, then right key, then right value.
+func sortPairs(pairs []EntryPair) {
+	sort.Slice(pairs, func(i, j int) bool {
+		a := [4]int64{pairs[i].l.GetKey(), pairs[i].l.GetValue(), pairs[i].r.GetKey(), pairs[i].r.GetValue()}
+		b := [4]int64{pairs[j].l.GetKey(), pairs[j].l.GetValue(), pairs[j].r.GetKey(), pairs[j].r.GetValue()}
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+}
+
+// JoinWithProgress joins leftTable on rightTable like Join. If progress is non-nil, it is
+// called every DEFAULT_PROGRESS_INTERVAL while probing, and once more with the final counts
+// after every bucket pair has been probed, before the errgroup's Wait returns.
+// The probing goroutines only update atomic counters; progress is always called from a single
+// coordinating goroutine, and is not called with final counts if the join fails.
+// If distinctLeft is set, each matching left entry is emitted at most once (a semi-join).
+func JoinWithProgress(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	distinctLeft bool,
+	progress ProgressFunc,
+) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
+	leftHashTable, rightHashTable, bucketPairs, cleanupCallback, err := buildJoinTables(
+		leftTable, rightTable, joinOnLeftKey, joinOnRightKey, nil)
+	if err != nil {
+		return nil, nil, nil, cleanupCallback, err
+	}
+	// Probe phase: match buckets to buckets and emit entries that match.
+	group, ctx := errgroup.WithContext(ctx)
+	resultsChan := make(chan EntryPair, 1024)
+	var seen *seenSet
+	if distinctLeft {
+		seen = newSeenSet()
+	}
+	var stats *joinStats
+	var probes sync.WaitGroup
+	if progress != nil {
+		stats = &joinStats{totalBuckets: int64(len(bucketPairs))}
+	}
+	for _, bucketPair := range bucketPairs {
+		lBucket, rBucket, err := getBucketPair(leftHashTable, rightHashTable, bucketPair)
 		if err != nil {
 			return nil, nil, nil, cleanupCallback, err
 		}
-		rBucket, err := rightHashTable.GetBucketByPN(rBucketPN, hash.NO_LOCK)
+		probes.Add(1)
+		group.Go(func() error {
+			defer probes.Done()
+			return probeBuckets(ctx, resultsChan, leftHashTable, rightHashTable, lBucket, rBucket, joinOnLeftKey, joinOnRightKey, seen, stats)
+		})
+	}
+	if progress != nil {
+		probesDone := make(chan bool)
+		go func() {
+			probes.Wait()
+			close(probesDone)
+		}()
+		group.Go(func() error {
+			return reportProgress(ctx, stats, progress, probesDone)
+		})
+	}
+	return resultsChan, ctx, group, cleanupCallback, nil
+}
+
+// JoinWithParallelism joins leftTable on rightTable like Join, but probes bucket pairs
+// from a queue using at most the given number of workers, rather than one goroutine per pair.
+// Buckets are only fetched once a worker picks up their pair.
+func JoinWithParallelism(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	distinctLeft bool,
+	workers int,
+) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
+	if workers < 1 {
+		return nil, nil, nil, nil, errors.New("number of workers must be positive")
+	}
+	leftHashTable, rightHashTable, bucketPairs, cleanupCallback, err := buildJoinTables(
+		leftTable, rightTable, joinOnLeftKey, joinOnRightKey, nil)
+	if err != nil {
+		return nil, nil, nil, cleanupCallback, err
+	}
+	// Queue up every bucket pair to be probed.
+	queue := make(chan pair, len(bucketPairs))
+	for _, bucketPair := range bucketPairs {
+		queue <- bucketPair
+	}
+	close(queue)
+	// Probe phase: each worker probes bucket pairs until the queue is empty.
+	group, ctx := errgroup.WithContext(ctx)
+	resultsChan := make(chan EntryPair, 1024)
+	var seen *seenSet
+	if distinctLeft {
+		seen = newSeenSet()
+	}
+	if workers > len(bucketPairs) {
+		workers = len(bucketPairs)
+	}
+	for i := 0; i < workers; i++ {
+		group.Go(func() error {
+			for bucketPair := range queue {
+				lBucket, rBucket, err := getBucketPair(leftHashTable, rightHashTable, bucketPair)
+				if err != nil {
+					return err
+				}
+				err = probeBuckets(ctx, resultsChan, leftHashTable, rightHashTable, lBucket, rBucket, joinOnLeftKey, joinOnRightKey, seen, nil)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return resultsChan, ctx, group, cleanupCallback, nil
+}
+
+// JoinWithPartitions joins leftTable on rightTable by splitting both inputs into the
+// same number of partitions by hash, then probing each pair of matching partitions.
+// Unlike Join, partitioning does not depend on either table's global depth. As in Join,
+// the partitions are spilled to temporary hash tables, whose buckets each hold whole
+// partitions, and only one pair of buckets is read into memory per probe.
+func JoinWithPartitions(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	numPartitions int64,
+) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
+	if numPartitions < 1 {
+		return nil, nil, nil, nil, errors.New("number of partitions must be positive")
+	}
+	// Equal join attributes fall in the same partition, and so in matching buckets.
+	partition := func(key int64) uint64 {
+		return uint64(hash.XxHasher(key, numPartitions))
+	}
+	leftHashTable, rightHashTable, bucketPairs, cleanupCallback, err := buildJoinTables(
+		leftTable, rightTable, joinOnLeftKey, joinOnRightKey, partition)
+	if err != nil {
+		return nil, nil, nil, cleanupCallback, err
+	}
+	// Probe phase: match partitions to partitions and emit entries that match.
+	group, ctx := errgroup.WithContext(ctx)
+	resultsChan := make(chan EntryPair, 1024)
+	for _, bucketPair := range bucketPairs {
+		lBucket, rBucket, err := getBucketPair(leftHashTable, rightHashTable, bucketPair)
 		if err != nil {
-			lBucket.GetPage().Put()
 			return nil, nil, nil, cleanupCallback, err
 		}
 		group.Go(func() error {
-			return probeBuckets(ctx, resultsChan, lBucket, rBucket, joinOnLeftKey, joinOnRightKey)
+			return probeBuckets(ctx, resultsChan, leftHashTable, rightHashTable, lBucket, rBucket, joinOnLeftKey, joinOnRightKey, nil, nil)
 		})
 	}
 	return resultsChan, ctx, group, cleanupCallback, nil
@@ -0,0 +1,130 @@
+package query
+
+import (
+	"context"
+	"errors"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	db "github.com/brown-csci1270/db/pkg/db"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+
+	errgroup "golang.org/x/sync/errgroup"
+)
+
+// Largest outer table that IndexJoin will probe a B+ tree with, entry by entry.
+var INDEX_JOIN_THRESHOLD int64 = 1024
+
+// loadOuterTable reads up to limit entries of sourceTable into memory,
+// returning false if the table holds more than limit entries.
+func loadOuterTable(sourceTable db.Index, limit int64) (entries []utils.Entry, small bool, err error) {
+	cursor, err := sourceTable.TableStart()
+	if err != nil {
+		return nil, false, err
+	}
+	entries = make([]utils.Entry, 0)
+	for {
+		if !cursor.IsEnd() {
+			if int64(len(entries)) == limit {
+				return nil, false, nil
+			}
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				return nil, false, err
+			}
+			entries = append(entries, entry)
+		}
+		if err = cursor.StepForward(); err != nil {
+			break
+		}
+	}
+	return entries, true, nil
+}
+
+// probeBTree looks up the join attribute of each outer entry in the B+ tree, emitting a
+// result for each match. The tree is always joined on its key, so there is at most one match.
+func probeBTree(
+	ctx context.Context,
+	resultsChan chan EntryPair,
+	outerEntries []utils.Entry,
+	tree *btree.BTreeIndex,
+	joinOnOuterKey bool,
+	treeIsLeft bool,
+	seen *seenSet,
+) error {
+	for _, outerEntry := range outerEntries {
+		matchKey := outerEntry.GetKey()
+		if !joinOnOuterKey {
+			matchKey = outerEntry.GetValue()
+		}
+		// Skip the descent for keys that the tree's bloom filter rules out, if it has one.
+		if !tree.MayContain(matchKey) {
+			continue
+		}
+		treeEntry, err := tree.Find(matchKey)
+		if errors.Is(err, utils.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// Copy both entries out, so results look the same as Join's.
+		var outerResult, treeResult hash.HashEntry
+		outerResult.SetKey(outerEntry.GetKey())
+		outerResult.SetValue(outerEntry.GetValue())
+		treeResult.SetKey(treeEntry.GetKey())
+		treeResult.SetValue(treeEntry.GetValue())
+		result := EntryPair{l: outerResult, r: treeResult}
+		if treeIsLeft {
+			result = EntryPair{l: treeResult, r: outerResult}
+		}
+		if err = sendResult(ctx, resultsChan, result, seen, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IndexJoin joins leftTable on rightTable like Join, but if one side is a B+ tree joined
+// on its key and the other side has at most INDEX_JOIN_THRESHOLD entries, it skips the
+// build phase and instead seeks into the B+ tree once per entry of the smaller side.
+// Otherwise, it falls back to Join.
+func IndexJoin(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	distinctLeft bool,
+) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
+	// Prefer probing the right table, so that the left table is the one read into memory.
+	var tree *btree.BTreeIndex
+	var outerTable db.Index
+	var joinOnOuterKey, treeIsLeft bool
+	if rightTree, ok := rightTable.(*btree.BTreeIndex); ok && joinOnRightKey {
+		tree, outerTable, joinOnOuterKey = rightTree, leftTable, joinOnLeftKey
+	} else if leftTree, ok := leftTable.(*btree.BTreeIndex); ok && joinOnLeftKey {
+		tree, outerTable, joinOnOuterKey, treeIsLeft = leftTree, rightTable, joinOnRightKey, true
+	} else {
+		return JoinWithProgress(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, distinctLeft, nil)
+	}
+	outerEntries, small, err := loadOuterTable(outerTable, INDEX_JOIN_THRESHOLD)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if !small {
+		return JoinWithProgress(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, distinctLeft, nil)
+	}
+	// Nothing is built, so there is nothing to clean up.
+	cleanupCallback := func() {}
+	// Probe phase: look up each outer entry in the tree.
+	group, ctx := errgroup.WithContext(ctx)
+	resultsChan := make(chan EntryPair, 1024)
+	var seen *seenSet
+	if distinctLeft {
+		seen = newSeenSet()
+	}
+	group.Go(func() error {
+		return probeBTree(ctx, resultsChan, outerEntries, tree, joinOnOuterKey, treeIsLeft, seen)
+	})
+	return resultsChan, ctx, group, cleanupCallback, nil
+}
@@ -0,0 +1,86 @@
+package query
+
+import (
+	"context"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+)
+
+// Schema of the typed tables that JoinInto writes: each row is one joined pair, numbered
+// by id in the order the join emitted it. Pairs are numbered rather than keyed by either
+// side, since a key may match many entries on the other side.
+const JOIN_INTO_SCHEMA = "id:int left_key:int left_value:int right_key:int right_value:int"
+
+// JoinInto joins leftTable on rightTable like Join, and stores the results in a new typed
+// table named dst with the JOIN_INTO_SCHEMA. It is an error for dst to exist already. The
+// join's temporary tables are removed once it is over, and if the join fails, so is dst.
+// Like db.Database.SelectInto, the new table is not logged.
+func JoinInto(
+	ctx context.Context,
+	d *db.Database,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	distinctLeft bool,
+	dst string,
+) error {
+	schema, err := db.ParseSchema(JOIN_INTO_SCHEMA)
+	if err != nil {
+		return err
+	}
+	table, err := d.CreateTypedTable(dst, schema)
+	if err != nil {
+		return err
+	}
+	if err = joinInto(ctx, table, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, distinctLeft); err != nil {
+		d.DropTable(dst)
+		return err
+	}
+	return nil
+}
+
+// joinInto runs the join, inserting each pair into the table as it arrives.
+func joinInto(
+	ctx context.Context,
+	table *db.TypedTable,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	distinctLeft bool,
+) error {
+	// Cancel the join if an insert fails, so that it stops producing pairs.
+	ctx, cancelCtx := context.WithCancel(ctx)
+	defer cancelCtx()
+	resultsChan, _, group, cleanupCallback, err := JoinWithProgress(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, distinctLeft, nil)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return err
+	}
+	// Keep draining the channel after a failed insert, so that no probe blocks on a send.
+	done := make(chan error)
+	go func() {
+		var insertErr error
+		id := int64(0)
+		for pair := range resultsChan {
+			if insertErr != nil {
+				continue
+			}
+			row := db.Row{id, pair.l.GetKey(), pair.l.GetValue(), pair.r.GetKey(), pair.r.GetValue()}
+			if insertErr = table.Insert(row); insertErr != nil {
+				cancelCtx()
+			}
+			id++
+		}
+		done <- insertErr
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	if insertErr := <-done; insertErr != nil {
+		return insertErr
+	}
+	return err
+}
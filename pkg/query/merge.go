@@ -0,0 +1,121 @@
+package query
+
+import (
+	"container/heap"
+	"errors"
+
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+// mergeItem is an input cursor along with the entry it currently points to.
+type mergeItem struct {
+	cursor utils.Cursor
+	entry  utils.Entry
+	index  int // The cursor's position in the input, used to break ties.
+}
+
+// mergeHeap is a min-heap of input cursors ordered by their current keys.
+type mergeHeap []*mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].entry.GetKey() != h[j].entry.GetKey() {
+		return h[i].entry.GetKey() < h[j].entry.GetKey()
+	}
+	return h[i].index < h[j].index
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeItem)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// MergeCursor walks over several key-sorted cursors as one sorted stream.
+type MergeCursor struct {
+	items mergeHeap
+	err   error // The first error hit while reading an input cursor.
+}
+
+// MergeCursors returns a cursor that yields the entries of all of the given cursors
+// in ascending key order. Entries with equal keys come out in the order of their cursors.
+// Each input cursor must itself be in key order; it is consumed by the merge.
+func MergeCursors(cursors []utils.Cursor) utils.Cursor {
+	merged := &MergeCursor{items: make(mergeHeap, 0, len(cursors))}
+	for i, cursor := range cursors {
+		item := &mergeItem{cursor: cursor, index: i}
+		ok, err := item.load()
+		if err != nil {
+			merged.err = err
+			break
+		}
+		if ok {
+			merged.items = append(merged.items, item)
+		}
+	}
+	heap.Init(&merged.items)
+	return merged
+}
+
+// load reads the entry the item's cursor points to, first stepping past any
+// positions that hold no entry (such as the end of a btree leaf).
+// Returns false once the cursor is exhausted.
+func (item *mergeItem) load() (bool, error) {
+	for item.cursor.IsEnd() {
+		if err := item.cursor.StepForward(); err != nil {
+			return false, nil
+		}
+	}
+	entry, err := item.cursor.GetEntry()
+	if err != nil {
+		return false, err
+	}
+	item.entry = entry
+	return true, nil
+}
+
+// StepForward moves the cursor ahead by one entry, advancing the input it was taken from.
+func (cursor *MergeCursor) StepForward() error {
+	if cursor.err != nil {
+		return cursor.err
+	}
+	if cursor.IsEnd() {
+		return errors.New("cannot advance the cursor further")
+	}
+	top := cursor.items[0]
+	ok := false
+	if err := top.cursor.StepForward(); err == nil {
+		if ok, err = top.load(); err != nil {
+			cursor.err = err
+			return err
+		}
+	}
+	if ok {
+		heap.Fix(&cursor.items, 0)
+	} else {
+		heap.Pop(&cursor.items)
+	}
+	return nil
+}
+
+// IsEnd returns true if every input cursor has been exhausted.
+func (cursor *MergeCursor) IsEnd() bool {
+	return len(cursor.items) == 0
+}
+
+// GetEntry returns the entry with the smallest key across the input cursors.
+func (cursor *MergeCursor) GetEntry() (utils.Entry, error) {
+	if cursor.err != nil {
+		return nil, cursor.err
+	}
+	if cursor.IsEnd() {
+		return nil, errors.New("getEntry: entry is non-existent")
+	}
+	return cursor.items[0].entry, nil
+}
@@ -13,6 +13,7 @@ import (
 // Query REPL.
 func QueryRepl(d *db.Database) *repl.REPL {
 	r := repl.NewRepl()
+	r.SetName("query")
 	r.AddCommand("join", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleJoin(d, payload, replConfig.GetWriter())
 	}, "Create a table. usage: create table <table>")
@@ -41,7 +42,7 @@ func HandleJoin(d *db.Database, payload string, w io.Writer) (err error) {
 	joinOnRightKey := fields[5] == "key"
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
-	resultsChan, _, group, cleanupCallback, err := Join(ctx, table1, table2, joinOnLeftKey, joinOnRightKey)
+	resultsChan, _, group, cleanupCallback, err := IndexJoin(ctx, table1, table2, joinOnLeftKey, joinOnRightKey, false)
 	if cleanupCallback != nil {
 		defer cleanupCallback()
 	}
@@ -56,7 +57,7 @@ func HandleJoin(d *db.Database, payload string, w io.Writer) (err error) {
 				break
 			}
 			io.WriteString(w, fmt.Sprintf("{(%v, %v), (%v, %v)}\n",
-				pair.l.GetKey(), pair.l.GetValue(), pair.r.GetKey(), pair.r.GetValue()))
+				pair.l.GetKey(), formatValue(pair.l), pair.r.GetKey(), formatValue(pair.r)))
 		}
 		done <- true
 	}()
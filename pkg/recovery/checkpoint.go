@@ -0,0 +1,153 @@
+package recovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+	"github.com/otiai10/copy"
+
+	uuid "github.com/google/uuid"
+)
+
+// A FuzzyCheckpoint is a checkpoint taken while transactions keep running. It begins by
+// logging the running transactions and noting each table's dirty pages; the pages are then
+// flushed and the tables copied into a new snapshot in the background, one table at a time.
+// The checkpoint is only logged as ended once its snapshot has replaced the last one, and
+// recovery ignores checkpoints that never ended.
+type FuzzyCheckpoint struct {
+	ids   []uuid.UUID        // Transactions running when the checkpoint began.
+	dirty map[string][]int64 // Dirty pages of each table when the checkpoint began.
+	done  chan struct{}
+	err   error
+}
+
+// GetActive returns the transactions that were running when the checkpoint began.
+func (fc *FuzzyCheckpoint) GetActive() []uuid.UUID {
+	return fc.ids
+}
+
+// GetDirtyPages returns the pages of each table that were dirty when the checkpoint began.
+func (fc *FuzzyCheckpoint) GetDirtyPages() map[string][]int64 {
+	return fc.dirty
+}
+
+// Wait blocks until the checkpoint has ended, and returns the error that stopped it, if any.
+func (fc *FuzzyCheckpoint) Wait() error {
+	<-fc.done
+	return fc.err
+}
+
+// StartCheckpoint begins a fuzzy checkpoint and returns without waiting for it to end.
+// Only one checkpoint is taken at a time; starting one waits for the last to end.
+// Tables should not be created or dropped until the checkpoint has begun.
+func (rm *RecoveryManager) StartCheckpoint() (*FuzzyCheckpoint, error) {
+	rm.checkpointMtx.Lock()
+	base := strings.TrimSuffix(rm.d.GetBasePath(), "/")
+	rm.mtx.Lock()
+	entries, err := ioutil.ReadDir(base)
+	if err != nil {
+		rm.mtx.Unlock()
+		rm.checkpointMtx.Unlock()
+		return nil, err
+	}
+	fc := &FuzzyCheckpoint{
+		dirty: make(map[string][]int64),
+		done:  make(chan struct{}),
+	}
+	tables := make(map[string]db.Index)
+	for name, table := range rm.d.GetTables() {
+		tables[name] = table
+		fc.dirty[name] = table.GetPager().GetDirtyPages()
+	}
+	for id := range rm.txStack {
+		fc.ids = append(fc.ids, id)
+	}
+	bcLog := beginCheckpointLog{ids: fc.ids}
+	err = rm.writeToBuffer(bcLog.toString())
+	rm.mtx.Unlock()
+	if err != nil {
+		rm.checkpointMtx.Unlock()
+		return nil, err
+	}
+	go func() {
+		defer rm.checkpointMtx.Unlock()
+		fc.err = rm.endCheckpoint(base, entries, tables, fc.dirty)
+		close(fc.done)
+	}()
+	return fc, nil
+}
+
+// endCheckpoint copies the database folder into a new snapshot, swaps it in for the last
+// checkpoint's snapshot, then logs the checkpoint's end.
+func (rm *RecoveryManager) endCheckpoint(base string, entries []os.FileInfo, tables map[string]db.Index, dirty map[string][]int64) error {
+	recoveryFolder := base + "-recovery"
+	staging := recoveryFolder + ".tmp"
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(staging, 0775); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		src := filepath.Join(base, entry.Name())
+		dst := filepath.Join(staging, entry.Name())
+		var err error
+		if table, ok := tables[entry.Name()]; ok {
+			err = snapshotTable(table, dirty[entry.Name()], src, dst)
+		} else {
+			err = copy.Copy(src, dst, copy.Options{Sync: true})
+		}
+		// Tables dropped since the checkpoint began are left out; redoing the drop is a no-op.
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// The snapshot must be in place before the end is logged, since recovery trusts any ended checkpoint.
+	old := recoveryFolder + ".old"
+	os.RemoveAll(old)
+	if err := os.Rename(recoveryFolder, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(staging, recoveryFolder); err != nil {
+		return err
+	}
+	os.RemoveAll(old)
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	ecLog := endCheckpointLog{}
+	return rm.writeToBuffer(ecLog.toString())
+}
+
+// snapshotTable copies a table's file into the snapshot. The pages that were dirty when the
+// checkpoint began are flushed first without holding up writers, so that updates to the table
+// are only blocked while the pages dirtied since are flushed and the file is copied.
+func snapshotTable(table db.Index, dirty []int64, src string, dst string) error {
+	pager := table.GetPager()
+	pager.FlushPages(dirty)
+	pager.LockAllUpdates()
+	defer pager.UnlockAllUpdates()
+	pager.FlushAllPages()
+	return copy.Copy(src, dst, copy.Options{Sync: true})
+}
+
+// redoLateEdits redoes the edits logged before a fuzzy checkpoint began by the transactions
+// running at the time. Edits are logged before they are applied, so these may have reached
+// their tables too late to be in the snapshot. Strict locking keeps other transactions off
+// their keys until they end, so redoing them out of turn is safe.
+func (rm *RecoveryManager) redoLateEdits(logs []Log, ids []uuid.UUID, dups map[int]bool, policy ConflictPolicy) error {
+	running := make(map[uuid.UUID]bool)
+	for _, id := range ids {
+		running[id] = true
+	}
+	for pos, log := range logs {
+		if log, ok := log.(*editLog); ok && running[log.id] && !dups[pos] {
+			if err := rm.redoEdits(log.tablename, []*editLog{log}, policy); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
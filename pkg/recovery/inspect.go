@@ -0,0 +1,132 @@
+package recovery
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	uuid "github.com/google/uuid"
+)
+
+// InspectLog prints every record in the log file at the given path in a readable form,
+// numbered by line, then sums up which transactions committed and which were still
+// running when the log ends, and so would be undone by recovery. Unlike recovery, it
+// reads the whole log rather than starting from the last checkpoint. A crash may cut the
+// last record short, so a last line that can't be parsed is reported as torn; any other
+// line that can't be parsed is an error.
+func InspectLog(path string, w io.Writer) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		lines = nil
+	}
+	order := make([]uuid.UUID, 0)         // Transactions in the order they first appear.
+	committed := make(map[uuid.UUID]bool) // Whether each transaction has committed.
+	note := func(id uuid.UUID) {
+		if _, ok := committed[id]; !ok {
+			order = append(order, id)
+			committed[id] = false
+		}
+	}
+	for i, line := range lines {
+		log, err := FromString(line)
+		if err != nil {
+			if i == len(lines)-1 {
+				fmt.Fprintf(w, "%d: TORN %q\n", i+1, line)
+				break
+			}
+			return fmt.Errorf("line %d: %v: %q", i+1, err, line)
+		}
+		fmt.Fprintf(w, "%d: %s\n", i+1, describeLog(log))
+		switch log := log.(type) {
+		case *startLog:
+			note(log.id)
+		case *editLog:
+			note(log.id)
+		case *dropTableLog:
+			if log.id != uuid.Nil {
+				note(log.id)
+			}
+		case *commitLog:
+			note(log.id)
+			committed[log.id] = true
+		case *checkpointLog:
+			for _, id := range log.ids {
+				note(id)
+			}
+		case *beginCheckpointLog:
+			for _, id := range log.ids {
+				note(id)
+			}
+		}
+	}
+	var done, active []string
+	for _, id := range order {
+		if committed[id] {
+			done = append(done, id.String())
+		} else {
+			active = append(active, id.String())
+		}
+	}
+	fmt.Fprintf(w, "committed (%d): %s\n", len(done), strings.Join(done, ", "))
+	fmt.Fprintf(w, "active, to be undone (%d): %s\n", len(active), strings.Join(active, ", "))
+	return nil
+}
+
+// describeLog returns a readable description of the log record.
+func describeLog(log Log) string {
+	switch log := log.(type) {
+	case *tableLog:
+		return fmt.Sprintf("CREATE %s table %s", log.tblType, log.tblName)
+	case *dropTableLog:
+		if log.id == uuid.Nil {
+			return fmt.Sprintf("DROP %s table %s", log.tblType, log.tblName)
+		}
+		return fmt.Sprintf("DROP tx %s: %s table %s", log.id, log.tblType, log.tblName)
+	case *restoreTableLog:
+		if log.id == uuid.Nil {
+			return fmt.Sprintf("RESTORE %s table %s", log.tblType, log.tblName)
+		}
+		return fmt.Sprintf("RESTORE tx %s: %s table %s", log.id, log.tblType, log.tblName)
+	case *startLog:
+		return fmt.Sprintf("START tx %s", log.id)
+	case *commitLog:
+		return fmt.Sprintf("COMMIT tx %s", log.id)
+	case *editLog:
+		seq := "unknown"
+		if log.seq != 0 {
+			seq = fmt.Sprint(log.seq)
+		}
+		return fmt.Sprintf("EDIT tx %s: %s %s key %d, %d -> %d, seq %s",
+			log.id, log.action, log.tablename, log.key, log.oldval, log.newval, seq)
+	case *checkpointLog:
+		return fmt.Sprintf("CHECKPOINT running [%s]", joinUUIDs(log.ids))
+	case *beginCheckpointLog:
+		return fmt.Sprintf("BEGIN CHECKPOINT running [%s]", joinUUIDs(log.ids))
+	case *endCheckpointLog:
+		return "END CHECKPOINT"
+	default:
+		return strings.TrimSpace(log.toString())
+	}
+}
+
+// joinUUIDs returns the ids separated by commas.
+func joinUUIDs(ids []uuid.UUID) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// DumpLog prints the recovery manager's log with InspectLog.
+func (rm *RecoveryManager) DumpLog(w io.Writer) error {
+	// Hold the log's mutex so that no record is caught partway through being written.
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return InspectLog(rm.fd.Name(), w)
+}
@@ -14,7 +14,9 @@ import (
    Logs come in the following forms:
 
    EDIT log -- actions that modify database state;
-   < Tx, table, INSERT|DELETE|UPDATE, key, oldval, newval >
+   < Tx, table, INSERT|DELETE|UPDATE, key, oldval, newval, seq >
+   where seq numbers the transaction's edits from 1. Logs written before
+   sequence numbers were added omit it, and are read with a seq of 0.
 
    START log -- start of a transaction:
    < Tx start >
@@ -24,6 +26,22 @@ import (
 
    CHECKPOINT log -- lists the currently running transactions:
    < Tx1, Tx2... checkpoint >
+
+   FUZZY CHECKPOINT logs -- bracket a checkpoint taken while transactions run;
+   the begin log lists the transactions running when it started:
+   < Tx1, Tx2... begin checkpoint >
+   < end checkpoint >
+
+   DROP log -- drop of a table by a transaction:
+   < Tx, drop btree|hash table name >
+   Logs written before drops were made in transactions omit Tx, and are
+   read as committed drops.
+
+   RESTORE log -- a dropped table brought back by undoing its drop:
+   < Tx, restore btree|hash table name >
+
+   Under UNDO_PAGE_IMAGE, transaction stacks also hold page image logs, which
+   are never written to the log file.
 */
 
 // A log.
@@ -40,14 +58,22 @@ const (
 	DELETE_ACTION = "DELETE"
 )
 
+// Log patterns, compiled once rather than for every log line.
+var (
+	tableExp           = regexp.MustCompile(fmt.Sprintf("< create (?P<tblType>\\w+) table (?P<tblName>\\w+) >"))
+	dropTableExp       = regexp.MustCompile(fmt.Sprintf("< (?:(?P<uuid>%s), )?drop (?P<tblType>\\w+) table (?P<tblName>\\w+) >", uuidPattern))
+	restoreTableExp    = regexp.MustCompile(fmt.Sprintf("< (?:(?P<uuid>%s), )?restore (?P<tblType>\\w+) table (?P<tblName>\\w+) >", uuidPattern))
+	editExp            = regexp.MustCompile(fmt.Sprintf("< (?P<uuid>%s), (?P<table>\\w+), (?P<action>UPDATE|INSERT|DELETE), (?P<key>\\d+), (?P<oldval>\\d+), (?P<newval>\\d+)(?:, (?P<seq>\\d+))? >", uuidPattern))
+	startExp           = regexp.MustCompile(fmt.Sprintf("< (%s) start >", uuidPattern))
+	commitExp          = regexp.MustCompile(fmt.Sprintf("< (%s) commit >", uuidPattern))
+	checkpointExp      = regexp.MustCompile(fmt.Sprintf("< (%s,?\\s)*checkpoint >", uuidPattern))
+	beginCheckpointExp = regexp.MustCompile(fmt.Sprintf("< (%s,?\\s)*begin checkpoint >", uuidPattern))
+	endCheckpointExp   = regexp.MustCompile("< end checkpoint >")
+	uuidExp            = regexp.MustCompile(uuidPattern)
+)
+
 // Convert a textual log to its respective struct.
 func FromString(s string) (Log, error) {
-	tableExp, _ := regexp.Compile(fmt.Sprintf("< create (?P<tblType>\\w+) table (?P<tblName>\\w+) >"))
-	editExp, _ := regexp.Compile(fmt.Sprintf("< (?P<uuid>%s), (?P<table>\\w+), (?P<action>UPDATE|INSERT|DELETE), (?P<key>\\d+), (?P<oldval>\\d+), (?P<newval>\\d+) >", uuidPattern))
-	startExp, _ := regexp.Compile(fmt.Sprintf("< (%s) start >", uuidPattern))
-	commitExp, _ := regexp.Compile(fmt.Sprintf("< (%s) commit >", uuidPattern))
-	checkpointExp, _ := regexp.Compile(fmt.Sprintf("< (%s,?\\s)*checkpoint >", uuidPattern))
-	uuidExp, _ := regexp.Compile(uuidPattern)
 	switch {
 	case tableExp.MatchString(s):
 		expStrs := tableExp.FindStringSubmatch(s)
@@ -57,12 +83,35 @@ func FromString(s string) (Log, error) {
 			tblType: tblType,
 			tblName: tblName,
 		}, nil
+	case dropTableExp.MatchString(s):
+		expStrs := dropTableExp.FindStringSubmatch(s)
+		var id uuid.UUID
+		if expStrs[1] != "" {
+			id = uuid.MustParse(expStrs[1])
+		}
+		return &dropTableLog{
+			id:      id,
+			tblType: expStrs[2],
+			tblName: expStrs[3],
+		}, nil
+	case restoreTableExp.MatchString(s):
+		expStrs := restoreTableExp.FindStringSubmatch(s)
+		var id uuid.UUID
+		if expStrs[1] != "" {
+			id = uuid.MustParse(expStrs[1])
+		}
+		return &restoreTableLog{
+			id:      id,
+			tblType: expStrs[2],
+			tblName: expStrs[3],
+		}, nil
 	case editExp.MatchString(s):
 		expStrs := editExp.FindStringSubmatch(s)
 		uuid := uuid.MustParse(expStrs[1])
 		key, _ := strconv.Atoi(expStrs[4])
 		oldval, _ := strconv.Atoi(expStrs[5])
 		newval, _ := strconv.Atoi(expStrs[6])
+		seq, _ := strconv.Atoi(expStrs[7])
 		return &editLog{
 			id:        uuid,
 			tablename: expStrs[2],
@@ -70,6 +119,7 @@ func FromString(s string) (Log, error) {
 			key:       int64(key),
 			oldval:    int64(oldval),
 			newval:    int64(newval),
+			seq:       int64(seq),
 		}, nil
 	case startExp.MatchString(s):
 		uuid := uuid.MustParse(uuidExp.FindString(s))
@@ -77,13 +127,12 @@ func FromString(s string) (Log, error) {
 	case commitExp.MatchString(s):
 		uuid := uuid.MustParse(uuidExp.FindString(s))
 		return &commitLog{id: uuid}, nil
+	case beginCheckpointExp.MatchString(s):
+		return &beginCheckpointLog{ids: parseUUIDs(s)}, nil
+	case endCheckpointExp.MatchString(s):
+		return &endCheckpointLog{}, nil
 	case checkpointExp.MatchString(s):
-		uuidStrs := uuidExp.FindAllString(s, -1)
-		uuids := make([]uuid.UUID, 0)
-		for _, uuidStr := range uuidStrs {
-			uuids = append(uuids, uuid.MustParse(uuidStr))
-		}
-		return &checkpointLog{ids: uuids}, nil
+		return &checkpointLog{ids: parseUUIDs(s)}, nil
 	default:
 		return nil, errors.New("could not parse log")
 	}
@@ -91,6 +140,15 @@ func FromString(s string) (Log, error) {
 
 var uuidPattern string = "[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}"
 
+// parseUUIDs returns every transaction id in the given log line.
+func parseUUIDs(s string) []uuid.UUID {
+	uuids := make([]uuid.UUID, 0)
+	for _, uuidStr := range uuidExp.FindAllString(s, -1) {
+		uuids = append(uuids, uuid.MustParse(uuidStr))
+	}
+	return uuids
+}
+
 // Log for a transaction edit.
 type tableLog struct {
 	tblType string
@@ -101,6 +159,34 @@ func (tl *tableLog) toString() string {
 	return fmt.Sprintf("< create %s table %s >\n", tl.tblType, tl.tblName)
 }
 
+// Log for a table drop.
+type dropTableLog struct {
+	id      uuid.UUID // Transaction that dropped the table; uuid.Nil if unknown.
+	tblType string
+	tblName string
+}
+
+func (dl *dropTableLog) toString() string {
+	if dl.id == uuid.Nil {
+		return fmt.Sprintf("< drop %s table %s >\n", dl.tblType, dl.tblName)
+	}
+	return fmt.Sprintf("< %s, drop %s table %s >\n", dl.id.String(), dl.tblType, dl.tblName)
+}
+
+// Log for a dropped table being restored.
+type restoreTableLog struct {
+	id      uuid.UUID // Transaction whose drop was undone; uuid.Nil if unknown.
+	tblType string
+	tblName string
+}
+
+func (rl *restoreTableLog) toString() string {
+	if rl.id == uuid.Nil {
+		return fmt.Sprintf("< restore %s table %s >\n", rl.tblType, rl.tblName)
+	}
+	return fmt.Sprintf("< %s, restore %s table %s >\n", rl.id.String(), rl.tblType, rl.tblName)
+}
+
 // Log for a transaction edit.
 type editLog struct {
 	id        uuid.UUID
@@ -109,10 +195,14 @@ type editLog struct {
 	key       int64
 	oldval    int64
 	newval    int64
+	seq       int64 // Position of the edit in its transaction, from 1; 0 if unknown.
 }
 
 func (el *editLog) toString() string {
-	return fmt.Sprintf("< %s, %s, %s, %v, %v, %v >\n", el.id.String(), el.tablename, el.action, el.key, el.oldval, el.newval)
+	if el.seq == 0 {
+		return fmt.Sprintf("< %s, %s, %s, %v, %v, %v >\n", el.id.String(), el.tablename, el.action, el.key, el.oldval, el.newval)
+	}
+	return fmt.Sprintf("< %s, %s, %s, %v, %v, %v, %v >\n", el.id.String(), el.tablename, el.action, el.key, el.oldval, el.newval, el.seq)
 }
 
 // Log for a transaction start.
@@ -148,3 +238,40 @@ func (cl *checkpointLog) toString() string {
 	}
 	return fmt.Sprintf("< %s checkpoint >\n", strings.Join(idStrings, ", "))
 }
+
+// Log for the start of a fuzzy checkpoint.
+type beginCheckpointLog struct {
+	ids []uuid.UUID
+}
+
+func (bl *beginCheckpointLog) toString() string {
+	idStrings := make([]string, 0)
+	for _, id := range bl.ids {
+		idStrings = append(idStrings, id.String())
+	}
+	if len(idStrings) == 0 {
+		return "< begin checkpoint >\n"
+	}
+	return fmt.Sprintf("< %s begin checkpoint >\n", strings.Join(idStrings, ", "))
+}
+
+// Log for the end of a fuzzy checkpoint, once its snapshot is in place.
+type endCheckpointLog struct{}
+
+func (el *endCheckpointLog) toString() string {
+	return "< end checkpoint >\n"
+}
+
+// Log of the bytes a transaction overwrote on a page. Page image logs are only
+// kept in the transaction's stack, for rollback, and are never written to disk.
+type pageImageLog struct {
+	id        uuid.UUID
+	tablename string
+	pagenum   int64
+	offset    int64
+	before    []byte
+}
+
+func (pl *pageImageLog) toString() string {
+	return fmt.Sprintf("< %s, %s, page %v, offset %v, %v bytes >\n", pl.id.String(), pl.tablename, pl.pagenum, pl.offset, len(pl.before))
+}
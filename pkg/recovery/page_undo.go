@@ -0,0 +1,191 @@
+package recovery
+
+import (
+	"fmt"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
+	db "github.com/brown-csci1270/db/pkg/db"
+
+	uuid "github.com/google/uuid"
+)
+
+// An UndoMode decides how Rollback undoes a transaction's edits.
+type UndoMode int
+
+const (
+	UNDO_LOGICAL    UndoMode = 0 // Reissue the inverse of each edit; the default.
+	UNDO_PAGE_IMAGE UndoMode = 1 // Restore the bytes each edit overwrote, where it is safe to.
+)
+
+// Identifies a page of a table.
+type pageKey struct {
+	tablename string
+	pagenum   int64
+}
+
+// SetUndoMode sets how Rollback undoes transactions. It should be set
+// before any transactions start.
+func (rm *RecoveryManager) SetUndoMode(mode UndoMode) error {
+	if mode < UNDO_LOGICAL || mode > UNDO_PAGE_IMAGE {
+		return fmt.Errorf("invalid undo mode %d", mode)
+	}
+	rm.undoMode = mode
+	return nil
+}
+
+// GetUndoMode returns how Rollback undoes transactions.
+func (rm *RecoveryManager) GetUndoMode() UndoMode {
+	return rm.undoMode
+}
+
+// runEdit runs the given edit of the given key on behalf of the transaction. Under
+// UNDO_PAGE_IMAGE, edits to B+ trees run one at a time, and every byte range they
+// overwrite, including those moved by splits, is pushed onto the transaction's stack.
+// Edits to other tables can only be undone logically.
+func (rm *RecoveryManager) runEdit(clientId uuid.UUID, table db.Index, key int64, edit func() error) error {
+	if rm.undoMode != UNDO_PAGE_IMAGE {
+		return edit()
+	}
+	if _, ok := table.(*btree.BTreeIndex); !ok {
+		rm.mtx.Lock()
+		rm.stale[clientId] = true
+		rm.mtx.Unlock()
+		return edit()
+	}
+	// [CONCURRENCY] Take the key's lock before serializing, so that we never wait on
+	// another transaction while holding the capture mutex. If this fails, so will the edit.
+	if err := rm.tm.Lock(clientId, table, key, concurrency.W_LOCK); err != nil {
+		return edit()
+	}
+	rm.captureMtx.Lock()
+	defer rm.captureMtx.Unlock()
+	tablename := table.GetName()
+	table.GetPager().SetUpdateHook(func(pagenum int64, offset int64, before []byte) {
+		rm.pushPageImage(&pageImageLog{
+			id:        clientId,
+			tablename: tablename,
+			pagenum:   pagenum,
+			offset:    offset,
+			before:    before,
+		})
+	})
+	defer table.GetPager().SetUpdateHook(nil)
+	return edit()
+}
+
+// pushPageImage pushes a before-image onto its transaction's stack. Any other running
+// transaction with images of the same page can no longer restore them, since doing
+// so would clobber this write.
+func (rm *RecoveryManager) pushPageImage(log *pageImageLog) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	key := pageKey{tablename: log.tablename, pagenum: log.pagenum}
+	writers, ok := rm.pageWriters[key]
+	if !ok {
+		writers = make(map[uuid.UUID]bool)
+		rm.pageWriters[key] = writers
+	}
+	for id := range writers {
+		if id != log.id {
+			rm.stale[id] = true
+		}
+	}
+	writers[log.id] = true
+	rm.txStack[log.id] = append(rm.txStack[log.id], log)
+}
+
+// forgetPageImages drops the transaction from the page writers. Expects rm.mtx to be locked.
+func (rm *RecoveryManager) forgetPageImages(clientId uuid.UUID) {
+	for _, log := range rm.txStack[clientId] {
+		if image, ok := log.(*pageImageLog); ok {
+			key := pageKey{tablename: image.tablename, pagenum: image.pagenum}
+			delete(rm.pageWriters[key], clientId)
+			if len(rm.pageWriters[key]) == 0 {
+				delete(rm.pageWriters, key)
+			}
+		}
+	}
+	delete(rm.stale, clientId)
+}
+
+// popEdits removes the transaction's last n edit logs from its stack,
+// keeping any page images pushed after them.
+func (rm *RecoveryManager) popEdits(clientId uuid.UUID, n int) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	stack := rm.txStack[clientId]
+	kept := make([]Log, 0, len(stack))
+	for i := len(stack) - 1; i >= 0; i-- {
+		if _, ok := stack[i].(*editLog); ok && n > 0 {
+			n -= 1
+			continue
+		}
+		kept = append(kept, stack[i])
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	rm.txStack[clientId] = kept
+}
+
+// restorePageImages rolls back the given transaction logs by copying each page
+// image back in, newest first, and returns false without changing anything if
+// the images can't be safely restored. Pages allocated by the transaction are
+// zeroed and left unreachable rather than freed.
+func (rm *RecoveryManager) restorePageImages(clientId uuid.UUID, logs []Log) (bool, error) {
+	rm.captureMtx.Lock()
+	defer rm.captureMtx.Unlock()
+	rm.mtx.Lock()
+	stale := rm.stale[clientId]
+	rm.mtx.Unlock()
+	if stale {
+		return false, nil
+	}
+	// Look up every page before changing any, so that a missing table can't leave a partial rollback.
+	tables := make(map[string]db.Index)
+	for _, log := range logs {
+		if image, ok := log.(*pageImageLog); ok {
+			if _, ok := tables[image.tablename]; ok {
+				continue
+			}
+			table, err := rm.d.GetTable(image.tablename)
+			if err != nil {
+				return false, nil
+			}
+			tables[image.tablename] = table
+		}
+	}
+	// Log the inverse of each edit, so that redo reaches the same state after a crash.
+	rm.mtx.Lock()
+	for i := len(logs) - 1; i > 0; i-- {
+		if log, ok := logs[i].(*editLog); ok {
+			inverse := editLog{id: clientId, tablename: log.tablename, key: log.key, oldval: log.newval, newval: log.oldval, seq: rm.nextSeq(clientId)}
+			switch log.action {
+			case INSERT_ACTION:
+				inverse.action = DELETE_ACTION
+			case UPDATE_ACTION:
+				inverse.action = UPDATE_ACTION
+			case DELETE_ACTION:
+				inverse.action = INSERT_ACTION
+			}
+			rm.writeToBuffer(inverse.toString())
+		}
+	}
+	rm.mtx.Unlock()
+	for i := len(logs) - 1; i > 0; i-- {
+		image, ok := logs[i].(*pageImageLog)
+		if !ok {
+			continue
+		}
+		page, err := tables[image.tablename].GetPager().GetPage(image.pagenum)
+		if err != nil {
+			return false, err
+		}
+		page.WLock()
+		page.Update(image.before, image.offset, int64(len(image.before)))
+		page.WUnlock()
+		page.Put()
+	}
+	return true, nil
+}
@@ -20,17 +20,19 @@ func (rm *RecoveryManager) getRelevantStrings() (
 	startTarget := []byte("start")
 	relevantStrings = make([]string, 0)
 	checkpointHit := false
+	ended := false // Whether a fuzzy checkpoint's end has been seen.
 	txs := make(map[uuid.UUID]bool)
 	for {
 		line, _, err := scanner.LineBytes()
 		if err != nil {
 			if err == io.EOF {
-				return relevantStrings, 0, nil
+				return reverseStrings(relevantStrings), 0, nil
 			} else {
 				return nil, 0, err
 			}
 		}
-		relevantStrings = append([]string{string(line)}, relevantStrings...)
+		// Lines are collected newest-first, then reversed once we're done.
+		relevantStrings = append(relevantStrings, string(line))
 		checkpointPos += 1
 		if checkpointHit {
 			if bytes.Contains(line, startTarget) {
@@ -43,21 +45,40 @@ func (rm *RecoveryManager) getRelevantStrings() (
 			}
 		}
 		if !checkpointHit && bytes.Contains(line, checkpointTarget) {
-			checkpointHit = true
 			log, err := FromString(string(line))
 			if err != nil {
 				return nil, 0, err
 			}
-			for _, tx := range log.(*checkpointLog).ids {
-				txs[tx] = true
+			var ids []uuid.UUID
+			switch log := log.(type) {
+			case *checkpointLog:
+				checkpointHit, ids = true, log.ids
+			case *endCheckpointLog:
+				ended = true
+			case *beginCheckpointLog:
+				// A fuzzy checkpoint that never ended has no snapshot to recover from.
+				checkpointHit, ids = ended, log.ids
+			}
+			if checkpointHit {
+				for _, tx := range ids {
+					txs[tx] = true
+				}
+				checkpointPos = 0
 			}
-			checkpointPos = 0
 		}
 		if checkpointHit && len(txs) <= 0 {
 			break
 		}
 	}
-	return relevantStrings, checkpointPos, err
+	return reverseStrings(relevantStrings), checkpointPos, err
+}
+
+// reverseStrings reverses the given slice in place and returns it.
+func reverseStrings(strs []string) []string {
+	for i, j := 0, len(strs)-1; i < j; i, j = i+1, j-1 {
+		strs[i], strs[j] = strs[j], strs[i]
+	}
+	return strs
 }
 
 func (rm *RecoveryManager) readLogs() (
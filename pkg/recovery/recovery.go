@@ -3,12 +3,15 @@ package recovery
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
 	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
 	db "github.com/brown-csci1270/db/pkg/db"
+	utils "github.com/brown-csci1270/db/pkg/utils"
 	"github.com/otiai10/copy"
 
 	uuid "github.com/google/uuid"
@@ -19,10 +22,29 @@ type RecoveryManager struct {
 	d       *db.Database
 	tm      *concurrency.TransactionManager
 	txStack map[uuid.UUID]([]Log)
+	seqs    map[uuid.UUID]int64 // Sequence number of each running transaction's last edit.
 	fd      *os.File
 	mtx     sync.Mutex
+	policy  ConflictPolicy
+
+	checkpointMtx sync.Mutex // Held while a checkpoint is being taken.
+
+	undoMode    UndoMode
+	captureMtx  sync.Mutex                     // Serializes edits whose page images are being captured.
+	pageWriters map[pageKey]map[uuid.UUID]bool // Running transactions with images of each page.
+	stale       map[uuid.UUID]bool             // Transactions whose images can no longer be restored.
 }
 
+// A ConflictPolicy decides what redo does with an edit whose effect is already
+// present in the table: an insert of an existing key, or an update or delete of a missing key.
+type ConflictPolicy int
+
+const (
+	CONFLICT_OVERWRITE ConflictPolicy = 0 // Force the edit's new value; the default.
+	CONFLICT_SKIP      ConflictPolicy = 1 // Leave the table as it is.
+	CONFLICT_ERROR     ConflictPolicy = 2 // Fail the redo.
+)
+
 // Construct a recovery manager.
 func NewRecoveryManager(
 	d *db.Database,
@@ -34,13 +56,30 @@ func NewRecoveryManager(
 		return nil, err
 	}
 	return &RecoveryManager{
-		d:       d,
-		tm:      tm,
-		txStack: make(map[uuid.UUID][]Log),
-		fd:      fd,
+		d:           d,
+		tm:          tm,
+		txStack:     make(map[uuid.UUID][]Log),
+		seqs:        make(map[uuid.UUID]int64),
+		fd:          fd,
+		pageWriters: make(map[pageKey]map[uuid.UUID]bool),
+		stale:       make(map[uuid.UUID]bool),
 	}, nil
 }
 
+// SetConflictPolicy sets how redo treats edits that are already applied.
+func (rm *RecoveryManager) SetConflictPolicy(policy ConflictPolicy) error {
+	if policy < CONFLICT_OVERWRITE || policy > CONFLICT_ERROR {
+		return fmt.Errorf("invalid conflict policy %d", policy)
+	}
+	rm.policy = policy
+	return nil
+}
+
+// GetConflictPolicy returns how redo treats edits that are already applied.
+func (rm *RecoveryManager) GetConflictPolicy() ConflictPolicy {
+	return rm.policy
+}
+
 // Write the string `s` to the log file. Expects rm.mtx to be locked
 func (rm *RecoveryManager) writeToBuffer(s string) error {
 	_, err := rm.fd.WriteString(s)
@@ -62,6 +101,32 @@ func (rm *RecoveryManager) Table(tblType string, tblName string) {
 	rm.writeToBuffer(tbLog.toString())
 }
 
+// Write a drop table log for the given table, which must exist, as part of the given
+// client's transaction, so that the drop is undone if the transaction is rolled back.
+func (rm *RecoveryManager) DropTable(clientId uuid.UUID, tblName string) error {
+	table, err := rm.d.GetTable(tblName)
+	if err != nil {
+		return err
+	}
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	if _, ok := rm.txStack[clientId]; !ok {
+		return errors.New("transaction not found")
+	}
+	dtLog := dropTableLog{
+		id:      clientId,
+		tblType: db.IndexTypeName(table),
+		tblName: tblName,
+	}
+	if err = rm.writeToBuffer(dtLog.toString()); err != nil {
+		return err
+	}
+	rm.txStack[clientId] = append(rm.txStack[clientId], &dtLog)
+	// The table's pages go with it, so its page images can't be restored.
+	rm.stale[clientId] = true
+	return nil
+}
+
 // Write an Edit log.
 func (rm *RecoveryManager) Edit(clientId uuid.UUID, table db.Index, action Action, key int64, oldval int64, newval int64) {
 	rm.mtx.Lock()
@@ -73,11 +138,18 @@ func (rm *RecoveryManager) Edit(clientId uuid.UUID, table db.Index, action Actio
 		key:       key,
 		oldval:    oldval,
 		newval:    newval,
+		seq:       rm.nextSeq(clientId),
 	}
 	rm.writeToBuffer(edLog.toString())
 	rm.txStack[clientId] = append(rm.txStack[clientId], &edLog)
 }
 
+// nextSeq returns the sequence number of the transaction's next edit. Expects rm.mtx to be locked.
+func (rm *RecoveryManager) nextSeq(clientId uuid.UUID) int64 {
+	rm.seqs[clientId] += 1
+	return rm.seqs[clientId]
+}
+
 // Write a transaction start log.
 func (rm *RecoveryManager) Start(clientId uuid.UUID) {
 	rm.mtx.Lock()
@@ -87,6 +159,7 @@ func (rm *RecoveryManager) Start(clientId uuid.UUID) {
 	}
 	rm.writeToBuffer(stLog.toString())
 	rm.txStack[clientId] = []Log{&stLog}
+	rm.seqs[clientId] = 0
 }
 
 // Write a transaction commit log.
@@ -96,26 +169,54 @@ func (rm *RecoveryManager) Commit(clientId uuid.UUID) {
 	cmLog := commitLog{
 		id: clientId,
 	}
+	rm.forgetPageImages(clientId)
 	delete(rm.txStack, clientId)
+	delete(rm.seqs, clientId)
 	rm.writeToBuffer(cmLog.toString())
 }
 
 // Flush all pages to disk and write a checkpoint log.
-func (rm *RecoveryManager) Checkpoint() {
+// Returns the transactions that were active at the checkpoint.
+func (rm *RecoveryManager) Checkpoint() ([]uuid.UUID, error) {
+	rm.checkpointMtx.Lock()
+	defer rm.checkpointMtx.Unlock()
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
 	tables := rm.d.GetTables()
 	for _, idx := range tables {
-		idx.GetPager().LockAllUpdates()
-		idx.GetPager().FlushAllPages()
-		idx.GetPager().UnlockAllUpdates()
+		p := idx.GetPager()
+		p.LockAllUpdates()
+		p.FlushAllPages()
+		// Make the flushed pages durable before logging the checkpoint.
+		err := p.SyncFile()
+		p.UnlockAllUpdates()
+		if err != nil {
+			return nil, err
+		}
 	}
 	ckLog := checkpointLog{}
 	for id := range rm.txStack {
 		ckLog.ids = append(ckLog.ids, id)
 	}
-	rm.writeToBuffer(ckLog.toString())
-	rm.Delta() // Sorta-semi-pseudo-copy-on-write (to ensure db recoverability)
+	if err := rm.writeToBuffer(ckLog.toString()); err != nil {
+		return nil, err
+	}
+	// Sorta-semi-pseudo-copy-on-write (to ensure db recoverability)
+	if err := rm.Delta(); err != nil {
+		return nil, err
+	}
+	return ckLog.ids, nil
+}
+
+// LogSize returns the size of the log file in bytes.
+func (rm *RecoveryManager) LogSize() (int64, error) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	info, err := rm.fd.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
 }
 
 // Redo a given log's action.
@@ -127,43 +228,105 @@ func (rm *RecoveryManager) Redo(log Log) error {
 		if err != nil {
 			return err
 		}
-	case *editLog:
-		switch log.action {
-		case INSERT_ACTION:
-			payload := fmt.Sprintf("insert %v %v into %s", log.key, log.newval, log.tablename)
-			err := db.HandleInsert(rm.d, payload)
-			if err != nil {
-				// There is already an entry, try updating
-				payload := fmt.Sprintf("update %s %v %v", log.tablename, log.key, log.newval)
-				err = db.HandleUpdate(rm.d, payload)
-				if err != nil {
-					return err
-				}
-			}
-		case UPDATE_ACTION:
-			payload := fmt.Sprintf("update %s %v %v", log.tablename, log.key, log.newval)
-			err := db.HandleUpdate(rm.d, payload)
-			if err != nil {
-				// Entry may have been deleted, try inserting
-				payload := fmt.Sprintf("insert %v %v into %s", log.key, log.newval, log.tablename)
-				err := db.HandleInsert(rm.d, payload)
-				if err != nil {
-					return err
-				}
-			}
-		case DELETE_ACTION:
-			payload := fmt.Sprintf("delete %v from %s", log.key, log.tablename)
-			err := db.HandleDelete(rm.d, payload)
-			if err != nil {
-				return err
-			}
+	case *dropTableLog:
+		// The table may already be gone, if it was dropped before the checkpoint.
+		if _, err := rm.d.GetTable(log.tblName); err != nil {
+			return nil
 		}
+		return rm.d.DropTable(log.tblName)
+	case *restoreTableLog:
+		_, err := rm.restoreTable(log.tblType, log.tblName)
+		return err
+	case *editLog:
+		return rm.redoEdits(log.tablename, []*editLog{log}, rm.policy)
 	default:
 		return errors.New("can only redo edit logs")
 	}
 	return nil
 }
 
+// redoEdits reapplies a run of edits to the same table directly through its index,
+// rather than formatting and re-parsing a payload for each edit. Every edit is
+// attempted; the first error encountered is returned.
+func (rm *RecoveryManager) redoEdits(tablename string, logs []*editLog, policy ConflictPolicy) (err error) {
+	table, err := rm.d.GetTable(tablename)
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		if editErr := redoEdit(table, log, policy); editErr != nil && err == nil {
+			err = editErr
+		}
+	}
+	return err
+}
+
+// redoEdit reapplies a single edit to the given table, resolving conflicts with the given policy.
+func redoEdit(table db.Index, log *editLog, policy ConflictPolicy) error {
+	// Overwriting inserts and updates don't need to know whether the entry exists.
+	if policy == CONFLICT_OVERWRITE && log.action != DELETE_ACTION {
+		return upsert(table, log.key, log.newval)
+	}
+	exists, err := containsKey(table, log.key)
+	if err != nil {
+		return err
+	}
+	switch log.action {
+	case INSERT_ACTION:
+		if !exists {
+			return table.Insert(log.key, log.newval)
+		}
+	case UPDATE_ACTION:
+		if exists {
+			return table.Update(log.key, log.newval)
+		}
+	case DELETE_ACTION:
+		if exists {
+			return table.Delete(log.key)
+		}
+		// The entry is already gone, which is all that overwriting could achieve.
+		if policy == CONFLICT_OVERWRITE {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown action %s", log.action)
+	}
+	if policy == CONFLICT_ERROR {
+		return fmt.Errorf("redo conflict: %s of key %d in table %s is already applied", log.action, log.key, log.tablename)
+	}
+	return nil
+}
+
+// upserter is implemented by indexes that can insert or update an entry in one operation.
+type upserter interface {
+	Upsert(int64, int64) error
+}
+
+// upsert inserts the given entry into the table, or updates it if it already exists.
+func upsert(table db.Index, key int64, value int64) error {
+	if u, ok := table.(upserter); ok {
+		return u.Upsert(key, value)
+	}
+	exists, err := containsKey(table, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return table.Update(key, value)
+	}
+	return table.Insert(key, value)
+}
+
+// containsKey checks whether the table has an entry with the given key. Only a missing
+// key counts as absent; any other error from the lookup is returned.
+func containsKey(table db.Index, key int64) (bool, error) {
+	_, err := table.Find(key)
+	if errors.Is(err, utils.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // Undo a given log's action.
 func (rm *RecoveryManager) Undo(log Log) error {
 	switch log := log.(type) {
@@ -188,27 +351,108 @@ func (rm *RecoveryManager) Undo(log Log) error {
 				return err
 			}
 		}
+	case *dropTableLog:
+		restored, err := rm.restoreTable(log.tblType, log.tblName)
+		if err != nil || !restored {
+			return err
+		}
+		// Log the restore, as edits are logged when undone, so that redo doesn't leave the table dropped.
+		rm.mtx.Lock()
+		defer rm.mtx.Unlock()
+		rtLog := restoreTableLog{
+			id:      log.id,
+			tblType: log.tblType,
+			tblName: log.tblName,
+		}
+		return rm.writeToBuffer(rtLog.toString())
 	default:
-		return errors.New("can only undo edit logs")
+		return errors.New("can only undo edit and drop table logs")
 	}
 	return nil
 }
 
+// restoreTable recreates a dropped table from its copy in the last checkpoint's snapshot,
+// or as an empty table if it was created after the checkpoint, and returns whether it had
+// to. A table that still exists is left as it is.
+func (rm *RecoveryManager) restoreTable(tblType string, tblName string) (bool, error) {
+	if _, err := rm.d.GetTable(tblName); err == nil {
+		return false, nil
+	}
+	snapshot := filepath.Join(strings.TrimSuffix(rm.d.GetBasePath(), "/")+"-recovery", tblName)
+	if _, err := os.Stat(snapshot); err != nil {
+		payload := fmt.Sprintf("create %s table %s", tblType, tblName)
+		return true, db.HandleCreateTable(rm.d, payload, ioutil.Discard)
+	}
+	path := filepath.Join(rm.d.GetBasePath(), tblName)
+	// Copy back every file that DropTable removes, where the snapshot has one.
+	for _, suffix := range []string{"", ".meta", db.SCHEMA_SUFFIX, db.TUPLES_SUFFIX, db.STATS_SUFFIX} {
+		if _, err := os.Stat(snapshot + suffix); err != nil {
+			continue
+		}
+		if err := copy.Copy(snapshot+suffix, path+suffix); err != nil {
+			return true, err
+		}
+	}
+	_, err := rm.d.GetTable(tblName)
+	return true, err
+}
+
 // Do a full recovery to the most recent checkpoint on startup.
 func (rm *RecoveryManager) Recover() error {
 	logs, pos, err := rm.readLogs()
 	if err != nil {
 		return err
 	}
+	dups, lastSeqs, err := findDuplicateEdits(logs)
+	if err != nil {
+		return err
+	}
 	actives := make(map[uuid.UUID]bool)
+	// Edits logged before a fuzzy checkpoint ended may already be in its snapshot,
+	// so they are redone without failing on conflicts.
+	policy := rm.policy
+	if pos < len(logs) {
+		if begin, ok := logs[pos].(*beginCheckpointLog); ok {
+			if policy == CONFLICT_ERROR {
+				policy = CONFLICT_SKIP
+			}
+			if err = rm.redoLateEdits(logs[:pos], begin.ids, dups, policy); err != nil {
+				return err
+			}
+		}
+	}
 	for pos < len(logs) {
 		log := logs[pos]
 		switch log := log.(type) {
 		case *tableLog:
 			rm.Redo(log)
-		case *editLog:
-			actives[log.id] = true
+		case *restoreTableLog:
 			rm.Redo(log)
+		case *dropTableLog:
+			// A drop that is never committed would only be undone, so the table is kept instead.
+			if log.id == uuid.Nil || committedAfter(logs, pos, log.id) {
+				rm.Redo(log)
+			} else {
+				actives[log.id] = true
+			}
+		case *editLog:
+			// Redo the whole run of consecutive edits to this table at once.
+			batch := make([]*editLog, 0)
+			for pos < len(logs) {
+				next, ok := logs[pos].(*editLog)
+				if !ok || next.tablename != log.tablename {
+					break
+				}
+				actives[next.id] = true
+				if !dups[pos] {
+					batch = append(batch, next)
+				}
+				pos += 1
+			}
+			if err = rm.redoEdits(log.tablename, batch, policy); err != nil {
+				return err
+			}
+			continue
 		case *startLog:
 			actives[log.id] = true
 			rm.tm.Begin(log.id)
@@ -220,14 +464,31 @@ func (rm *RecoveryManager) Recover() error {
 				actives[id] = true
 				rm.tm.Begin(id)
 			}
+		case *beginCheckpointLog:
+			for _, id := range log.ids {
+				actives[id] = true
+				rm.tm.Begin(id)
+			}
+		case *endCheckpointLog:
+			policy = rm.policy
 		}
 		pos += 1
 	}
+	// Number the undo edits after the ones being undone, so they aren't taken for duplicates.
+	rm.mtx.Lock()
+	for id := range actives {
+		rm.seqs[id] = lastSeqs[id]
+	}
+	rm.mtx.Unlock()
 	pos = len(logs) - 1
 	for pos >= 0 {
 		log := logs[pos]
 		switch log := log.(type) {
 		case *editLog:
+			if _, ok := actives[log.id]; ok && !dups[pos] {
+				rm.Undo(log)
+			}
+		case *dropTableLog:
 			if _, ok := actives[log.id]; ok {
 				rm.Undo(log)
 			}
@@ -240,6 +501,79 @@ func (rm *RecoveryManager) Recover() error {
 		}
 		pos -= 1
 	}
+	return rm.recomputeCounts()
+}
+
+// committedAfter returns whether the given transaction commits after the log at pos.
+func committedAfter(logs []Log, pos int, id uuid.UUID) bool {
+	for _, log := range logs[pos+1:] {
+		if commit, ok := log.(*commitLog); ok && commit.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// findDuplicateEdits returns the positions of edits that repeat an earlier edit of
+// the same transaction, as happens when an edit is logged again after a crash, and
+// the last sequence number each transaction used. Edits without a sequence number
+// are never duplicates; two different edits with the same one are an error.
+// A start record for a transaction that never committed begins a retry of it rather
+// than a new transaction, so the retry's edits are checked against the earlier run's.
+func findDuplicateEdits(logs []Log) (dups map[int]bool, lastSeqs map[uuid.UUID]int64, err error) {
+	dups = make(map[int]bool)
+	lastSeqs = make(map[uuid.UUID]int64)
+	seen := make(map[uuid.UUID]map[int64]*editLog)
+	running := make(map[uuid.UUID]bool)
+	for pos, log := range logs {
+		switch log := log.(type) {
+		case *startLog:
+			// Sequence numbers start over with each new transaction, but not with a retry.
+			if !running[log.id] {
+				delete(seen, log.id)
+				delete(lastSeqs, log.id)
+			}
+			running[log.id] = true
+		case *commitLog:
+			delete(running, log.id)
+		case *editLog:
+			if log.seq == 0 {
+				continue
+			}
+			if seen[log.id] == nil {
+				seen[log.id] = make(map[int64]*editLog)
+			}
+			if prev, ok := seen[log.id][log.seq]; ok {
+				if *prev != *log {
+					return nil, nil, fmt.Errorf("transaction %s logged two different edits with sequence number %d", log.id, log.seq)
+				}
+				dups[pos] = true
+				continue
+			}
+			seen[log.id][log.seq] = log
+			if log.seq > lastSeqs[log.id] {
+				lastSeqs[log.id] = log.seq
+			}
+		}
+	}
+	return dups, lastSeqs, nil
+}
+
+// countRecomputer is implemented by indexes that cache their entry count outside
+// of their data pages, which may be stale after a crash.
+type countRecomputer interface {
+	RecomputeCount() error
+}
+
+// recomputeCounts resets the cached entry count of every open table after recovery.
+func (rm *RecoveryManager) recomputeCounts() error {
+	for _, table := range rm.d.GetTables() {
+		if c, ok := table.(countRecomputer); ok {
+			if err := c.RecomputeCount(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -261,15 +595,31 @@ func (rm *RecoveryManager) Rollback(clientId uuid.UUID) error {
 		return errors.New("transactions logs are not well formed")
 	}
 	for _, log := range logs {
+		if _, ok := log.(*pageImageLog); ok {
+			continue
+		}
 		_, err := FromString(log.toString())
 		if err != nil {
 			return err
 		}
 	}
+	if rm.undoMode == UNDO_PAGE_IMAGE {
+		restored, err := rm.restorePageImages(clientId, logs)
+		if err != nil {
+			return err
+		}
+		if restored {
+			rm.Commit(clientId)
+			return rm.tm.Commit(clientId)
+		}
+	}
 	i := len(logs) - 1
 	for i > 0 {
 		log := logs[i]
-		rm.Undo(log)
+		switch log.(type) {
+		case *editLog, *dropTableLog:
+			rm.Undo(log)
+		}
 		i -= 1
 	}
 	rm.Commit(clientId)
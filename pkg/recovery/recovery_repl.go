@@ -18,9 +18,13 @@ import (
 // Recovery REPL.
 func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager) *repl.REPL {
 	r := repl.NewRepl()
+	r.SetName("recovery")
 	r.AddCommand("create", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCreateTable(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Create a table. usage: create table <table>")
+	r.AddCommand("drop", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleDropTable(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
+	}, "Drop a table and delete its files. usage: drop table <table>")
 	r.AddCommand("find", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleFind(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Find an element. usage: find <key> from <table>")
@@ -47,19 +51,67 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	}, "Grabs a write lock on a resource. usage: lock <table> <key>")
 	r.AddCommand("checkpoint", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCheckpoint(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Simulate an abort of the current transaction. usage: abort")
+	}, "Flush all pages and log a checkpoint, then report the log size and active transactions. A fuzzy checkpoint doesn't block other clients. usage: checkpoint [fuzzy]")
 	r.AddCommand("abort", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleAbort(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Simulate an abort of the current transaction. usage: abort")
 	r.AddCommand("crash", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCrash(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Crash the database. usage: crash")
+	r.AddCommand("log", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleLog(rm, payload, replConfig.GetWriter())
+	}, "Print every record in the log, then the transactions that recovery would undo. usage: log")
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(d, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
+	r.SetBlockHandler(func(statements []string, replConfig *repl.REPLConfig) error {
+		return HandleBlock(d, tm, rm, r, statements, replConfig)
+	})
 	return r
 }
 
+// Commands that end or abandon the running transaction, so can't appear in a block.
+var blockForbidden = map[string]bool{"transaction": true, "abort": true, "crash": true}
+
+// HandleBlock runs the statements of a `begin;` ... `commit;` block in one transaction,
+// rolling every one of them back if any fails.
+func HandleBlock(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, r *repl.REPL, statements []string, replConfig *repl.REPLConfig) (err error) {
+	clientId := replConfig.GetAddr()
+	if _, found := tm.GetTransaction(clientId); found {
+		return errors.New("block error: a transaction is already running")
+	}
+	// Check every statement before starting, so that a typo doesn't cost a rollback.
+	commands := r.GetCommands()
+	for i, statement := range statements {
+		fields := strings.Fields(statement)
+		if len(fields) == 0 {
+			return fmt.Errorf("block error: statement %d is empty", i+1)
+		}
+		if _, found := commands[fields[0]]; !found || blockForbidden[fields[0]] {
+			return fmt.Errorf("block error: statement %d: %s can't be run in a block", i+1, fields[0])
+		}
+	}
+	if err = HandleTransaction(d, tm, rm, "transaction begin", replConfig.GetWriter(), clientId); err != nil {
+		return err
+	}
+	for i, statement := range statements {
+		if err = r.Exec(statement, replConfig); err != nil {
+			// Statements that fail may already have rolled the transaction back.
+			if _, found := tm.GetTransaction(clientId); found {
+				if rberr := rm.Rollback(clientId); rberr != nil {
+					return rberr
+				}
+			}
+			return fmt.Errorf("block aborted at statement %d (%s): %v", i+1, statement, err)
+		}
+	}
+	if err = HandleTransaction(d, tm, rm, "transaction commit", replConfig.GetWriter(), clientId); err != nil {
+		return err
+	}
+	io.WriteString(replConfig.GetWriter(), fmt.Sprintf("block committed: %d statements\n", len(statements)))
+	return nil
+}
+
 // Handle transaction.
 func HandleTransaction(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
@@ -99,6 +151,34 @@ func HandleCreateTable(d *db.Database, tm *concurrency.TransactionManager, rm *R
 	return db.HandleCreateTable(d, payload, w)
 }
 
+// Handle drop table.
+func HandleDropTable(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: drop table <table>
+	if numFields != 3 || fields[1] != "table" {
+		return fmt.Errorf("usage: drop table <table>")
+	}
+	table, err := d.GetTable(fields[2])
+	if err != nil {
+		return fmt.Errorf("drop error: %v", err)
+	}
+	// Keep every other transaction out of the table before it goes.
+	if err = tm.LockTable(clientId, table); err != nil {
+		return fmt.Errorf("drop error: %v", err)
+	}
+	if err = rm.DropTable(clientId, fields[2]); err != nil {
+		return fmt.Errorf("drop error: %v", err)
+	}
+	if err = db.HandleDropTable(d, payload, w); err != nil {
+		rberr := rm.Rollback(clientId)
+		if rberr != nil {
+			return rberr
+		}
+	}
+	return err
+}
+
 // Handle find.
 func HandleFind(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	return concurrency.HandleFind(d, tm, payload, w, clientId)
@@ -131,14 +211,15 @@ func HandleInsert(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	// Log.
 	rm.Edit(clientId, table, INSERT_ACTION, int64(key), 0, int64(newval))
 	// Run transaction insert.
-	err = concurrency.HandleInsert(d, tm, payload, clientId)
+	err = rm.runEdit(clientId, table, int64(key), func() error {
+		return concurrency.HandleInsert(d, tm, payload, clientId)
+	})
 	if err != nil {
 		// Add a log to mark this insert as a no-op.
 		rm.Edit(clientId, table, DELETE_ACTION, int64(key), int64(newval), int64(0))
 		// Then pop the last two actions from the transaction stack because
 		// these last two actions were no-ops.
-		stack := rm.txStack[clientId]
-		rm.txStack[clientId] = stack[:len(stack)-2]
+		rm.popEdits(clientId, 2)
 		rberr := rm.Rollback(clientId)
 		if rberr != nil {
 			return rberr
@@ -174,14 +255,15 @@ func HandleUpdate(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	// Log.
 	rm.Edit(clientId, table, UPDATE_ACTION, int64(key), oldval.GetValue(), int64(newval))
 	// Run transaction insert.
-	err = concurrency.HandleUpdate(d, tm, payload, clientId)
+	err = rm.runEdit(clientId, table, int64(key), func() error {
+		return concurrency.HandleUpdate(d, tm, payload, clientId)
+	})
 	if err != nil {
 		// Add a log to mark this update as a no-op.
 		rm.Edit(clientId, table, UPDATE_ACTION, int64(key), int64(newval), oldval.GetValue())
 		// Then pop the last two actions from the transaction stack because
 		// these last two actions were no-ops.
-		stack := rm.txStack[clientId]
-		rm.txStack[clientId] = stack[:len(stack)-2]
+		rm.popEdits(clientId, 2)
 		rberr := rm.Rollback(clientId)
 		if rberr != nil {
 			return rberr
@@ -214,14 +296,15 @@ func HandleDelete(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	// Log.
 	rm.Edit(clientId, table, DELETE_ACTION, int64(key), oldval.GetValue(), 0)
 	// Run transaction insert.
-	err = concurrency.HandleDelete(d, tm, payload, clientId)
+	err = rm.runEdit(clientId, table, int64(key), func() error {
+		return concurrency.HandleDelete(d, tm, payload, clientId)
+	})
 	if err != nil {
 		// Add a log to mark this delete as a no-op.
 		rm.Edit(clientId, table, INSERT_ACTION, int64(key), 0, oldval.GetValue())
 		// Then pop the last two actions from the transaction stack because
 		// these last two actions were no-ops.
-		stack := rm.txStack[clientId]
-		rm.txStack[clientId] = stack[:len(stack)-2]
+		rm.popEdits(clientId, 2)
 		rberr := rm.Rollback(clientId)
 		if rberr != nil {
 			return rberr
@@ -265,13 +348,30 @@ func HandleLock(d *db.Database, tm *concurrency.TransactionManager, payload stri
 func HandleCheckpoint(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: checkpoint
-	if numFields != 1 {
-		return fmt.Errorf("usage: checkpoint")
+	// Usage: checkpoint [fuzzy]
+	if numFields > 2 || (numFields == 2 && fields[1] != "fuzzy") {
+		return fmt.Errorf("usage: checkpoint [fuzzy]")
 	}
-	// Get the transaction, run the find, release lock and rollback if error.
-	rm.Checkpoint()
-	return err
+	// Checkpoint, then report how much log there is and how many transactions it still covers.
+	var active []uuid.UUID
+	if numFields == 2 {
+		fc, err := rm.StartCheckpoint()
+		if err != nil {
+			return err
+		}
+		if err = fc.Wait(); err != nil {
+			return err
+		}
+		active = fc.GetActive()
+	} else if active, err = rm.Checkpoint(); err != nil {
+		return err
+	}
+	size, err := rm.LogSize()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "checkpoint: log is %d bytes, %d active transactions\n", size, len(active))
+	return nil
 }
 
 // Handle abort.
@@ -302,6 +402,17 @@ func HandleCrash(d *db.Database, tm *concurrency.TransactionManager, rm *Recover
 	panic("it's the end of the world!")
 }
 
+// Handle printing the log.
+func HandleLog(rm *RecoveryManager, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: log
+	if numFields != 1 {
+		return fmt.Errorf("usage: log")
+	}
+	return rm.DumpLog(w)
+}
+
 // Handle pretty printing.
 func HandlePretty(d *db.Database, payload string, w io.Writer) (err error) {
 	return db.HandlePretty(d, payload, w)
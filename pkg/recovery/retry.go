@@ -0,0 +1,52 @@
+package recovery
+
+import (
+	"errors"
+	"time"
+
+	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
+	uuid "github.com/google/uuid"
+)
+
+// Number of times RunTransaction reruns an aborted transaction before giving up.
+var MAX_TRANSACTION_RETRIES = 5
+
+// How long RunTransaction waits before its first rerun; the wait doubles with each rerun.
+var TRANSACTION_BACKOFF = 10 * time.Millisecond
+
+// RunTransaction runs fn in a new transaction, and commits it if fn succeeds. If fn fails,
+// the transaction is rolled back; if it failed with concurrency.ErrDeadlock or
+// concurrency.ErrConflict, it is rerun after an exponential backoff, up to
+// MAX_TRANSACTION_RETRIES times. Returns fn's last error if it never succeeds.
+func RunTransaction(
+	tm *concurrency.TransactionManager,
+	rm *RecoveryManager,
+	fn func(clientId uuid.UUID) error,
+) error {
+	clientId := uuid.New()
+	backoff := TRANSACTION_BACKOFF
+	for attempt := 0; ; attempt++ {
+		if err := tm.Begin(clientId); err != nil {
+			return err
+		}
+		rm.Start(clientId)
+		err := fn(clientId)
+		if err == nil {
+			rm.Commit(clientId)
+			return tm.Commit(clientId)
+		}
+		if rberr := rm.Rollback(clientId); rberr != nil {
+			return rberr
+		}
+		if !isRetryable(err) || attempt >= MAX_TRANSACTION_RETRIES {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isRetryable returns whether a transaction that failed with the given error may succeed if rerun.
+func isRetryable(err error) bool {
+	return errors.Is(err, concurrency.ErrDeadlock) || errors.Is(err, concurrency.ErrConflict)
+}
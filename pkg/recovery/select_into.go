@@ -0,0 +1,42 @@
+package recovery
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+
+	uuid "github.com/google/uuid"
+)
+
+// SelectInto creates a B+ tree table named dst and fills it with the entries of src that
+// match the predicate, as part of the client's running transaction. The new table and each
+// insert into it are logged, so the copy is redone after a crash. If the transaction aborts,
+// the inserts are undone, but the table itself is left behind, empty.
+func (rm *RecoveryManager) SelectInto(clientId uuid.UUID, src db.Index, dst string, predicate func(utils.Entry) bool) error {
+	if _, found := rm.tm.GetTransaction(clientId); !found {
+		return errors.New("no running transaction")
+	}
+	if _, err := rm.d.GetTable(dst); err == nil {
+		return fmt.Errorf("table %s already exists", dst)
+	}
+	// NOTE: Like select, the scan is unsafe; not locking anything. May copy an inconsistent view of the source.
+	entries, err := db.SelectMatching(src, predicate)
+	if err != nil {
+		return err
+	}
+	payload := fmt.Sprintf("create btree table %s", dst)
+	if err = HandleCreateTable(rm.d, rm.tm, rm, payload, ioutil.Discard, clientId); err != nil {
+		return err
+	}
+	// Each insert takes its lock and is logged; a failed insert rolls back the transaction.
+	for _, entry := range entries {
+		payload = fmt.Sprintf("insert %d %d into %s", entry.GetKey(), entry.GetValue(), dst)
+		if err = HandleInsert(rm.d, rm.tm, rm, payload, clientId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,26 +2,46 @@ package repl
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	uuid "github.com/google/uuid"
 )
 
+// Default number of commands kept in a REPL's history.
+var DEFAULT_HISTORY_LIMIT int = 1000
+
 // REPL struct.
+// Commands may be added while the REPL is serving clients.
 type REPL struct {
+	name     string // Name used to namespace this REPL's commands when combining.
 	commands map[string]func(string, *REPLConfig) error
 	help     map[string]string
+	timeout  time.Duration // How long Run lets each command run, or 0 for no limit.
+	block    BlockHandler  // Runs `begin;` ... `commit;` blocks, if they're enabled.
+	mtx      sync.RWMutex  // Guards commands, help, timeout, and block.
+
+	history       []string   // Commands entered so far, oldest first.
+	historyFile   string     // File that history is persisted to, if any.
+	historyLimit  int        // Maximum number of commands kept in history.
+	historyLoaded bool       // Whether history has been read from historyFile.
+	historyMtx    sync.Mutex // Guards the history fields.
 }
 
 // REPL Config struct.
 type REPLConfig struct {
 	writer   io.Writer
 	clientId uuid.UUID
+	ctx      context.Context // Cancelled once the current command runs out of time.
 }
 
 // Get writer.
@@ -29,70 +49,324 @@ func (replConfig *REPLConfig) GetWriter() io.Writer {
 	return replConfig.writer
 }
 
+// Get the context of the current command. Long-running commands should pass it to
+// context-aware scans, so that they stop once the REPL's timeout is up.
+func (replConfig *REPLConfig) GetContext() context.Context {
+	if replConfig.ctx == nil {
+		return context.Background()
+	}
+	return replConfig.ctx
+}
+
 // Get address.
 func (replConfig *REPLConfig) GetAddr() uuid.UUID {
 	return replConfig.clientId
 }
 
+// A BlockHandler runs the statements buffered between `begin;` and `commit;` as a unit.
+type BlockHandler func(statements []string, replConfig *REPLConfig) error
+
 // Construct an empty REPL.
 func NewRepl() *REPL {
 	/* SOLUTION {{{ */
 	commands := make(map[string]func(string, *REPLConfig) error)
 	help := make(map[string]string)
-	return &REPL{commands: commands, help: help}
+	return &REPL{commands: commands, help: help, historyLimit: DEFAULT_HISTORY_LIMIT}
 	/* SOLUTION }}} */
 }
 
-// Combines a slice of REPLs.
+// Combines a slice of REPLs, erroring if two REPLs share a trigger.
 func CombineRepls(repls []*REPL) (*REPL, error) {
+	return CombineReplsWithPolicy(repls, COLLISION_ERROR, ioutil.Discard)
+}
+
+// A CollisionPolicy decides what CombineReplsWithPolicy does when more than one REPL has the same trigger.
+type CollisionPolicy int
+
+const (
+	COLLISION_ERROR     CollisionPolicy = 0 // Fail to combine; the default.
+	COLLISION_NAMESPACE CollisionPolicy = 1 // Prefix each colliding trigger with its REPL's name, as `<name>:<trigger>`.
+	COLLISION_LAST_WINS CollisionPolicy = 2 // Keep the command from the last REPL, writing a warning.
+)
+
+// Combines a slice of REPLs, resolving shared triggers with the given policy.
+// Warnings about overridden commands are written to w. The block handler, timeout, and
+// history file are taken from the last REPL that sets each of them.
+func CombineReplsWithPolicy(repls []*REPL, policy CollisionPolicy, w io.Writer) (*REPL, error) {
+	if policy < COLLISION_ERROR || policy > COLLISION_LAST_WINS {
+		return nil, fmt.Errorf("invalid collision policy %d", policy)
+	}
 	/* SOLUTION {{{ */
 	// If no REPLs are passed, just return an empty one.
 	if len(repls) == 0 {
 		return NewRepl(), nil
 	}
+	// Find which triggers are shared, so that every copy of them can be namespaced.
+	owners := make(map[string]int)
+	for _, r := range repls {
+		for k := range r.GetCommands() {
+			owners[k]++
+		}
+	}
 	// Go through each repl and construct a new command/help set
 	commands := make(map[string]func(string, *REPLConfig) error)
 	help := make(map[string]string)
-	for _, r := range repls {
-		// Combine the commands
-		for k, v := range r.commands {
-			if _, found := commands[k]; found {
-				return nil, errors.New("duplicate trigger" + k)
-			}
-			commands[k] = v
+	sources := make(map[string]string)
+	for i, r := range repls {
+		name := r.GetName()
+		if name == "" {
+			name = fmt.Sprintf("repl%d", i)
 		}
-		// Combine the help strings
-		for k, v := range r.help {
-			if _, found := help[k]; found {
-				return nil, errors.New("duplicate trigger" + k)
+		helpStrings := r.GetHelp()
+		for k, v := range r.GetCommands() {
+			trigger := k
+			if owners[k] > 1 {
+				switch policy {
+				case COLLISION_ERROR:
+					return nil, errors.New("duplicate trigger " + k)
+				case COLLISION_NAMESPACE:
+					trigger = name + ":" + k
+				case COLLISION_LAST_WINS:
+					if source, found := sources[k]; found {
+						io.WriteString(w, fmt.Sprintf("warning: %s from %s overrides %s from %s\n", k, name, k, source))
+					}
+				}
+			}
+			if _, found := commands[trigger]; found && policy != COLLISION_LAST_WINS {
+				return nil, errors.New("duplicate trigger " + trigger)
 			}
-			help[k] = v
+			commands[trigger] = v
+			help[trigger] = helpStrings[k]
+			sources[trigger] = name
 		}
 	}
-	return &REPL{commands: commands, help: help}, nil
+	combined := NewRepl()
+	combined.commands = commands
+	combined.help = help
+	for _, r := range repls {
+		if handler := r.getBlockHandler(); handler != nil {
+			combined.block = handler
+		}
+		if timeout := r.GetTimeout(); timeout != 0 {
+			combined.timeout = timeout
+		}
+		r.historyMtx.Lock()
+		if r.historyFile != "" {
+			combined.historyFile = r.historyFile
+			combined.historyLimit = r.historyLimit
+		}
+		r.historyMtx.Unlock()
+	}
+	return combined, nil
 	/* SOLUTION }}} */
 }
 
-// Get commands.
+// Set the name used to namespace this REPL's commands when combining.
+func (r *REPL) SetName(name string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.name = name
+}
+
+// Get the REPL's name.
+func (r *REPL) GetName() string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.name
+}
+
+// Get a copy of the commands.
 func (r *REPL) GetCommands() map[string]func(string, *REPLConfig) error {
-	return r.commands
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	commands := make(map[string]func(string, *REPLConfig) error, len(r.commands))
+	for k, v := range r.commands {
+		commands[k] = v
+	}
+	return commands
 }
 
-// Get help.
+// Get a copy of the help strings.
 func (r *REPL) GetHelp() map[string]string {
-	return r.help
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	help := make(map[string]string, len(r.help))
+	for k, v := range r.help {
+		help[k] = v
+	}
+	return help
 }
 
 // Add a command, along with its help string, to the set of commands.
+// Safe to call while the REPL is running.
 func (r *REPL) AddCommand(trigger string, action func(string, *REPLConfig) error, help string) {
 	/* SOLUTION {{{ */
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
 	r.commands[trigger] = action
 	r.help[trigger] = help
 	/* SOLUTION }}} */
 }
 
+// SetTimeout sets how long Run lets each command run before cancelling its context,
+// or 0 for no limit. Commands that ignore their context still run to completion.
+func (r *REPL) SetTimeout(timeout time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.timeout = timeout
+}
+
+// Get how long Run lets each command run, or 0 if there is no limit.
+func (r *REPL) GetTimeout() time.Duration {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.timeout
+}
+
+// runCommand runs the command under the REPL's timeout, writing any error it returns.
+func (r *REPL) runCommand(command func(string, *REPLConfig) error, payload string, replConfig *REPLConfig) {
+	ctx := context.Background()
+	timeout := r.GetTimeout()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	replConfig.ctx = ctx
+	err := command(payload, replConfig)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		io.WriteString(replConfig.writer, fmt.Sprintf("command timed out after %v\n", timeout))
+	} else if err != nil {
+		io.WriteString(replConfig.writer, fmt.Sprintf("%v\n", err))
+	}
+}
+
+// SetBlockHandler enables blocks: between `begin;` and `commit;`, Run buffers statements
+// rather than running them, then hands them all to the handler on `commit;`. `abort;`,
+// `.quit`, and the end of input discard an open block. A nil handler disables blocks.
+func (r *REPL) SetBlockHandler(handler BlockHandler) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.block = handler
+}
+
+// getBlockHandler returns the block handler, or nil if blocks are disabled.
+func (r *REPL) getBlockHandler() BlockHandler {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.block
+}
+
+// Exec runs the command that the payload triggers, e.g. on behalf of a block handler.
+func (r *REPL) Exec(payload string, replConfig *REPLConfig) error {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return errors.New("empty command")
+	}
+	command, exists := r.getCommand(cleanInput(fields[0]))
+	if !exists {
+		return errors.New("command not found")
+	}
+	return command(payload, replConfig)
+}
+
+// getCommand returns the command with the given trigger, if any.
+func (r *REPL) getCommand(trigger string) (func(string, *REPLConfig) error, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	command, exists := r.commands[trigger]
+	return command, exists
+}
+
+// SetHistoryFile persists the REPL's command history to the given file, keeping at most
+// limit commands. History is loaded when Run starts and saved when it ends.
+func (r *REPL) SetHistoryFile(path string, limit int) {
+	if limit < 0 {
+		limit = 0
+	}
+	r.historyMtx.Lock()
+	defer r.historyMtx.Unlock()
+	r.historyFile = path
+	r.historyLimit = limit
+	r.historyLoaded = false
+	r.trimHistory()
+}
+
+// Get a copy of the command history, oldest first.
+func (r *REPL) GetHistory() []string {
+	r.historyMtx.Lock()
+	defer r.historyMtx.Unlock()
+	history := make([]string, len(r.history))
+	copy(history, r.history)
+	return history
+}
+
+// addHistory records a command in the history.
+func (r *REPL) addHistory(command string) {
+	r.historyMtx.Lock()
+	defer r.historyMtx.Unlock()
+	r.history = append(r.history, command)
+	r.trimHistory()
+}
+
+// trimHistory drops the oldest commands beyond the history limit.
+// Assumes historyMtx is held.
+func (r *REPL) trimHistory() {
+	if len(r.history) > r.historyLimit {
+		r.history = r.history[len(r.history)-r.historyLimit:]
+	}
+}
+
+// loadHistory reads the history file, if it hasn't been read yet, ahead of any
+// commands already entered. A missing or corrupt file is treated as empty.
+func (r *REPL) loadHistory() {
+	r.historyMtx.Lock()
+	defer r.historyMtx.Unlock()
+	if r.historyFile == "" || r.historyLoaded {
+		return
+	}
+	r.historyLoaded = true
+	data, err := ioutil.ReadFile(r.historyFile)
+	if err != nil || !utf8.Valid(data) {
+		return
+	}
+	loaded := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			loaded = append(loaded, line)
+		}
+	}
+	r.history = append(loaded, r.history...)
+	r.trimHistory()
+}
+
+// saveHistory writes the history out to the history file, if there is one.
+func (r *REPL) saveHistory() error {
+	r.historyMtx.Lock()
+	defer r.historyMtx.Unlock()
+	if r.historyFile == "" {
+		return nil
+	}
+	var sb strings.Builder
+	for _, command := range r.history {
+		sb.WriteString(command + "\n")
+	}
+	return ioutil.WriteFile(r.historyFile, []byte(sb.String()), 0666)
+}
+
+// historyString returns the history as a numbered list.
+func (r *REPL) historyString() string {
+	var sb strings.Builder
+	for i, command := range r.GetHistory() {
+		sb.WriteString(fmt.Sprintf("%d: %s\n", i+1, command))
+	}
+	return sb.String()
+}
+
 // Return all REPL usage information as a string.
 func (r *REPL) HelpString() string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
 	var sb strings.Builder
 	for k, v := range r.help {
 		sb.WriteString(fmt.Sprintf("%s: %s\n", k, v))
@@ -114,6 +388,10 @@ func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 	}
 	scanner := bufio.NewScanner((reader))
 	replConfig := &REPLConfig{writer: writer, clientId: clientId}
+	// Load history from previous sessions.
+	r.loadHistory()
+	// Statements buffered since `begin;`, or nil outside of a block.
+	var block []string
 	// Begin the repl loop!
 	/* SOLUTION {{{ */
 	io.WriteString(writer, prompt)
@@ -126,18 +404,31 @@ func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 		}
 		trigger := cleanInput(fields[0])
 		// Check for a meta-command.
+		if trigger == ".quit" {
+			break
+		}
+		if trigger == ".history" {
+			io.WriteString(writer, r.historyString())
+			io.WriteString(writer, prompt)
+			continue
+		}
+		r.addHistory(payload)
 		if trigger == ".help" {
 			io.WriteString(writer, r.HelpString())
 			io.WriteString(writer, prompt)
 			continue
 		}
-		// Else, check user commands.
-		if command, exists := r.commands[trigger]; exists {
-			// Call a hardcoded function.
-			err := command(payload, replConfig)
-			if err != nil {
-				io.WriteString(writer, fmt.Sprintf("%v\n", err))
+		// Check for block statements, if blocks are enabled.
+		if handler := r.getBlockHandler(); handler != nil {
+			if r.handleBlock(handler, &block, payload, replConfig) {
+				io.WriteString(writer, prompt)
+				continue
 			}
+		}
+		// Else, check user commands.
+		if command, exists := r.getCommand(trigger); exists {
+			// Call a hardcoded function, cancelling it if it runs out of time.
+			r.runCommand(command, payload, replConfig)
 		} else {
 			io.WriteString(writer, "command not found\n")
 		}
@@ -146,6 +437,52 @@ func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 	// Print an additional line if we encountered an EOF character.
 	io.WriteString(writer, "\n")
 	/* SOLUTION }}} */
+	// Discard any block that was never committed.
+	if block != nil {
+		io.WriteString(writer, fmt.Sprintf("block aborted: %d statements discarded\n", len(block)))
+	}
+	// Save history for the next session.
+	if err := r.saveHistory(); err != nil {
+		io.WriteString(writer, fmt.Sprintf("could not save history: %v\n", err))
+	}
+}
+
+// handleBlock handles the payload if it opens, commits, or aborts a block, or if a block
+// is open, in which case the payload is buffered. Returns false if the payload should run
+// as usual. A nil block means that no block is open.
+func (r *REPL) handleBlock(handler BlockHandler, block *[]string, payload string, replConfig *REPLConfig) bool {
+	writer := replConfig.writer
+	switch payload {
+	case "begin;":
+		if *block != nil {
+			io.WriteString(writer, "already in a block\n")
+		} else {
+			*block = make([]string, 0)
+		}
+	case "commit;":
+		if *block == nil {
+			io.WriteString(writer, "no block to commit\n")
+			break
+		}
+		statements := *block
+		*block = nil
+		r.runCommand(func(_ string, config *REPLConfig) error {
+			return handler(statements, config)
+		}, payload, replConfig)
+	case "abort;":
+		if *block == nil {
+			io.WriteString(writer, "no block to abort\n")
+			break
+		}
+		io.WriteString(writer, fmt.Sprintf("block aborted: %d statements discarded\n", len(*block)))
+		*block = nil
+	default:
+		if *block == nil {
+			return false
+		}
+		*block = append(*block, strings.TrimSpace(strings.TrimSuffix(payload, ";")))
+	}
+	return true
 }
 
 // cleanInput preprocesses input to the db repl.
@@ -179,7 +516,7 @@ func (r *REPL) RunChan(c chan string, clientId uuid.UUID, prompt string) {
 			continue
 		}
 		// Else, check user commands.
-		if command, exists := r.commands[trigger]; exists {
+		if command, exists := r.getCommand(trigger); exists {
 			// Call a hardcoded function.
 			err := command(payload, replConfig)
 			if err != nil {
@@ -0,0 +1,27 @@
+package utils
+
+import "sort"
+
+// CompareEntries orders entries by key, breaking ties by value. It returns a negative
+// number if a comes first, a positive number if b does, and 0 if they are equal.
+func CompareEntries(a Entry, b Entry) int {
+	switch {
+	case a.GetKey() < b.GetKey():
+		return -1
+	case a.GetKey() > b.GetKey():
+		return 1
+	case a.GetValue() < b.GetValue():
+		return -1
+	case a.GetValue() > b.GetValue():
+		return 1
+	}
+	return 0
+}
+
+// SortEntries sorts the entries in place by CompareEntries. The sort is stable,
+// so entries that compare equal keep their relative order.
+func SortEntries(entries []Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return CompareEntries(entries[i], entries[j]) < 0
+	})
+}
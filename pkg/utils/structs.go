@@ -1,9 +1,24 @@
 package utils
 
+import "errors"
+
+// ErrUnsupportedVersion is returned when opening a file written in a format version
+// that this build can't read.
+var ErrUnsupportedVersion = errors.New("unsupported file format version")
+
+// ErrImmutable is returned when modifying an index that has been frozen.
+var ErrImmutable = errors.New("index is frozen")
+
+// ErrNotFound is returned when looking up a key that isn't in an index.
+var ErrNotFound = errors.New("entry could not be found")
+
 // Interface for an entry in a table.
+// A null entry is present but has no value, which is distinct from a value of 0; its
+// GetValue returns 0, so callers that care must check IsNull first.
 type Entry interface {
 	GetKey() int64
 	GetValue() int64
+	IsNull() bool
 	Marshal() []byte
 }
 
@@ -13,3 +28,24 @@ type Cursor interface {
 	IsEnd() bool
 	GetEntry() (Entry, error)
 }
+
+// Projection picks which field of each entry a projected scan returns.
+type Projection int
+
+const (
+	PROJECT_KEY   Projection = iota // Return only keys.
+	PROJECT_VALUE                   // Return only values.
+)
+
+// Valid returns true if the projection is one of the known fields.
+func (fields Projection) Valid() bool {
+	return fields == PROJECT_KEY || fields == PROJECT_VALUE
+}
+
+// Project returns the projected field of the given key-value pair.
+func (fields Projection) Project(key int64, value int64) int64 {
+	if fields == PROJECT_VALUE {
+		return value
+	}
+	return key
+}
@@ -0,0 +1,1992 @@
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"testing/quick"
+	"time"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+func TestBTree(t *testing.T) {
+	t.Run("TestBTreeLeafCapacity", testBTreeLeafCapacity)
+	t.Run("TestBTreeTombstoneScan", testBTreeTombstoneScan)
+	t.Run("TestBTreeCursorAt", testBTreeCursorAt)
+	t.Run("TestBTreeSubtreeCounts", testBTreeSubtreeCounts)
+	t.Run("TestBTreeUpsert", testBTreeUpsert)
+	t.Run("TestBTreeEmptyRoot", testBTreeEmptyRoot)
+	t.Run("TestBTreeNextID", testBTreeNextID)
+	t.Run("TestBTreeScanCancel", testBTreeScanCancel)
+	t.Run("TestBTreeScanDuringSplit", testBTreeScanDuringSplit)
+	t.Run("TestBTreeSelectProject", testBTreeSelectProject)
+	t.Run("TestBTreeMemPager", testBTreeMemPager)
+	t.Run("TestBTreeEntryRoundTrip", testBTreeEntryRoundTrip)
+	t.Run("TestBTreeFormatVersion", testBTreeFormatVersion)
+	t.Run("TestBTreeLegacyFile", testBTreeLegacyFile)
+	t.Run("TestBTreeResumeFrom", testBTreeResumeFrom)
+	t.Run("TestBTreeLastLeaf", testBTreeLastLeaf)
+	t.Run("TestBTreeUpdateInPlace", testBTreeUpdateInPlace)
+	t.Run("TestBTreeSplitSmallPool", testBTreeSplitSmallPool)
+	t.Run("TestBTreeFindOrphanPages", testBTreeFindOrphanPages)
+	t.Run("TestBTreeMaxHeight", testBTreeMaxHeight)
+	t.Run("TestBTreeDescendingOrder", testBTreeDescendingOrder)
+	t.Run("TestBTreeEstimateRangeCount", testBTreeEstimateRangeCount)
+	t.Run("TestBTreeFreeze", testBTreeFreeze)
+	t.Run("TestBTreeRawScan", testBTreeRawScan)
+	t.Run("TestBTreeNullEntry", testBTreeNullEntry)
+	t.Run("TestBTreeMayContain", testBTreeMayContain)
+	t.Run("TestBTreeCrabbing", testBTreeCrabbing)
+	t.Run("TestBTreeCursorSnapshot", testBTreeCursorSnapshot)
+}
+
+func testBTreeLeafCapacity(t *testing.T) {
+	smallName := getTempBTreeDB(t)
+	defer os.Remove(smallName)
+	largeName := getTempBTreeDB(t)
+	defer os.Remove(largeName)
+
+	// Init two databases with different leaf capacities
+	small, err := btree.OpenTableWithLeafCapacity(smallName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := btree.OpenTable(largeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert the same entries into both
+	for i := int64(0); i < 100; i++ {
+		if err = small.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+		if err = large.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// The small table should have split many more times
+	if small.GetPager().GetNumPages() <= large.GetPager().GetNumPages() {
+		t.Errorf("expected small-capacity table to use more pages, got %d vs %d",
+			small.GetPager().GetNumPages(), large.GetPager().GetNumPages())
+	}
+	// Close and reopen; the capacity should be read back
+	small.Close()
+	large.Close()
+	small, err = btree.OpenTable(smallName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err = btree.OpenTable(largeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.GetLeafCapacity() != 4 {
+		t.Errorf("expected leaf capacity 4, got %d", small.GetLeafCapacity())
+	}
+	if large.GetLeafCapacity() != btree.ENTRIES_PER_LEAF_NODE {
+		t.Errorf("expected default leaf capacity, got %d", large.GetLeafCapacity())
+	}
+	// Retrieve entries from both
+	for i := int64(0); i < 100; i++ {
+		for _, index := range []*btree.BTreeIndex{small, large} {
+			entry, err := index.Find(i)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if entry.GetValue() != i%btree_salt {
+				t.Error("Entry found has the wrong value")
+			}
+		}
+	}
+	small.Close()
+	large.Close()
+}
+
+func testBTreeTombstoneScan(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init the database in tombstone mode, spanning more leaves than the buffer pool holds
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = index.SetTombstoneMode(true); err != nil {
+		t.Fatal(err)
+	}
+	// Insert entries
+	for i := int64(0); i < 400; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// Scan the table, deleting the current entry at each step
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := int64(0)
+	for {
+		if !cursor.IsEnd() {
+			entry, err := cursor.GetEntry()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.GetKey() != expected {
+				t.Fatalf("expected key %d during scan, got %d", expected, entry.GetKey())
+			}
+			index.Delete(entry.GetKey())
+			expected++
+		}
+		if err := cursor.StepForward(); err != nil {
+			break
+		}
+	}
+	if expected != 400 {
+		t.Errorf("expected to scan 400 entries, scanned %d", expected)
+	}
+	// Deleted entries should be invisible to finds and selects
+	if _, err = index.Find(42); !errors.Is(err, utils.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a deleted entry, got %v", err)
+	}
+	if entries, _ := index.Select(); len(entries) != 0 {
+		t.Errorf("expected no entries after deletion, got %d", len(entries))
+	}
+	// Deleted entries can be reinserted, but not updated
+	if err = index.Update(7, 0); err == nil {
+		t.Error("Could update deleted entry")
+	}
+	if err = index.Insert(7, 77); err != nil {
+		t.Error(err)
+	}
+	// Vacuum and check that only the reinserted entry remains
+	if err = index.Vacuum(); err != nil {
+		t.Error(err)
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != 1 || entries[0].GetKey() != 7 || entries[0].GetValue() != 77 {
+		t.Errorf("expected only (7, 77) after vacuum, got %v", entries)
+	}
+	// The mode should persist across reopening
+	index.Close()
+	index, err = btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.GetTombstoneMode() {
+		t.Error("tombstone mode was not persisted")
+	}
+	index.Close()
+}
+
+func testBTreeCursorAt(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database spanning many leaves
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Insert even keys in a scrambled order
+	n := int64(200)
+	for _, i := range rand.Perm(int(n)) {
+		if err = index.Insert(int64(i)*2, int64(i)%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// Position at the first, middle, and last entries
+	for _, ordinal := range []int64{0, n / 2, n - 1} {
+		cursor, err := index.CursorAt(ordinal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.GetKey() != ordinal*2 {
+			t.Errorf("expected key %d at ordinal %d, got %d", ordinal*2, ordinal, entry.GetKey())
+		}
+	}
+	// Stepping from a positioned cursor should continue in key order
+	cursor, err := index.CursorAt(n - 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor.StepForward()
+	if entry, err := cursor.GetEntry(); err != nil || entry.GetKey() != (n-2)*2 {
+		t.Errorf("expected key %d after stepping, got %v", (n-2)*2, entry)
+	}
+	// Out-of-range ordinals should be rejected
+	for _, ordinal := range []int64{-1, n, n + 100} {
+		if _, err := index.CursorAt(ordinal); err == nil {
+			t.Errorf("expected an error for ordinal %d", ordinal)
+		}
+	}
+}
+
+func testBTreeSubtreeCounts(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database small enough per leaf that internal nodes split too
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Run a randomized insert/delete workload, tombstoning for the second half
+	present := make(map[int64]bool)
+	for round := 0; round < 2; round++ {
+		if err = index.SetTombstoneMode(round == 1); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			key := rand.Int63n(3000)
+			if rand.Intn(3) == 0 {
+				index.Delete(key)
+				delete(present, key)
+			} else if !present[key] {
+				if err = index.Insert(key, key%btree_salt); err != nil {
+					t.Error(err)
+				}
+				present[key] = true
+			}
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("tree failed the structural check: %v", err)
+	}
+	// Build the expected key order
+	keys := make([]int64, 0, len(present))
+	for key := range present {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if count, err := index.Count(); err != nil || count != int64(len(keys)) {
+		t.Errorf("expected count %d, got %d (%v)", len(keys), count, err)
+	}
+	// Check rank and select against the expected order
+	for i := 0; i < 200; i++ {
+		key := rand.Int63n(3100) - 50
+		expected := int64(sort.Search(len(keys), func(j int) bool { return keys[j] >= key }))
+		if rank, err := index.Rank(key); err != nil || rank != expected {
+			t.Errorf("expected rank %d for key %d, got %d (%v)", expected, key, rank, err)
+		}
+	}
+	for ordinal, key := range keys {
+		cursor, err := index.CursorAt(int64(ordinal))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := cursor.GetEntry()
+		if err != nil || entry.GetKey() != key {
+			t.Fatalf("expected key %d at ordinal %d, got %v (%v)", key, ordinal, entry, err)
+		}
+	}
+	// Vacuuming doesn't change any counts
+	if err = index.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("tree failed the structural check after vacuuming: %v", err)
+	}
+	// Ranks stay exact while other keys are inserted, splitting nodes under the readers
+	var writers sync.WaitGroup
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		for key := int64(3000); key < 4000; key++ {
+			if err := index.Insert(key, key%btree_salt); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		key := rand.Int63n(3000)
+		expected := int64(sort.Search(len(keys), func(j int) bool { return keys[j] >= key }))
+		if rank, err := index.Rank(key); err != nil || rank != expected {
+			t.Errorf("expected rank %d for key %d during inserts, got %d (%v)", expected, key, rank, err)
+		}
+		ordinal := rand.Intn(len(keys))
+		cursor, err := index.CursorAt(int64(ordinal))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry, err := cursor.GetEntry(); err != nil || entry.GetKey() != keys[ordinal] {
+			t.Errorf("expected key %d at ordinal %d during inserts, got %v (%v)", keys[ordinal], ordinal, entry, err)
+		}
+	}
+	writers.Wait()
+}
+
+func testBTreeUpsert(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database with small leaves so that upserts split nodes
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Upsert new keys
+	for i := int64(0); i < 200; i++ {
+		if err = index.Upsert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("tree failed the structural check: %v", err)
+	}
+	// Upsert existing keys, and tombstone some so that upserts revive them
+	if err = index.SetTombstoneMode(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 200; i += 4 {
+		if err = index.Delete(i); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := int64(0); i < 200; i += 2 {
+		if err = index.Upsert(i, -i); err != nil {
+			t.Error(err)
+		}
+	}
+	// Check that every key holds the latest value
+	for i := int64(0); i < 200; i++ {
+		expected := i % btree_salt
+		if i%2 == 0 {
+			expected = -i
+		}
+		entry, err := index.Find(i)
+		if err != nil {
+			t.Errorf("could not find key %d: %v", i, err)
+		} else if entry.GetValue() != expected {
+			t.Errorf("wrong value for key %d: expected %d, got %d", i, expected, entry.GetValue())
+		}
+	}
+	if count, err := index.Count(); err != nil || count != 200 {
+		t.Errorf("expected count 200, got %d (%v)", count, err)
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("tree failed the structural check after upserting: %v", err)
+	}
+}
+
+func testBTreeEmptyRoot(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database with enough entries for the root to become an internal node
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 10; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	rootPage, err := index.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rootPage.Put()
+	if (*rootPage.GetData())[btree.NODETYPE_OFFSET] != 0 {
+		t.Fatal("expected the root to be an internal node")
+	}
+	// Drop the root's keys, leaving only its leftmost child
+	numKeysData := make([]byte, btree.NUM_KEYS_SIZE)
+	binary.PutVarint(numKeysData, 0)
+	rootPage.Update(numKeysData, btree.NUM_KEYS_OFFSET, btree.NUM_KEYS_SIZE)
+	if entry, err := index.Find(0); err != nil || entry.GetValue() != 0 {
+		t.Errorf("expected to find key 0 under the only child, got %v (%v)", entry, err)
+	}
+	if _, err = index.Find(9); err == nil {
+		t.Error("expected key 9 to be unreachable from an empty root")
+	}
+	if _, err = index.TableStart(); err != nil {
+		t.Errorf("expected to descend to the only child: %v", err)
+	}
+	// Wipe the root entirely, so that its child pointer is never written
+	rootPage.Update(make([]byte, pager.PAGESIZE), 0, pager.PAGESIZE)
+	for _, key := range []int64{0, 5, 9, 100} {
+		if _, err = index.Find(key); err == nil {
+			t.Errorf("expected key %d not to be found under a degenerate root", key)
+		}
+	}
+	if _, err = index.TableStart(); err == nil {
+		t.Error("expected a cursor over a degenerate root to error")
+	}
+	if _, err = index.TableFind(5); err == nil {
+		t.Error("expected finding in a degenerate root to error")
+	}
+	if _, err = index.Rank(5); err == nil {
+		t.Error("expected ranking in a degenerate root to error")
+	}
+}
+
+func testBTreeNextID(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database and insert rows under fresh ids
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		id, err := index.NextID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != i {
+			t.Errorf("expected id %d, got %d", i, id)
+		}
+		if err = index.Insert(id, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// Ids should pick up where they left off after a restart
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if id, err := index.NextID(); err != nil || id != 100 {
+		t.Errorf("expected id %d after reopening, got %d (%v)", 100, id, err)
+	}
+	// Concurrent callers should never get the same id
+	numWorkers := 8
+	numIDs := 200
+	ids := make(chan int64, numWorkers*numIDs)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := int64(-1)
+			for i := 0; i < numIDs; i++ {
+				id, err := index.NextID()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if id <= last {
+					t.Errorf("ids went backwards: %d after %d", id, last)
+				}
+				last = id
+				ids <- id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	seen := make(map[int64]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("id %d was handed out twice", id)
+		}
+		if id <= 100 {
+			t.Errorf("id %d was handed out before the restart", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != numWorkers*numIDs {
+		t.Errorf("expected %d ids, got %d", numWorkers*numIDs, len(seen))
+	}
+}
+
+// countdownContext is a context that reports itself cancelled once Err has been
+// called more than a fixed number of times, so scans can be cancelled mid-way.
+type countdownContext struct {
+	context.Context
+	remaining int
+}
+
+func newCountdownContext(checks int) *countdownContext {
+	return &countdownContext{Context: context.Background(), remaining: checks}
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.remaining <= 0 {
+		return context.Canceled
+	}
+	ctx.remaining--
+	return nil
+}
+
+func testBTreeScanCancel(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database with enough entries for many cancellation checks
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	numEntries := 20 * btree.SCAN_CHECK_INTERVAL
+	for i := int64(0); i < numEntries; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// Scans with a live context should see everything
+	entries, err := index.SelectCtx(context.Background())
+	if err != nil || int64(len(entries)) != numEntries {
+		t.Errorf("expected %d entries, got %d (%v)", numEntries, len(entries), err)
+	}
+	entries, err = index.TableFindRangeCtx(context.Background(), 0, numEntries/2)
+	if err != nil || int64(len(entries)) != numEntries/2 {
+		t.Errorf("expected %d entries, got %d (%v)", numEntries/2, len(entries), err)
+	}
+	// Scans cancelled part of the way through should stop early
+	if _, err = index.SelectCtx(newCountdownContext(3)); err != context.Canceled {
+		t.Errorf("expected select to be cancelled, got %v", err)
+	}
+	entries, err = index.TableFindRangeCtx(newCountdownContext(3), 0, numEntries)
+	if err != context.Canceled {
+		t.Errorf("expected range scan to be cancelled, got %v", err)
+	}
+	if int64(len(entries)) > 3*btree.SCAN_CHECK_INTERVAL {
+		t.Errorf("expected range scan to stop after %d entries, got %d", 3*btree.SCAN_CHECK_INTERVAL, len(entries))
+	}
+	// An already-cancelled context should stop the scan right away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = index.SelectCtx(ctx); err != context.Canceled {
+		t.Errorf("expected select to be cancelled, got %v", err)
+	}
+}
+
+func testBTreeScanDuringSplit(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database with small leaves so that inserts split often
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 1000; i += 2 {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// Scan while another goroutine splits leaves; every scan should see each
+	// leaf either before or after its split, so no key is lost or repeated.
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := int64(1); i < 1000; i += 2 {
+			if err := index.Insert(i, i%btree_salt); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for scanning := true; scanning; {
+		select {
+		case <-done:
+			scanning = false
+		default:
+		}
+		entries, err := index.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		evens := 0
+		for i, entry := range entries {
+			if i > 0 && entries[i-1].GetKey() >= entry.GetKey() {
+				t.Fatalf("scan is out of order at position %d", i)
+			}
+			if entry.GetKey()%2 == 0 {
+				evens++
+			}
+		}
+		if evens != 500 {
+			t.Fatalf("expected scan to see all %d preloaded keys, saw %d", 500, evens)
+		}
+	}
+}
+
+func testBTreeSelectProject(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database spanning several leaves, with a few tombstones
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 300; i++ {
+		if err = index.Insert(i, -i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = index.SetTombstoneMode(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 300; i += 7 {
+		if err = index.Delete(i); err != nil {
+			t.Error(err)
+		}
+	}
+	// Projections should match the fields of a full select
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := index.SelectProject(utils.PROJECT_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := index.SelectProject(utils.PROJECT_VALUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(entries) || len(values) != len(entries) {
+		t.Fatalf("expected %d projected entries, got %d keys and %d values", len(entries), len(keys), len(values))
+	}
+	for i, entry := range entries {
+		if keys[i] != entry.GetKey() || values[i] != entry.GetValue() {
+			t.Errorf("projection mismatch at %d: (%d, %d) vs (%d, %d)",
+				i, keys[i], values[i], entry.GetKey(), entry.GetValue())
+		}
+	}
+	if _, err = index.SelectProject(utils.Projection(-1)); err == nil {
+		t.Error("expected an invalid projection to error")
+	}
+}
+
+func testBTreeMemPager(t *testing.T) {
+	before, err := ioutil.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Init a btree in memory, with more pages than the pager has frames
+	p := pager.NewMemPager()
+	if err = p.Open("mem-btree"); err != nil {
+		t.Fatal(err)
+	}
+	if p.HasFile() || !p.IsMem() {
+		t.Error("expected an in-memory pager without a file")
+	}
+	index, err := btree.OpenTableWithPager(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numEntries := int64(10000)
+	for i := int64(0); i < numEntries; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	if p.GetNumPages() <= int64(p.GetNumFrames()) {
+		t.Errorf("expected more pages than frames, got %d pages", p.GetNumPages())
+	}
+	// Evicted pages should come back intact
+	for i := int64(0); i < numEntries; i++ {
+		entry, err := index.Find(i)
+		if err != nil {
+			t.Fatalf("could not find key %d: %v", i, err)
+		}
+		if entry.GetValue() != i%btree_salt {
+			t.Errorf("wrong value for key %d", i)
+		}
+	}
+	if index.GetName() != "mem-btree" {
+		t.Errorf("expected name %q, got %q", "mem-btree", index.GetName())
+	}
+	if err = index.Close(); err != nil {
+		t.Error(err)
+	}
+	// Nothing should have been written to disk
+	after, err := ioutil.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("expected no new files, had %d and now have %d", len(before), len(after))
+	}
+	if _, err = os.Stat("mem-btree"); !os.IsNotExist(err) {
+		t.Error("expected no file for the in-memory btree")
+	}
+}
+
+// Keys and values at the edges of the varint encoding: extremes, and values on
+// either side of each point where the encoding grows by a byte.
+func entryEdgeValues() []int64 {
+	values := []int64{0, 1, -1, math.MaxInt64, math.MinInt64, math.MaxInt64 - 1, math.MinInt64 + 1}
+	for shift := uint(6); shift < 63; shift += 7 {
+		edge := int64(1) << shift
+		values = append(values, edge-1, edge, -edge, -edge-1)
+	}
+	return values
+}
+
+func testBTreeEntryRoundTrip(t *testing.T) {
+	roundTrips := func(key int64, value int64) bool {
+		var entry, decoded btree.BTreeEntry
+		entry.SetKey(key)
+		entry.SetValue(value)
+		data := entry.Marshal()
+		if int64(len(data)) != btree.ENTRYSIZE {
+			return false
+		}
+		return decoded.Unmarshal(data) == nil && decoded == entry
+	}
+	// Every pair of edge values, and random pairs, should survive a round trip
+	for _, key := range entryEdgeValues() {
+		for _, value := range entryEdgeValues() {
+			if !roundTrips(key, value) {
+				t.Errorf("entry (%d, %d) did not survive a round trip", key, value)
+			}
+		}
+	}
+	if err := quick.Check(roundTrips, nil); err != nil {
+		t.Error(err)
+	}
+	// Malformed data should be rejected
+	var decoded btree.BTreeEntry
+	if err := decoded.Unmarshal(make([]byte, btree.ENTRYSIZE-1)); err == nil {
+		t.Error("expected a short entry to be rejected")
+	}
+	garbage := make([]byte, btree.ENTRYSIZE)
+	for i := range garbage {
+		garbage[i] = 0xff
+	}
+	if err := decoded.Unmarshal(garbage); err == nil {
+		t.Error("expected an unterminated varint to be rejected")
+	}
+	// Edge values should also survive a trip through the table's pages
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i, key := range entryEdgeValues() {
+		value := entryEdgeValues()[len(entryEdgeValues())-1-i]
+		if err = index.Insert(key, value); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := index.Find(key)
+		if err != nil || entry.GetValue() != value {
+			t.Errorf("entry (%d, %d) did not survive a trip through the table", key, value)
+		}
+	}
+}
+
+// setFormatVersion overwrites the format version byte at the given offset of a file.
+func setFormatVersion(t *testing.T, filename string, offset int64, version byte) {
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteAt([]byte{version}, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBTreeFormatVersion(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a table and close it
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	index.Close()
+	// A file from a newer format should be refused rather than misread
+	setFormatVersion(t, dbName, btree.META_VERSION_OFFSET, btree.FORMAT_VERSION+1)
+	if _, err = btree.OpenTable(dbName); !errors.Is(err, utils.ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	// So should a file that doesn't record its version at all
+	setFormatVersion(t, dbName, btree.META_VERSION_OFFSET, 0)
+	if _, err = btree.OpenTable(dbName); !errors.Is(err, utils.ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	// And one whose entries are a different size
+	setFormatVersion(t, dbName, btree.META_VERSION_OFFSET, btree.FORMAT_VERSION)
+	setMetaField(t, dbName, btree.META_ENTRY_SIZE_OFFSET, btree.ENTRYSIZE+1)
+	if _, err = btree.OpenTable(dbName); !errors.Is(err, utils.ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+	// Restoring both makes the file readable again
+	setMetaField(t, dbName, btree.META_ENTRY_SIZE_OFFSET, btree.ENTRYSIZE)
+	index, err = btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 100; i++ {
+		if entry, err := index.Find(i); err != nil || entry.GetValue() != i%btree_salt {
+			t.Errorf("could not find key %d after reopening", i)
+		}
+	}
+}
+
+// writeRawPages writes the given pages, each padded to a full page, as the contents of a file.
+func writeRawPages(t *testing.T, filename string, pages ...[]byte) {
+	data := make([]byte, int64(len(pages))*pager.PAGESIZE)
+	for i, page := range pages {
+		copy(data[int64(i)*pager.PAGESIZE:], page)
+	}
+	if err := ioutil.WriteFile(filename, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBTreeLegacyFile(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Write a table in the layout from before tables had a metadata page: a root leaf
+	// on page 0 holding a few entries, with no capacity and no flags in its cells
+	root := make([]byte, pager.PAGESIZE)
+	root[0] = 1
+	binary.PutVarint(root[1:], 3)
+	for i := int64(0); i < 3; i++ {
+		cell := root[21+i*2*binary.MaxVarintLen64:]
+		binary.PutVarint(cell, i)
+		binary.PutVarint(cell[binary.MaxVarintLen64:], i%btree_salt)
+	}
+	writeRawPages(t, dbName, root)
+	// It should be refused rather than misread
+	if _, err := btree.OpenTable(dbName); !errors.Is(err, utils.ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+// nextKey returns the key of the next entry at or after the cursor's position, or false at the end.
+func nextKey(t *testing.T, cursor utils.Cursor) (int64, bool) {
+	for cursor.IsEnd() {
+		if err := cursor.StepForward(); err != nil {
+			return 0, false
+		}
+	}
+	entry, err := cursor.GetEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry.GetKey(), true
+}
+
+func testBTreeResumeFrom(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a table with small leaves holding the even keys
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 200; i += 2 {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// Read the first page of results, then bookmark the next entry, key 50
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		if _, ok := nextKey(t, cursor); !ok {
+			t.Fatal("table ended early")
+		}
+		cursor.StepForward()
+	}
+	if key, _ := nextKey(t, cursor); key != 50 {
+		t.Fatalf("expected to be at key 50, got %d", key)
+	}
+	bookmark := cursor.(*btree.BTreeCursor).Bookmark()
+	// Change the table around the bookmark, deleting the bookmarked key itself
+	index.Insert(49, 0)
+	index.Insert(51, 0)
+	if err = index.Delete(50); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := index.ResumeFrom(bookmark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int64{51, 52, 54}
+	for _, key := range expected {
+		got, ok := nextKey(t, resumed)
+		if !ok || got != key {
+			t.Fatalf("expected to resume at key %d, got %d", key, got)
+		}
+		resumed.StepForward()
+	}
+	// Bookmarks taken past the end of a leaf resume after that leaf's last key
+	cursor, err = index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last int64
+	for !cursor.IsEnd() {
+		entry, _ := cursor.GetEntry()
+		last = entry.GetKey()
+		cursor.StepForward()
+	}
+	bookmark = cursor.(*btree.BTreeCursor).Bookmark()
+	if err = index.Insert(last+1, 0); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err = index.ResumeFrom(bookmark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := nextKey(t, resumed); !ok || got != last+1 {
+		t.Errorf("expected to resume at key %d, got %d", last+1, got)
+	}
+	// A bookmark at the end of the table resumes at the end
+	for {
+		if _, ok := nextKey(t, cursor); !ok {
+			break
+		}
+		cursor.StepForward()
+	}
+	resumed, err = index.ResumeFrom(cursor.(*btree.BTreeCursor).Bookmark())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := nextKey(t, resumed); ok {
+		t.Errorf("expected to resume at the end, got key %d", key)
+	}
+	// Malformed bookmarks are rejected
+	for _, bad := range [][]byte{nil, {7}, {btree.BOOKMARK_AT}, {btree.BOOKMARK_AT, 0x80}} {
+		if _, err = index.ResumeFrom(bad); err == nil {
+			t.Errorf("expected bookmark %v to be rejected", bad)
+		}
+	}
+}
+
+// scanKeys returns every key in the table, in cursor order.
+func scanKeys(t *testing.T, index *btree.BTreeIndex) []int64 {
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]int64, 0)
+	for {
+		key, ok := nextKey(t, cursor)
+		if !ok {
+			break
+		}
+		keys = append(keys, key)
+		cursor.StepForward()
+	}
+	// Stepping past the end keeps failing rather than wrapping around
+	for i := 0; i < 2; i++ {
+		if err = cursor.StepForward(); err == nil {
+			t.Error("expected the cursor to stay at the end")
+		}
+	}
+	return keys
+}
+
+func testBTreeLastLeaf(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// A scan over many leaves ends at the last one
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(99); i >= 0; i-- {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	keys := scanKeys(t, index)
+	if len(keys) != 100 {
+		t.Fatalf("expected 100 keys, got %d", len(keys))
+	}
+	for i, key := range keys {
+		if key != int64(i) {
+			t.Fatalf("expected key %d at position %d, got %d", i, i, key)
+		}
+	}
+	index.Close()
+
+	// A leaf whose sibling was left zeroed is treated as the last leaf, not a link to page 0
+	smallName := getTempBTreeDB(t)
+	defer os.Remove(smallName)
+	index, err = btree.OpenTable(smallName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 5; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	index.Close()
+	file, err := os.OpenFile(smallName, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := make([]byte, btree.RIGHT_SIBLING_PN_SIZE)
+	binary.PutVarint(zero, 0)
+	_, err = file.WriteAt(zero, btree.ROOT_PN*pager.PAGESIZE+btree.RIGHT_SIBLING_PN_OFFSET)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err = btree.OpenTable(smallName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if keys = scanKeys(t, index); len(keys) != 5 {
+		t.Errorf("expected 5 keys, got %v", keys)
+	}
+}
+
+func testBTreeUpdateInPlace(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a table with a single leaf
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 10; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	root, err := index.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Put()
+	cellPos := btree.LEAF_NODE_HEADER_SIZE + 5*btree.ENTRYSIZE
+	valuePos := cellPos + btree.ENTRY_VALUE_OFFSET
+	for _, value := range []int64{12345, -1, math.MaxInt64, math.MinInt64, 0} {
+		before := append([]byte(nil), *root.GetData()...)
+		// Record every write the update makes
+		writes := make([][2]int64, 0)
+		index.GetPager().SetUpdateHook(func(pagenum int64, offset int64, data []byte) {
+			writes = append(writes, [2]int64{pagenum, offset})
+		})
+		err = index.Update(5, value)
+		index.GetPager().SetUpdateHook(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(writes) != 1 || writes[0] != [2]int64{btree.ROOT_PN, valuePos} {
+			t.Errorf("expected a single write at the value's offset %d, got %v", valuePos, writes)
+		}
+		// Only the value's bytes may have changed
+		after := *root.GetData()
+		for i := range before {
+			inValue := int64(i) >= valuePos && int64(i) < valuePos+btree.ENTRY_VALUE_SIZE
+			if !inValue && before[i] != after[i] {
+				t.Fatalf("expected byte %d outside the value to be unchanged", i)
+			}
+		}
+		key, _ := binary.Varint(after[cellPos+btree.ENTRY_KEY_OFFSET : cellPos+btree.ENTRY_KEY_OFFSET+btree.ENTRY_KEY_SIZE])
+		if key != 5 {
+			t.Errorf("expected key 5 in the cell, got %d", key)
+		}
+		if entry, err := index.Find(5); err != nil || entry.GetValue() != value {
+			t.Errorf("expected value %d, got %v, %v", value, entry, err)
+		}
+	}
+}
+
+func testBTreeSplitSmallPool(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Use small internal nodes, so that splits cascade through several levels
+	oldKeys := btree.KEYS_PER_INTERNAL_NODE
+	btree.KEYS_PER_INTERNAL_NODE = 4
+	defer func() {
+		btree.KEYS_PER_INTERNAL_NODE = oldKeys
+	}()
+	// Init a table in a pool just big enough for the deepest cascade of splits
+	numFrames := 6
+	p, err := pager.NewPagerWithFrames(numFrames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	index, err := btree.OpenTableWithPager(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	keys := rand.Perm(3000)
+	for _, key := range keys {
+		if err = index.Insert(int64(key), int64(key)%btree_salt); err != nil {
+			t.Fatalf("insert %d: %v", key, err)
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(index); !ok || err != nil {
+		t.Errorf("expected a valid B+ tree: %v", err)
+	}
+	for _, key := range keys {
+		if entry, err := index.Find(int64(key)); err != nil || entry.GetValue() != int64(key)%btree_salt {
+			t.Errorf("key %d: expected value %d, got %v (%v)", key, int64(key)%btree_salt, entry, err)
+		}
+	}
+	// Every split's pins were released, so a scope can take every frame
+	scope := p.PinSet()
+	defer scope.Release()
+	for pn := int64(0); pn < int64(numFrames); pn++ {
+		if _, err = scope.Get(pn); err != nil {
+			t.Fatalf("expected frame %d to be free: %v", pn, err)
+		}
+	}
+}
+
+func testBTreeFindOrphanPages(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database whose root has several leaves
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 20; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// A healthy tree has no orphans
+	if orphans, err := index.FindOrphanPages(); err != nil || len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %v (%v)", orphans, err)
+	}
+	// Detach the root's last child by dropping its last key
+	rootPage, err := index.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rootPage.Put()
+	if (*rootPage.GetData())[btree.NODETYPE_OFFSET] != 0 {
+		t.Fatal("expected the root to be an internal node")
+	}
+	numKeys, _ := binary.Varint((*rootPage.GetData())[btree.NUM_KEYS_OFFSET : btree.NUM_KEYS_OFFSET+btree.NUM_KEYS_SIZE])
+	lastPNPos := btree.PNS_OFFSET + numKeys*btree.PN_SIZE
+	detachedPN, _ := binary.Varint((*rootPage.GetData())[lastPNPos : lastPNPos+btree.PN_SIZE])
+	numKeysData := make([]byte, btree.NUM_KEYS_SIZE)
+	binary.PutVarint(numKeysData, numKeys-1)
+	rootPage.Update(numKeysData, btree.NUM_KEYS_OFFSET, btree.NUM_KEYS_SIZE)
+	orphans, err := index.FindOrphanPages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(orphans, []int64{detachedPN}) {
+		t.Errorf("expected page %d to be the only orphan, got %v", detachedPN, orphans)
+	}
+	// A page that was allocated but never linked is an orphan too
+	page, err := index.GetPager().AllocatePage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPN := page.GetPageNum()
+	page.Put()
+	orphans, err = index.FindOrphanPages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int64{detachedPN, newPN}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	if !reflect.DeepEqual(orphans, expected) {
+		t.Errorf("expected orphans %v, got %v", expected, orphans)
+	}
+}
+
+// pointInternalAt turns the given page into an internal node whose only child is target.
+func pointInternalAt(t *testing.T, index *btree.BTreeIndex, pagenum int64, target int64) {
+	page, err := index.GetPager().GetPage(pagenum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	page.Update(make([]byte, pager.PAGESIZE), 0, pager.PAGESIZE)
+	pnData := make([]byte, btree.PN_SIZE)
+	binary.PutVarint(pnData, target)
+	page.Update(pnData, btree.PNS_OFFSET, btree.PN_SIZE)
+}
+
+// expectTooDeep runs the given descent, failing if it hangs or doesn't error with ErrTreeTooDeep.
+func expectTooDeep(t *testing.T, name string, descend func() error) {
+	result := make(chan error, 1)
+	go func() {
+		result <- descend()
+	}()
+	select {
+	case err := <-result:
+		if !errors.Is(err, btree.ErrTreeTooDeep) {
+			t.Errorf("%s: expected ErrTreeTooDeep, got %v", name, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: descent hung", name)
+	}
+}
+
+func testBTreeMaxHeight(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database whose root has several leaves
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if index.GetMaxHeight() != btree.DEFAULT_MAX_HEIGHT {
+		t.Errorf("expected the default max height %d, got %d", btree.DEFAULT_MAX_HEIGHT, index.GetMaxHeight())
+	}
+	if height, err := index.Height(); err != nil || height != 1 {
+		t.Errorf("expected height 1, got %d (%v)", height, err)
+	}
+	for i := int64(0); i < 20; i++ {
+		if err = index.Insert(i, i%btree_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	if height, err := index.Height(); err != nil || height != 2 {
+		t.Errorf("expected height 2, got %d (%v)", height, err)
+	}
+	// A limit below the tree's height stops every descent
+	if err = index.SetMaxHeight(0); err == nil {
+		t.Error("expected a max height of 0 to be rejected")
+	}
+	if err = index.SetMaxHeight(1); err != nil {
+		t.Fatal(err)
+	}
+	expectTooDeep(t, "find under a low limit", func() error {
+		_, err := index.Find(0)
+		return err
+	})
+	expectTooDeep(t, "table start under a low limit", func() error {
+		_, err := index.TableStart()
+		return err
+	})
+	expectTooDeep(t, "table end under a low limit", func() error {
+		_, err := index.TableEnd()
+		return err
+	})
+	expectTooDeep(t, "cursor at an ordinal under a low limit", func() error {
+		_, err := index.CursorAt(0)
+		return err
+	})
+	expectTooDeep(t, "rank under a low limit", func() error {
+		_, err := index.Rank(0)
+		return err
+	})
+	if err = index.SetMaxHeight(btree.DEFAULT_MAX_HEIGHT); err != nil {
+		t.Fatal(err)
+	}
+	// Find the second and third children of the root, and a key that routes to the second
+	rootPage, err := index.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := *rootPage.GetData()
+	key, _ := binary.Varint(data[btree.KEYS_OFFSET : btree.KEYS_OFFSET+btree.KEY_SIZE])
+	second, _ := binary.Varint(data[btree.PNS_OFFSET+btree.PN_SIZE : btree.PNS_OFFSET+2*btree.PN_SIZE])
+	third, _ := binary.Varint(data[btree.PNS_OFFSET+2*btree.PN_SIZE : btree.PNS_OFFSET+3*btree.PN_SIZE])
+	rootPage.Put()
+	// Descending into a node that points at itself errors rather than hanging
+	pointInternalAt(t, index, second, second)
+	expectTooDeep(t, "find through a self-referential node", func() error {
+		_, err := index.Find(key)
+		return err
+	})
+	expectTooDeep(t, "insert through a self-referential node", func() error {
+		return index.Insert(key, 0)
+	})
+	expectTooDeep(t, "cursor through a self-referential node", func() error {
+		_, err := index.TableFind(key)
+		return err
+	})
+	expectTooDeep(t, "rank through a self-referential node", func() error {
+		_, err := index.Rank(key)
+		return err
+	})
+	// As does descending into two nodes that point at each other
+	pointInternalAt(t, index, second, third)
+	pointInternalAt(t, index, third, second)
+	expectTooDeep(t, "find through a cycle", func() error {
+		_, err := index.Find(key)
+		return err
+	})
+	expectTooDeep(t, "upsert through a cycle", func() error {
+		return index.Upsert(key, 0)
+	})
+	expectTooDeep(t, "cursor through a cycle", func() error {
+		_, err := index.TableFind(key)
+		return err
+	})
+	expectTooDeep(t, "rank through a cycle", func() error {
+		_, err := index.Rank(key)
+		return err
+	})
+	// The rest of the tree is still usable
+	if entry, err := index.Find(0); err != nil || entry.GetValue() != 0 {
+		t.Errorf("expected to find key 0, got %v (%v)", entry, err)
+	}
+	if err = index.Insert(-1, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func testBTreeDescendingOrder(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	if _, err := btree.OpenTableWithOrder(dbName, btree.KeyOrder(2)); err == nil {
+		t.Error("expected an invalid order to be rejected")
+	}
+	// Init a descending table with enough entries to split several times
+	index, err := btree.OpenTableWithOrder(dbName, btree.DESCENDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numKeys := int64(1000)
+	for _, key := range rand.Perm(int(numKeys)) {
+		if err = index.Insert(int64(key), int64(key)%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// checkDescending checks that a forward scan of the table returns its keys high-to-low
+	checkDescending := func(expected []int64) {
+		entries, err := index.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != len(expected) {
+			t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+		}
+		for i, entry := range entries {
+			if entry.GetKey() != expected[i] || entry.GetValue() != expected[i]%btree_salt {
+				t.Fatalf("entry %d: expected key %d, got %v", i, expected[i], entry)
+			}
+		}
+		if first, last, ok, err := btree.IsBTree(index); err != nil || !ok || first != expected[0] || last != expected[len(expected)-1] {
+			t.Errorf("expected a valid descending tree from %d to %d, got %d to %d (%v, %v)", expected[0], expected[len(expected)-1], first, last, ok, err)
+		}
+	}
+	expected := make([]int64, 0)
+	for key := numKeys - 1; key >= 0; key-- {
+		expected = append(expected, key)
+	}
+	checkDescending(expected)
+	for key := int64(0); key < numKeys; key++ {
+		if entry, err := index.Find(key); err != nil || entry.GetValue() != key%btree_salt {
+			t.Errorf("key %d: expected value %d, got %v (%v)", key, key%btree_salt, entry, err)
+		}
+	}
+	// Ranges and ranks follow the table's order
+	entries, err := index.TableFindRange(900, 800)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 100 || entries[0].GetKey() != 900 || entries[99].GetKey() != 801 {
+		t.Errorf("expected keys 900 down to 801, got %d entries", len(entries))
+	}
+	if rank, err := index.Rank(900); err != nil || rank != numKeys-901 {
+		t.Errorf("expected rank %d, got %d (%v)", numKeys-901, rank, err)
+	}
+	cursor, err := index.TableFind(500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stepping past the last cell of a leaf leaves the cursor at the end of it, so skip ahead
+	cursor.StepForward()
+	if key, ok := nextKey(t, cursor); !ok || key != 499 {
+		t.Errorf("expected key 499 after key 500, got %d (%v)", key, ok)
+	}
+	// The order is kept across reopens
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if index.GetOrder() != btree.DESCENDING {
+		t.Fatalf("expected the order to be descending, got %d", index.GetOrder())
+	}
+	if err = index.Insert(-1, -1%btree_salt); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Insert(numKeys, numKeys%btree_salt); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Delete(500); err != nil {
+		t.Fatal(err)
+	}
+	expected = []int64{numKeys}
+	for key := numKeys - 1; key >= -1; key-- {
+		if key != 500 {
+			expected = append(expected, key)
+		}
+	}
+	checkDescending(expected)
+}
+
+func testBTreeEstimateRangeCount(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	// Init a database small enough per leaf that ranges span many leaves
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Insert uniformly spread keys, then delete some with tombstones
+	keys := rand.Perm(20000)[:5000]
+	for _, key := range keys {
+		if err = index.Insert(int64(key), int64(key)%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.SetTombstoneMode(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[:500] {
+		if err = index.Delete(int64(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The estimate should match the size of the range on a quiet table
+	for i := 0; i < 100; i++ {
+		lo := rand.Int63n(21000) - 500
+		hi := lo + rand.Int63n(5000)
+		entries, err := index.TableFindRange(lo, hi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		estimate, err := index.EstimateRangeCount(lo, hi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if estimate != int64(len(entries)) {
+			t.Errorf("range [%d, %d): expected an estimate of %d, got %d", lo, hi, len(entries), estimate)
+		}
+	}
+	// Empty and backwards ranges have no entries
+	for _, bounds := range [][2]int64{{100, 100}, {5000, 100}} {
+		if estimate, err := index.EstimateRangeCount(bounds[0], bounds[1]); err != nil || estimate != 0 {
+			t.Errorf("range [%d, %d): expected an estimate of 0, got %d (%v)", bounds[0], bounds[1], estimate, err)
+		}
+	}
+}
+
+func testBTreeFreeze(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	// Init a database small enough per leaf that the tree has several levels
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	numKeys := int64(500)
+	for _, key := range rand.Perm(int(numKeys)) {
+		if err = index.Insert(int64(key), int64(key)%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Freezing is safe while readers are running
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := int64(0); key < numKeys; key += 7 {
+				if _, err := index.Find(key); err != nil {
+					t.Errorf("key %d: %v", key, err)
+				}
+			}
+		}()
+	}
+	if err = index.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if !index.IsFrozen() {
+		t.Fatal("expected the table to be frozen")
+	}
+	// Every write should be rejected
+	writes := map[string]func() error{
+		"insert":    func() error { return index.Insert(numKeys, 0) },
+		"upsert":    func() error { return index.Upsert(0, 1) },
+		"update":    func() error { return index.Update(0, 1) },
+		"delete":    func() error { return index.Delete(0) },
+		"vacuum":    index.Vacuum,
+		"tombstone": func() error { return index.SetTombstoneMode(true) },
+		"next id":   func() error { _, err := index.NextID(); return err },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, utils.ErrImmutable) {
+			t.Errorf("%s: expected ErrImmutable, got %v", name, err)
+		}
+	}
+	// Reads should still work, and take no latches: hold the root's latch throughout
+	rootPage, err := index.GetPager().GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootPage.WLock()
+	withDeadline(t, "reading a frozen table", func() {
+		for key := int64(0); key < numKeys; key++ {
+			if entry, err := index.Find(key); err != nil || entry.GetValue() != key%btree_salt {
+				t.Errorf("key %d: expected value %d, got %v (%v)", key, key%btree_salt, entry, err)
+			}
+		}
+		if _, err := index.Find(numKeys); err == nil {
+			t.Errorf("expected key %d to be missing", numKeys)
+		}
+		if entries, err := index.Select(); err != nil || int64(len(entries)) != numKeys {
+			t.Errorf("expected %d entries, got %d (%v)", numKeys, len(entries), err)
+		}
+		if count, err := index.Count(); err != nil || count != numKeys {
+			t.Errorf("expected count %d, got %d (%v)", numKeys, count, err)
+		}
+	})
+	rootPage.WUnlock()
+	rootPage.Put()
+}
+
+func testBTreeRawScan(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	// Init a database small enough per leaf that the scan crosses many leaves
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// checkScan checks that the raw scan yields the same entries as Select
+	checkScan := func() {
+		expected, err := index.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		it, err := index.RawScan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; ; i++ {
+			key, value, ok := it.Next()
+			if !ok {
+				if i != len(expected) {
+					t.Errorf("expected %d entries, got %d", len(expected), i)
+				}
+				break
+			}
+			if i >= len(expected) || key != expected[i].GetKey() || value != expected[i].GetValue() {
+				t.Fatalf("entry %d: expected %v, got (%d, %d)", i, expected[i:], key, value)
+			}
+		}
+		// An exhausted iterator stays exhausted
+		if _, _, ok := it.Next(); ok {
+			t.Error("expected no entries past the end")
+		}
+	}
+	checkScan()
+	for _, key := range rand.Perm(1000) {
+		if err = index.Insert(int64(key), int64(key)%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkScan()
+	// Deleted entries are skipped, including whole leaves of them
+	if err = index.SetTombstoneMode(true); err != nil {
+		t.Fatal(err)
+	}
+	for key := int64(0); key < 1000; key++ {
+		if key%3 == 0 || (key >= 400 && key < 500) {
+			if err = index.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkScan()
+}
+
+// fillBTreeForScan returns a table holding the given number of entries.
+func fillBTreeForScan(b *testing.B, dbName string, n int64) *btree.BTreeIndex {
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for key := int64(0); key < n; key++ {
+		if err = index.Insert(key, key); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return index
+}
+
+func BenchmarkBTreeScanBoxed(b *testing.B) {
+	dbName := getTempBTreeDB(b)
+	defer os.Remove(dbName)
+	index := fillBTreeForScan(b, dbName, 100000)
+	defer index.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cursor, err := index.TableStart()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var sum int64
+		for {
+			if !cursor.IsEnd() {
+				entry, err := cursor.GetEntry()
+				if err != nil {
+					b.Fatal(err)
+				}
+				sum += entry.GetValue()
+			}
+			if err = cursor.StepForward(); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkBTreeScanRaw(b *testing.B) {
+	dbName := getTempBTreeDB(b)
+	defer os.Remove(dbName)
+	index := fillBTreeForScan(b, dbName, 100000)
+	defer index.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it, err := index.RawScan()
+		if err != nil {
+			b.Fatal(err)
+		}
+		var sum int64
+		for {
+			_, value, ok := it.Next()
+			if !ok {
+				break
+			}
+			sum += value
+		}
+	}
+}
+
+func testBTreeNullEntry(t *testing.T) {
+	// A null entry and an entry holding 0 read back as different entries
+	var null, zero, decoded btree.BTreeEntry
+	null.SetKey(7)
+	null.SetNull()
+	zero.SetKey(7)
+	zero.SetValue(0)
+	if !null.IsNull() || zero.IsNull() {
+		t.Fatal("expected only the null entry to be null")
+	}
+	for _, entry := range []btree.BTreeEntry{null, zero} {
+		if err := decoded.Unmarshal(entry.Marshal()); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != entry || decoded.IsNull() != entry.IsNull() || decoded.GetValue() != 0 {
+			t.Errorf("entry %v did not survive a round trip, got %v", entry, decoded)
+		}
+	}
+	// Setting a value clears the null
+	null.SetValue(3)
+	if null.IsNull() || null.GetValue() != 3 {
+		t.Errorf("expected setting a value to clear the null, got %v", null)
+	}
+	// Stored entries are not null
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err = index.Insert(7, 0); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := index.Find(7); err != nil || entry.IsNull() {
+		t.Errorf("expected a stored zero not to be null, got %v, %v", entry, err)
+	}
+}
+
+func testBTreeMayContain(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Without a filter, every key may be present
+	if !index.MayContain(42) {
+		t.Error("expected every key to be possible without a filter")
+	}
+	for key := int64(0); key < 500; key++ {
+		if err = index.Insert(key*2, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = index.RebuildFilter(); err != nil {
+		t.Fatal(err)
+	}
+	// Run a mixed workload, with inserts racing a rebuild of the filter
+	present := make(map[int64]bool)
+	for key := int64(0); key < 500; key++ {
+		present[key*2] = true
+	}
+	rng := rand.New(rand.NewSource(int64(len(present))))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := index.RebuildFilter(); err != nil {
+			t.Error(err)
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		key := rng.Int63n(4000)
+		switch rng.Intn(3) {
+		case 0:
+			if err = index.Insert(key, key); err == nil {
+				present[key] = true
+			}
+		case 1:
+			if err = index.Upsert(key, key+1); err != nil {
+				t.Fatal(err)
+			}
+			present[key] = true
+		case 2:
+			if err = index.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(present, key)
+		}
+	}
+	wg.Wait()
+	// No present key may be reported absent, before or after a rebuild
+	checkPresent := func() {
+		for key := range present {
+			if !index.MayContain(key) {
+				t.Fatalf("present key %d was reported absent", key)
+			}
+		}
+	}
+	checkPresent()
+	if err = index.RebuildFilter(); err != nil {
+		t.Fatal(err)
+	}
+	checkPresent()
+	// Most absent keys should be ruled out
+	falsePositives := 0
+	for key := int64(10000); key < 11000; key++ {
+		if index.MayContain(key) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("expected few of 1000 absent keys to pass the filter, got %d", falsePositives)
+	}
+	// Dropping the filter makes every key possible again
+	index.DropFilter()
+	if !index.MayContain(10000) {
+		t.Error("expected every key to be possible once the filter is dropped")
+	}
+}
+
+func testBTreeCrabbing(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a table with small nodes, so that it is several levels deep
+	oldKeys := btree.KEYS_PER_INTERNAL_NODE
+	btree.KEYS_PER_INTERNAL_NODE = 4
+	defer func() {
+		btree.KEYS_PER_INTERNAL_NODE = oldKeys
+	}()
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	n := int64(100)
+	for i := int64(0); i < n; i++ {
+		if err = index.Insert(2*i, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if height, err := index.Height(); err != nil || height < 3 {
+		t.Fatalf("expected at least 3 levels, got %d (%v)", height, err)
+	}
+	// Stall an insert at the leftmost nodes, which have room, when it first writes below the root
+	stalledKey := int64(-1)
+	stalled, resume := make(chan bool), make(chan bool)
+	var once sync.Once
+	index.GetPager().SetUpdateHook(func(pagenum int64, offset int64, data []byte) {
+		if pagenum != btree.ROOT_PN {
+			once.Do(func() {
+				close(stalled)
+				<-resume
+			})
+		}
+	})
+	done := make(chan error)
+	go func() {
+		done <- index.Insert(stalledKey, 1)
+	}()
+	<-stalled
+	index.GetPager().SetUpdateHook(nil)
+	// The stalled insert has released the root, so writes and reads in other subtrees go ahead
+	key := 2*n + 1
+	if uint64(key)%btree.NUM_KEY_LOCKS == uint64(stalledKey)%btree.NUM_KEY_LOCKS {
+		key += 2
+	}
+	withDeadline(t, "crabbing", func() {
+		if err := index.Insert(key, 1); err != nil {
+			t.Error(err)
+		}
+		if err := index.Delete(2 * (n - 1)); err != nil {
+			t.Error(err)
+		}
+		if entry, err := index.Find(key); err != nil || entry.GetValue() != 1 {
+			t.Errorf("expected to find key %d, got %v (%v)", key, entry, err)
+		}
+	})
+	close(resume)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	// Every write should be counted once
+	if count, err := index.Count(); err != nil || count != n+1 {
+		t.Errorf("expected count %d, got %d (%v)", n+1, count, err)
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("tree failed the structural check: %v", err)
+	}
+	// Concurrent inserts and deletes across the tree keep every subtree count exact
+	var wg sync.WaitGroup
+	for w := int64(0); w < 4; w++ {
+		wg.Add(1)
+		go func(w int64) {
+			defer wg.Done()
+			for i := int64(0); i < n; i++ {
+				if i%4 != w {
+					continue
+				}
+				if err := index.Delete(2 * i); err != nil {
+					t.Error(err)
+				}
+				if err := index.Insert(2*i+1, i%btree_salt); err != nil {
+					t.Error(err)
+				}
+				if _, err := index.Find(2*i + 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if count, err := index.Count(); err != nil || count != n+2 {
+		t.Errorf("expected count %d, got %d (%v)", n+2, count, err)
+	}
+	if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+		t.Fatalf("tree failed the structural check after concurrent writes: %v", err)
+	}
+}
+
+func testBTreeCursorSnapshot(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+
+	// Init a database with several leaves
+	index, err := btree.OpenTableWithLeafCapacity(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 20; i++ {
+		if err = index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A cursor reads its leaf as it was when the cursor was positioned
+	cursors := map[string]func() (utils.Cursor, error){
+		"table start":          index.TableStart,
+		"table end":            index.TableEnd,
+		"table find":           func() (utils.Cursor, error) { return index.TableFind(5) },
+		"cursor at an ordinal": func() (utils.Cursor, error) { return index.CursorAt(9) },
+	}
+	for name, position := range cursors {
+		cursor, err := position()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := entry.GetKey()
+		if err = index.Update(key, key+100); err != nil {
+			t.Fatal(err)
+		}
+		if entry, err = cursor.GetEntry(); err != nil || entry.GetKey() != key || entry.GetValue() != key {
+			t.Errorf("%s: expected the snapshot of (%d, %d), got %v (%v)", name, key, key, entry, err)
+		}
+		if err = index.Update(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
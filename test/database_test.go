@@ -0,0 +1,634 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	db "github.com/brown-csci1270/db/pkg/db"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	list "github.com/brown-csci1270/db/pkg/list"
+	repl "github.com/brown-csci1270/db/pkg/repl"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+)
+
+func TestDatabase(t *testing.T) {
+	t.Run("TestDatabaseCSVRoundTrip", testDatabaseCSVRoundTrip)
+	t.Run("TestDatabaseVerify", testDatabaseVerify)
+	t.Run("TestDatabaseListTables", testDatabaseListTables)
+	t.Run("TestDatabaseManifest", testDatabaseManifest)
+	t.Run("TestDatabaseSelectInto", testDatabaseSelectInto)
+	t.Run("TestDatabaseTypedTable", testDatabaseTypedTable)
+	t.Run("TestDatabaseAnalyze", testDatabaseAnalyze)
+	t.Run("TestDatabaseAnalyzeDescending", testDatabaseAnalyzeDescending)
+	t.Run("TestDatabasePageDump", testDatabasePageDump)
+}
+
+func getTempDatabase(t *testing.T) (string, *db.Database) {
+	dir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, database
+}
+
+func testDatabaseCSVRoundTrip(t *testing.T) {
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+	var out bytes.Buffer
+
+	// Create and populate the source table
+	if err := db.HandleCreateTable(database, "create btree table src", &out); err != nil {
+		t.Fatal(err)
+	}
+	src, _ := database.GetTable("src")
+	for i := int64(0); i < 500; i++ {
+		if err := src.Insert(i, -i); err != nil {
+			t.Error(err)
+		}
+	}
+	// Export it, then append some malformed lines
+	csvPath := filepath.Join(dir, "src.csv")
+	if err := db.HandleExport(database, "export src "+csvPath, &out); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(csvPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("abc,1\n1000,xyz\n1001\n1002,1002\n")
+	file.Close()
+	// Import into a fresh table; bad lines are reported but don't abort
+	if err := db.HandleCreateTable(database, "create btree table dst", &out); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := db.HandleImport(database, "import dst "+csvPath, &out); err == nil {
+		t.Error("expected import to report malformed lines")
+	}
+	if !bytes.Contains(out.Bytes(), []byte("imported 501 entries")) {
+		t.Errorf("unexpected import report: %s", out.String())
+	}
+	// Check that every entry made it across
+	dst, _ := database.GetTable("dst")
+	entries, err := dst.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 501 {
+		t.Errorf("expected 501 entries after import, got %d", len(entries))
+	}
+	for i := int64(0); i < 500; i++ {
+		entry, err := dst.Find(i)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if entry.GetValue() != -i {
+			t.Errorf("expected value %d for key %d, got %d", -i, i, entry.GetValue())
+		}
+	}
+}
+
+func testDatabaseVerify(t *testing.T) {
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	// Hash tables keep their metadata file in the working directory.
+	defer os.Remove("good.meta")
+	defer os.Remove("bad.meta")
+	defer database.Close()
+	var out bytes.Buffer
+
+	// Create and populate one table of each type, plus a hash table to corrupt
+	for _, cmd := range []string{"create btree table tree", "create hash table good", "create hash table bad"} {
+		if err := db.HandleCreateTable(database, cmd, &out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"tree", "good", "bad"} {
+		table, _ := database.GetTable(name)
+		for i := int64(0); i < 1000; i++ {
+			if err := table.Insert(i, i); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if err := db.Verify(database); err != nil {
+		t.Fatalf("expected a consistent database, got %v", err)
+	}
+	// Place an entry in a bucket that its key doesn't hash to
+	bad, _ := database.GetTable("bad")
+	table := bad.(*hash.HashIndex).GetTable()
+	key := int64(1000)
+	for hash.Hasher(key, table.GetDepth()) == 0 {
+		key++
+	}
+	bucket, err := table.GetBucket(0, hash.NO_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket.Insert(key, key)
+	bucket.GetPage().Put()
+	// Only the corrupted table should be reported
+	err = db.Verify(database)
+	if err == nil {
+		t.Fatal("expected verify to report the corrupted table")
+	}
+	out.Reset()
+	db.HandleVerify(database, "verify", &out)
+	expected := "bad: entry found in the wrong bucket\ngood: ok\ntree: ok\n"
+	if out.String() != expected {
+		t.Errorf("expected verify output %q, got %q", expected, out.String())
+	}
+}
+
+func testDatabaseListTables(t *testing.T) {
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	// Hash tables keep their metadata file in the working directory.
+	defer os.Remove("good.meta")
+	defer database.Close()
+	r := db.DatabaseRepl(database)
+
+	// An empty database has nothing to list
+	output := runReplScript(t, r, ".tables\n")
+	if !strings.Contains(output, "no open tables\n") {
+		t.Errorf("expected no tables to be listed, got %q", output)
+	}
+	// Created tables are listed in name order, with their types and sizes
+	output = runReplScript(t, r, "create hash table good\ncreate btree table tree\n.tables\n.help\n")
+	good, _ := database.GetTable("good")
+	tree, _ := database.GetTable("tree")
+	expected := fmt.Sprintf("good: hash, %d pages\ntree: btree, %d pages\n",
+		good.GetPager().GetNumPages(), tree.GetPager().GetNumPages())
+	if !strings.Contains(output, expected) {
+		t.Errorf("expected tables %q in output, got %q", expected, output)
+	}
+	if !strings.Contains(output, ".tables: ") {
+		t.Error("expected .tables to be listed in help")
+	}
+	if output = runReplScript(t, r, ".tables extra\n"); !strings.Contains(output, "usage: .tables") {
+		t.Errorf("expected a usage error, got %q", output)
+	}
+}
+
+func testDatabaseManifest(t *testing.T) {
+	// Well-formed manifests parse, skipping comments and blank lines
+	entries, err := db.ParseManifest(strings.NewReader(
+		"# tables to serve\n\nusers btree users.db\n  scores   hash /tmp/scores.db  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []db.ManifestEntry{
+		{Name: "users", Type: db.BTreeIndexType, File: "users.db"},
+		{Name: "scores", Type: db.HashIndexType, File: "/tmp/scores.db"},
+	}
+	if fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, entries)
+	}
+	// Malformed manifests are rejected with the offending line
+	for _, manifest := range []string{
+		"users btree\n",
+		"users btree users.db extra\n",
+		"users list users.db\n",
+		"us-ers btree users.db\n",
+		"users btree a.db\nusers hash b.db\n",
+	} {
+		if _, err = db.ParseManifest(strings.NewReader(manifest)); err == nil || !strings.Contains(err.Error(), "line ") {
+			t.Errorf("expected manifest %q to be rejected with a line number, got %v", manifest, err)
+		}
+	}
+	if _, err = db.ReadManifest("missing-manifest"); err == nil {
+		t.Error("expected a missing manifest to be rejected")
+	}
+
+	// Open a manifest with a stubbed opener
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+	opened := make([]string, 0)
+	stub := func(path string, indexType db.IndexType) (db.Index, error) {
+		opened = append(opened, fmt.Sprintf("%s:%d", path, indexType))
+		if indexType == db.HashIndexType {
+			return nil, fmt.Errorf("no hash tables")
+		}
+		return btree.OpenTable(path)
+	}
+	if err = database.OpenManifest(expected[:1], stub); err != nil {
+		t.Fatal(err)
+	}
+	if err = database.OpenManifest(expected[1:], stub); err == nil || !strings.Contains(err.Error(), "scores") {
+		t.Errorf("expected the opener's error to name the table, got %v", err)
+	}
+	expectedOpens := []string{filepath.Join(database.GetBasePath(), "users.db") + ":0", "/tmp/scores.db:1"}
+	if fmt.Sprint(opened) != fmt.Sprint(expectedOpens) {
+		t.Errorf("expected opens %v, got %v", expectedOpens, opened)
+	}
+	if err = database.OpenManifest(expected[:1], stub); err == nil {
+		t.Error("expected reopening an open table to fail")
+	}
+	// The manifest's tables are served alongside the list REPL
+	r, err := repl.CombineRepls([]*repl.REPL{list.ListRepl(list.NewList()), db.DatabaseRepl(database)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := runReplScript(t, r, "insert 1 10 into users\nfind 1 from users\nlist_push_head 5\nlist_print\n.tables\n")
+	for _, want := range []string{"found entry: (1, 10)", "5, ", "users: btree"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got %q", want, output)
+		}
+	}
+}
+
+func testDatabaseSelectInto(t *testing.T) {
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+
+	// Populate a hash table, whose entries come back in no particular order
+	hashName := getTempHashDB(t)
+	defer os.Remove(hashName)
+	defer os.Remove(hashName + ".meta")
+	src, err := hash.OpenTable(hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	expected := make(map[int64]int64)
+	for i := int64(0); i < 1000; i++ {
+		if err := src.Insert(i, i%7); err != nil {
+			t.Error(err)
+		}
+		if i%7 == 3 {
+			expected[i] = i % 7
+		}
+	}
+	// Copy the matching entries into a new table
+	matches := func(entry utils.Entry) bool {
+		return entry.GetValue() == 3
+	}
+	if err = database.SelectInto(src, "threes", matches); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := database.GetTable("threes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dst.(*btree.BTreeIndex); !ok {
+		t.Errorf("expected a B+ tree, got %T", dst)
+	}
+	checkTableContents(t, dst, expected)
+	if err = db.VerifyTable(dst); err != nil {
+		t.Error(err)
+	}
+	// Existing tables are never overwritten
+	if err = database.SelectInto(src, "threes", matches); err == nil {
+		t.Error("expected copying into an existing table to fail")
+	}
+	checkTableContents(t, dst, expected)
+	// An empty result still creates the table
+	none := func(utils.Entry) bool { return false }
+	if err = database.SelectInto(dst, "empty", none); err != nil {
+		t.Fatal(err)
+	}
+	empty, err := database.GetTable("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTableContents(t, empty, map[int64]int64{})
+}
+
+func testDatabaseTypedTable(t *testing.T) {
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+
+	schema, err := db.ParseSchema("id:int name:string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := database.CreateTypedTable("people", schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rows go in with any length of string, including one that spans several pages
+	long := strings.Repeat("abcdefgh", 1000)
+	rows := []db.Row{{int64(3), "carol"}, {int64(1), "alice"}, {int64(2), long}, {int64(4), ""}}
+	for _, row := range rows {
+		if err = table.Insert(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = table.Insert(db.Row{int64(1), "again"}); err == nil {
+		t.Error("expected inserting a duplicate key to fail")
+	}
+	if err = table.Insert(db.Row{int64(5), true}); err == nil {
+		t.Error("expected inserting a bool into a string column to fail")
+	}
+	// Of several clients racing to insert the same key, exactly one succeeds
+	var wg sync.WaitGroup
+	var inserted int64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if table.Insert(db.Row{int64(9), fmt.Sprint(i)}) == nil {
+				atomic.AddInt64(&inserted, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if inserted != 1 {
+		t.Errorf("expected exactly one insert of key 9 to succeed, %d did", inserted)
+	}
+	if err = table.GetIndex().Delete(9); err != nil {
+		t.Fatal(err)
+	}
+	if row, err := table.Find(2); err != nil || row[1] != long {
+		t.Errorf("expected to find the long row, got %v", err)
+	}
+	// checkRows checks that the table holds the inserted rows, in key order
+	checkRows := func(table *db.TypedTable) {
+		selected, err := table.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []db.Row{rows[1], rows[2], rows[0], rows[3]}
+		if len(selected) != len(expected) {
+			t.Fatalf("expected %d rows, got %d", len(expected), len(selected))
+		}
+		for i, row := range selected {
+			if row[0] != expected[i][0] || row[1] != expected[i][1] {
+				t.Errorf("expected row %v, got %v", expected[i][0], row[0])
+			}
+		}
+	}
+	checkRows(table)
+
+	// The schema and rows survive reopening the database
+	if err = database.Close(); err != nil {
+		t.Fatal(err)
+	}
+	database, err = db.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if table, err = database.GetTypedTable("people"); err != nil {
+		t.Fatal(err)
+	}
+	if table.GetSchema().String() != "id:int name:string" {
+		t.Errorf("expected the schema to be kept, got %q", table.GetSchema())
+	}
+	checkRows(table)
+
+	// Typed rows can be inserted and selected through the REPL
+	r := db.DatabaseRepl(database)
+	output := runReplScript(t, r, "typed_create flags id:int label:string on:bool\n"+
+		"typed_insert flags 7 seven true\ntyped_insert flags 2 two false\ntyped_insert flags 3 three maybe\n"+
+		"typed_select flags\n")
+	if !strings.Contains(output, "typed table flags created.") || !strings.Contains(output, "(2, two, false)\n(7, seven, true)\n") {
+		t.Errorf("expected the typed rows in key order, got %q", output)
+	}
+	if !strings.Contains(output, "typed_insert error") {
+		t.Errorf("expected a malformed bool to be rejected, got %q", output)
+	}
+	// Schemas need an int primary key
+	if _, err = db.ParseSchema("name:string id:int"); err == nil {
+		t.Error("expected a string primary key to be rejected")
+	}
+	if _, err = database.GetTypedTable("missing"); err == nil {
+		t.Error("expected a missing table to fail")
+	}
+}
+
+func testDatabaseAnalyze(t *testing.T) {
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	defer os.Remove("h.meta")
+
+	// Fill a hash table with 1000 keys over 10 distinct values
+	var out bytes.Buffer
+	if err := db.HandleCreateTable(database, "create hash table h", &out); err != nil {
+		t.Fatal(err)
+	}
+	table, err := database.GetTable("h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := int64(0); k < 1000; k++ {
+		if err = table.Insert(k, k%10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Without statistics, estimates come from the table itself
+	if _, err = database.GetStats("h"); err != db.ErrNoStats {
+		t.Errorf("expected no statistics before analyzing, got %v", err)
+	}
+	if estimate, err := db.EstimateCardinality(database, "h", 0, 100); err != nil || estimate != 100 {
+		t.Errorf("expected a live estimate of 100, got %d (%v)", estimate, err)
+	}
+	// Analyze computes every statistic
+	stats, err := db.Analyze(database, "h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 1000 || stats.DistinctValues != 10 || stats.MinKey != 0 || stats.MaxKey != 999 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+	if len(stats.Histogram) != db.STATS_HISTOGRAM_BUCKETS {
+		t.Errorf("expected %d histogram buckets, got %d", db.STATS_HISTOGRAM_BUCKETS, len(stats.Histogram))
+	}
+	total := int64(0)
+	for _, bucket := range stats.Histogram {
+		total += bucket.Count
+	}
+	if total != 1000 {
+		t.Errorf("expected the histogram to count 1000 keys, got %d", total)
+	}
+	for _, r := range [][3]int64{{0, 100, 100}, {250, 750, 500}, {-50, 0, 0}, {990, 5000, 10}} {
+		if estimate := stats.EstimateRange(r[0], r[1]); estimate < r[2]-5 || estimate > r[2]+5 {
+			t.Errorf("expected about %d keys in [%d, %d), estimated %d", r[2], r[0], r[1], estimate)
+		}
+	}
+	// Once analyzed, estimates come from the stored statistics, even as they go stale
+	for k := int64(1000); k < 2000; k++ {
+		if err = table.Insert(k, k%10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if estimate, err := db.EstimateCardinality(database, "h", 0, 5000); err != nil || estimate != 1000 {
+		t.Errorf("expected the stored estimate of 1000, got %d (%v)", estimate, err)
+	}
+	// Analyzing again refreshes them, and they outlive the database
+	r := db.DatabaseRepl(database)
+	if output := runReplScript(t, r, "analyze h\n"); !strings.Contains(output, "count 2000\n") {
+		t.Errorf("expected analyze to print the new count, got %q", output)
+	}
+	if output := runReplScript(t, r, "analyze\n"); !strings.Contains(output, "usage: analyze <table>") {
+		t.Errorf("expected a usage error, got %q", output)
+	}
+	// With fewer keys sampled than in the table, the histogram still covers every key once
+	defer func(size int) { db.STATS_SAMPLE_SIZE = size }(db.STATS_SAMPLE_SIZE)
+	db.STATS_SAMPLE_SIZE = 50
+	if stats, err = db.Analyze(database, "h"); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 2000 || stats.MinKey != 0 || stats.MaxKey != 1999 {
+		t.Errorf("unexpected sampled statistics %+v", stats)
+	}
+	total = 0
+	for i, bucket := range stats.Histogram {
+		if bucket.Lo > bucket.Hi || (i > 0 && bucket.Lo <= stats.Histogram[i-1].Hi) {
+			t.Errorf("expected ordered, disjoint buckets, got %+v", stats.Histogram)
+			break
+		}
+		total += bucket.Count
+	}
+	if total != 2000 {
+		t.Errorf("expected the sampled histogram to count 2000 keys, got %d", total)
+	}
+	if err = database.Close(); err != nil {
+		t.Fatal(err)
+	}
+	database, err = db.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if stats, err = database.GetStats("h"); err != nil || stats.Count != 2000 || stats.MaxKey != 1999 {
+		t.Errorf("expected the refreshed statistics after reopening, got %+v (%v)", stats, err)
+	}
+	if estimate, err := db.EstimateCardinality(database, "h", 0, 5000); err != nil || estimate != 2000 {
+		t.Errorf("expected the stored estimate of 2000, got %d (%v)", estimate, err)
+	}
+	// Dropping the table drops its statistics
+	if err = database.DropTable("h"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "h"+db.STATS_SUFFIX)); !os.IsNotExist(err) {
+		t.Errorf("expected the statistics to be removed, got %v", err)
+	}
+}
+
+func testDatabaseAnalyzeDescending(t *testing.T) {
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+
+	// Fill a descending B+ tree with 1000 keys, which the database then opens as is
+	tree, err := btree.OpenTableWithOrder(filepath.Join(dir, "d"), btree.DESCENDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := int64(0); k < 1000; k++ {
+		if err = tree.Insert(k, k%10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Live estimates take the range in key order, whatever the table's order
+	for _, r := range [][3]int64{{0, 100, 100}, {250, 750, 500}, {-50, 0, 0}, {990, 5000, 10}, {500, 500, 0}, {math.MinInt64, 10, 10}} {
+		if estimate, err := db.EstimateCardinality(database, "d", r[0], r[1]); err != nil || estimate != r[2] {
+			t.Errorf("expected a live estimate of %d in [%d, %d), got %d (%v)", r[2], r[0], r[1], estimate, err)
+		}
+	}
+	// Analyze buckets the keys in ascending order
+	stats, err := db.Analyze(database, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 1000 || stats.DistinctValues != 10 || stats.MinKey != 0 || stats.MaxKey != 999 {
+		t.Errorf("unexpected statistics %+v", stats)
+	}
+	if len(stats.Histogram) != db.STATS_HISTOGRAM_BUCKETS {
+		t.Fatalf("expected %d histogram buckets, got %d", db.STATS_HISTOGRAM_BUCKETS, len(stats.Histogram))
+	}
+	size := int64(1000 / db.STATS_HISTOGRAM_BUCKETS)
+	next := int64(0)
+	for i, bucket := range stats.Histogram {
+		if bucket.Lo != next || bucket.Count != bucket.Hi-bucket.Lo+1 || bucket.Count < size || bucket.Count > size+1 {
+			t.Errorf("unexpected bucket %d: %+v", i, bucket)
+		}
+		next = bucket.Hi + 1
+	}
+	for _, r := range [][3]int64{{0, 100, 100}, {250, 750, 500}, {-50, 0, 0}, {990, 5000, 10}} {
+		if estimate := stats.EstimateRange(r[0], r[1]); estimate < r[2]-5 || estimate > r[2]+5 {
+			t.Errorf("expected about %d keys in [%d, %d), estimated %d", r[2], r[0], r[1], estimate)
+		}
+	}
+}
+
+func testDatabasePageDump(t *testing.T) {
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	defer os.Remove("hd.meta")
+	defer database.Close()
+	var out bytes.Buffer
+	for _, payload := range []string{"create btree table b", "create hash table hd"} {
+		if err := db.HandleCreateTable(database, payload, &out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"b", "hd"} {
+		table, err := database.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := int64(0); k < 3; k++ {
+			if err = table.Insert(k, k*100); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The root of a small B+ tree is a leaf holding every entry
+	out.Reset()
+	if err := db.HandlePageDump(database, "page_dump b 1", &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"btree leaf node\n",
+		"node type: 0x01 (offset 0)\n",
+		"numKeys: 3 (offset 1)\n",
+		"right sibling: -1 (offset 11)\n",
+		"00000000  01 06 ",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected the dump to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+	// Hash pages are annotated as buckets
+	out.Reset()
+	if err := db.HandlePageDump(database, "page_dump hd 0", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "hash bucket\n") || !strings.Contains(out.String(), "numKeys: ") {
+		t.Errorf("expected a hash bucket header, got:\n%s", out.String())
+	}
+	// Out-of-range pages and malformed commands are rejected
+	pages := database.GetTables()["b"].GetPager().GetNumPages()
+	for payload, expected := range map[string]string{
+		fmt.Sprintf("page_dump b %d", pages): "out of range",
+		"page_dump b -1":                     "out of range",
+		"page_dump missing 0":                "page_dump error",
+		"page_dump b":                        "usage: page_dump <table> <pagenum>",
+	} {
+		if err := db.HandlePageDump(database, payload, &out); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected an error containing %q, got %v", payload, expected, err)
+		}
+	}
+}
@@ -1,12 +1,23 @@
 package test
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"sync"
 	"testing"
+	"testing/quick"
+	"time"
 
+	btree "github.com/brown-csci1270/db/pkg/btree"
 	hash "github.com/brown-csci1270/db/pkg/hash"
+	pager "github.com/brown-csci1270/db/pkg/pager"
+	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
 type hash_kv struct {
@@ -51,6 +62,384 @@ func TestHashTA(t *testing.T) {
 	t.Run("TestHashUpdateTen", testHashUpdateTen)
 }
 
+func TestHash(t *testing.T) {
+	t.Run("TestHashBucketSize", testHashBucketSize)
+	t.Run("TestHashOverflowChains", testHashOverflowChains)
+	t.Run("TestHashCollidingKeys", testHashCollidingKeys)
+	t.Run("TestHashChainReclaim", testHashChainReclaim)
+	t.Run("TestHashNegativeKeys", testHashNegativeKeys)
+	t.Run("TestHashCorruptedBucket", testHashCorruptedBucket)
+	t.Run("TestHashCachedCount", testHashCachedCount)
+	t.Run("TestHashSelectSorted", testHashSelectSorted)
+	t.Run("TestHashSelectCancel", testHashSelectCancel)
+	t.Run("TestHashContains", testHashContains)
+	t.Run("TestHashSelectProject", testHashSelectProject)
+	t.Run("TestHashGetBucketResolved", testHashGetBucketResolved)
+	t.Run("TestHashScanner", testHashScanner)
+	t.Run("TestHashEntryRoundTrip", testHashEntryRoundTrip)
+	t.Run("TestHashFormatVersion", testHashFormatVersion)
+	t.Run("TestHashLegacyFile", testHashLegacyFile)
+	t.Run("TestHashStoredHasher", testHashStoredHasher)
+	t.Run("TestHashConcurrentFindInsert", testHashConcurrentFindInsert)
+	t.Run("TestHashPartitionFunc", testHashPartitionFunc)
+	t.Run("TestHashRingTable", testHashRingTable)
+	t.Run("TestHashSelectLimit", testHashSelectLimit)
+	t.Run("TestHashFullBucket", testHashFullBucket)
+	t.Run("TestHashFreeze", testHashFreeze)
+	t.Run("TestHashTryShrink", testHashTryShrink)
+	t.Run("TestHashNullEntry", testHashNullEntry)
+	t.Run("TestHashOptimisticFind", testHashOptimisticFind)
+	t.Run("TestHashVersionNotPersisted", testHashVersionNotPersisted)
+	t.Run("TestHashSelectDuringChainWrites", testHashSelectDuringChainWrites)
+}
+
+func testHashBucketSize(t *testing.T) {
+	smallName := getTempHashDB(t)
+	defer os.Remove(smallName)
+	defer os.Remove(smallName + ".meta")
+	largeName := getTempHashDB(t)
+	defer os.Remove(largeName)
+	defer os.Remove(largeName + ".meta")
+
+	// Init two databases with different bucket sizes
+	small, err := hash.OpenTableWithBucketSize(smallName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := hash.OpenTable(largeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert the same entries into both
+	entries, _ := genRandomHashEntries(200)
+	for _, e := range entries {
+		if err = small.Insert(e.key, e.val); err != nil {
+			t.Error(err)
+		}
+		if err = large.Insert(e.key, e.val); err != nil {
+			t.Error(err)
+		}
+	}
+	if small.GetTable().GetDepth() <= large.GetTable().GetDepth() {
+		t.Errorf("expected small-bucket table to be deeper, got %d vs %d",
+			small.GetTable().GetDepth(), large.GetTable().GetDepth())
+	}
+	// Close and reopen; the bucket size should be read back
+	small.Close()
+	large.Close()
+	small, err = hash.OpenTable(smallName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err = hash.OpenTable(largeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small.GetTable().GetBucketSize() != 4 {
+		t.Errorf("expected bucket size 4, got %d", small.GetTable().GetBucketSize())
+	}
+	if large.GetTable().GetBucketSize() != hash.BUCKETSIZE {
+		t.Errorf("expected default bucket size, got %d", large.GetTable().GetBucketSize())
+	}
+	// Retrieve entries from both
+	for _, e := range entries {
+		for _, index := range []*hash.HashIndex{small, large} {
+			entry, err := index.Find(e.key)
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			if entry.GetValue() != e.val {
+				t.Error("Entry found has the wrong value")
+			}
+		}
+	}
+	small.Close()
+	large.Close()
+}
+
+func testHashOverflowChains(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init the database in overflow mode
+	index, err := hash.OpenTableWithBucketSize(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.GetTable().SetOverflowMode(true)
+	depth := index.GetTable().GetDepth()
+	// Generate a skewed key set that all lands in the same bucket
+	keys := make([]int64, 0)
+	for k := int64(0); len(keys) < 50; k++ {
+		if hash.Hasher(k, depth) == 0 {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		if err = index.Insert(k, k%hash_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// The directory should not have grown, so the bucket must have chained
+	if index.GetTable().GetDepth() != depth {
+		t.Errorf("expected depth %d, got %d", depth, index.GetTable().GetDepth())
+	}
+	bucket, err := index.GetTable().GetBucket(0, hash.NO_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.GetNextOverflowPN() == hash.NO_OVERFLOW_PN {
+		t.Error("expected an overflow chain to form")
+	}
+	bucket.GetPage().Put()
+	// The check walks the chain through read-only pages
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Errorf("expected a valid hash table, got %v (%v)", ok, err)
+	}
+	// Close and reopen the database
+	index.Close()
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.GetTable().GetOverflowMode() {
+		t.Error("overflow mode was not persisted")
+	}
+	// Update and delete half of the keys, then check all of them
+	for i, k := range keys {
+		if i%2 == 0 {
+			err = index.Delete(k)
+		} else {
+			err = index.Update(k, -k)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for i, k := range keys {
+		entry, err := index.Find(k)
+		if i%2 == 0 {
+			if err == nil {
+				t.Errorf("found deleted key %d", k)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("could not find key %d: %v", k, err)
+		} else if entry.GetValue() != -k {
+			t.Errorf("wrong value for key %d", k)
+		}
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(entries) != len(keys)/2 {
+		t.Errorf("expected %d entries, got %d", len(keys)/2, len(entries))
+	}
+	index.Close()
+}
+
+func testHashCollidingKeys(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	index, err := hash.OpenTableWithBucketSize(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	table := index.GetTable()
+	depth := table.GetDepth()
+	// Copies of one key can never be separated by a split
+	for i := int64(0); i < 20; i++ {
+		if err = table.Insert(7, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if table.GetDepth() != depth {
+		t.Errorf("expected depth %d, got %d", depth, table.GetDepth())
+	}
+	if entries, err := table.Select(); err != nil || len(entries) != 20 {
+		t.Errorf("expected 20 entries, got %d (%v)", len(entries), err)
+	}
+	// Distinct keys that collide in more bits than a split will look at chain too
+	collisionBits := depth + hash.MAX_SPLIT_BITS + 2
+	keys := make([]int64, 0)
+	for k := int64(8); len(keys) < 20; k++ {
+		if hash.Hasher(k, collisionBits) == hash.Hasher(7, collisionBits) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		if err = table.Insert(k, k%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if table.GetDepth() != depth {
+		t.Errorf("expected depth %d, got %d", depth, table.GetDepth())
+	}
+	bucket, err := table.GetBucket(hash.Hasher(7, depth), hash.NO_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.GetNextOverflowPN() == hash.NO_OVERFLOW_PN {
+		t.Error("expected an overflow chain to form")
+	}
+	bucket.GetPage().Put()
+	for _, k := range keys {
+		if entry, err := table.Find(k); err != nil || entry.GetValue() != k%hash_salt {
+			t.Errorf("key %d: expected value %d, got %v (%v)", k, k%hash_salt, entry, err)
+		}
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Errorf("expected a valid hash table, got %v (%v)", ok, err)
+	}
+	// Keys that collide in fewer bits still split apart
+	shallowBits := depth + 2
+	shallow := make([]int64, 0)
+	for k := int64(-1); len(shallow) < 20; k-- {
+		if hash.Hasher(k, shallowBits) == 0 {
+			shallow = append(shallow, k)
+		}
+	}
+	for _, k := range shallow {
+		if err = table.Insert(k, k%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if table.GetDepth() <= shallowBits {
+		t.Errorf("expected the directory to deepen past %d, got %d", shallowBits, table.GetDepth())
+	}
+}
+
+func testHashChainReclaim(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	index, err := hash.OpenTableWithBucketSize(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := index.GetTable()
+	depth := table.GetDepth()
+	// Copies of one key chain off their bucket
+	for i := int64(0); i < 20; i++ {
+		if err = table.Insert(7, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	numPages := table.GetPager().GetNumPages()
+	// Emptied overflow buckets are unlinked from the chain
+	for i := 0; i < 20; i++ {
+		if err = table.Delete(7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bucket, err := table.GetBucket(hash.Hasher(7, depth), hash.NO_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.GetNextOverflowPN() != hash.NO_OVERFLOW_PN {
+		t.Error("expected the emptied overflow chain to be unlinked")
+	}
+	bucket.GetPage().Put()
+	// Their pages are reused, also after reopening the table
+	index.Close()
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	table = index.GetTable()
+	for i := int64(0); i < 20; i++ {
+		if err = table.Insert(7, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if table.GetPager().GetNumPages() != numPages {
+		t.Errorf("expected the chain to reuse freed pages, file grew from %d to %d pages", numPages, table.GetPager().GetNumPages())
+	}
+	// A chained bucket still splits once its keys separate
+	keys := make([]int64, 0)
+	for k := int64(8); len(keys) < 20; k++ {
+		if hash.Hasher(k, depth) == hash.Hasher(7, depth) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range keys {
+		if err = table.Insert(k, k%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if table.GetDepth() <= depth {
+		t.Errorf("expected the directory to deepen past %d, got %d", depth, table.GetDepth())
+	}
+	for _, k := range keys {
+		if entry, err := table.Find(k); err != nil || entry.GetValue() != k%hash_salt {
+			t.Errorf("key %d: expected value %d, got %v (%v)", k, k%hash_salt, entry, err)
+		}
+	}
+	if entries, err := table.Select(); err != nil || len(entries) != 40 {
+		t.Errorf("expected 40 entries, got %d (%v)", len(entries), err)
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Errorf("expected a valid hash table, got %v (%v)", ok, err)
+	}
+}
+
+func testHashNegativeKeys(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Hashes should always land in the directory, whatever the key
+	keys := []int64{0, -1, 1, -2, math.MinInt64, math.MaxInt64, math.MinInt64 + 1}
+	for i := int64(1); i <= 500; i++ {
+		keys = append(keys, -i*7919)
+	}
+	for _, key := range keys {
+		for depth := int64(0); depth <= 16; depth++ {
+			if h := hash.Hasher(key, depth); h < 0 || h >= int64(1)<<depth {
+				t.Fatalf("Hasher(%d, %d) = %d is out of range", key, depth, h)
+			}
+		}
+	}
+	// Init the database
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert entries
+	for _, key := range keys {
+		if err = index.Insert(key, key%hash_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// Close and reopen the database
+	index.Close()
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Retrieve entries
+	for _, key := range keys {
+		entry, err := index.Find(key)
+		if err != nil {
+			t.Errorf("could not find key %d: %v", key, err)
+			continue
+		}
+		if entry.GetValue() != key%hash_salt {
+			t.Error("Entry found has the wrong value")
+		}
+	}
+	index.Close()
+}
+
 func testHashInsertTenNoWrite(t *testing.T) {
 	dbName := getTempHashDB(t)
 	defer os.Remove(dbName)
@@ -380,3 +769,1465 @@ func testHashUpdateTen(t *testing.T) {
 	}
 	index.Close()
 }
+
+func testHashCorruptedBucket(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init the database
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Insert a few entries
+	for i := int64(0); i < 20; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// Write a bogus key count into the first bucket
+	bucket, err := index.GetTable().GetBucket(0, hash.NO_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numKeysData := make([]byte, hash.NUM_KEYS_SIZE)
+	binary.PutVarint(numKeysData, hash.BUCKETSIZE*4)
+	bucket.GetPage().Update(numKeysData, hash.NUM_KEYS_OFFSET, hash.NUM_KEYS_SIZE)
+	bucket.GetPage().Put()
+	// Reads that touch the bucket should error rather than return garbage
+	if _, err = index.Select(); err == nil {
+		t.Error("expected select on a corrupted bucket to error")
+	}
+	for i := int64(0); i < 20; i++ {
+		if hash.Hasher(i, index.GetTable().GetDepth()) != 0 {
+			continue
+		}
+		if _, err = index.Find(i); err == nil {
+			t.Errorf("expected find of key %d in a corrupted bucket to error", i)
+		}
+	}
+}
+
+func testHashCachedCount(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// checkCount compares the cached count against a fresh scan
+	checkCount := func(index *hash.HashIndex) {
+		entries, err := index.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count, err := index.Count(); err != nil || count != int64(len(entries)) {
+			t.Errorf("expected cached count %d, got %d (%v)", len(entries), count, err)
+		}
+	}
+	// Init the database with small buckets, chaining for part of the workload
+	index, err := hash.OpenTableWithBucketSize(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	present := make(map[int64]bool)
+	for round := 0; round < 2; round++ {
+		index.GetTable().SetOverflowMode(round == 1)
+		for i := 0; i < 1000; i++ {
+			key := rand.Int63n(1500)
+			switch rand.Intn(3) {
+			case 0:
+				err = index.Delete(key)
+				if (err == nil) != present[key] {
+					t.Errorf("unexpected delete result for key %d: %v", key, err)
+				}
+				delete(present, key)
+			case 1:
+				index.Update(key, key%hash_salt)
+			default:
+				if !present[key] {
+					if err = index.Insert(key, key%hash_salt); err != nil {
+						t.Error(err)
+					}
+					present[key] = true
+				}
+			}
+		}
+		checkCount(index)
+	}
+	if count, _ := index.Count(); count != int64(len(present)) {
+		t.Errorf("expected count %d, got %d", len(present), count)
+	}
+	// The count should survive a restart
+	index.Close()
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCount(index)
+	// Recomputing the count should agree with the cached one
+	if err = index.RecomputeCount(); err != nil {
+		t.Fatal(err)
+	}
+	checkCount(index)
+	// Counts written by later restarts should replace earlier ones
+	for key := range present {
+		if err = index.Delete(key); err != nil {
+			t.Error(err)
+		}
+		break
+	}
+	index.Close()
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := index.Count(); count != int64(len(present)-1) {
+		t.Errorf("expected count %d after a second restart, got %d", len(present)-1, count)
+	}
+	checkCount(index)
+	index.Close()
+	// A stale or corrupted stored count should be recomputed on open, not trusted
+	for _, stored := range []int64{0, -1, 1 << 40} {
+		setMetaField(t, dbName+".meta", hash.META_COUNT_OFFSET, stored)
+		index, err = hash.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkCount(index)
+		index.Close()
+	}
+}
+
+func testHashSelectSorted(t *testing.T) {
+	hashName := getTempHashDB(t)
+	defer os.Remove(hashName)
+	defer os.Remove(hashName + ".meta")
+	btreeName := getTempBTreeDB(t)
+	defer os.Remove(btreeName)
+
+	// Init a hash table with small buckets so that it splits, and a btree
+	hashIndex, err := hash.OpenTableWithBucketSize(hashName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashIndex.Close()
+	btreeIndex, err := btree.OpenTable(btreeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer btreeIndex.Close()
+	// Insert the same entries into both, including negative keys
+	entries, _ := genRandomHashEntries(500)
+	for _, e := range entries {
+		key := e.key - math.MaxInt64/2
+		if err = hashIndex.Insert(key, e.val); err != nil {
+			t.Error(err)
+		}
+		if err = btreeIndex.Insert(key, e.val); err != nil {
+			t.Error(err)
+		}
+	}
+	sorted, err := hashIndex.SelectSorted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := btreeIndex.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sorted) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(sorted))
+	}
+	for i, entry := range sorted {
+		if i > 0 && sorted[i-1].GetKey() >= entry.GetKey() {
+			t.Fatalf("entries are not strictly sorted at position %d", i)
+		}
+		if entry.GetKey() != expected[i].GetKey() || entry.GetValue() != expected[i].GetValue() {
+			t.Errorf("entry %d differs from the btree's: (%d, %d) vs (%d, %d)", i,
+				entry.GetKey(), entry.GetValue(), expected[i].GetKey(), expected[i].GetValue())
+		}
+	}
+}
+
+func testHashSelectCancel(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a hash table with small buckets so that it has many of them
+	index, err := hash.OpenTableWithBucketSize(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 1000; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	entries, err := index.SelectCtx(context.Background())
+	if err != nil || len(entries) != 1000 {
+		t.Errorf("expected %d entries, got %d (%v)", 1000, len(entries), err)
+	}
+	// A scan cancelled part of the way through should stop early
+	if _, err = index.SelectCtx(newCountdownContext(3)); err != context.Canceled {
+		t.Errorf("expected select to be cancelled, got %v", err)
+	}
+}
+
+func testHashContains(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a hash table with small buckets so that keys move around on splits
+	index, err := hash.OpenTableWithBucketSize(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checkContains checks that every present key is reported present, and that
+	// absent keys are usually ruled out.
+	checkContains := func(present map[int64]bool, stage string) {
+		for key := int64(0); key < 4000; key++ {
+			if present[key] && !index.Contains(key) {
+				t.Errorf("%s: present key %d reported absent", stage, key)
+			}
+		}
+		falsePositives := 0
+		for key := int64(10000); key < 11000; key++ {
+			if index.Contains(key) {
+				falsePositives++
+			}
+		}
+		if falsePositives > 50 {
+			t.Errorf("%s: %d of 1000 never-inserted keys reported present", stage, falsePositives)
+		}
+	}
+	present := make(map[int64]bool)
+	for i := int64(0); i < 4000; i += 2 {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Error(err)
+		}
+		present[i] = true
+	}
+	checkContains(present, "after inserts")
+	// Deleted keys are no longer contained, filter or not
+	for i := int64(0); i < 4000; i += 6 {
+		if err = index.Delete(i); err != nil {
+			t.Error(err)
+		}
+		delete(present, i)
+	}
+	checkContains(present, "after deletes")
+	if index.Contains(0) {
+		t.Error("deleted key 0 reported present")
+	}
+	if err = index.RebuildFilter(); err != nil {
+		t.Fatal(err)
+	}
+	checkContains(present, "after rebuild")
+	// The filter is rebuilt when the table is reopened
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	checkContains(present, "after reopening")
+}
+
+func testHashSelectProject(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a hash table with small buckets so that it has many of them
+	index, err := hash.OpenTableWithBucketSize(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entries, answerKey := genRandomHashEntries(500)
+	for _, e := range entries {
+		if err = index.Insert(e.key, e.val); err != nil {
+			t.Error(err)
+		}
+	}
+	// Projections should match the fields of a full select, in the same order
+	selected, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := index.SelectProject(utils.PROJECT_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := index.SelectProject(utils.PROJECT_VALUE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(selected) || len(values) != len(selected) {
+		t.Fatalf("expected %d projected entries, got %d keys and %d values", len(selected), len(keys), len(values))
+	}
+	for i, entry := range selected {
+		if keys[i] != entry.GetKey() || values[i] != entry.GetValue() {
+			t.Errorf("projection mismatch at %d", i)
+		}
+		if answerKey[keys[i]] != values[i] {
+			t.Errorf("wrong value %d for key %d", values[i], keys[i])
+		}
+	}
+}
+
+func testHashGetBucketResolved(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a hash table with small buckets so that it splits several times
+	index, err := hash.OpenTableWithBucketSize(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 500; i++ {
+		if err = index.Insert(i*31, i%hash_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	table := index.GetTable()
+	if table.GetDepth() <= 2 {
+		t.Fatalf("expected the table to have split, depth is %d", table.GetDepth())
+	}
+	// Each key should resolve through the slot it hashes to, to the bucket holding it
+	for i := int64(0); i < 500; i++ {
+		key := i * 31
+		table.RLock()
+		bucket, idx, err := table.GetBucketResolved(key, hash.NO_LOCK)
+		if err != nil {
+			table.RUnlock()
+			t.Fatal(err)
+		}
+		if expected := hash.Hasher(key, table.GetDepth()); idx != expected {
+			t.Errorf("key %d: expected directory index %d, got %d", key, expected, idx)
+		}
+		if pn := table.GetBuckets()[idx]; bucket.GetPage().GetPageNum() != pn {
+			t.Errorf("key %d: expected bucket on page %d, got %d", key, pn, bucket.GetPage().GetPageNum())
+		}
+		if _, found, err := bucket.FindEntry(key); err != nil || !found {
+			t.Errorf("key %d: not in its resolved bucket", key)
+		}
+		bucket.GetPage().Put()
+		table.RUnlock()
+	}
+}
+
+func testHashScanner(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a hash table with small buckets so that writes during the scan split them
+	index, err := hash.OpenTableWithBucketSize(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	table := index.GetTable()
+	for i := int64(0); i < 500; i++ {
+		if err = table.Insert(i, i%hash_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	// Interleave the scan with inserts of new keys and deletes of odd keys
+	depth := table.GetDepth()
+	scanner := table.Scanner()
+	seen := make(map[int64]bool)
+	next := int64(500)
+	for {
+		entry, ok, err := scanner.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		if seen[entry.GetKey()] {
+			t.Errorf("key %d returned twice", entry.GetKey())
+		}
+		seen[entry.GetKey()] = true
+		for j := 0; j < 4; j++ {
+			if err = table.Insert(next, next%hash_salt); err != nil {
+				t.Error(err)
+			}
+			next++
+		}
+		if odd := 2*(next%250) + 1; odd < 500 {
+			table.Delete(odd)
+		}
+	}
+	if table.GetDepth() <= depth {
+		t.Errorf("expected the table to grow during the scan, depth is still %d", depth)
+	}
+	// Keys untouched for the whole scan should each have been returned
+	for key := int64(0); key < 500; key += 2 {
+		if !seen[key] {
+			t.Errorf("key %d missing from the scan", key)
+		}
+	}
+	for key := range seen {
+		if key >= next {
+			t.Errorf("unexpected key %d", key)
+		}
+	}
+}
+
+func testHashEntryRoundTrip(t *testing.T) {
+	roundTrips := func(key int64, value int64) bool {
+		var entry, decoded hash.HashEntry
+		entry.SetKey(key)
+		entry.SetValue(value)
+		data := entry.Marshal()
+		if int64(len(data)) != hash.ENTRYSIZE {
+			return false
+		}
+		return decoded.Unmarshal(data) == nil && decoded == entry
+	}
+	// Every pair of edge values, and random pairs, should survive a round trip
+	for _, key := range entryEdgeValues() {
+		for _, value := range entryEdgeValues() {
+			if !roundTrips(key, value) {
+				t.Errorf("entry (%d, %d) did not survive a round trip", key, value)
+			}
+		}
+	}
+	if err := quick.Check(roundTrips, nil); err != nil {
+		t.Error(err)
+	}
+	var decoded hash.HashEntry
+	if err := decoded.Unmarshal(make([]byte, hash.ENTRYSIZE+1)); err == nil {
+		t.Error("expected a long entry to be rejected")
+	}
+	// Edge values should also survive a trip through the table's buckets
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTableWithBucketSize(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i, key := range entryEdgeValues() {
+		value := entryEdgeValues()[len(entryEdgeValues())-1-i]
+		if err = index.Insert(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, key := range entryEdgeValues() {
+		value := entryEdgeValues()[len(entryEdgeValues())-1-i]
+		if entry, err := index.Find(key); err != nil || entry.GetValue() != value {
+			t.Errorf("entry (%d, %d) did not survive a trip through the table", key, value)
+		}
+	}
+}
+
+func testHashFormatVersion(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a table and close it
+	index, err := hash.OpenTableWithBucketSize(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		if err = index.Insert(i, i%hash_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	index.Close()
+	// The version is checked on open, and a matching version reads back the table
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.GetTable().Count() != 100 {
+		t.Errorf("expected 100 entries after reopening, got %d", index.GetTable().Count())
+	}
+	index.Close()
+	// A file from another format should be refused rather than misread
+	for _, version := range []byte{0, hash.FORMAT_VERSION + 1} {
+		setFormatVersion(t, dbName+".meta", hash.META_VERSION_OFFSET, version)
+		if _, err = hash.OpenTable(dbName); !errors.Is(err, utils.ErrUnsupportedVersion) {
+			t.Errorf("version %d: expected ErrUnsupportedVersion, got %v", version, err)
+		}
+	}
+}
+
+func testHashLegacyFile(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Write a table in the layout from before meta files had a header: the global
+	// depth followed right away by the directory, and four empty buckets
+	buckets := make([][]byte, 4)
+	directory := make([]byte, pager.PAGESIZE)
+	binary.PutVarint(directory, 2)
+	for i := range buckets {
+		buckets[i] = make([]byte, binary.MaxVarintLen64)
+		binary.PutVarint(buckets[i], 2)
+		binary.PutVarint(directory[(i+1)*binary.MaxVarintLen64:], int64(i))
+	}
+	writeRawPages(t, dbName, buckets...)
+	writeRawPages(t, dbName+".meta", directory)
+	// It should be refused rather than misread
+	if _, err := hash.OpenTable(dbName); !errors.Is(err, utils.ErrUnsupportedVersion) {
+		t.Fatalf("expected ErrUnsupportedVersion, got %v", err)
+	}
+}
+
+func setMetaField(t *testing.T, filename string, offset int64, value int64) {
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data := make([]byte, binary.MaxVarintLen64)
+	binary.PutVarint(data, value)
+	if _, err = file.WriteAt(data, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testHashStoredHasher(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// New tables get the default hasher
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.GetTable().GetHasher() != hash.DEFAULT_HASHER {
+		t.Errorf("expected hasher %d, got %d", hash.DEFAULT_HASHER, index.GetTable().GetHasher())
+	}
+	index.Close()
+	// A table keeps the hasher stored in its header across reopens
+	for round := 0; round < 2; round++ {
+		index, err = hash.OpenTableWithBucketSize(dbName, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index.GetTable().GetHasher() != hash.XX_HASHER {
+			t.Errorf("expected hasher %d, got %d", hash.XX_HASHER, index.GetTable().GetHasher())
+		}
+		for i := int64(-100); i < 100 && round == 0; i++ {
+			if err = index.Insert(i, i%hash_salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := int64(-100); i < 100; i++ {
+			if entry, err := index.Find(i); err != nil || entry.GetValue() != i%hash_salt {
+				t.Errorf("key %d: expected value %d, got %v (%v)", i, i%hash_salt, entry, err)
+			}
+		}
+		if ok, err := hash.IsHash(index); err != nil || !ok {
+			t.Errorf("expected a valid hash table, got %v (%v)", ok, err)
+		}
+		index.Close()
+	}
+	// Hashers we don't have should be refused
+	for _, hasher := range []int64{0, 99} {
+		setMetaField(t, dbName+".meta", hash.META_HASHER_OFFSET, hasher)
+		if _, err = hash.OpenTable(dbName); err == nil {
+			t.Errorf("expected unknown hasher %d to be refused", hasher)
+		}
+	}
+}
+
+func testHashConcurrentFindInsert(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Chain instead of splitting, so that every key stays in the same bucket
+	index, err := hash.OpenTableWithBucketSize(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	table := index.GetTable()
+	table.SetOverflowMode(true)
+	depth := table.GetDepth()
+	keys := make([]int64, 0)
+	for k := int64(0); len(keys) < 200; k++ {
+		if hash.Hasher(k, depth) == hash.Hasher(0, depth) {
+			keys = append(keys, k)
+		}
+	}
+	old, fresh := keys[:100], keys[100:]
+	for _, k := range old {
+		if err = table.Insert(k, k%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Insert the rest of the keys while readers look up keys in the same bucket
+	numReaders := 4
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < numReaders; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Keys inserted beforehand are always found whole
+				k := old[i%len(old)]
+				if entry, err := table.Find(k); err != nil || entry.GetKey() != k || entry.GetValue() != k%hash_salt {
+					t.Errorf("key %d: expected value %d, got %v (%v)", k, k%hash_salt, entry, err)
+					return
+				}
+				// Keys being inserted are either missing or whole
+				k = fresh[i%len(fresh)]
+				if entry, err := table.Find(k); err == nil && (entry.GetKey() != k || entry.GetValue() != k%hash_salt) {
+					t.Errorf("key %d: expected value %d, got a torn entry %v", k, k%hash_salt, entry)
+					return
+				}
+			}
+		}(r)
+	}
+	for _, k := range fresh {
+		if err = table.Insert(k, k%hash_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	for _, k := range keys {
+		if entry, err := table.Find(k); err != nil || entry.GetValue() != k%hash_salt {
+			t.Errorf("key %d: expected value %d, got %v (%v)", k, k%hash_salt, entry, err)
+		}
+	}
+}
+
+func testHashPartitionFunc(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Group keys by tens, so that each group of ten shares a bucket
+	partition := func(key int64) uint64 { return uint64(key / 10) }
+	index, err := hash.OpenTableWithPartition(dbName, 16, partition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range rand.Perm(1000) {
+		if err = index.Insert(int64(i), int64(i)%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// checkPartitions checks that every key lives in the bucket its partition dictates
+	checkPartitions := func(index *hash.HashIndex) {
+		table := index.GetTable()
+		if table.GetDepth() <= 2 {
+			t.Fatalf("expected the table to have split, depth is %d", table.GetDepth())
+		}
+		mask := uint64(1)<<uint64(table.GetDepth()) - 1
+		buckets := table.GetBuckets()
+		for key := int64(0); key < 1000; key++ {
+			expected := buckets[partition(key)&mask]
+			if group := buckets[partition(key-key%10)&mask]; group != expected {
+				t.Errorf("key %d: expected to share a bucket with the rest of its group", key)
+			}
+			table.RLock()
+			bucket, idx, err := table.GetBucketResolved(key, hash.NO_LOCK)
+			if err != nil {
+				table.RUnlock()
+				t.Fatal(err)
+			}
+			if bucket.GetPage().GetPageNum() != expected || uint64(idx) != partition(key)&mask {
+				t.Errorf("key %d: expected bucket on page %d, got %d", key, expected, bucket.GetPage().GetPageNum())
+			}
+			if _, found, err := bucket.FindEntry(key); err != nil || !found {
+				t.Errorf("key %d: not in the bucket its partition dictates", key)
+			}
+			bucket.GetPage().Put()
+			table.RUnlock()
+		}
+		if ok, err := hash.IsHash(index); err != nil || !ok {
+			t.Errorf("expected a valid hash table, got %v (%v)", ok, err)
+		}
+	}
+	checkPartitions(index)
+	// The partition function is given again on reopen
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = hash.OpenTableWithPartition(dbName, 16, partition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	checkPartitions(index)
+	for key := int64(0); key < 1000; key++ {
+		if entry, err := index.Find(key); err != nil || entry.GetValue() != key%hash_salt {
+			t.Errorf("key %d: expected value %d, got %v (%v)", key, key%hash_salt, entry, err)
+		}
+	}
+}
+
+func testHashRingTable(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a ring table with small buckets so that it splits many times
+	table, err := hash.OpenRingTable(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numKeys := int64(2000)
+	numSegments := len(table.GetBuckets())
+	for _, i := range rand.Perm(int(numKeys)) {
+		if err = table.Insert(int64(i), int64(i)%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+		// A split only adds a single segment to the ring
+		if n := len(table.GetBuckets()); n > numSegments+1 {
+			t.Fatalf("expected the ring to grow by at most one segment, went from %d to %d", numSegments, n)
+		} else {
+			numSegments = n
+		}
+	}
+	// checkRing checks that every key is found and that each bucket owns exactly one segment
+	checkRing := func(table *hash.RingTable, expected map[int64]int64) {
+		for key, value := range expected {
+			if entry, err := table.Find(key); err != nil || entry.GetValue() != value {
+				t.Errorf("key %d: expected value %d, got %v (%v)", key, value, entry, err)
+			}
+		}
+		entries, err := table.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(entries)) != int64(len(expected)) || table.Count() != int64(len(expected)) {
+			t.Errorf("expected %d entries, selected %d and counted %d", len(expected), len(entries), table.Count())
+		}
+		buckets := table.GetBuckets()
+		seen := make(map[int64]bool)
+		for _, pn := range buckets {
+			if seen[pn] {
+				t.Errorf("expected bucket %d to own a single segment", pn)
+			}
+			seen[pn] = true
+		}
+		if int64(len(buckets)) != table.GetPager().GetNumPages() {
+			t.Errorf("expected one segment per bucket page, got %d segments and %d pages", len(buckets), table.GetPager().GetNumPages())
+		}
+	}
+	expected := make(map[int64]int64)
+	for key := int64(0); key < numKeys; key++ {
+		expected[key] = key % hash_salt
+	}
+	checkRing(table, expected)
+	// Splits cut at the median, so every bucket is left at least half full
+	if max := numKeys / (table.GetBucketSize() / 2); int64(numSegments) > max {
+		t.Errorf("expected at most %d segments, got %d", max, numSegments)
+	}
+	if _, err = table.Find(numKeys); err == nil {
+		t.Error("expected a missing key not to be found")
+	}
+	// Update and delete some keys
+	for key := int64(0); key < numKeys; key += 3 {
+		if err = table.Update(key, -key); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = -key
+	}
+	for key := int64(1); key < numKeys; key += 3 {
+		if err = table.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, key)
+	}
+	if err = table.Delete(1); err == nil {
+		t.Error("expected deleting a missing key to fail")
+	}
+	checkRing(table, expected)
+	// The ring is kept across reopens
+	if err = table.Close(); err != nil {
+		t.Fatal(err)
+	}
+	table, err = hash.OpenRingTable(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Close()
+	if len(table.GetBuckets()) != numSegments {
+		t.Errorf("expected %d segments after reopening, got %d", numSegments, len(table.GetBuckets()))
+	}
+	checkRing(table, expected)
+	if _, err = hash.NewRingTable(table.GetPager(), 1); err == nil {
+		t.Error("expected a bucket size of 1 to be rejected")
+	}
+
+	// Copies of one key share a hash, so their bucket chains instead of splitting
+	chainedName := getTempHashDB(t)
+	defer os.Remove(chainedName)
+	defer os.Remove(chainedName + ".meta")
+	chained, err := hash.OpenRingTable(chainedName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 20; i++ {
+		if err = chained.Insert(7, i); err != nil {
+			t.Fatalf("insert %d of key 7: %v", i, err)
+		}
+	}
+	for key := int64(100); key < 150; key++ {
+		if err = chained.Insert(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if chained.Count() != 70 {
+		t.Errorf("expected 70 entries, counted %d", chained.Count())
+	}
+	if entries, err := chained.Select(); err != nil || len(entries) != 70 {
+		t.Errorf("expected 70 entries, got %d (%v)", len(entries), err)
+	}
+	for key := int64(100); key < 150; key++ {
+		if entry, err := chained.Find(key); err != nil || entry.GetValue() != key {
+			t.Errorf("key %d: expected value %d, got %v (%v)", key, key, entry, err)
+		}
+	}
+	// Every copy can be deleted, and the chain is kept across reopens
+	for i := 0; i < 10; i++ {
+		if err = chained.Delete(7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = chained.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if chained, err = hash.OpenRingTable(chainedName, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer chained.Close()
+	for i := 0; i < 10; i++ {
+		if err = chained.Delete(7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = chained.Find(7); !errors.Is(err, utils.ErrNotFound) {
+		t.Errorf("expected every copy of key 7 to be deleted, got %v", err)
+	}
+	if entries, err := chained.Select(); err != nil || len(entries) != 50 || chained.Count() != 50 {
+		t.Errorf("expected 50 entries, selected %d and counted %d (%v)", len(entries), chained.Count(), err)
+	}
+
+	// Overflow pages freed before a reopen are reused after it, rather than leaked
+	freedName := getTempHashDB(t)
+	defer os.Remove(freedName)
+	defer os.Remove(freedName + ".meta")
+	freed, err := hash.OpenRingTable(freedName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 30; i++ {
+		if err = freed.Insert(7, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	numPages := freed.GetPager().GetNumPages()
+	if numPages < 3 {
+		t.Fatalf("expected key 7 to need an overflow chain, got %d pages", numPages)
+	}
+	for i := 0; i < 30; i++ {
+		if err = freed.Delete(7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = freed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if freed, err = hash.OpenRingTable(freedName, 8); err != nil {
+		t.Fatal(err)
+	}
+	defer freed.Close()
+	for i := int64(0); i < 30; i++ {
+		if err = freed.Insert(7, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := freed.GetPager().GetNumPages(); n != numPages {
+		t.Errorf("expected the freed pages to be reused, went from %d to %d pages", numPages, n)
+	}
+}
+
+func testHashSelectLimit(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a hash table with small buckets so that a limit stops partway through them
+	index, err := hash.OpenTableWithBucketSize(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entries, answerKey := genRandomHashEntries(500)
+	for _, e := range entries {
+		if err = index.Insert(e.key, e.val); err != nil {
+			t.Error(err)
+		}
+	}
+	// checkSample checks that the sample holds n distinct entries of the table
+	checkSample := func(sample []utils.Entry, n int) {
+		if len(sample) != n {
+			t.Errorf("expected %d entries, got %d", n, len(sample))
+		}
+		seen := make(map[int64]bool)
+		for _, entry := range sample {
+			if value, ok := answerKey[entry.GetKey()]; !ok || value != entry.GetValue() || seen[entry.GetKey()] {
+				t.Errorf("unexpected entry (%d, %d)", entry.GetKey(), entry.GetValue())
+			}
+			seen[entry.GetKey()] = true
+		}
+	}
+	for _, limit := range []int64{0, 1, 7, 8, 9, 100} {
+		sample, err := index.SelectLimit(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSample(sample, int(limit))
+	}
+	// Limits past the table's size return every entry
+	sample, err := index.SelectLimit(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSample(sample, len(answerKey))
+	if _, err = index.SelectLimit(-1); err == nil {
+		t.Error("expected a negative limit to fail")
+	}
+}
+
+func testHashFullBucket(t *testing.T) {
+	// Every cell of a full bucket lies on its page, and another one wouldn't
+	if end := hash.BUCKET_HEADER_SIZE + hash.BUCKETSIZE*hash.ENTRYSIZE; end > pager.PAGESIZE || end+hash.ENTRYSIZE <= pager.PAGESIZE {
+		t.Fatalf("expected %d bucket cells to fill a %d byte page, got %d bytes", hash.BUCKETSIZE, pager.PAGESIZE, end)
+	}
+	// Init a bucket followed by a neighbour in the next frame
+	p := pager.NewMemPager()
+	bucket, err := hash.NewHashBucket(p, 0, hash.BUCKETSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.GetPage().Put()
+	neighbour, err := p.AllocatePage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer neighbour.Put()
+	canary := bytes.Repeat([]byte{0xab}, int(pager.PAGESIZE))
+	neighbour.Update(canary, 0, pager.PAGESIZE)
+	// Inserting up to capacity asks for a split on the last entry
+	for i := int64(0); i < hash.BUCKETSIZE; i++ {
+		split, err := bucket.Insert(i, i*10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if split != (i == hash.BUCKETSIZE-1) {
+			t.Errorf("expected a split only once the bucket is full, got %v at entry %d", split, i)
+		}
+	}
+	// One past capacity is refused, leaving the bucket and its neighbour alone
+	if _, err = bucket.Insert(hash.BUCKETSIZE, 0); err == nil {
+		t.Error("expected inserting into a full bucket to fail")
+	}
+	entries, err := bucket.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != hash.BUCKETSIZE {
+		t.Errorf("expected %d entries, got %d", hash.BUCKETSIZE, len(entries))
+	}
+	if !bytes.Equal(*neighbour.GetData(), canary) {
+		t.Error("expected the neighbouring page to be untouched")
+	}
+	// Writes past the end of a page never reach the next frame
+	expectPanic(t, "writing past the end of a page", func() {
+		bucket.GetPage().Update(make([]byte, 8), pager.PAGESIZE-4, 8)
+	})
+	if !bytes.Equal(*neighbour.GetData(), canary) {
+		t.Error("expected the neighbouring page to be untouched")
+	}
+}
+
+func testHashFreeze(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a hash table and fill it
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entries, answerKey := genRandomHashEntries(500)
+	for _, e := range entries {
+		if err = index.Insert(e.key, e.val); err != nil {
+			t.Error(err)
+		}
+	}
+	table := index.GetTable()
+	// Freezing is safe while readers are running
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, e := range entries[:100] {
+				if _, err := index.Find(e.key); err != nil {
+					t.Errorf("key %d: %v", e.key, err)
+				}
+			}
+		}()
+	}
+	index.Freeze()
+	wg.Wait()
+	if !table.IsFrozen() {
+		t.Fatal("expected the table to be frozen")
+	}
+	// Every write should be rejected, and leave the table as it was
+	if err = index.Insert(-1, 0); !errors.Is(err, utils.ErrImmutable) {
+		t.Errorf("insert: expected ErrImmutable, got %v", err)
+	}
+	if err = index.Update(entries[0].key, 0); !errors.Is(err, utils.ErrImmutable) {
+		t.Errorf("update: expected ErrImmutable, got %v", err)
+	}
+	if err = index.Delete(entries[0].key); !errors.Is(err, utils.ErrImmutable) {
+		t.Errorf("delete: expected ErrImmutable, got %v", err)
+	}
+	bucket, err := table.GetBucket(0, hash.NO_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = table.Split(bucket, 0); !errors.Is(err, utils.ErrImmutable) {
+		t.Errorf("split: expected ErrImmutable, got %v", err)
+	}
+	bucket.GetPage().Put()
+	if count, err := index.Count(); err != nil || count != int64(len(entries)) {
+		t.Errorf("expected count %d, got %d (%v)", len(entries), count, err)
+	}
+	// Reads should still work, and take no locks: hold the index's and every bucket's throughout
+	table.WLock()
+	pages := make([]*pager.Page, 0)
+	for pn := int64(0); pn < table.GetPager().GetNumPages(); pn++ {
+		page, err := table.GetPager().GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.WLock()
+		pages = append(pages, page)
+	}
+	withDeadline(t, "reading a frozen table", func() {
+		for key, val := range answerKey {
+			if entry, err := index.Find(key); err != nil || entry.GetValue() != val {
+				t.Errorf("key %d: expected value %d, got %v (%v)", key, val, entry, err)
+			}
+		}
+		if selected, err := index.Select(); err != nil || len(selected) != len(entries) {
+			t.Errorf("expected %d entries, got %d (%v)", len(entries), len(selected), err)
+		}
+	})
+	for _, page := range pages {
+		page.WUnlock()
+		page.Put()
+	}
+	table.WUnlock()
+}
+
+func testHashTryShrink(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init a hash table with small buckets and a few entries, none of which split
+	index, err := hash.OpenTableWithBucketSize(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := index.GetTable()
+	startDepth := table.GetDepth()
+	entries, answerKey := genRandomHashEntries(4)
+	for _, e := range entries {
+		if err = index.Insert(e.key, e.val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// checkEntries checks that every entry can still be found
+	checkEntries := func() {
+		for key, val := range answerKey {
+			if entry, err := index.Find(key); err != nil || entry.GetValue() != val {
+				t.Errorf("key %d: expected value %d, got %v (%v)", key, val, entry, err)
+			}
+		}
+	}
+	// A table that was extended but never split shrinks back all the way
+	table.ExtendTable()
+	table.ExtendTable()
+	if shrunk, err := index.TryShrink(); err != nil || !shrunk {
+		t.Fatalf("expected the table to shrink, got %v (%v)", shrunk, err)
+	}
+	if table.GetDepth() != startDepth || int64(len(table.GetBuckets())) != 1<<uint(startDepth) {
+		t.Errorf("expected depth %d with %d buckets, got depth %d with %d", startDepth, 1<<uint(startDepth), table.GetDepth(), len(table.GetBuckets()))
+	}
+	checkEntries()
+	// A table whose buckets have reached the global depth doesn't shrink
+	if shrunk, err := index.TryShrink(); err != nil || shrunk {
+		t.Errorf("expected the table not to shrink again, got %v (%v)", shrunk, err)
+	}
+	entries, answerKey = genRandomHashEntries(500)
+	for _, e := range entries {
+		if err = index.Insert(e.key, e.val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	splitDepth := table.GetDepth()
+	if splitDepth <= startDepth {
+		t.Fatalf("expected inserts to deepen the table past depth %d", startDepth)
+	}
+	if shrunk, err := index.TryShrink(); err != nil || shrunk || table.GetDepth() != splitDepth {
+		t.Errorf("expected a split table not to shrink, got %v at depth %d (%v)", shrunk, table.GetDepth(), err)
+	}
+	// Extending it again only shrinks it back to where the splits left it
+	table.ExtendTable()
+	if shrunk, err := index.TryShrink(); err != nil || !shrunk || table.GetDepth() != splitDepth {
+		t.Errorf("expected the table to shrink to depth %d, got %v at depth %d (%v)", splitDepth, shrunk, table.GetDepth(), err)
+	}
+	checkEntries()
+	// The smaller directory persists
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if depth := index.GetTable().GetDepth(); depth != splitDepth {
+		t.Errorf("expected depth %d after reopening, got %d", splitDepth, depth)
+	}
+	checkEntries()
+}
+
+func testHashNullEntry(t *testing.T) {
+	// A null entry and an entry holding 0 read back as different entries
+	var null, zero, decoded hash.HashEntry
+	null.SetKey(7)
+	null.SetNull()
+	zero.SetKey(7)
+	zero.SetValue(0)
+	if !null.IsNull() || zero.IsNull() {
+		t.Fatal("expected only the null entry to be null")
+	}
+	if bytes.Equal(null.Marshal(), zero.Marshal()) {
+		t.Error("expected a null entry to marshal differently from a zero")
+	}
+	for _, entry := range []hash.HashEntry{null, zero} {
+		if err := decoded.Unmarshal(entry.Marshal()); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != entry || decoded.IsNull() != entry.IsNull() || decoded.GetValue() != 0 {
+			t.Errorf("entry %v did not survive a round trip, got %v", entry, decoded)
+		}
+	}
+	var w bytes.Buffer
+	null.Print(&w)
+	if w.String() != "(7, null), " {
+		t.Errorf("expected a null entry to print as null, got %q", w.String())
+	}
+	// Setting a value clears the null
+	null.SetValue(3)
+	if null.IsNull() || null.GetValue() != 3 {
+		t.Errorf("expected setting a value to clear the null, got %v", null)
+	}
+}
+
+func testHashOptimisticFind(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Small buckets, so that the inserts below keep splitting buckets under the readers
+	index, err := hash.OpenTableWithBucketSize(dbName, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	table := index.GetTable()
+	numOld, numFresh := int64(200), int64(800)
+	for k := int64(0); k < numOld; k++ {
+		if err = table.Insert(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Values are always the key plus a multiple of round, so torn reads show up
+	round := int64(1) << 20
+	numReaders, numUpdaters := 8, 2
+	var readers, writers sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < numReaders; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for i := int64(r); ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Keys inserted beforehand are always found whole
+				k := i % numOld
+				if entry, err := table.Find(k); err != nil || entry.GetKey() != k || (entry.GetValue()-k)%round != 0 {
+					t.Errorf("key %d: expected a value of %d plus a multiple of %d, got %v (%v)", k, k, round, entry, err)
+					return
+				}
+				// Keys being inserted are either missing or whole
+				k = numOld + i%numFresh
+				if entry, err := table.Find(k); err == nil && (entry.GetKey() != k || entry.GetValue() != k) {
+					t.Errorf("key %d: expected value %d, got a torn entry %v", k, k, entry)
+					return
+				}
+			}
+		}(r)
+	}
+	// Update the old keys and insert the fresh ones at the same time
+	for u := 0; u < numUpdaters; u++ {
+		writers.Add(1)
+		go func(u int) {
+			defer writers.Done()
+			for i := int64(1); i <= 5; i++ {
+				for k := int64(u); k < numOld; k += int64(numUpdaters) {
+					if err := table.Update(k, k+i*round); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(u)
+	}
+	for k := numOld; k < numOld+numFresh; k++ {
+		if err = table.Insert(k, k); err != nil {
+			t.Error(err)
+		}
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	for k := int64(0); k < numOld+numFresh; k++ {
+		expected := k
+		if k < numOld {
+			expected = k + 5*round
+		}
+		if entry, err := table.Find(k); err != nil || entry.GetValue() != expected {
+			t.Errorf("key %d: expected value %d, got %v (%v)", k, expected, entry, err)
+		}
+	}
+
+	// Finds in a write locked bucket wait for the writer, but finds elsewhere don't
+	bucket, err := table.GetBucket(hash.Hasher(0, table.GetDepth()), hash.WRITE_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets := table.GetBuckets()
+	other := int64(1)
+	for buckets[hash.Hasher(other, table.GetDepth())] == bucket.GetPage().GetPageNum() {
+		other++
+	}
+	withDeadline(t, "finding a key in an unlocked bucket", func() {
+		if _, err := table.Find(other); err != nil {
+			t.Error(err)
+		}
+	})
+	found := make(chan error)
+	go func() {
+		_, err := table.Find(0)
+		found <- err
+	}()
+	waited := true
+	select {
+	case err = <-found:
+		t.Errorf("expected the find to wait for the writer, got %v", err)
+		waited = false
+	case <-time.After(100 * time.Millisecond):
+	}
+	bucket.WUnlock()
+	bucket.GetPage().Put()
+	if waited {
+		if err = <-found; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func testHashVersionNotPersisted(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := index.GetTable()
+	if err = table.Insert(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Flush the bucket while it is write locked, i.e. while its version stamp is odd
+	bucket, err := table.GetBucket(hash.Hasher(0, table.GetDepth()), hash.WRITE_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.GetPager().FlushPage(bucket.GetPage())
+	bucket.WUnlock()
+	bucket.GetPage().Put()
+	if err = index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	table = index.GetTable()
+	// The stamp starts out even, and locking the bucket doesn't dirty it
+	bucket, err = table.GetBucket(hash.Hasher(0, table.GetDepth()), hash.NO_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bucket.GetPage().Put()
+	if version := bucket.GetPage().GetVersion(); version%2 != 0 {
+		t.Errorf("expected an even version stamp after reopening, got %d", version)
+	}
+	bucket.WLock()
+	bucket.WUnlock()
+	if bucket.GetPage().IsDirty() {
+		t.Error("expected locking a bucket not to dirty its page")
+	}
+	if entry, err := table.Find(0); err != nil || entry.GetValue() != 0 {
+		t.Errorf("expected to find key 0, got %v (%v)", entry, err)
+	}
+}
+
+func testHashSelectDuringChainWrites(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Keys in the same hundred never separate, so they chain
+	partition := func(key int64) uint64 { return uint64(key / 100) }
+	index, err := hash.OpenTableWithPartition(dbName, 4, partition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	table := index.GetTable()
+	// Free some overflow pages, so that a bucket split off later can get an overflow
+	// bucket on a page before its own; selects reading pages in order would then read
+	// the overflow bucket without the lock on the chain's first bucket
+	for k := int64(0); k < 12; k++ {
+		if err = table.Insert(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k := int64(0); k < 12; k++ {
+		if err = table.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []int64{100, 101, 500, 501, 502, 503, 504, 505} {
+		if err = table.Insert(k, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head, err := table.GetBucket(5, hash.NO_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headPN, overflowPN := head.GetPage().GetPageNum(), head.GetNextOverflowPN()
+	head.GetPage().Put()
+	if overflowPN == hash.NO_OVERFLOW_PN || overflowPN > headPN {
+		t.Fatalf("expected bucket %d to have an overflow bucket on an earlier page, got %d", headPN, overflowPN)
+	}
+	overflow, err := table.GetBucketByPN(overflowPN, hash.NO_LOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := overflow.Select()
+	overflow.GetPage().Put()
+	if err != nil || len(entries) < 2 {
+		t.Fatalf("expected at least two entries in the overflow bucket, got %v (%v)", entries, err)
+	}
+	// Stall a delete from the overflow bucket halfway through shifting the other entries
+	// left, when the next entry has been copied down but not yet overwritten
+	updates := 0
+	stalled, release := make(chan struct{}), make(chan struct{})
+	table.GetPager().SetUpdateHook(func(pagenum int64, offset int64, data []byte) {
+		if updates++; updates == 2 {
+			close(stalled)
+			<-release
+		}
+	})
+	deleted := make(chan error)
+	go func() {
+		deleted <- table.Delete(entries[0].GetKey())
+	}()
+	<-stalled
+	selected := make(chan []utils.Entry)
+	go func() {
+		entries, err := table.Select()
+		if err != nil {
+			t.Error(err)
+		}
+		selected <- entries
+	}()
+	// The select waits for the delete, which holds the lock on the chain's first bucket
+	entries = nil
+	select {
+	case entries = <-selected:
+		t.Error("expected the select to wait for the delete")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if err = <-deleted; err != nil {
+		t.Fatal(err)
+	}
+	table.GetPager().SetUpdateHook(nil)
+	if entries == nil {
+		entries = <-selected
+	}
+	seen := make(map[int64]bool)
+	for _, entry := range entries {
+		if seen[entry.GetKey()] {
+			t.Errorf("key %d selected twice", entry.GetKey())
+		}
+		seen[entry.GetKey()] = true
+	}
+	if len(entries) != 7 {
+		t.Errorf("expected 7 entries, got %d", len(entries))
+	}
+}
@@ -0,0 +1,178 @@
+package test
+
+import (
+	"testing"
+
+	list "github.com/brown-csci1270/db/pkg/list"
+)
+
+func TestList(t *testing.T) {
+	t.Run("TestListInsertAdjacent", testListInsertAdjacent)
+	t.Run("TestListLen", testListLen)
+	t.Run("TestListFindPrefix", testListFindPrefix)
+	t.Run("TestListPopDuringMap", testListPopDuringMap)
+}
+
+// listValues returns the values of a list from head to tail.
+func listValues(l *list.List) []int {
+	values := make([]int, 0)
+	l.Map(func(link *list.Link) {
+		values = append(values, link.GetKey().(int))
+	})
+	return values
+}
+
+// listValuesReversed returns the values of a list from tail to head.
+func listValuesReversed(l *list.List) []int {
+	values := make([]int, 0)
+	for link := l.PeekTail(); link != nil; link = link.GetPrev() {
+		values = append(values, link.GetKey().(int))
+	}
+	return values
+}
+
+func checkListValues(t *testing.T, l *list.List, expected []int) {
+	forward := listValues(l)
+	backward := listValuesReversed(l)
+	if len(forward) != len(expected) || len(backward) != len(expected) {
+		t.Fatalf("expected %v, got %v forwards and %v backwards", expected, forward, backward)
+	}
+	for i := range expected {
+		if forward[i] != expected[i] || backward[len(expected)-1-i] != expected[i] {
+			t.Fatalf("expected %v, got %v forwards and %v backwards", expected, forward, backward)
+		}
+	}
+}
+
+func testListInsertAdjacent(t *testing.T) {
+	l := list.NewList()
+	middle := l.PushHead(2)
+	// Insert around a lone link
+	middle.InsertBefore(1)
+	last := middle.InsertAfter(4)
+	checkListValues(t, l, []int{1, 2, 4})
+	// Insert in the middle
+	last.InsertBefore(3)
+	checkListValues(t, l, []int{1, 2, 3, 4})
+	// Insert after the tail and before the head
+	l.PeekTail().InsertAfter(5)
+	l.PeekHead().InsertBefore(0)
+	checkListValues(t, l, []int{0, 1, 2, 3, 4, 5})
+	if l.PeekHead().GetKey() != 0 || l.PeekTail().GetKey() != 5 {
+		t.Errorf("bad head or tail after inserting at the ends")
+	}
+	// Popping an inserted link should leave the rest intact
+	last.GetPrev().PopSelf()
+	checkListValues(t, l, []int{0, 1, 2, 4, 5})
+	if last.GetList() != l {
+		t.Error("inserted link does not belong to the list")
+	}
+	// Inserting around a popped link should leave the list alone
+	popped := l.PeekHead()
+	popped.PopSelf()
+	if popped.InsertAfter(6) != nil || popped.InsertBefore(7) != nil {
+		t.Error("expected no link to be inserted around a popped link")
+	}
+	checkListValues(t, l, []int{1, 2, 4, 5})
+	if l.Len() != 4 {
+		t.Errorf("expected 4 links, got %d", l.Len())
+	}
+}
+
+func testListLen(t *testing.T) {
+	l := list.NewList()
+	checkLen := func(expected int) {
+		if l.Len() != expected {
+			t.Fatalf("expected length %d, got %d", expected, l.Len())
+		}
+	}
+	checkLen(0)
+	// Pushes and inserts grow the list
+	a := l.PushHead(1)
+	b := l.PushTail(2)
+	c := l.PushHead(0)
+	checkLen(3)
+	d := b.InsertBefore(5)
+	a.InsertAfter(6)
+	checkLen(5)
+	// Pops shrink it, from the ends and the middle
+	c.PopSelf()
+	b.PopSelf()
+	d.PopSelf()
+	checkLen(2)
+	// Popping an already removed link is a no-op
+	d.PopSelf()
+	checkLen(2)
+	// Drain the list
+	for l.PeekHead() != nil {
+		l.PeekHead().PopSelf()
+	}
+	checkLen(0)
+	l.PushTail(7)
+	checkLen(1)
+}
+
+func testListFindPrefix(t *testing.T) {
+	// Init a populated list and its REPL
+	l := list.NewList()
+	for _, value := range []string{"apple", "banana", "apricot", "cherry", "ap"} {
+		l.PushTail(value)
+	}
+	r := list.ListRepl(l)
+	// Matches are printed in list order, one per line
+	cases := map[string]string{
+		"list_find_prefix ap\n":       "apple\napricot\nap\n\n",
+		"list_find_prefix ban\n":      "banana\n\n",
+		"list_find_prefix cherry\n":   "cherry\n\n",
+		"list_find_prefix durian\n":   "not found\n\n",
+		"list_find_prefix\n":          "usage: list_find_prefix <prefix>\n\n",
+		"list_find_prefix a b\n":      "usage: list_find_prefix <prefix>\n\n",
+		"list_find_prefix apricots\n": "not found\n\n",
+	}
+	for script, expected := range cases {
+		if output := runReplScript(t, r, script); output != expected {
+			t.Errorf("%q: expected %q, got %q", script, expected, output)
+		}
+	}
+}
+
+func testListPopDuringMap(t *testing.T) {
+	l := list.NewList()
+	for i := 0; i < 10; i++ {
+		l.PushTail(i)
+	}
+	// Popping the current link, including the head and the tail, shouldn't end the walk early
+	visited := make([]int, 0)
+	l.Map(func(link *list.Link) {
+		value := link.GetKey().(int)
+		visited = append(visited, value)
+		if value%2 == 0 || value == 9 {
+			link.PopSelf()
+		}
+	})
+	if len(visited) != 10 {
+		t.Fatalf("expected every link to be visited, got %v", visited)
+	}
+	checkListValues(t, l, []int{1, 3, 5, 7})
+	// Find should keep searching past the links it pops
+	found := l.Find(func(link *list.Link) bool {
+		if link.GetKey().(int) == 5 {
+			return true
+		}
+		link.PopSelf()
+		return false
+	})
+	if found == nil || found.GetKey().(int) != 5 {
+		t.Fatalf("expected to find 5, got %v", found)
+	}
+	checkListValues(t, l, []int{5, 7})
+	// Popping every link should empty the list
+	count := 0
+	l.Map(func(link *list.Link) {
+		count++
+		link.PopSelf()
+	})
+	if count != 2 || l.Len() != 0 || l.PeekHead() != nil || l.PeekTail() != nil {
+		t.Errorf("expected to visit and pop 2 links, visited %d and left %d", count, l.Len())
+	}
+}
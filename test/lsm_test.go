@@ -0,0 +1,202 @@
+package test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+	lsm "github.com/brown-csci1270/db/pkg/lsm"
+)
+
+// Mod vals by this value to prevent hardcoding tests
+var lsm_salt int64 = rand.Int63n(1000)
+
+// LSM indexes must be usable wherever other indexes are.
+var _ db.Index = (*lsm.LSMIndex)(nil)
+
+func getTempLSMDB(t *testing.T) string {
+	tmpfile, err := ioutil.TempFile(".", "db-*")
+	if err != nil {
+		t.Error(err)
+	}
+	defer tmpfile.Close()
+	return tmpfile.Name()
+}
+
+// removeLSMDB removes an LSM index's manifest and all of its runs.
+func removeLSMDB(dbName string) {
+	runs, _ := filepath.Glob(dbName + ".run*")
+	for _, run := range runs {
+		os.Remove(run)
+	}
+	os.Remove(dbName)
+}
+
+// checkLSMContents checks that the index holds exactly the given entries, in key order.
+func checkLSMContents(t *testing.T, index *lsm.LSMIndex, answerKey map[int64]int64) {
+	for key, val := range answerKey {
+		entry, err := index.Find(key)
+		if err != nil {
+			t.Errorf("could not find key %d: %v", key, err)
+			continue
+		}
+		if entry.GetValue() != val {
+			t.Errorf("wrong value for key %d: expected %d, got %d", key, val, entry.GetValue())
+		}
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(answerKey) {
+		t.Errorf("expected %d entries, got %d", len(answerKey), len(entries))
+	}
+	for i, entry := range entries {
+		if i > 0 && entries[i-1].GetKey() >= entry.GetKey() {
+			t.Fatalf("select is out of order at position %d", i)
+		}
+		if val, ok := answerKey[entry.GetKey()]; !ok || val != entry.GetValue() {
+			t.Errorf("unexpected entry (%d, %d)", entry.GetKey(), entry.GetValue())
+		}
+	}
+}
+
+func TestLSM(t *testing.T) {
+	t.Run("TestLSMReadYourWrites", testLSMReadYourWrites)
+	t.Run("TestLSMBackgroundMerge", testLSMBackgroundMerge)
+}
+
+func testLSMReadYourWrites(t *testing.T) {
+	dbName := getTempLSMDB(t)
+	defer removeLSMDB(dbName)
+
+	// Init the index with a small memtable so that writes spill into runs
+	index, err := lsm.OpenTableWithMemtableSize(dbName, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answerKey := make(map[int64]int64)
+	for i := int64(0); i < 500; i++ {
+		key := (i * 7919) % 500
+		if err = index.Insert(key, key%lsm_salt); err != nil {
+			t.Error(err)
+		}
+		answerKey[key] = key % lsm_salt
+	}
+	if err = index.Insert(7, 0); err == nil {
+		t.Error("expected inserting a duplicate key to error")
+	}
+	checkLSMContents(t, index, answerKey)
+	// Update and delete keys that now live in runs
+	if err = index.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for key := int64(0); key < 500; key += 3 {
+		if key%2 == 0 {
+			err = index.Delete(key)
+			delete(answerKey, key)
+		} else {
+			err = index.Update(key, -key)
+			answerKey[key] = -key
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if err = index.Delete(0); err == nil {
+		t.Error("expected deleting a deleted key to error")
+	}
+	if _, err = index.Find(0); err == nil {
+		t.Error("found deleted key 0")
+	}
+	checkLSMContents(t, index, answerKey)
+	// Deleted keys can be reinserted
+	if err = index.Insert(0, 1); err != nil {
+		t.Error(err)
+	}
+	answerKey[0] = 1
+	// Merge everything into a single run
+	if err = index.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = index.Merge(); err != nil {
+		t.Fatal(err)
+	}
+	if index.GetNumRuns() != 1 {
+		t.Errorf("expected one run after merging, got %d", index.GetNumRuns())
+	}
+	checkLSMContents(t, index, answerKey)
+	// Close and reopen the index
+	if err = index.Close(); err != nil {
+		t.Error(err)
+	}
+	index, err = lsm.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLSMContents(t, index, answerKey)
+	// The cursor should walk the same entries as select
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for ; !cursor.IsEnd(); n++ {
+		if err = cursor.StepForward(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != len(answerKey) {
+		t.Errorf("expected cursor to visit %d entries, got %d", len(answerKey), n)
+	}
+	index.Close()
+}
+
+func testLSMBackgroundMerge(t *testing.T) {
+	dbName := getTempLSMDB(t)
+	defer removeLSMDB(dbName)
+
+	// Init the index with a tiny memtable so that many runs are flushed
+	index, err := lsm.OpenTableWithMemtableSize(dbName, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answerKey := make(map[int64]int64)
+	for i := int64(0); i < 1000; i++ {
+		if err = index.Insert(i, i%lsm_salt); err != nil {
+			t.Error(err)
+		}
+		answerKey[i] = i % lsm_salt
+		if i%10 == 0 {
+			if err = index.Delete(i); err != nil {
+				t.Error(err)
+			}
+			delete(answerKey, i)
+		}
+		// Reads should see every write, whatever merges are in flight
+		if i%100 == 0 {
+			checkLSMContents(t, index, answerKey)
+		}
+	}
+	if err = index.Close(); err != nil {
+		t.Error(err)
+	}
+	// Background merges should have kept the number of runs bounded
+	index, err = lsm.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.GetNumRuns() > lsm.MERGE_THRESHOLD {
+		t.Errorf("expected at most %d runs, got %d", lsm.MERGE_THRESHOLD, index.GetNumRuns())
+	}
+	checkLSMContents(t, index, answerKey)
+	index.Close()
+	// Merged-away runs should have been removed
+	runs, _ := filepath.Glob(dbName + ".run*")
+	if len(runs) > lsm.MERGE_THRESHOLD {
+		t.Errorf("expected at most %d run files, got %d", lsm.MERGE_THRESHOLD, len(runs))
+	}
+}
@@ -0,0 +1,1487 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pager "github.com/brown-csci1270/db/pkg/pager"
+)
+
+func getTempPagerDB(t testing.TB) string {
+	tmpfile, err := ioutil.TempFile(".", "db-*")
+	if err != nil {
+		t.Error(err)
+	}
+	defer tmpfile.Close()
+	return tmpfile.Name()
+}
+
+func TestPager(t *testing.T) {
+	t.Run("TestPagerSync", testPagerSync)
+	t.Run("TestPagerBufferedFallback", testPagerBufferedFallback)
+	t.Run("TestPagerResize", testPagerResize)
+	t.Run("TestPagerAllocate", testPagerAllocate)
+	t.Run("TestPagerClone", testPagerClone)
+	t.Run("TestPagerReadOnly", testPagerReadOnly)
+	t.Run("TestPagerTryGetPage", testPagerTryGetPage)
+	t.Run("TestPagerConcurrentAccess", testPagerConcurrentAccess)
+	t.Run("TestPagerFlushOrder", testPagerFlushOrder)
+	t.Run("TestPagerFlushHint", testPagerFlushHint)
+	t.Run("TestPagerPinScope", testPagerPinScope)
+	t.Run("TestPagerReadPageHeader", testPagerReadPageHeader)
+	t.Run("TestPagerDumpPinnedPages", testPagerDumpPinnedPages)
+	t.Run("TestPagerNestedGetPage", testPagerNestedGetPage)
+	t.Run("TestPagerDirtyEviction", testPagerDirtyEviction)
+	t.Run("TestPagerCacheMiss", testPagerCacheMiss)
+	t.Run("TestPagerWarmCache", testPagerWarmCache)
+	t.Run("TestPagerCompression", testPagerCompression)
+	t.Run("TestPagerCloseDrains", testPagerCloseDrains)
+	t.Run("TestPagerCloseTimeout", testPagerCloseTimeout)
+}
+
+func testPagerSync(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init the pager and write a page
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	page, err := p.AllocatePage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello, bumble")
+	page.Update(data, 0, int64(len(data)))
+	page.Put()
+	// Sync without closing
+	if err = p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if page.IsDirty() {
+		t.Error("page is still dirty after sync")
+	}
+	// Read the file independently of the pager
+	onDisk, err := ioutil.ReadFile(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(onDisk)) != pager.PAGESIZE || !bytes.HasPrefix(onDisk, data) {
+		t.Error("synced data was not found on disk")
+	}
+	p.Close()
+}
+
+func testPagerBufferedFallback(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+	defer func(force bool) { pager.FORCE_BUFFERED_IO = force }(pager.FORCE_BUFFERED_IO)
+	pager.FORCE_BUFFERED_IO = true
+
+	// Write more pages than there are frames, so that some are evicted and read back
+	p, err := pager.NewPagerWithFrames(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	numPages := int64(8)
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte{byte(pn + 1)}, 64)
+		page.Update(data, pager.PAGESIZE-64, 64)
+		page.Put()
+	}
+	check := func(p *pager.Pager) {
+		for pn := int64(0); pn < numPages; pn++ {
+			page, err := p.GetPage(pn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := (*page.GetData())[pager.PAGESIZE-64:]
+			if !bytes.Equal(data, bytes.Repeat([]byte{byte(pn + 1)}, 64)) {
+				t.Errorf("page %d did not round-trip", pn)
+			}
+			page.Put()
+		}
+	}
+	check(p)
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The file has the same layout either way, so it can be reopened with direct I/O
+	info, err := os.Stat(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != numPages*pager.PAGESIZE {
+		t.Errorf("expected %d bytes on disk, got %d", numPages*pager.PAGESIZE, info.Size())
+	}
+	pager.FORCE_BUFFERED_IO = false
+	p = pager.NewPager()
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if p.GetNumPages() != numPages {
+		t.Fatalf("expected %d pages, got %d", numPages, p.GetNumPages())
+	}
+	check(p)
+}
+
+func testPagerResize(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init a pager with a tiny pool and write more pages than it can hold at once
+	p, err := pager.NewPagerWithFrames(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	numPages := int64(10)
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Update([]byte{byte(pn)}, 0, 1)
+		page.Put()
+	}
+	// A scan that keeps every page pinned should exhaust the pool
+	pinned := make([]*pager.Page, 0)
+	var pn int64
+	for pn = 0; pn < numPages; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			break
+		}
+		pinned = append(pinned, page)
+	}
+	if pn != 4 {
+		t.Fatalf("expected the scan to exhaust the pool after 4 pages, got %d", pn)
+	}
+	// Shrinking is unsupported, but growing lets the scan complete
+	if err = p.Resize(2); err == nil {
+		t.Error("expected shrinking the pool to error")
+	}
+	if err = p.Resize(int(numPages)); err != nil {
+		t.Fatal(err)
+	}
+	if p.GetNumFrames() != int(numPages) {
+		t.Errorf("expected %d frames, got %d", numPages, p.GetNumFrames())
+	}
+	for ; pn < numPages; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pinned = append(pinned, page)
+	}
+	for i, page := range pinned {
+		if (*page.GetData())[0] != byte(i) {
+			t.Errorf("wrong data on page %d", i)
+		}
+		page.Put()
+	}
+	p.Close()
+}
+
+func testPagerAllocate(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init the pager
+	p := pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	// Pages past the end of the file can't be read into existence
+	for _, pn := range []int64{0, 1, 5} {
+		if _, err := p.GetPage(pn); err == nil {
+			t.Errorf("expected getting unallocated page %d to error", pn)
+		}
+	}
+	if p.GetNumPages() != 0 {
+		t.Errorf("expected no pages, got %d", p.GetNumPages())
+	}
+	// Allocate pages in order, writing to each
+	for pn := int64(0); pn < 3; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.GetPageNum() != pn {
+			t.Errorf("expected to allocate page %d, got %d", pn, page.GetPageNum())
+		}
+		page.Update([]byte{byte(pn + 1)}, 0, 1)
+		page.Put()
+	}
+	if _, err := p.GetPage(3); err == nil {
+		t.Error("expected getting unallocated page 3 to error")
+	}
+	// Allocated pages can be read back, and survive a restart
+	p.Close()
+	p = pager.NewPager()
+	if err := p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	if p.GetNumPages() != 3 {
+		t.Errorf("expected 3 pages, got %d", p.GetNumPages())
+	}
+	for pn := int64(0); pn < 3; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (*page.GetData())[0] != byte(pn+1) {
+			t.Errorf("wrong data on page %d", pn)
+		}
+		page.Put()
+	}
+	p.Close()
+}
+
+func testPagerClone(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init a pager with only two frames
+	p, err := pager.NewPagerWithFrames(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	page, err := p.AllocatePage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	page.Update([]byte{1}, 0, 1)
+	// Clones are detached copies that take no frames
+	clones := make([]*pager.Page, 0)
+	for i := 0; i < 10; i++ {
+		clone := page.Clone()
+		if !clone.IsDetached() || page.IsDetached() {
+			t.Error("expected only the clone to be detached")
+		}
+		clones = append(clones, clone)
+	}
+	other, err := p.AllocatePage()
+	if err != nil {
+		t.Fatalf("expected a free frame after cloning: %v", err)
+	}
+	other.Put()
+	page.Update([]byte{2}, 0, 1)
+	for _, clone := range clones {
+		if (*clone.GetData())[0] != 1 {
+			t.Error("clone changed along with the original page")
+		}
+		clone.Put()
+	}
+	// Clones taken under a read latch never see a writer partway through
+	chunkSize := int64(256)
+	numChunks := pager.PAGESIZE / chunkSize
+	page.Update(bytes.Repeat([]byte{0xff}, int(pager.PAGESIZE)), 0, pager.PAGESIZE)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for v := 0; v < 200; v++ {
+			page.WLock()
+			for c := int64(0); c < numChunks; c++ {
+				page.Update(bytes.Repeat([]byte{byte(v)}, int(chunkSize)), c*chunkSize, chunkSize)
+			}
+			page.WUnlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			page.RLock()
+			clone := page.Clone()
+			page.RUnlock()
+			data := *clone.GetData()
+			if !bytes.Equal(data, bytes.Repeat(data[:1], len(data))) {
+				t.Error("clone saw a partially written page")
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+// expectPanic checks that f panics.
+func expectPanic(t *testing.T, name string, f func()) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected %s to panic", name)
+		}
+	}()
+	f()
+}
+
+func testPagerReadOnly(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init a pager with a tiny pool
+	p, err := pager.NewPagerWithFrames(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for pn := int64(0); pn < 4; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Update([]byte{byte(pn + 1)}, 0, 1)
+		page.Put()
+	}
+	// Writing through a read-only page should be caught
+	readOnly, err := p.GetPageReadOnly(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !readOnly.IsReadOnly() || readOnly.GetPageNum() != 0 || (*readOnly.GetData())[0] != 1 {
+		t.Fatal("expected a read-only handle to page 0")
+	}
+	expectPanic(t, "Update", func() { readOnly.Update([]byte{9}, 0, 1) })
+	expectPanic(t, "SetDirty", func() { readOnly.SetDirty(true) })
+	expectPanic(t, "WLock", func() { readOnly.WLock() })
+	readOnly.RLock()
+	readOnly.RUnlock()
+	// Writers holding their own reference are unaffected, and the reader sees their writes
+	page, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Update([]byte{5}, 0, 1)
+	page.Put()
+	if (*readOnly.GetData())[0] != 5 || !readOnly.IsDirty() {
+		t.Error("expected the read-only page to share the pinned page's data")
+	}
+	// The read-only page stays pinned, so other pages have to share the one free frame
+	for pn := int64(1); pn < 4; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = p.GetPage((pn % 3) + 1); err == nil {
+			t.Error("expected the pool to be exhausted")
+		}
+		page.Put()
+	}
+	if (*readOnly.GetData())[0] != 5 {
+		t.Error("expected the read-only page not to be evicted")
+	}
+	// Once put, the frame can be reused
+	readOnly.Put()
+	for pn := int64(1); pn < 3; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer page.Put()
+	}
+}
+
+func testPagerTryGetPage(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init a pager with a tiny pool; the last two pages stay resident
+	p, err := pager.NewPagerWithFrames(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for pn := int64(0); pn < 4; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Update([]byte{byte(pn + 1)}, 0, 1)
+		page.Put()
+	}
+	// Resident pages are returned, pinned
+	page, ok, err := p.TryGetPage(3)
+	if err != nil || !ok {
+		t.Fatalf("expected resident page 3 to be returned, got %v, %v", ok, err)
+	}
+	if page.GetPageNum() != 3 || (*page.GetData())[0] != 4 {
+		t.Error("expected the contents of page 3")
+	}
+	page.Put()
+	// Non-resident pages are declined rather than evicting a resident one
+	if page, ok, err = p.TryGetPage(0); ok || page != nil || err != nil {
+		t.Errorf("expected page 0 to be declined, got %v, %v", ok, err)
+	}
+	// Declining pins nothing, so both frames can still be taken
+	pinned := make([]*pager.Page, 0)
+	for pn := int64(0); pn < 2; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pinned = append(pinned, page)
+	}
+	if page, ok, err = p.TryGetPage(2); ok || err != nil {
+		t.Errorf("expected page 2 to be declined by a pinned pool, got %v, %v", ok, err)
+	}
+	// A free frame is used without evicting anything
+	if err = p.Resize(3); err != nil {
+		t.Fatal(err)
+	}
+	if page, ok, err = p.TryGetPage(2); !ok || err != nil || (*page.GetData())[0] != 3 {
+		t.Fatalf("expected page 2 to be read into the free frame, got %v, %v", ok, err)
+	}
+	pinned = append(pinned, page)
+	if page, ok, err = p.TryGetPage(0); !ok || err != nil || page != pinned[0] {
+		t.Errorf("expected pinned page 0 to be returned, got %v, %v", ok, err)
+	}
+	page.Put()
+	for _, page := range pinned {
+		page.Put()
+	}
+	// Bad page numbers are errors
+	if _, _, err = p.TryGetPage(-1); err == nil {
+		t.Error("expected a negative pagenum to error")
+	}
+	if _, _, err = p.TryGetPage(4); err == nil {
+		t.Error("expected an unallocated pagenum to error")
+	}
+}
+
+func testPagerConcurrentAccess(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init a pager with half as many frames as pages, so hits race with evictions
+	numPages := int64(16)
+	p, err := pager.NewPagerWithFrames(int(numPages / 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamp := make([]byte, 8)
+		binary.PutVarint(stamp, pn)
+		page.Update(stamp, 0, 8)
+		page.Put()
+	}
+	// Each worker checks every page it pins, and counts its writes on the page
+	numWorkers := 4
+	numOps := 2000
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < numOps; i++ {
+				pn := rng.Int63n(numPages)
+				page, err := p.GetPage(pn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				page.WLock()
+				if stamp, _ := binary.Varint((*page.GetData())[0:8]); stamp != pn || page.GetPageNum() != pn {
+					t.Errorf("expected page %d, got page %d stamped %d", pn, page.GetPageNum(), stamp)
+				}
+				count, _ := binary.Varint((*page.GetData())[8:16])
+				data := make([]byte, 8)
+				binary.PutVarint(data, count+1)
+				page.Update(data, 8, 8)
+				page.WUnlock()
+				page.Put()
+			}
+		}(w)
+	}
+	wg.Wait()
+	// No write was lost to an eviction
+	total := int64(0)
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count, _ := binary.Varint((*page.GetData())[8:16])
+		total += count
+		page.Put()
+	}
+	if total != int64(numWorkers*numOps) {
+		t.Errorf("expected %d writes, got %d", numWorkers*numOps, total)
+	}
+}
+
+func testPagerPinScope(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init a pager with a tiny pool
+	p := newStampedPager(t, dbName, 3)
+	defer p.Close()
+	for pn := int64(3); pn < 6; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Put()
+	}
+	// Pin two pages in a scope, one of them twice, and hand it a third
+	scope := p.PinSet()
+	for _, pn := range []int64{0, 1, 1} {
+		if page, err := scope.Get(pn); err != nil || page.GetPageNum() != pn {
+			t.Fatalf("expected page %d, got %v (%v)", pn, page, err)
+		}
+	}
+	page, err := scope.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.GetPageNum() != 6 || scope.Len() != 4 {
+		t.Errorf("expected to allocate page 6 into a scope of 4 pins, got page %d and %d pins", page.GetPageNum(), scope.Len())
+	}
+	// Every frame is held by the scope, so nothing can be read in
+	if _, err = p.GetPage(2); err == nil {
+		t.Error("expected the scope's pages not to be evicted")
+	}
+	// Putting a pin back early frees its frame before the scope is released
+	scope.Put(page)
+	if scope.Len() != 3 {
+		t.Errorf("expected a scope of 3 pins, got %d", scope.Len())
+	}
+	if page, err = p.GetPage(2); err != nil {
+		t.Fatalf("expected an early put to free a frame: %v", err)
+	}
+	page.Put()
+	scope.Release()
+	if scope.Len() != 0 {
+		t.Errorf("expected an empty scope, got %d pins", scope.Len())
+	}
+	// Released pages can be evicted, and the scope can be reused
+	for pn := int64(2); pn < 6; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scope.Add(page)
+		scope.Release()
+	}
+	for pn := int64(0); pn < 3; pn++ {
+		page, err := scope.Get(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stamp, _ := binary.Varint((*page.GetData())[0:8]); stamp != pn {
+			t.Errorf("expected page %d, got page stamped %d", pn, stamp)
+		}
+	}
+	scope.Release()
+}
+
+// newStampedPager opens a pager with the given number of frames and pages, all
+// resident, and stamps each page with its page number and the given round.
+func newStampedPager(t testing.TB, dbName string, numPages int64) *pager.Pager {
+	p, err := pager.NewPagerWithFrames(int(numPages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Put()
+		stampPage(t, p, pn, 0)
+	}
+	return p
+}
+
+// stampPage writes the page number and the given round to the start of the page.
+func stampPage(t testing.TB, p *pager.Pager, pn int64, round int64) {
+	page, err := p.GetPage(pn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 16)
+	binary.PutVarint(data[0:8], pn)
+	binary.PutVarint(data[8:16], round)
+	page.WLock()
+	page.Update(data, 0, 16)
+	page.WUnlock()
+	page.Put()
+}
+
+func testPagerFlushOrder(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	numPages := int64(256)
+	p := newStampedPager(t, dbName, numPages)
+	defer p.Close()
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Dirty a run longer than a single write, scattered pages, and a short run, in no particular order
+	dirty := make([]int64, 0)
+	for pn := int64(0); pn < pager.MAX_FLUSH_RUN+36; pn++ {
+		dirty = append(dirty, pn)
+	}
+	for pn := int64(120); pn < 200; pn += 3 {
+		dirty = append(dirty, pn)
+	}
+	dirty = append(dirty, 201, 202, 250, 251, 252, 253, 254, 255)
+	rand.Shuffle(len(dirty), func(i, j int) {
+		dirty[i], dirty[j] = dirty[j], dirty[i]
+	})
+	rounds := make(map[int64]int64)
+	for _, pn := range dirty {
+		stampPage(t, p, pn, 1)
+		rounds[pn] = 1
+	}
+	p.FlushAllPages()
+	// Every page should be clean and on disk
+	data, err := ioutil.ReadFile(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != numPages*pager.PAGESIZE {
+		t.Fatalf("expected %d bytes on disk, got %d", numPages*pager.PAGESIZE, len(data))
+	}
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.IsDirty() {
+			t.Errorf("expected page %d to be clean", pn)
+		}
+		page.Put()
+		onDisk := data[pn*pager.PAGESIZE:]
+		stamp, _ := binary.Varint(onDisk[0:8])
+		round, _ := binary.Varint(onDisk[8:16])
+		if stamp != pn || round != rounds[pn] {
+			t.Errorf("expected page %d from round %d on disk, got page %d from round %d", pn, rounds[pn], stamp, round)
+		}
+	}
+}
+
+func testPagerFlushHint(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	numPages := int64(128)
+	p := newStampedPager(t, dbName, numPages)
+	defer p.Close()
+	if err := p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// flush dirties two runs of pages in the given round, then returns the number of writes the hint takes
+	buffered := int64(0)
+	flush := func(hint pager.WriteHint, round int64) int64 {
+		for pn := int64(0); pn < 40; pn++ {
+			stampPage(t, p, pn, round)
+		}
+		for pn := int64(100); pn < 110; pn++ {
+			stampPage(t, p, pn, round)
+		}
+		before, bufferedBefore := p.GetNumWrites(), p.GetNumBufferedWrites()
+		p.FlushAllPagesWithHint(hint)
+		buffered = p.GetNumBufferedWrites() - bufferedBefore
+		return p.GetNumWrites() - before
+	}
+	// checkRound checks that the dirtied pages reached the disk
+	checkRound := func(round int64) {
+		data, err := ioutil.ReadFile(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pn := range []int64{0, 39, 100, 109} {
+			if stamp, _ := binary.Varint(data[pn*pager.PAGESIZE+8 : pn*pager.PAGESIZE+16]); stamp != round {
+				t.Errorf("expected page %d from round %d on disk, got round %d", pn, round, stamp)
+			}
+		}
+	}
+	// Sequential flushes coalesce each run into one write, with direct I/O
+	if writes := flush(pager.SEQUENTIAL_WRITES, 1); writes != 2 || buffered != 0 {
+		t.Errorf("expected a sequential flush to take 2 direct writes, got %d writes, %d buffered", writes, buffered)
+	}
+	checkRound(1)
+	// Random flushes write every page on its own, through the page cache
+	if writes := flush(pager.RANDOM_WRITES, 2); writes != 50 || buffered != 50 {
+		t.Errorf("expected a random flush to take 50 buffered writes, got %d writes, %d buffered", writes, buffered)
+	}
+	checkRound(2)
+	// Single pages can be flushed either way
+	for i, hint := range []pager.WriteHint{pager.SEQUENTIAL_WRITES, pager.RANDOM_WRITES} {
+		stampPage(t, p, 5, int64(10+i))
+		page, err := p.GetPage(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := p.GetNumBufferedWrites()
+		p.FlushPageWithHint(page, hint)
+		page.Put()
+		if n := p.GetNumBufferedWrites() - before; n != int64(i) {
+			t.Errorf("hint %d: expected %d buffered writes, got %d", hint, i, n)
+		}
+		data, err := ioutil.ReadFile(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if round, _ := binary.Varint(data[5*pager.PAGESIZE+8 : 5*pager.PAGESIZE+16]); round != int64(10+i) {
+			t.Errorf("hint %d: expected page 5 from round %d on disk, got round %d", hint, 10+i, round)
+		}
+	}
+	// The default is sequential
+	for pn := int64(0); pn < 40; pn++ {
+		stampPage(t, p, pn, 3)
+	}
+	before := p.GetNumWrites()
+	p.FlushAllPages()
+	if writes := p.GetNumWrites() - before; writes != 1 {
+		t.Errorf("expected the default flush to take 1 write, got %d", writes)
+	}
+}
+
+func BenchmarkPagerFlushScattered(b *testing.B) {
+	dbName := getTempPagerDB(b)
+	defer os.Remove(dbName)
+
+	numPages := int64(1024)
+	p := newStampedPager(b, dbName, numPages)
+	defer p.Close()
+	order := make([]int64, numPages)
+	for i := range order {
+		order[i] = int64(i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Dirty a random half of the pages
+		b.StopTimer()
+		rand.Shuffle(len(order), func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+		for _, pn := range order[:numPages/2] {
+			stampPage(b, p, pn, int64(i))
+		}
+		b.StartTimer()
+		p.FlushAllPages()
+	}
+}
+
+func BenchmarkPagerConcurrentHits(b *testing.B) {
+	dbName := getTempPagerDB(b)
+	defer os.Remove(dbName)
+
+	// Init a pager whose pages all stay resident
+	numPages := int64(pager.NUMPAGES)
+	p, err := pager.NewPagerWithFrames(int(numPages))
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		b.Fatal(err)
+	}
+	defer p.Close()
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			b.Fatal(err)
+		}
+		page.Put()
+	}
+	// Each goroutine pins and releases pages in its own order
+	var seed int64
+	var mtx sync.Mutex
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mtx.Lock()
+		pn := seed
+		seed++
+		mtx.Unlock()
+		for pb.Next() {
+			page, err := p.GetPage(pn % numPages)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			page.Put()
+			pn += 7
+		}
+	})
+}
+
+func testPagerReadPageHeader(t *testing.T) {
+	// Init an in-memory pager with more pages than frames, so the first few are evicted
+	p := pager.NewMemPager()
+	if err := p.Open("headers"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	numPages := int64(pager.NUMPAGES + 8)
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, 32)
+		binary.PutVarint(data[0:8], pn)
+		binary.PutVarint(data[8:16], pn*pn)
+		data[31] = byte(pn)
+		page.Update(data, 0, 32)
+		page.Put()
+	}
+	// Header reads of both evicted and resident pages match the start of a full read
+	for pn := int64(0); pn < numPages; pn++ {
+		header, err := p.ReadPageHeader(pn, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(header, (*page.GetData())[:16]) {
+			t.Errorf("page %d: expected header %v, got %v", pn, (*page.GetData())[:16], header)
+		}
+		page.Put()
+	}
+	// Bad page numbers and sizes are errors
+	if _, err := p.ReadPageHeader(-1, 16); err == nil {
+		t.Error("expected a negative pagenum to error")
+	}
+	if _, err := p.ReadPageHeader(numPages, 16); err == nil {
+		t.Error("expected an unallocated pagenum to error")
+	}
+	if _, err := p.ReadPageHeader(0, 0); err == nil {
+		t.Error("expected an empty header to error")
+	}
+	if _, err := p.ReadPageHeader(0, pager.PAGESIZE+1); err == nil {
+		t.Error("expected a header larger than a page to error")
+	}
+
+	// Directio files only serve header reads of resident pages
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+	fp := newStampedPager(t, dbName, 2)
+	if header, err := fp.ReadPageHeader(1, 8); err != nil {
+		t.Errorf("expected a resident page's header to be read, got %v", err)
+	} else if stamp, _ := binary.Varint(header); stamp != 1 {
+		t.Errorf("expected page 1, got page stamped %d", stamp)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := pager.NewPagerWithFrames(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fp.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if _, err = fp.ReadPageHeader(1, 8); !errors.Is(err, pager.ErrPartialReadUnsupported) {
+		t.Errorf("expected a partial read of a directio file to be refused, got %v", err)
+	}
+
+	// Buffered files serve header reads of any page straight from the file
+	defer func(buffered bool) { pager.FORCE_BUFFERED_IO = buffered }(pager.FORCE_BUFFERED_IO)
+	pager.FORCE_BUFFERED_IO = true
+	bufferedName := getTempPagerDB(t)
+	defer os.Remove(bufferedName)
+	bp := newStampedPager(t, bufferedName, 2)
+	if err = bp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bp, err = pager.NewPagerWithFrames(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bp.Open(bufferedName); err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+	if header, err := bp.ReadPageHeader(1, 8); err != nil {
+		t.Errorf("expected a buffered file's header to be read, got %v", err)
+	} else if stamp, _ := binary.Varint(header); stamp != 1 {
+		t.Errorf("expected page 1, got page stamped %d", stamp)
+	}
+}
+
+func testPagerDumpPinnedPages(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+	defer func(debug bool) { pager.DEBUG_PIN_STACKS = debug }(pager.DEBUG_PIN_STACKS)
+	pager.DEBUG_PIN_STACKS = true
+
+	p := newStampedPager(t, dbName, 4)
+	defer p.Close()
+	// Pin page 1 and forget to put it; pin page 2 twice and put it once
+	leaked, err := p.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := p.GetPage(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Get()
+	page.Put()
+	readOnly, err := p.GetPageReadOnly(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly.Put()
+	if leaked.GetPinCount() != 1 || page.GetPinCount() != 1 || readOnly.GetPinCount() != 0 {
+		t.Errorf("expected pin counts 1, 1 and 0, got %d, %d and %d", leaked.GetPinCount(), page.GetPinCount(), readOnly.GetPinCount())
+	}
+	var buf bytes.Buffer
+	p.DumpPinnedPages(&buf)
+	dump := buf.String()
+	if !strings.Contains(dump, "pagenum 1: pincount 1\n") || !strings.Contains(dump, "pagenum 2: pincount 1\n") {
+		t.Errorf("expected pages 1 and 2 to be reported pinned, got %q", dump)
+	}
+	if strings.Contains(dump, "pagenum 0") || strings.Contains(dump, "pagenum 3") {
+		t.Errorf("expected only pinned pages to be reported, got %q", dump)
+	}
+	// Each outstanding pin is reported with the stack that took it
+	if n := strings.Count(dump, "pinned at:"); n != 2 {
+		t.Errorf("expected 2 pin stacks, got %d in %q", n, dump)
+	}
+	if !strings.Contains(dump, "testPagerDumpPinnedPages") {
+		t.Errorf("expected the leaking test to appear in the pin stacks, got %q", dump)
+	}
+	// Once every pin is put, nothing is reported
+	leaked.Put()
+	page.Put()
+	buf.Reset()
+	p.DumpPinnedPages(&buf)
+	if buf.Len() != 0 {
+		t.Errorf("expected no pinned pages, got %q", buf.String())
+	}
+}
+
+// withDeadline runs f, failing the test if it doesn't return in time.
+func withDeadline(t *testing.T, name string, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s deadlocked", name)
+	}
+}
+
+func testPagerNestedGetPage(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Init a pager with two frames, so that with a parent pinned every other read evicts
+	numPages := int64(8)
+	p, err := pager.NewPagerWithFrames(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Put()
+	}
+	parent, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Getting a page that is already pinned doesn't need the ptMtx, even while someone holds it
+	p.LockAllUpdates()
+	withDeadline(t, "getting a pinned page", func() {
+		nested, err := p.GetPage(0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if nested != parent || nested.GetPinCount() != 2 {
+			t.Errorf("expected the parent's frame pinned twice, got %d pins", nested.GetPinCount())
+		}
+		nested.Put()
+	})
+	p.UnlockAllUpdates()
+	// Each child dirtied under the parent is flushed when the next one evicts it
+	withDeadline(t, "evicting dirty pages", func() {
+		for round := int64(1); round <= 2; round++ {
+			for pn := int64(1); pn < numPages; pn++ {
+				page, err := p.GetPage(pn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data := make([]byte, 16)
+				binary.PutVarint(data[0:8], pn)
+				binary.PutVarint(data[8:16], round)
+				page.Update(data, 0, 16)
+				page.Put()
+			}
+		}
+	})
+	parent.Put()
+	for pn := int64(1); pn < numPages; pn++ {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamp, _ := binary.Varint((*page.GetData())[0:8])
+		round, _ := binary.Varint((*page.GetData())[8:16])
+		if stamp != pn || round != 2 {
+			t.Errorf("expected page %d at round 2, got page %d at round %d", pn, stamp, round)
+		}
+		page.Put()
+	}
+}
+
+func testPagerDirtyEviction(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Fill the pool with dirty, unpinned pages
+	numFrames := int64(4)
+	p := newStampedPager(t, dbName, numFrames)
+	defer p.Close()
+	// Every read past the pool's size has to evict, and write back, a dirty page
+	withDeadline(t, "evicting a dirty page", func() {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		page.Put()
+		for pn := int64(0); pn < numFrames; pn++ {
+			page, err := p.GetPage(pn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if stamp, _ := binary.Varint((*page.GetData())[0:8]); stamp != pn {
+				t.Errorf("expected page %d to survive eviction, got %d", pn, stamp)
+			}
+			page.Put()
+		}
+	})
+	// Flushing a page from outside the pager takes the lock itself
+	page, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer page.Put()
+	withDeadline(t, "flushing a page", func() { p.FlushPage(page) })
+	if page.IsDirty() {
+		t.Error("expected the flushed page to be clean")
+	}
+}
+
+func testPagerCacheMiss(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+
+	// Stamp more pages than there are frames, then reopen with an empty pool
+	numPages := int64(6)
+	p := newStampedPager(t, dbName, numPages)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := pager.NewPagerWithFrames(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// Every get misses; the first two fill free frames, and the rest evict
+	withDeadline(t, "getting a missing page", func() {
+		for pn := int64(0); pn < numPages; pn++ {
+			page, err := p.GetPage(pn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if stamp, _ := binary.Varint((*page.GetData())[0:8]); stamp != pn {
+				t.Errorf("expected page %d, got %d", pn, stamp)
+			}
+			page.Put()
+		}
+	})
+	if n := p.GetNumFrames(); n != 2 {
+		t.Errorf("expected the pool to keep 2 frames, got %d", n)
+	}
+}
+
+func testPagerWarmCache(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+	logName := dbName + ".access"
+	defer os.Remove(logName)
+
+	// Nothing is recorded by default
+	numPages := int64(10)
+	p := newStampedPager(t, dbName, numPages)
+	log := pager.NewAccessLog()
+	stampPage(t, p, 0, 1)
+	if hot := log.GetHotPages(); len(hot) != 0 {
+		t.Errorf("expected no pages to be recorded, got %v", hot)
+	}
+	// Record a workload where pages 7, 3 and 5 are hot, then save the log
+	p.SetAccessLog(log)
+	for i := 0; i < 3; i++ {
+		stampPage(t, p, 7, 1)
+		stampPage(t, p, 3, 1)
+	}
+	stampPage(t, p, 3, 1)
+	stampPage(t, p, 5, 1)
+	stampPage(t, p, 5, 1)
+	stampPage(t, p, 1, 1)
+	// Recording stops once the log is unset
+	p.SetAccessLog(nil)
+	stampPage(t, p, 9, 1)
+	if err := log.Save(logName); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen with room for three pages, and warm the pool from the saved log
+	log, err := pager.LoadAccessLog(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int64{3, 7, 5, 1}
+	if hot := log.GetHotPages(); len(hot) != len(expected) {
+		t.Errorf("expected hot pages %v, got %v", expected, hot)
+	} else {
+		for i := range hot {
+			if hot[i] != expected[i] {
+				t.Errorf("expected hot pages %v, got %v", expected, hot)
+				break
+			}
+		}
+	}
+	p, err = pager.NewPagerWithFrames(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	loaded, err := p.WarmCache(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 3 {
+		t.Errorf("expected warming to load 3 pages, got %d", loaded)
+	}
+	if p.GetNumHits() != 0 || p.GetNumMisses() != 0 {
+		t.Errorf("expected warming not to count as hits or misses, got %d and %d", p.GetNumHits(), p.GetNumMisses())
+	}
+	// The three hottest pages now hit, with their recorded contents
+	for _, pn := range expected[:3] {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stamp, _ := binary.Varint((*page.GetData())[8:16]); stamp != 1 {
+			t.Errorf("expected page %d from round 1, got round %d", pn, stamp)
+		}
+		page.Put()
+	}
+	if p.GetNumHits() != 3 || p.GetNumMisses() != 0 {
+		t.Errorf("expected 3 hits and no misses, got %d and %d", p.GetNumHits(), p.GetNumMisses())
+	}
+	// Pages that didn't fit still miss
+	page, err := p.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Put()
+	if p.GetNumMisses() != 1 {
+		t.Errorf("expected 1 miss, got %d", p.GetNumMisses())
+	}
+
+	// Torn logs are errors
+	if err = ioutil.WriteFile(logName, []byte{0x80}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pager.LoadAccessLog(logName); err == nil {
+		t.Error("expected a torn access log to fail to load")
+	}
+}
+
+func testPagerCompression(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+	numPages, numFrames := int64(20), 4
+	open := func() *pager.Pager {
+		p, err := pager.NewPagerWithFrames(numFrames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.SetCompression(true); err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Open(dbName); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	write := func(p *pager.Pager, pn int64, data []byte) {
+		page, err := p.GetPage(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.WLock()
+		page.Update(data, 0, int64(len(data)))
+		page.WUnlock()
+		page.Put()
+	}
+	check := func(p *pager.Pager, expected map[int64][]byte) {
+		if p.GetNumPages() != numPages {
+			t.Fatalf("expected %d pages, got %d", numPages, p.GetNumPages())
+		}
+		for pn, data := range expected {
+			page, err := p.GetPage(pn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(*page.GetData(), data) {
+				t.Errorf("page %d did not round-trip", pn)
+			}
+			page.Put()
+		}
+	}
+	// Write compressible pages through a small buffer pool, so that most are evicted
+	p := open()
+	expected := make(map[int64][]byte)
+	for pn := int64(0); pn < numPages; pn++ {
+		page, err := p.AllocatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Put()
+		expected[pn] = bytes.Repeat([]byte{byte(pn), 'x', 'y'}, int(pager.PAGESIZE))[:pager.PAGESIZE]
+		write(p, pn, expected[pn])
+	}
+	if err := p.SetCompression(false); err == nil {
+		t.Error("expected compression to be fixed once the pager is open")
+	}
+	check(p, expected)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= numPages*pager.PAGESIZE/4 {
+		t.Errorf("expected %d pages to compress well, but the file has %d bytes", numPages, info.Size())
+	}
+	// Reopen and check every page, including one read with ReadPageHeader while not resident
+	p = open()
+	header, err := p.ReadPageHeader(numPages-1, 16)
+	if err != nil || !bytes.Equal(header, expected[numPages-1][:16]) {
+		t.Errorf("expected header %v, got %v (%v)", expected[numPages-1][:16], header, err)
+	}
+	check(p, expected)
+	// Rewrite some pages with incompressible data, which no longer fits where they were
+	rng := rand.New(rand.NewSource(int64(numPages)))
+	for pn := int64(0); pn < numPages; pn += 3 {
+		data := make([]byte, pager.PAGESIZE)
+		rng.Read(data)
+		expected[pn] = data
+		write(p, pn, data)
+	}
+	check(p, expected)
+	if err = p.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+	p = open()
+	check(p, expected)
+	p.Close()
+	// Uncompressed files can't be opened by compressed pagers, nor can compression be
+	// turned on for in-memory pagers
+	plainName := getTempPagerDB(t)
+	defer os.Remove(plainName)
+	plain := newStampedPager(t, plainName, 2)
+	plain.Close()
+	compressed := pager.NewPager()
+	if err = compressed.SetCompression(true); err != nil {
+		t.Fatal(err)
+	}
+	if err = compressed.Open(plainName); err == nil {
+		t.Error("expected an uncompressed file to be rejected")
+	}
+	if err = pager.NewMemPager().SetCompression(true); err == nil {
+		t.Error("expected compression to be refused for in-memory pagers")
+	}
+}
+
+func testPagerCloseDrains(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+	p := newStampedPager(t, dbName, 4)
+	// Hold a pin, as an in-flight operation would, and start closing
+	page, err := p.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan error)
+	go func() {
+		closed <- p.Close()
+	}()
+	for !p.IsClosing() {
+		time.Sleep(time.Millisecond)
+	}
+	// New pins are refused, whether or not their page is resident
+	if _, err = p.GetPage(2); err != pager.ErrClosed {
+		t.Errorf("expected GetPage to fail with ErrClosed, got %v", err)
+	}
+	if _, _, err = p.TryGetPage(2); err != pager.ErrClosed {
+		t.Errorf("expected TryGetPage to fail with ErrClosed, got %v", err)
+	}
+	if _, err = p.AllocatePage(); err != pager.ErrClosed {
+		t.Errorf("expected AllocatePage to fail with ErrClosed, got %v", err)
+	}
+	// Close waits for the outstanding pin, so the operation can finish its update
+	select {
+	case err = <-closed:
+		t.Fatalf("expected close to wait for the pin, but it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	data := []byte("written while closing")
+	page.WLock()
+	page.Update(data, 16, int64(len(data)))
+	page.WUnlock()
+	page.Put()
+	withDeadline(t, "close", func() {
+		if err := <-closed; err != nil {
+			t.Error(err)
+		}
+	})
+	// The update made before the pin was put should have been flushed
+	p = pager.NewPager()
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	page, err = p.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal((*page.GetData())[16:16+len(data)], data) {
+		t.Error("expected the update made during close to be flushed")
+	}
+	page.Put()
+}
+
+func testPagerCloseTimeout(t *testing.T) {
+	dbName := getTempPagerDB(t)
+	defer os.Remove(dbName)
+	defer func(timeout time.Duration) { pager.CLOSE_TIMEOUT = timeout }(pager.CLOSE_TIMEOUT)
+	pager.CLOSE_TIMEOUT = 50 * time.Millisecond
+	p := newStampedPager(t, dbName, 4)
+	// A pin that outlives the timeout fails the close, without flushing the pinned page
+	page, err := p.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("half-done update")
+	page.WLock()
+	page.Update(data, 16, int64(len(data)))
+	withDeadline(t, "close", func() {
+		err := p.Close()
+		if !errors.Is(err, pager.ErrPinned) {
+			t.Errorf("expected close to fail with ErrPinned, got %v", err)
+		} else if !strings.Contains(err.Error(), "pagenum 1: pincount 1") {
+			t.Errorf("expected the error to list the pinned page, got %v", err)
+		}
+	})
+	if !p.IsClosing() {
+		t.Error("expected the pager to keep refusing pins")
+	}
+	if _, err = p.GetPage(2); err != pager.ErrClosed {
+		t.Errorf("expected GetPage to fail with ErrClosed, got %v", err)
+	}
+	onDisk, err := ioutil.ReadFile(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(onDisk, data) {
+		t.Error("expected the pinned page not to be flushed")
+	}
+	// Once the pin is put, closing again flushes it
+	page.WUnlock()
+	page.Put()
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p = pager.NewPager()
+	if err = p.Open(dbName); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	page, err = p.GetPage(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal((*page.GetData())[16:16+len(data)], data) {
+		t.Error("expected the update to be flushed by the second close")
+	}
+	page.Put()
+}
@@ -4,12 +4,19 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	db "github.com/brown-csci1270/db/pkg/db"
 	hash "github.com/brown-csci1270/db/pkg/hash"
 	"github.com/brown-csci1270/db/pkg/query"
+	utils "github.com/brown-csci1270/db/pkg/utils"
 )
 
 func TestQueryTA(t *testing.T) {
@@ -17,6 +24,23 @@ func TestQueryTA(t *testing.T) {
 	t.Run("TestFilterInsertAndCheckSmall", testFilterInsertAndCheckSmall)
 }
 
+func TestQuery(t *testing.T) {
+	t.Run("TestQueryPartitionedJoin", testQueryPartitionedJoin)
+	t.Run("TestQueryDistinctLeftJoin", testQueryDistinctLeftJoin)
+	t.Run("TestQueryOrderedJoin", testQueryOrderedJoin)
+	t.Run("TestQueryParallelJoin", testQueryParallelJoin)
+	t.Run("TestQueryJoinProgress", testQueryJoinProgress)
+	t.Run("TestQueryMergeCursors", testQueryMergeCursors)
+	t.Run("TestQueryGroupBy", testQueryGroupBy)
+	t.Run("TestQueryJoinInto", testQueryJoinInto)
+	t.Run("TestQueryAggregateJoin", testQueryAggregateJoin)
+	t.Run("TestQuerySortEntries", testQuerySortEntries)
+	t.Run("TestQueryIndexJoin", testQueryIndexJoin)
+	t.Run("TestQueryEmptyJoin", testQueryEmptyJoin)
+	t.Run("TestFilterSetOperations", testFilterSetOperations)
+	t.Run("TestFilterSeeds", testFilterSeeds)
+}
+
 // Mod vals by this value to prevent hardcoding tests
 var query_salt int64 = rand.Int63n(1000)
 
@@ -86,6 +110,82 @@ func getresults(t *testing.T, index1 *hash.HashIndex, index2 *hash.HashIndex, jo
 	return results, nil
 }
 
+func getJoinResults(t *testing.T, index1 db.Index, index2 db.Index, joinOnLeftKey bool, joinOnRightKey bool, distinctLeft bool) ([]query.EntryPair, error) {
+	// Create context.
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	// Join the indixes; set up cleanup.
+	resultsChan, _, group, cleanupCallback, err := query.JoinWithProgress(ctx, index1, index2, joinOnLeftKey, joinOnRightKey, distinctLeft, nil)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Iterate through results.
+	done := make(chan bool)
+	results := make([]query.EntryPair, 0)
+	go func() {
+		for {
+			pair, valid := <-resultsChan
+			if !valid {
+				break
+			}
+			results = append(results, pair)
+		}
+		done <- true
+	}()
+
+	// Wait, close, and return.
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	if err != nil {
+		return nil, fmt.Errorf("join error: %v", err)
+	}
+	return results, nil
+}
+
+func getPartitionedResults(t *testing.T, index1 *hash.HashIndex, index2 *hash.HashIndex, joinOnLeftKey bool, joinOnRightKey bool, numPartitions int64) ([]query.EntryPair, error) {
+	// Create context.
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	// Join the indixes; set up cleanup.
+	resultsChan, _, group, cleanupCallback, err := query.JoinWithPartitions(ctx, index1, index2, joinOnLeftKey, joinOnRightKey, numPartitions)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Iterate through results.
+	done := make(chan bool)
+	results := make([]query.EntryPair, 0)
+	go func() {
+		for {
+			pair, valid := <-resultsChan
+			if !valid {
+				break
+			}
+			results = append(results, pair)
+		}
+		done <- true
+	}()
+
+	// Wait, close, and return.
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	if err != nil {
+		return nil, fmt.Errorf("join error: %v", err)
+	}
+	return results, nil
+}
+
 func teardownQuery(dbName1 string, dbName2 string, index1 *hash.HashIndex, index2 *hash.HashIndex) {
 	index1.Close()
 	index2.Close()
@@ -136,3 +236,938 @@ func testFilterInsertAndCheckSmall(t *testing.T) {
 		}
 	}
 }
+
+func testFilterSetOperations(t *testing.T) {
+	// Init two filters over overlapping ranges of keys
+	left, right := query.CreateFilter(1024), query.CreateFilter(1024)
+	for i := int64(0); i < 300; i++ {
+		left.Insert(i)
+		right.Insert(i + 200)
+	}
+	// countContained returns how many keys in a fixed range the filter contains.
+	countContained := func(filter *query.BloomFilter) int {
+		n := 0
+		for i := int64(-1000); i < 1000; i++ {
+			if filter.Contains(i) {
+				n++
+			}
+		}
+		return n
+	}
+	leftCount, rightCount := countContained(left), countContained(right)
+	intersection, err := left.Intersect(right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	union, err := left.Union(right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The intersection contains a key exactly when both sources do;
+	// the union contains every key that either source does.
+	for i := int64(-1000); i < 1000; i++ {
+		inLeft, inRight := left.Contains(i), right.Contains(i)
+		if intersection.Contains(i) != (inLeft && inRight) {
+			t.Errorf("key %d: intersection disagrees with its sources", i)
+		}
+		if (inLeft || inRight) && !union.Contains(i) {
+			t.Errorf("key %d: missing from the union", i)
+		}
+		if i >= 200 && i < 300 && !intersection.Contains(i) {
+			t.Errorf("key %d: in both sets but missing from the intersection", i)
+		}
+	}
+	// Combining shouldn't modify the sources
+	if countContained(left) != leftCount || countContained(right) != rightCount {
+		t.Error("expected the sources to be unchanged")
+	}
+	// Only filters of the same size can be combined
+	if _, err = left.Intersect(query.CreateFilter(512)); err == nil {
+		t.Error("expected intersecting filters of different sizes to error")
+	}
+	if _, err = left.Union(nil); err == nil {
+		t.Error("expected a union with a nil filter to error")
+	}
+}
+
+func testFilterSeeds(t *testing.T) {
+	size, k, numKeys, numProbes := int64(8192), int64(3), int64(1000), int64(20000)
+	// falsePositives builds a seeded filter over the keys [0, numKeys) and returns which
+	// of the probes [numKeys, numKeys+numProbes) it wrongly contains.
+	falsePositives := func(seed uint64) map[int64]bool {
+		filter := query.CreateFilterSeeded(size, k, seed)
+		for i := int64(0); i < numKeys; i++ {
+			filter.Insert(i)
+		}
+		for i := int64(0); i < numKeys; i++ {
+			if !filter.Contains(i) {
+				t.Fatalf("seed %d: inserted key %d but not found", seed, i)
+			}
+		}
+		positives := make(map[int64]bool)
+		for i := numKeys; i < numKeys+numProbes; i++ {
+			if filter.Contains(i) {
+				positives[i] = true
+			}
+		}
+		return positives
+	}
+	// Each seed should have about the expected false positive rate, (1 - e^(-kn/m))^k
+	expected := math.Pow(1-math.Exp(-float64(k*numKeys)/float64(size)), float64(k)) * float64(numProbes)
+	results := make([]map[int64]bool, 0)
+	for seed := uint64(1); seed <= 4; seed++ {
+		positives := falsePositives(seed)
+		if n := float64(len(positives)); n < expected/2 || n > expected*2 {
+			t.Errorf("seed %d: expected about %.0f false positives, got %.0f", seed, expected, n)
+		}
+		results = append(results, positives)
+	}
+	// The same seed gives the same filter
+	if again := falsePositives(1); !reflect.DeepEqual(again, results[0]) {
+		t.Error("expected the same seed to give the same false positives")
+	}
+	// Different seeds should share only about as many false positives as chance would
+	for i := 1; i < len(results); i++ {
+		shared := 0
+		for key := range results[i] {
+			if results[0][key] {
+				shared++
+			}
+		}
+		if limit := len(results[0]) / 4; shared > limit {
+			t.Errorf("seeds 1 and %d: expected at most %d shared false positives, got %d", i+1, limit, shared)
+		}
+	}
+	// Filters can only be combined if they hash keys the same way
+	base := query.CreateFilterSeeded(size, k, 1)
+	if _, err := base.Union(query.CreateFilterSeeded(size, k, 2)); err == nil {
+		t.Error("expected combining filters with different seeds to error")
+	}
+	if _, err := base.Intersect(query.CreateFilterSeeded(size, k+1, 1)); err == nil {
+		t.Error("expected combining filters with different numbers of hashes to error")
+	}
+	if _, err := base.Intersect(query.CreateFilterSeeded(size, k, 1)); err != nil {
+		t.Error(err)
+	}
+}
+
+// countPairs returns how many times each distinct pair appears in results.
+func countPairs(results []query.EntryPair) map[string]int {
+	counts := make(map[string]int)
+	for _, pair := range results {
+		counts[fmt.Sprint(pair)]++
+	}
+	return counts
+}
+
+func testQueryPartitionedJoin(t *testing.T) {
+	// Setup.
+	var err error
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+
+	// Insert entries; the right table is far larger, so its depth differs.
+	for i := int64(0); i < 20; i++ {
+		if err = index1.Insert(i*50, i%query_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := int64(0); i < 1000; i++ {
+		if err = index2.Insert(i, i%query_salt); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, onKeys := range [][2]bool{{true, true}, {true, false}, {false, true}, {false, false}} {
+		partitioned, err := getPartitionedResults(t, index1, index2, onKeys[0], onKeys[1], 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := getresults(t, index1, index2, onKeys[0], onKeys[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Both strategies should produce the same multiset of pairs
+		if len(partitioned) != len(expected) {
+			t.Errorf("join on %v: expected %d results, got %d", onKeys, len(expected), len(partitioned))
+		}
+		expectedCounts := countPairs(expected)
+		for pair, count := range countPairs(partitioned) {
+			if expectedCounts[pair] != count {
+				t.Errorf("join on %v: pair %s appeared %d times, expected %d", onKeys, pair, count, expectedCounts[pair])
+			}
+		}
+	}
+	if _, err = getPartitionedResults(t, index1, index2, true, true, 0); err == nil {
+		t.Error("expected an error for zero partitions")
+	}
+}
+
+func testQueryDistinctLeftJoin(t *testing.T) {
+	// Setup.
+	var err error
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+
+	// Insert entries; every right value below 50 appears four times.
+	for i := int64(0); i < 100; i++ {
+		if err = index1.Insert(i, i%query_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := int64(0); i < 200; i++ {
+		if err = index2.Insert(i, i%50); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Without distinct, each matching left entry appears once per right match.
+	results, err := getJoinResults(t, index1, index2, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 200 {
+		t.Errorf("expected %d results, got %d", 200, len(results))
+	}
+	// With distinct, each matching left entry appears exactly once.
+	results, err = getJoinResults(t, index1, index2, true, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 50 {
+		t.Errorf("expected %d results, got %d", 50, len(results))
+	}
+	seen := make(map[int64]bool)
+	for _, pair := range results {
+		var lKey, lVal, rKey, rVal int64
+		if _, err = fmt.Sscanf(fmt.Sprint(pair), "{{%d %d} {%d %d}}", &lKey, &lVal, &rKey, &rVal); err != nil {
+			t.Fatal(err)
+		}
+		if seen[lKey] {
+			t.Errorf("left key %d was emitted more than once", lKey)
+		}
+		seen[lKey] = true
+		if lKey >= 50 || rVal != lKey {
+			t.Errorf("unexpected pair %v", pair)
+		}
+	}
+}
+
+func getOrderedResults(t *testing.T, index1 db.Index, index2 db.Index, joinOnLeftKey bool, joinOnRightKey bool, distinctLeft bool) ([]query.EntryPair, error) {
+	// Create context.
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	// Join the indixes; set up cleanup.
+	resultsChan, _, group, cleanupCallback, err := query.JoinOrdered(ctx, index1, index2, joinOnLeftKey, joinOnRightKey, distinctLeft)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Iterate through results.
+	done := make(chan bool)
+	results := make([]query.EntryPair, 0)
+	go func() {
+		for {
+			pair, valid := <-resultsChan
+			if !valid {
+				break
+			}
+			results = append(results, pair)
+		}
+		done <- true
+	}()
+
+	// Wait, close, and return.
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	if err != nil {
+		return nil, fmt.Errorf("join error: %v", err)
+	}
+	return results, nil
+}
+
+func testQueryOrderedJoin(t *testing.T) {
+	// Setup.
+	var err error
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+
+	// Insert entries; every right value below 50 appears four times.
+	for i := int64(0); i < 100; i++ {
+		if err = index1.Insert(i, i+query_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := int64(0); i < 200; i++ {
+		if err = index2.Insert(i, i%50); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// parsePair returns the keys and values of a result.
+	parsePair := func(pair query.EntryPair) [4]int64 {
+		var parsed [4]int64
+		if _, err := fmt.Sscanf(fmt.Sprint(pair), "{{%d %d} {%d %d}}", &parsed[0], &parsed[1], &parsed[2], &parsed[3]); err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	// The same inputs should always give the same sequence, sorted by left key then right key.
+	expected, err := getOrderedResults(t, index1, index2, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 200 {
+		t.Fatalf("expected %d results, got %d", 200, len(expected))
+	}
+	for i := 1; i < len(expected); i++ {
+		prev, cur := parsePair(expected[i-1]), parsePair(expected[i])
+		if prev[0] > cur[0] || (prev[0] == cur[0] && prev[2] >= cur[2]) {
+			t.Fatalf("results %d and %d are out of order: %v, %v", i-1, i, expected[i-1], expected[i])
+		}
+	}
+	for run := 0; run < 5; run++ {
+		results, err := getOrderedResults(t, index1, index2, true, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(results, expected) {
+			t.Fatalf("run %d emitted a different sequence", run)
+		}
+	}
+	// With distinct, each left entry should come with its first match, i.e. the right key equal to it.
+	for run := 0; run < 5; run++ {
+		results, err := getOrderedResults(t, index1, index2, true, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 50 {
+			t.Fatalf("expected %d results, got %d", 50, len(results))
+		}
+		for i, pair := range results {
+			if parsed := parsePair(pair); parsed[0] != int64(i) || parsed[2] != int64(i) {
+				t.Errorf("expected left key %d with right key %d, got %v", i, i, pair)
+			}
+		}
+	}
+}
+
+func getParallelResults(t *testing.T, index1 *hash.HashIndex, index2 *hash.HashIndex, joinOnLeftKey bool, joinOnRightKey bool, workers int) ([]query.EntryPair, int, error) {
+	// Create context.
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	// Join the indixes; set up cleanup.
+	baseGoroutines := runtime.NumGoroutine()
+	resultsChan, _, group, cleanupCallback, err := query.JoinWithParallelism(ctx, index1, index2, joinOnLeftKey, joinOnRightKey, false, workers)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Iterate through results, tracking the most probes seen running at once.
+	results := make([]query.EntryPair, 0)
+	maxProbes := runtime.NumGoroutine() - baseGoroutines
+	done := make(chan error)
+	go func() {
+		done <- group.Wait()
+	}()
+	for {
+		if probes := runtime.NumGoroutine() - baseGoroutines - 1; probes > maxProbes {
+			maxProbes = probes
+		}
+		select {
+		case pair := <-resultsChan:
+			results = append(results, pair)
+			continue
+		case err = <-done:
+		}
+		break
+	}
+
+	// Collect any stragglers and return.
+	close(resultsChan)
+	for pair := range resultsChan {
+		results = append(results, pair)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("join error: %v", err)
+	}
+	return results, maxProbes, nil
+}
+
+func testQueryParallelJoin(t *testing.T) {
+	// Setup.
+	var err error
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+
+	// Insert entries.
+	for i := int64(0); i < 300; i++ {
+		if err = index1.Insert(i*3, i%query_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := int64(0); i < 600; i++ {
+		if err = index2.Insert(i, i%query_salt); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The bounded join should produce the same multiset of pairs as the unbounded one.
+	for _, onKeys := range [][2]bool{{true, true}, {false, true}} {
+		expected, err := getresults(t, index1, index2, onKeys[0], onKeys[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedCounts := countPairs(expected)
+		for _, workers := range []int{1, 3, 1000} {
+			results, maxProbes, err := getParallelResults(t, index1, index2, onKeys[0], onKeys[1], workers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != len(expected) {
+				t.Errorf("join on %v with %d workers: expected %d results, got %d", onKeys, workers, len(expected), len(results))
+			}
+			for pair, count := range countPairs(results) {
+				if expectedCounts[pair] != count {
+					t.Errorf("join on %v with %d workers: pair %s appeared %d times, expected %d", onKeys, workers, pair, count, expectedCounts[pair])
+				}
+			}
+			if workers < 1000 && maxProbes > workers {
+				t.Errorf("expected at most %d concurrent probes, saw %d", workers, maxProbes)
+			}
+		}
+	}
+	// Grow the right table to many buckets; the number of probes should stay bounded.
+	for i := int64(600); i < 5000; i++ {
+		if err = index2.Insert(i, i%query_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	results, maxProbes, err := getParallelResults(t, index1, index2, true, true, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 300 {
+		t.Errorf("expected %d results, got %d", 300, len(results))
+	}
+	if maxProbes > 2 {
+		t.Errorf("expected at most %d concurrent probes, saw %d", 2, maxProbes)
+	}
+	if _, _, err = getParallelResults(t, index1, index2, true, true, 0); err == nil {
+		t.Error("expected an error for zero workers")
+	}
+}
+
+func testQuerySortEntries(t *testing.T) {
+	newEntry := func(key int64, value int64) utils.Entry {
+		var entry hash.HashEntry
+		entry.SetKey(key)
+		entry.SetValue(value)
+		return entry
+	}
+	// Entries compare by key, then by value
+	if c := utils.CompareEntries(newEntry(-1, 5), newEntry(0, -5)); c >= 0 {
+		t.Errorf("expected key -1 to come before key 0, got %d", c)
+	}
+	if c := utils.CompareEntries(newEntry(3, -2), newEntry(3, -7)); c <= 0 {
+		t.Errorf("expected value -7 to come before value -2, got %d", c)
+	}
+	if c := utils.CompareEntries(newEntry(3, -2), newEntry(3, -2)); c != 0 {
+		t.Errorf("expected equal entries to compare equal, got %d", c)
+	}
+	// Sorting orders duplicate keys by value, negatives first
+	entries := make([]utils.Entry, 0)
+	for _, i := range rand.Perm(200) {
+		entries = append(entries, newEntry(int64(i%10-5), int64(i/10-10)))
+	}
+	utils.SortEntries(entries)
+	for i := 1; i < len(entries); i++ {
+		prev, cur := entries[i-1], entries[i]
+		if prev.GetKey() > cur.GetKey() || (prev.GetKey() == cur.GetKey() && prev.GetValue() >= cur.GetValue()) {
+			t.Fatalf("entries %d and %d out of order: %v, %v", i-1, i, prev, cur)
+		}
+	}
+	if entries[0].GetKey() != -5 || entries[0].GetValue() != -10 {
+		t.Errorf("expected (-5, -10) first, got %v", entries[0])
+	}
+	// Entries that compare equal keep their order
+	var first btree.BTreeEntry
+	first.SetKey(1)
+	first.SetValue(-1)
+	second := newEntry(1, -1)
+	entries = []utils.Entry{newEntry(2, 0), first, newEntry(0, 0), second, newEntry(1, -2)}
+	utils.SortEntries(entries)
+	if entries[2] != utils.Entry(first) || entries[3] != second {
+		t.Errorf("expected equal entries to keep their order, got %v", entries)
+	}
+}
+
+func testQueryMergeCursors(t *testing.T) {
+	// Init three btrees with overlapping key ranges of different lengths;
+	// each entry's value records which tree it came from.
+	ranges := [][3]int64{{0, 300, 1}, {200, 1000, 2}, {250, 260, 5}}
+	cursors := make([]utils.Cursor, 0)
+	total := 0
+	for i, r := range ranges {
+		dbName := getTempBTreeDB(t)
+		defer os.Remove(dbName)
+		index, err := btree.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		for key := r[0]; key < r[1]; key += r[2] {
+			if err = index.Insert(key, int64(i)); err != nil {
+				t.Error(err)
+			}
+			total++
+		}
+		cursor, err := index.TableStart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursors = append(cursors, cursor)
+	}
+
+	// The merged stream should hold every entry, sorted by key and then by input.
+	merged := query.MergeCursors(cursors)
+	n := 0
+	var prevKey, prevVal int64
+	for ; !merged.IsEnd(); n++ {
+		entry, err := merged.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 && (entry.GetKey() < prevKey || (entry.GetKey() == prevKey && entry.GetValue() <= prevVal)) {
+			t.Fatalf("entry (%d, %d) came after (%d, %d)", entry.GetKey(), entry.GetValue(), prevKey, prevVal)
+		}
+		prevKey, prevVal = entry.GetKey(), entry.GetValue()
+		if err = merged.StepForward(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != total {
+		t.Errorf("expected %d merged entries, got %d", total, n)
+	}
+	if err := merged.StepForward(); err == nil {
+		t.Error("expected stepping past the end to error")
+	}
+	// Merging nothing yields an empty cursor.
+	if !query.MergeCursors(nil).IsEnd() {
+		t.Error("expected merging no cursors to be empty")
+	}
+}
+
+func getIndexJoinResults(t *testing.T, index1 db.Index, index2 db.Index, joinOnLeftKey bool, joinOnRightKey bool, distinctLeft bool) ([]query.EntryPair, error) {
+	// Create context.
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+
+	// Join the indixes; set up cleanup.
+	resultsChan, _, group, cleanupCallback, err := query.IndexJoin(ctx, index1, index2, joinOnLeftKey, joinOnRightKey, distinctLeft)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Iterate through results.
+	done := make(chan bool)
+	results := make([]query.EntryPair, 0)
+	go func() {
+		for pair := range resultsChan {
+			results = append(results, pair)
+		}
+		done <- true
+	}()
+
+	// Wait, close, and return.
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	if err != nil {
+		return nil, fmt.Errorf("join error: %v", err)
+	}
+	return results, nil
+}
+
+func testQueryIndexJoin(t *testing.T) {
+	// Init two btrees; the left one is small enough to probe the right one with.
+	dbName1 := getTempBTreeDB(t)
+	defer os.Remove(dbName1)
+	index1, err := btree.OpenTable(dbName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index1.Close()
+	dbName2 := getTempBTreeDB(t)
+	defer os.Remove(dbName2)
+	index2, err := btree.OpenTable(dbName2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index2.Close()
+	for i := int64(0); i < 200; i++ {
+		if err = index1.Insert(i*7, i%50); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := int64(0); i < 2000; i++ {
+		if err = index2.Insert(i, i%100); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Every combination should match the Grace join, whether or not it can seek,
+	// and whether or not the outer table is small enough.
+	for _, threshold := range []int64{query.INDEX_JOIN_THRESHOLD, 10} {
+		oldThreshold := query.INDEX_JOIN_THRESHOLD
+		query.INDEX_JOIN_THRESHOLD = threshold
+		for _, onKeys := range [][2]bool{{true, true}, {true, false}, {false, true}, {false, false}} {
+			for _, distinctLeft := range []bool{false, true} {
+				results, err := getIndexJoinResults(t, index1, index2, onKeys[0], onKeys[1], distinctLeft)
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, err := getJoinResults(t, index1, index2, onKeys[0], onKeys[1], distinctLeft)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(results) != len(expected) {
+					t.Errorf("join on %v (distinct %v, threshold %d): expected %d results, got %d",
+						onKeys, distinctLeft, threshold, len(expected), len(results))
+				}
+				if distinctLeft {
+					continue
+				}
+				expectedCounts := countPairs(expected)
+				for pair, count := range countPairs(results) {
+					if expectedCounts[pair] != count {
+						t.Errorf("join on %v (threshold %d): pair %s appeared %d times, expected %d",
+							onKeys, threshold, pair, count, expectedCounts[pair])
+					}
+				}
+			}
+		}
+		query.INDEX_JOIN_THRESHOLD = oldThreshold
+	}
+}
+
+func testQueryJoinProgress(t *testing.T) {
+	// Setup.
+	var err error
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	defer func(interval time.Duration) { query.DEFAULT_PROGRESS_INTERVAL = interval }(query.DEFAULT_PROGRESS_INTERVAL)
+	query.DEFAULT_PROGRESS_INTERVAL = time.Millisecond
+
+	// Insert entries; every third key on the right has a match on the left.
+	for i := int64(0); i < 1000; i++ {
+		if err = index1.Insert(i*3, i%query_salt); err != nil {
+			t.Error(err)
+		}
+	}
+	for i := int64(0); i < 2000; i++ {
+		if err = index2.Insert(i, i%query_salt); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Join, recording every progress report.
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	reports := make([]query.JoinProgress, 0)
+	resultsChan, _, group, cleanupCallback, err := query.JoinWithProgress(ctx, index1, index2, true, true, false,
+		func(progress query.JoinProgress) {
+			reports = append(reports, progress)
+		})
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int64)
+	go func() {
+		drained := int64(0)
+		for range resultsChan {
+			drained++
+		}
+		done <- drained
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	drained := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The final report should account for every result and bucket pair.
+	if drained != 667 {
+		t.Errorf("expected 667 results, got %d", drained)
+	}
+	if len(reports) == 0 {
+		t.Fatal("expected at least one progress report")
+	}
+	final := reports[len(reports)-1]
+	if final.PairsEmitted != drained {
+		t.Errorf("expected %d emitted pairs to be reported, got %d", drained, final.PairsEmitted)
+	}
+	if final.TotalBuckets == 0 || final.BucketsProcessed != final.TotalBuckets {
+		t.Errorf("expected all %d bucket pairs to be processed, got %d", final.TotalBuckets, final.BucketsProcessed)
+	}
+	if final.FilterHits < drained || final.FilterHits+final.FilterMisses < 1000 {
+		t.Errorf("expected every left entry to be checked against a filter, got %d hits and %d misses", final.FilterHits, final.FilterMisses)
+	}
+	if ratio := final.FilterHitRatio(); ratio <= 0 || ratio > 1 {
+		t.Errorf("expected a filter hit ratio in (0, 1], got %v", ratio)
+	}
+	// Counters only ever grow.
+	for i := 1; i < len(reports); i++ {
+		prev, cur := reports[i-1], reports[i]
+		if cur.PairsEmitted < prev.PairsEmitted || cur.BucketsProcessed < prev.BucketsProcessed ||
+			cur.FilterHits < prev.FilterHits || cur.FilterMisses < prev.FilterMisses {
+			t.Errorf("expected report %d not to go backwards, got %+v after %+v", i, cur, prev)
+		}
+	}
+}
+
+func testQueryGroupBy(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Group entries by key modulo the number of groups
+	numGroups, numEntries := int64(7), int64(500)
+	sums := make(map[int64]int64)
+	counts := make(map[int64]int64)
+	for key := int64(0); key < numEntries; key++ {
+		value := key*31 + query_salt
+		if err = index.Insert(key, value); err != nil {
+			t.Fatal(err)
+		}
+		sums[key%numGroups] += value
+		counts[key%numGroups]++
+	}
+	byGroup := func(entry utils.Entry) int64 { return entry.GetKey() % numGroups }
+	// Sum per group
+	result, err := query.GroupBy(index, byGroup, func(acc, val int64) int64 { return acc + val }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, sums) {
+		t.Errorf("expected sums %v, got %v", sums, result)
+	}
+	// Count per group, starting from a non-zero accumulator
+	result, err = query.GroupBy(index, byGroup, func(acc, val int64) int64 { return acc + 1 }, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for group, count := range counts {
+		counts[group] = count + 100
+	}
+	if !reflect.DeepEqual(result, counts) {
+		t.Errorf("expected counts %v, got %v", counts, result)
+	}
+	// An empty table has no groups
+	emptyName := getTempBTreeDB(t)
+	defer os.Remove(emptyName)
+	empty, err := btree.OpenTable(emptyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if result, err = query.GroupBy(empty, byGroup, func(acc, val int64) int64 { return acc + 1 }, 0); err != nil || len(result) != 0 {
+		t.Errorf("expected no groups, got %v, %v", result, err)
+	}
+}
+
+func testQueryJoinInto(t *testing.T) {
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+	dbName1, dbName2 := getTempBTreeDB(t), getTempBTreeDB(t)
+	defer os.Remove(dbName1)
+	defer os.Remove(dbName2)
+	left, err := btree.OpenTable(dbName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer left.Close()
+	right, err := btree.OpenTable(dbName2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer right.Close()
+	// Join on values, so that every left entry matches several right entries
+	for key := int64(0); key < 100; key++ {
+		if err = left.Insert(key, key%10+query_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := int64(0); key < 30; key++ {
+		if err = right.Insert(key, key%10+query_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = query.JoinInto(context.Background(), database, left, right, false, false, false, "joined"); err != nil {
+		t.Fatal(err)
+	}
+	// The table should hold one row per pair, numbered from 0
+	table, err := database.GetTypedTable("joined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema := table.GetSchema().String(); schema != query.JOIN_INTO_SCHEMA {
+		t.Errorf("expected schema %q, got %q", query.JOIN_INTO_SCHEMA, schema)
+	}
+	rows, err := table.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := make(map[[4]int64]bool)
+	for l := int64(0); l < 100; l++ {
+		for r := l % 10; r < 30; r += 10 {
+			pairs[[4]int64{l, l%10 + query_salt, r, r%10 + query_salt}] = true
+		}
+	}
+	if len(rows) != len(pairs) {
+		t.Fatalf("expected %d rows, got %d", len(pairs), len(rows))
+	}
+	for i, row := range rows {
+		if row[0].(int64) != int64(i) {
+			t.Errorf("expected row %d to have id %d, got %v", i, i, row[0])
+		}
+		pair := [4]int64{row[1].(int64), row[2].(int64), row[3].(int64), row[4].(int64)}
+		if !pairs[pair] {
+			t.Errorf("unexpected or repeated row %v", row)
+		}
+		delete(pairs, pair)
+	}
+	// Joining into an existing table should fail and leave it alone
+	if err = query.JoinInto(context.Background(), database, left, right, false, false, false, "joined"); err == nil {
+		t.Error("expected an error joining into an existing table")
+	}
+	if rows, err = table.Select(); err != nil || len(rows) != 300 {
+		t.Errorf("expected 300 rows to remain, got %d (%v)", len(rows), err)
+	}
+}
+
+func testQueryAggregateJoin(t *testing.T) {
+	dbName1, dbName2 := getTempBTreeDB(t), getTempBTreeDB(t)
+	defer os.Remove(dbName1)
+	defer os.Remove(dbName2)
+	left, err := btree.OpenTable(dbName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer left.Close()
+	right, err := btree.OpenTable(dbName2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer right.Close()
+	// Join on values, so that left entries match varying numbers of right entries,
+	// and each right entry matches several left entries
+	expected := make(map[int64]int64)
+	for key := int64(0); key < 100; key++ {
+		if err = left.Insert(key, key%10+query_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := int64(0); key < 45; key++ {
+		if err = right.Insert(key, key%10+query_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for l := int64(0); l < 100; l++ {
+		for r := l % 10; r < 45; r += 10 {
+			expected[l]++
+		}
+	}
+	// Count matches per left key
+	byLeftKey := func(pair query.EntryPair) int64 { return pair.GetLeft().GetKey() }
+	count := func(acc int64, pair query.EntryPair) int64 { return acc + 1 }
+	result, err := query.AggregateJoin(context.Background(), left, right, false, false, false, byLeftKey, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected counts %v, got %v", expected, result)
+	}
+	// Sum the matching right keys per left key
+	sum := func(acc int64, pair query.EntryPair) int64 { return acc + pair.GetRight().GetKey() }
+	if result, err = query.AggregateJoin(context.Background(), left, right, false, false, false, byLeftKey, sum); err != nil {
+		t.Fatal(err)
+	}
+	for l := int64(0); l < 100; l++ {
+		expected[l] = 0
+		for r := l % 10; r < 45; r += 10 {
+			expected[l] += r
+		}
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected sums %v, got %v", expected, result)
+	}
+	// A cancelled join should surface its error rather than a partial result
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result, err = query.AggregateJoin(ctx, left, right, false, false, false, byLeftKey, count); err == nil {
+		t.Errorf("expected an error from a cancelled join, got %v", result)
+	}
+}
+
+func testQueryEmptyJoin(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+
+	// Enough entries on the left that its directory grows well past the empty right's
+	for i := int64(0); i < 2000; i++ {
+		if err := index1.Insert(i, i%query_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Joining either way round, on either field, finds nothing
+	for _, joinOnLeftKey := range []bool{true, false} {
+		for _, joinOnRightKey := range []bool{true, false} {
+			for _, tables := range [][2]db.Index{{index1, index2}, {index2, index1}} {
+				results, err := getJoinResults(t, tables[0], tables[1], joinOnLeftKey, joinOnRightKey, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(results) != 0 {
+					t.Errorf("expected no results joining with an empty table, got %d", len(results))
+				}
+			}
+		}
+	}
+	// So does a parallel join, which has no bucket pairs to hand its workers
+	ctx := context.Background()
+	resultsChan, _, group, cleanupCallback, err := query.JoinWithParallelism(ctx, index1, index2, true, true, false, 4)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = group.Wait(); err != nil {
+		t.Error(err)
+	}
+	close(resultsChan)
+	if _, ok := <-resultsChan; ok {
+		t.Error("expected no results joining with an empty table")
+	}
+}
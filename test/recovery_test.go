@@ -0,0 +1,1085 @@
+package test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	btree "github.com/brown-csci1270/db/pkg/btree"
+	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
+	db "github.com/brown-csci1270/db/pkg/db"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+	recovery "github.com/brown-csci1270/db/pkg/recovery"
+	utils "github.com/brown-csci1270/db/pkg/utils"
+
+	uuid "github.com/google/uuid"
+)
+
+func TestRecovery(t *testing.T) {
+	t.Run("TestRecoveryRedo", testRecoveryRedo)
+	t.Run("TestRecoveryConflictPolicy", testRecoveryConflictPolicy)
+	t.Run("TestRecoveryPageImageUndo", testRecoveryPageImageUndo)
+	t.Run("TestRecoveryCheckpointCommand", testRecoveryCheckpointCommand)
+	t.Run("TestRecoveryDuplicateEdit", testRecoveryDuplicateEdit)
+	t.Run("TestRecoverySelectInto", testRecoverySelectInto)
+	t.Run("TestRecoveryBlocks", testRecoveryBlocks)
+	t.Run("TestRecoveryDropTable", testRecoveryDropTable)
+	t.Run("TestRecoveryFuzzyCheckpoint", testRecoveryFuzzyCheckpoint)
+	t.Run("TestRecoveryInspectLog", testRecoveryInspectLog)
+	t.Run("TestRecoveryRunTransaction", testRecoveryRunTransaction)
+}
+
+// writeRecoveryLog writes the given log lines as a single committed transaction
+// against a freshly created btree table named "tbl".
+func writeRecoveryLog(t testing.TB, logName string, edits []string) {
+	id := uuid.New()
+	var sb strings.Builder
+	sb.WriteString("< create btree table tbl >\n")
+	sb.WriteString(fmt.Sprintf("< %s start >\n", id))
+	for _, edit := range edits {
+		sb.WriteString(fmt.Sprintf("< %s, tbl, %s >\n", id, edit))
+	}
+	sb.WriteString(fmt.Sprintf("< %s commit >\n", id))
+	if err := ioutil.WriteFile(logName, []byte(sb.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recoverFromLog opens an empty database in a temporary directory and recovers it from the given log.
+func recoverFromLog(t testing.TB, logName string) (string, *db.Database) {
+	dir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(database, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	return dir, database
+}
+
+func testRecoveryRedo(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "log-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	writeRecoveryLog(t, logName, []string{
+		"INSERT, 1, 0, 10",
+		"INSERT, 2, 0, 20",
+		"INSERT, 3, 0, 30",
+		"INSERT, 1, 10, 11", // Duplicate insert becomes an update
+		"UPDATE, 2, 20, 21",
+		"UPDATE, 4, 0, 40", // Update of a missing key becomes an insert
+		"DELETE, 3, 30, 0",
+	})
+
+	// Recover, then check the final state of the table
+	dataDir, database := recoverFromLog(t, logName)
+	defer os.RemoveAll(dataDir)
+	defer database.Close()
+	table, err := database.GetTable("tbl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int64]int64{1: 11, 2: 21, 4: 40}
+	entries, err := table.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("expected %d entries after recovery, got %d", len(expected), len(entries))
+	}
+	for _, entry := range entries {
+		if value, ok := expected[entry.GetKey()]; !ok || value != entry.GetValue() {
+			t.Errorf("unexpected entry (%d, %d) after recovery", entry.GetKey(), entry.GetValue())
+		}
+	}
+}
+
+// checkTableContents checks that the table holds exactly the given entries.
+func checkTableContents(t *testing.T, table db.Index, expected map[int64]int64) {
+	entries, err := table.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for _, entry := range entries {
+		if value, ok := expected[entry.GetKey()]; !ok || value != entry.GetValue() {
+			t.Errorf("unexpected entry (%d, %d)", entry.GetKey(), entry.GetValue())
+		}
+	}
+}
+
+func testRecoveryConflictPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "log-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	writeRecoveryLog(t, logName, []string{
+		"INSERT, 1, 0, 10",
+		"INSERT, 2, 0, 20",
+		"UPDATE, 3, 30, 31",
+		"DELETE, 4, 40, 0",
+		"INSERT, 5, 0, 50",
+	})
+
+	// Each policy's final table, given a snapshot that already holds the first
+	// insert, holds key 2 at a later value, and has lost keys 3 and 4.
+	expected := map[recovery.ConflictPolicy]map[int64]int64{
+		recovery.CONFLICT_OVERWRITE: {1: 10, 2: 20, 3: 31, 5: 50},
+		recovery.CONFLICT_SKIP:      {1: 10, 2: 22, 5: 50},
+	}
+	for _, policy := range []recovery.ConflictPolicy{recovery.CONFLICT_OVERWRITE, recovery.CONFLICT_SKIP, recovery.CONFLICT_ERROR} {
+		dataDir, err := ioutil.TempDir(".", "data-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dataDir)
+		database, err := db.Open(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer database.Close()
+		if err = db.HandleCreateTable(database, "create btree table tbl", ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		table, err := database.GetTable("tbl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		table.Insert(1, 10)
+		table.Insert(2, 22)
+		// Recover under the policy
+		tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+		rm, err := recovery.NewRecoveryManager(database, tm, logName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = rm.SetConflictPolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+		err = rm.Recover()
+		if policy == recovery.CONFLICT_ERROR {
+			if err == nil {
+				t.Error("expected recovery to fail on an applied edit")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("policy %d: %v", policy, err)
+		}
+		checkTableContents(t, table, expected[policy])
+	}
+	// Unknown policies are rejected
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(nil, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.SetConflictPolicy(recovery.ConflictPolicy(7)); err == nil {
+		t.Error("expected an invalid policy to be rejected")
+	}
+	if rm.GetConflictPolicy() != recovery.CONFLICT_OVERWRITE {
+		t.Error("expected the policy to default to overwriting")
+	}
+}
+
+func testRecoveryPageImageUndo(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	if err = ioutil.WriteFile(logName, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(database, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.SetUndoMode(recovery.UNDO_PAGE_IMAGE); err != nil {
+		t.Fatal(err)
+	}
+	if err = recovery.HandleCreateTable(database, tm, rm, "create btree table tbl", ioutil.Discard, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	table, err := database.GetTable("tbl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(clientId uuid.UUID, payloads ...string) {
+		for _, payload := range payloads {
+			var err error
+			switch strings.Fields(payload)[0] {
+			case "transaction":
+				err = recovery.HandleTransaction(database, tm, rm, payload, ioutil.Discard, clientId)
+			case "insert":
+				err = recovery.HandleInsert(database, tm, rm, payload, clientId)
+			case "abort":
+				err = recovery.HandleAbort(database, tm, rm, payload, ioutil.Discard, clientId)
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", payload, err)
+			}
+		}
+	}
+	// Commit a few entries
+	committed := make(map[int64]int64)
+	client := uuid.New()
+	run(client, "transaction begin")
+	for i := int64(0); i < 10; i++ {
+		run(client, fmt.Sprintf("insert %d %d into tbl", i, i*10))
+		committed[i] = i * 10
+	}
+	run(client, "transaction commit")
+	rootBefore, err := table.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootData := append([]byte(nil), *rootBefore.GetData()...)
+	rootBefore.Put()
+
+	// Insert enough entries to split the root, then abort
+	run(client, "transaction begin")
+	for i := int64(10); i < 3*btree.ENTRIES_PER_LEAF_NODE; i++ {
+		run(client, fmt.Sprintf("insert %d %d into tbl", i, i*10))
+	}
+	if _, err = table.Find(3*btree.ENTRIES_PER_LEAF_NODE - 1); err != nil {
+		t.Fatal(err)
+	}
+	run(client, "abort")
+	checkTableContents(t, table, committed)
+	if _, _, ok, err := btree.IsBTree(table.(*btree.BTreeIndex)); !ok || err != nil {
+		t.Errorf("expected a valid B+ tree after rollback: %v", err)
+	}
+	// A logical undo would have left the split root behind
+	rootAfter, err := table.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(*rootAfter.GetData()) != string(rootData) {
+		t.Error("expected the root page to be restored byte for byte")
+	}
+	rootAfter.Put()
+
+	// Interleaved transactions writing to the same page fall back to logical undo
+	other := uuid.New()
+	run(client, "transaction begin", "insert 100 1000 into tbl")
+	run(other, "transaction begin", "insert 101 1010 into tbl")
+	run(client, "abort")
+	expected := map[int64]int64{101: 1010}
+	for key, value := range committed {
+		expected[key] = value
+	}
+	checkTableContents(t, table, expected)
+	run(other, "abort")
+	checkTableContents(t, table, committed)
+
+	// Unknown modes are rejected
+	if err = rm.SetUndoMode(recovery.UndoMode(7)); err == nil {
+		t.Error("expected an invalid undo mode to be rejected")
+	}
+}
+
+func testRecoveryCheckpointCommand(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	if err = ioutil.WriteFile(logName, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(database, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := recovery.RecoveryREPL(database, tm, rm)
+	report := regexp.MustCompile(`checkpoint: log is (\d+) bytes, (\d+) active transactions`)
+	// checkpoint runs the command and returns the log size and transaction count it reported
+	checkpoint := func() (int64, int) {
+		output := runReplScript(t, r, "checkpoint\n")
+		match := report.FindStringSubmatch(output)
+		if match == nil {
+			t.Fatalf("expected a checkpoint report, got %q", output)
+		}
+		size, _ := strconv.ParseInt(match[1], 10, 64)
+		active, _ := strconv.Atoi(match[2])
+		return size, active
+	}
+	logSize := func() int64 {
+		info, err := os.Stat(logName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	// Start a few transactions, then commit one of them
+	clients := make([]uuid.UUID, 3)
+	for i := range clients {
+		clients[i] = uuid.New()
+		if err = recovery.HandleTransaction(database, tm, rm, "transaction begin", ioutil.Discard, clients[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = recovery.HandleTransaction(database, tm, rm, "transaction commit", ioutil.Discard, clients[0]); err != nil {
+		t.Fatal(err)
+	}
+	size, active := checkpoint()
+	if active != 2 {
+		t.Errorf("expected 2 active transactions, got %d", active)
+	}
+	if size != logSize() {
+		t.Errorf("expected a log size of %d, got %d", logSize(), size)
+	}
+	// The report should follow the manager as transactions finish
+	for _, client := range clients[1:] {
+		if err = recovery.HandleTransaction(database, tm, rm, "transaction commit", ioutil.Discard, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nextSize, active := checkpoint()
+	if active != 0 {
+		t.Errorf("expected no active transactions, got %d", active)
+	}
+	if nextSize != logSize() || nextSize <= size {
+		t.Errorf("expected the log to grow past %d bytes to %d, got %d", size, logSize(), nextSize)
+	}
+	if ids, err := rm.Checkpoint(); err != nil || len(ids) != 0 {
+		t.Errorf("expected Checkpoint to capture no transactions, got %v (%v)", ids, err)
+	}
+}
+
+func testRecoveryDuplicateEdit(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "log-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	// Edits 1 and 2 are logged again after a crash; replaying edit 1 twice would revive key 1
+	writeRecoveryLog(t, logName, []string{
+		"INSERT, 1, 0, 10, 1",
+		"INSERT, 2, 0, 20, 2",
+		"DELETE, 1, 10, 0, 3",
+		"INSERT, 1, 0, 10, 1",
+		"INSERT, 2, 0, 20, 2",
+		"UPDATE, 2, 20, 21, 4",
+	})
+	for _, policy := range []recovery.ConflictPolicy{recovery.CONFLICT_OVERWRITE, recovery.CONFLICT_ERROR} {
+		dataDir, err := ioutil.TempDir(".", "data-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dataDir)
+		database, err := db.Open(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer database.Close()
+		rm, err := recovery.NewRecoveryManager(database, concurrency.NewTransactionManager(concurrency.NewLockManager()), logName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rm.SetConflictPolicy(policy)
+		if err = rm.Recover(); err != nil {
+			t.Fatalf("policy %d: %v", policy, err)
+		}
+		table, err := database.GetTable("tbl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTableContents(t, table, map[int64]int64{2: 21})
+	}
+
+	// The same holds when the edits are logged again by a retry of the unfinished transaction
+	id := uuid.New()
+	var sb strings.Builder
+	sb.WriteString("< create btree table tbl >\n")
+	for _, run := range [][]string{
+		{"INSERT, 1, 0, 10, 1", "INSERT, 2, 0, 20, 2", "DELETE, 1, 10, 0, 3"},
+		{"INSERT, 1, 0, 10, 1", "INSERT, 2, 0, 20, 2", "UPDATE, 2, 20, 21, 4"},
+	} {
+		sb.WriteString(fmt.Sprintf("< %s start >\n", id))
+		for _, edit := range run {
+			sb.WriteString(fmt.Sprintf("< %s, tbl, %s >\n", id, edit))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("< %s commit >\n", id))
+	if err = ioutil.WriteFile(logName, []byte(sb.String()), 0666); err != nil {
+		t.Fatal(err)
+	}
+	retryDir, retryDatabase := recoverFromLog(t, logName)
+	defer os.RemoveAll(retryDir)
+	defer retryDatabase.Close()
+	retryTable, err := retryDatabase.GetTable("tbl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTableContents(t, retryTable, map[int64]int64{2: 21})
+
+	// Different edits with the same sequence number can't be told apart
+	writeRecoveryLog(t, logName, []string{
+		"INSERT, 1, 0, 10, 1",
+		"INSERT, 2, 0, 20, 1",
+	})
+	dataDir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataDir)
+	database, err := db.Open(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	rm, err := recovery.NewRecoveryManager(database, concurrency.NewTransactionManager(concurrency.NewLockManager()), logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.Recover(); err == nil {
+		t.Error("expected conflicting sequence numbers to be rejected")
+	}
+
+	// Undoing an unfinished transaction continues its sequence numbers
+	id = uuid.New()
+	uncommitted := fmt.Sprintf("< create btree table tbl >\n< %s start >\n< %s, tbl, INSERT, 1, 0, 10, 1 >\n", id, id)
+	if err = ioutil.WriteFile(logName, []byte(uncommitted), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		dataDir, database := recoverFromLog(t, logName)
+		defer os.RemoveAll(dataDir)
+		defer database.Close()
+		table, err := database.GetTable("tbl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTableContents(t, table, map[int64]int64{})
+	}
+	data, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if undo := fmt.Sprintf("< %s, tbl, DELETE, 1, 10, 0, 2 >", id); !strings.Contains(string(data), undo) {
+		t.Errorf("expected the undo to be logged as %q, got %q", undo, data)
+	}
+}
+
+func testRecoverySelectInto(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	if err = ioutil.WriteFile(logName, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(database, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := uuid.New()
+	transaction := func(action string) {
+		if err := recovery.HandleTransaction(database, tm, rm, "transaction "+action, ioutil.Discard, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Populate a source table
+	if err = recovery.HandleCreateTable(database, tm, rm, "create btree table src", ioutil.Discard, client); err != nil {
+		t.Fatal(err)
+	}
+	transaction("begin")
+	for i := 0; i < 100; i++ {
+		if err = recovery.HandleInsert(database, tm, rm, fmt.Sprintf("insert %d %d into src", i, i*10), client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transaction("commit")
+	src, err := database.GetTable("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	isEven := func(entry utils.Entry) bool {
+		return entry.GetKey()%2 == 0
+	}
+	evens := make(map[int64]int64)
+	for i := int64(0); i < 100; i += 2 {
+		evens[i] = i * 10
+	}
+	// Copying needs a transaction
+	if err = rm.SelectInto(client, src, "evens", isEven); err == nil {
+		t.Error("expected a copy outside a transaction to fail")
+	}
+	transaction("begin")
+	if err = rm.SelectInto(client, src, "evens", isEven); err != nil {
+		t.Fatal(err)
+	}
+	if err = rm.SelectInto(client, src, "src", isEven); err == nil {
+		t.Error("expected copying into an existing table to fail")
+	}
+	transaction("commit")
+	// An aborted copy leaves its table empty
+	transaction("begin")
+	if err = rm.SelectInto(client, src, "aborted", isEven); err != nil {
+		t.Fatal(err)
+	}
+	if err = recovery.HandleAbort(database, tm, rm, "abort", ioutil.Discard, client); err != nil {
+		t.Fatal(err)
+	}
+	// Recovering from the log alone reproduces both copies
+	dataDir, recovered := recoverFromLog(t, logName)
+	defer os.RemoveAll(dataDir)
+	defer recovered.Close()
+	for name, expected := range map[string]map[int64]int64{"evens": evens, "aborted": {}} {
+		table, err := recovered.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTableContents(t, table, expected)
+	}
+}
+
+func BenchmarkRecover(b *testing.B) {
+	dir, err := ioutil.TempDir(".", "log-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	edits := make([]string, 0, 100000)
+	for i := 0; i < 100000; i++ {
+		edits = append(edits, fmt.Sprintf("INSERT, %d, 0, %d", i, i))
+	}
+	writeRecoveryLog(b, logName, edits)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dataDir, database := recoverFromLog(b, logName)
+		b.StopTimer()
+		database.Close()
+		os.RemoveAll(dataDir)
+		b.StartTimer()
+	}
+}
+
+func testRecoveryBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	if err = ioutil.WriteFile(logName, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(database, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := recovery.RecoveryREPL(database, tm, rm)
+	runReplScript(t, r, "create btree table t\n")
+	table, err := database.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A committed block applies every statement
+	output := runReplScript(t, r, "begin;\ninsert 1 10 into t;\ninsert 2 20 into t;\nupdate t 1 11;\ncommit;\n")
+	if !strings.Contains(output, "block committed: 3 statements") {
+		t.Errorf("expected the block to commit, got %q", output)
+	}
+	checkTableContents(t, table, map[int64]int64{1: 11, 2: 20})
+	// An aborted block applies nothing
+	output = runReplScript(t, r, "begin;\ninsert 3 30 into t;\ndelete 2 from t;\nabort;\n")
+	if !strings.Contains(output, "block aborted: 2 statements discarded") {
+		t.Errorf("expected the block to abort, got %q", output)
+	}
+	checkTableContents(t, table, map[int64]int64{1: 11, 2: 20})
+	// A block whose statement fails rolls back the statements before it
+	output = runReplScript(t, r, "begin;\ninsert 4 40 into t;\nupdate t 2 21;\ninsert 1 99 into t;\ncommit;\n")
+	if !strings.Contains(output, "block aborted at statement 3") {
+		t.Errorf("expected the block to fail at its third statement, got %q", output)
+	}
+	checkTableContents(t, table, map[int64]int64{1: 11, 2: 20})
+	// Statements that would end the transaction are rejected before anything runs
+	output = runReplScript(t, r, "begin;\ninsert 5 50 into t;\ntransaction commit;\ncommit;\n")
+	if !strings.Contains(output, "statement 2: transaction can't be run in a block") {
+		t.Errorf("expected the block to be rejected, got %q", output)
+	}
+	checkTableContents(t, table, map[int64]int64{1: 11, 2: 20})
+	// A block left open at the end of input is discarded
+	output = runReplScript(t, r, "begin;\ninsert 6 60 into t;\n")
+	if !strings.Contains(output, "block aborted: 1 statements discarded") {
+		t.Errorf("expected the open block to be discarded, got %q", output)
+	}
+	checkTableContents(t, table, map[int64]int64{1: 11, 2: 20})
+	if n := len(tm.GetTransactions()); n != 0 {
+		t.Errorf("expected no running transactions, got %d", n)
+	}
+	// Statements outside of a block run as usual
+	runReplScript(t, r, "transaction begin\ninsert 7 70 into t\ntransaction commit\n")
+	checkTableContents(t, table, map[int64]int64{1: 11, 2: 20, 7: 70})
+}
+
+func testRecoveryDropTable(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	if err = ioutil.WriteFile(logName, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	dbFolder := filepath.Join(dir, "db")
+	database, err := db.Open(dbFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	// Hash tables keep their meta file in the working directory
+	defer os.Remove("b.meta")
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(database, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := recovery.RecoveryREPL(database, tm, rm)
+	// Table a is checkpointed before it is dropped; b is created and dropped after it
+	runReplScript(t, r, "create btree table a\ncreate btree table e\ntransaction begin\ninsert 1 10 into a\ninsert 2 20 into a\n"+
+		"insert 5 50 into e\ntransaction commit\ncheckpoint\n")
+	output := runReplScript(t, r, "create hash table b\ntransaction begin\ninsert 3 30 into b\ntransaction commit\n"+
+		"transaction begin\ndrop table a\ndrop table b\ntransaction commit\ncreate btree table c\ntransaction begin\ninsert 4 40 into c\ntransaction commit\n")
+	if !strings.Contains(output, "table a dropped.") || !strings.Contains(output, "table b dropped.") {
+		t.Fatalf("expected both tables to be dropped, got %q", output)
+	}
+	// Drops are made in transactions
+	if output = runReplScript(t, r, "drop table c\n"); !strings.Contains(output, "transaction not found") {
+		t.Errorf("expected a drop outside of a transaction to fail, got %q", output)
+	}
+	// An aborted drop brings the table back as of the checkpoint
+	runReplScript(t, r, "transaction begin\ndrop table e\nabort\n")
+	e, err := database.GetTable("e")
+	if err != nil {
+		t.Fatalf("expected the aborted drop to be undone, got %v", err)
+	}
+	checkTableContents(t, e, map[int64]int64{5: 50})
+	for _, name := range []string{"a", "b"} {
+		if _, err = os.Stat(filepath.Join(dbFolder, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+	if output = runReplScript(t, r, "drop table a\n"); !strings.Contains(output, "table not found") {
+		t.Errorf("expected dropping a missing table to fail, got %q", output)
+	}
+	logBytes, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(logBytes), ", drop btree table a >") || !strings.Contains(string(logBytes), ", drop hash table b >") {
+		t.Errorf("expected both drops to be logged, got %q", logBytes)
+	}
+	// Leave a drop running when the database crashes
+	runReplScript(t, r, "transaction begin\ninsert 6 60 into c\ndrop table c\n")
+
+	// Crash, then recover from the checkpoint's snapshot
+	recovered, err := recovery.Prime(dbFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	rtm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rrm, err := recovery.NewRecoveryManager(recovered, rtm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rrm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if _, err = recovered.GetTable(name); err == nil {
+			t.Errorf("expected table %s to stay dropped after recovery", name)
+		}
+	}
+	// The running drop and its transaction's edits are undone, and the aborted drop stays undone
+	c, err := recovered.GetTable("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTableContents(t, c, map[int64]int64{4: 40})
+	if e, err = recovered.GetTable("e"); err != nil {
+		t.Fatal(err)
+	}
+	checkTableContents(t, e, map[int64]int64{5: 50})
+
+	// Undoing a drop restores the table as of the checkpoint
+	log, err := recovery.FromString("< drop btree table a >")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rrm.Undo(log); err != nil {
+		t.Fatal(err)
+	}
+	a, err := recovered.GetTable("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTableContents(t, a, map[int64]int64{1: 10, 2: 20})
+	// Tables created after the checkpoint come back empty
+	if log, err = recovery.FromString("< drop hash table b >"); err != nil {
+		t.Fatal(err)
+	}
+	if err = rrm.Undo(log); err != nil {
+		t.Fatal(err)
+	}
+	b, err := recovered.GetTable("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(*hash.HashIndex); !ok {
+		t.Errorf("expected b to be recreated as a hash table, got %T", b)
+	}
+	checkTableContents(t, b, map[int64]int64{})
+}
+
+func testRecoveryFuzzyCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	if err = ioutil.WriteFile(logName, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	dbFolder := filepath.Join(dir, "db")
+	database, err := db.Open(dbFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(database, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := recovery.RecoveryREPL(database, tm, rm)
+	runReplScript(t, r, "create btree table a\n")
+	// run runs a command as the given client
+	run := func(client uuid.UUID, command string) {
+		var err error
+		switch strings.Fields(command)[0] {
+		case "transaction":
+			err = recovery.HandleTransaction(database, tm, rm, command, ioutil.Discard, client)
+		case "insert":
+			err = recovery.HandleInsert(database, tm, rm, command, client)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", command, err)
+		}
+	}
+	// A transaction that is still running when the checkpoint begins, and never commits
+	straggler := uuid.New()
+	run(straggler, "transaction begin")
+	run(straggler, "insert 1000 1 into a")
+
+	// Writers keep committing transactions while the checkpoint is taken
+	expected := make(map[int64]int64)
+	numWriters, numTxs := 4, 30
+	var started, finished sync.WaitGroup
+	started.Add(numWriters)
+	finished.Add(numWriters)
+	for w := 0; w < numWriters; w++ {
+		for i := 0; i < numTxs; i++ {
+			key := int64(w*numTxs + i)
+			expected[key] = key * 10
+		}
+		go func(w int) {
+			defer finished.Done()
+			client := uuid.New()
+			for i := 0; i < numTxs; i++ {
+				if i == numTxs/3 {
+					started.Done()
+				}
+				key := w*numTxs + i
+				run(client, "transaction begin")
+				run(client, fmt.Sprintf("insert %d %d into a", key, key*10))
+				run(client, "transaction commit")
+			}
+		}(w)
+	}
+	started.Wait()
+	fc, err := rm.StartCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, id := range fc.GetActive() {
+		found = found || id == straggler
+	}
+	if !found {
+		t.Errorf("expected the running transaction %v to be recorded, got %v", straggler, fc.GetActive())
+	}
+	if len(fc.GetDirtyPages()["a"]) == 0 {
+		t.Error("expected the table's dirty pages to be recorded")
+	}
+	if err = fc.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	finished.Wait()
+	run(straggler, "insert 1001 1 into a")
+	logBytes, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(logBytes), "begin checkpoint >") || !strings.Contains(string(logBytes), "< end checkpoint >") {
+		t.Errorf("expected the checkpoint to be logged, got %q", logBytes)
+	}
+	// A checkpoint that began but never ended is ignored
+	fd, err := os.OpenFile(logName, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString("< begin checkpoint >\n")
+	fd.Close()
+
+	// Crash, then recover from the checkpoint's snapshot
+	recovered, err := recovery.Prime(dbFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	rtm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rrm, err := recovery.NewRecoveryManager(recovered, rtm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rrm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := recovered.GetTable("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTableContents(t, a, expected)
+}
+
+func testRecoveryInspectLog(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "log-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+
+	// Write a log with every kind of record; tx1 commits, tx2 doesn't, and the last record is torn
+	tx1, tx2 := uuid.New(), uuid.New()
+	records := []string{
+		"< create btree table tbl >",
+		fmt.Sprintf("< %s start >", tx1),
+		fmt.Sprintf("< %s, tbl, INSERT, 1, 0, 10, 1 >", tx1),
+		fmt.Sprintf("< %s start >", tx2),
+		fmt.Sprintf("< %s checkpoint >", tx1),
+		fmt.Sprintf("< %s, tbl, UPDATE, 1, 10, 11 >", tx1),
+		fmt.Sprintf("< %s, %s begin checkpoint >", tx1, tx2),
+		"< end checkpoint >",
+		fmt.Sprintf("< %s, tbl, DELETE, 1, 11, 0, 1 >", tx2),
+		fmt.Sprintf("< %s commit >", tx1),
+		"< drop hash table old >",
+		fmt.Sprintf("< %s, tbl, INS", tx2),
+	}
+	if err = ioutil.WriteFile(logName, []byte(strings.Join(records, "\n")), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	if err = recovery.InspectLog(logName, &sb); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"1: CREATE btree table tbl",
+		fmt.Sprintf("2: START tx %s", tx1),
+		fmt.Sprintf("3: EDIT tx %s: INSERT tbl key 1, 0 -> 10, seq 1", tx1),
+		fmt.Sprintf("4: START tx %s", tx2),
+		fmt.Sprintf("5: CHECKPOINT running [%s]", tx1),
+		fmt.Sprintf("6: EDIT tx %s: UPDATE tbl key 1, 10 -> 11, seq unknown", tx1),
+		fmt.Sprintf("7: BEGIN CHECKPOINT running [%s, %s]", tx1, tx2),
+		"8: END CHECKPOINT",
+		fmt.Sprintf("9: EDIT tx %s: DELETE tbl key 1, 11 -> 0, seq 1", tx2),
+		fmt.Sprintf("10: COMMIT tx %s", tx1),
+		"11: DROP hash table old",
+		fmt.Sprintf("12: TORN %q", records[11]),
+		fmt.Sprintf("committed (1): %s", tx1),
+		fmt.Sprintf("active, to be undone (1): %s", tx2),
+	}
+	if output := sb.String(); output != strings.Join(expected, "\n")+"\n" {
+		t.Errorf("expected the dump:\n%s\ngot:\n%s", strings.Join(expected, "\n"), output)
+	}
+	// A record that can't be parsed anywhere but at the end is an error
+	records[11] = "< garbage >"
+	records = append(records, fmt.Sprintf("< %s commit >", tx2))
+	if err = ioutil.WriteFile(logName, []byte(strings.Join(records, "\n")+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = recovery.InspectLog(logName, &sb); err == nil || !strings.Contains(err.Error(), "line 12") {
+		t.Errorf("expected an error on line 12, got %v", err)
+	}
+	// An empty log has no records or transactions
+	if err = ioutil.WriteFile(logName, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	sb.Reset()
+	if err = recovery.InspectLog(logName, &sb); err != nil || sb.String() != "committed (0): \nactive, to be undone (0): \n" {
+		t.Errorf("expected an empty summary, got %q (%v)", sb.String(), err)
+	}
+}
+
+func testRecoveryRunTransaction(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "data-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logName := filepath.Join(dir, "db.log")
+	if err = ioutil.WriteFile(logName, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(database, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = recovery.HandleCreateTable(database, tm, rm, "create btree table tbl", ioutil.Discard, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	table, err := database.GetTable("tbl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(retries int, backoff time.Duration) {
+		recovery.MAX_TRANSACTION_RETRIES, recovery.TRANSACTION_BACKOFF = retries, backoff
+	}(recovery.MAX_TRANSACTION_RETRIES, recovery.TRANSACTION_BACKOFF)
+	recovery.MAX_TRANSACTION_RETRIES, recovery.TRANSACTION_BACKOFF = 3, time.Millisecond
+	// A transaction that conflicts once should be rolled back, rerun, and committed
+	attempts := 0
+	err = recovery.RunTransaction(tm, rm, func(clientId uuid.UUID) error {
+		attempts++
+		if err := recovery.HandleInsert(database, tm, rm, fmt.Sprintf("insert 1 %d into tbl", attempts), clientId); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			return concurrency.ErrConflict
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("expected to commit on the second attempt, got %d attempts (%v)", attempts, err)
+	}
+	checkTableContents(t, table, map[int64]int64{1: 2})
+	if len(tm.GetTransactions()) != 0 {
+		t.Error("expected no transactions to be left running")
+	}
+	// A transaction that can't upgrade its read lock past another reader is retried
+	reader := uuid.New()
+	if err = tm.Begin(reader); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tm.Find(reader, table, 1); err != nil {
+		t.Fatal(err)
+	}
+	attempts = 0
+	err = recovery.RunTransaction(tm, rm, func(clientId uuid.UUID) error {
+		attempts++
+		if attempts == 2 {
+			if err := tm.Commit(reader); err != nil {
+				return err
+			}
+		}
+		if _, err := tm.Find(clientId, table, 1); err != nil {
+			return err
+		}
+		return recovery.HandleUpdate(database, tm, rm, "update tbl 1 3", clientId)
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("expected to commit on the second attempt, got %d attempts (%v)", attempts, err)
+	}
+	checkTableContents(t, table, map[int64]int64{1: 3})
+	// A transaction that always deadlocks should give up after the last retry
+	attempts = 0
+	err = recovery.RunTransaction(tm, rm, func(clientId uuid.UUID) error {
+		attempts++
+		if err := recovery.HandleInsert(database, tm, rm, "insert 2 20 into tbl", clientId); err != nil {
+			return err
+		}
+		return fmt.Errorf("update failed: %w", concurrency.ErrDeadlock)
+	})
+	if !errors.Is(err, concurrency.ErrDeadlock) || attempts != recovery.MAX_TRANSACTION_RETRIES+1 {
+		t.Errorf("expected to give up with a deadlock after %d attempts, got %d attempts (%v)",
+			recovery.MAX_TRANSACTION_RETRIES+1, attempts, err)
+	}
+	checkTableContents(t, table, map[int64]int64{1: 3})
+	// Other errors are not retried
+	attempts = 0
+	failure := errors.New("failure")
+	if err = recovery.RunTransaction(tm, rm, func(clientId uuid.UUID) error {
+		attempts++
+		return failure
+	}); err != failure || attempts != 1 {
+		t.Errorf("expected to give up after one attempt, got %d attempts (%v)", attempts, err)
+	}
+	if len(tm.GetTransactions()) != 0 {
+		t.Error("expected no transactions to be left running")
+	}
+}
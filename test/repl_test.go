@@ -0,0 +1,341 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	db "github.com/brown-csci1270/db/pkg/db"
+	repl "github.com/brown-csci1270/db/pkg/repl"
+	uuid "github.com/google/uuid"
+)
+
+func TestRepl(t *testing.T) {
+	t.Run("TestReplConcurrentDispatch", testReplConcurrentDispatch)
+	t.Run("TestReplHistory", testReplHistory)
+	t.Run("TestReplCombineCollisions", testReplCombineCollisions)
+	t.Run("TestReplTimeout", testReplTimeout)
+}
+
+// runReplScript serves the REPL over a loopback connection, sends it the given
+// script, and returns everything the REPL wrote back.
+func runReplScript(t *testing.T, r *repl.REPL, script string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		r.Run(c, uuid.New(), "")
+		c.Close()
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, script)
+	conn.(*net.TCPConn).CloseWrite()
+	output, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output)
+}
+
+func testReplConcurrentDispatch(t *testing.T) {
+	// Init a REPL with a command that echoes its payload
+	r := repl.NewRepl()
+	r.AddCommand("echo", func(payload string, config *repl.REPLConfig) error {
+		io.WriteString(config.GetWriter(), payload+"\n")
+		return nil
+	}, "Echo the payload.")
+	numClients := 8
+	numCommands := 200
+	var wg sync.WaitGroup
+	// Serve several clients at once
+	for c := 0; c < numClients; c++ {
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			r.Run(serverConn, uuid.New(), "")
+			serverConn.Close()
+		}()
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			defer clientConn.Close()
+			go func() {
+				for i := 0; i < numCommands; i++ {
+					fmt.Fprintf(clientConn, "echo %d %d\n", c, i)
+				}
+			}()
+			scanner := bufio.NewScanner(clientConn)
+			for i := 0; i < numCommands; i++ {
+				if !scanner.Scan() {
+					t.Errorf("client %d: output ended after %d commands", c, i)
+					return
+				}
+				if expected := fmt.Sprintf("echo %d %d", c, i); scanner.Text() != expected {
+					t.Errorf("client %d: expected %q, got %q", c, expected, scanner.Text())
+				}
+			}
+		}(c)
+	}
+	// Meanwhile, register and inspect commands from other goroutines
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numCommands; i++ {
+			r.AddCommand(fmt.Sprintf("extra_%d", i), func(string, *repl.REPLConfig) error {
+				return nil
+			}, "Do nothing.")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < numCommands; i++ {
+			r.HelpString()
+			r.GetCommands()
+		}
+	}()
+	wg.Wait()
+	if len(r.GetCommands()) != numCommands+1 || len(r.GetHelp()) != numCommands+1 {
+		t.Errorf("expected %d commands, got %d", numCommands+1, len(r.GetCommands()))
+	}
+}
+
+// newEchoRepl returns a REPL with a command that echoes its payload.
+func newEchoRepl() *repl.REPL {
+	r := repl.NewRepl()
+	r.AddCommand("echo", func(payload string, config *repl.REPLConfig) error {
+		io.WriteString(config.GetWriter(), payload+"\n")
+		return nil
+	}, "Echo the payload.")
+	return r
+}
+
+func testReplHistory(t *testing.T) {
+	historyFile, err := ioutil.TempFile(".", "history-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	historyFile.Close()
+	historyName := historyFile.Name()
+	os.Remove(historyName)
+	defer os.Remove(historyName)
+
+	// A missing history file starts an empty history
+	r := newEchoRepl()
+	r.SetHistoryFile(historyName, 3)
+	output := runReplScript(t, r, "echo a\necho b\n.quit\necho c\n")
+	if strings.Contains(output, "echo c") {
+		t.Error("expected .quit to end the session")
+	}
+	if history := r.GetHistory(); !reflect.DeepEqual(history, []string{"echo a", "echo b"}) {
+		t.Errorf("unexpected history %v", history)
+	}
+	// The next session should load the previous session's history
+	r = newEchoRepl()
+	r.SetHistoryFile(historyName, 3)
+	output = runReplScript(t, r, ".history\necho d\necho e\n")
+	if !strings.Contains(output, "1: echo a\n2: echo b\n") {
+		t.Errorf("expected loaded history in output, got %q", output)
+	}
+	if history := r.GetHistory(); !reflect.DeepEqual(history, []string{"echo b", "echo d", "echo e"}) {
+		t.Errorf("expected history capped to the last 3 commands, got %v", history)
+	}
+	r = newEchoRepl()
+	r.SetHistoryFile(historyName, 2)
+	runReplScript(t, r, "")
+	if history := r.GetHistory(); !reflect.DeepEqual(history, []string{"echo d", "echo e"}) {
+		t.Errorf("expected history capped to the last 2 commands, got %v", history)
+	}
+	// A corrupt history file starts an empty history
+	if err = ioutil.WriteFile(historyName, []byte{0xff, 0xfe, '\n'}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	r = newEchoRepl()
+	r.SetHistoryFile(historyName, 3)
+	runReplScript(t, r, "echo f\n")
+	if history := r.GetHistory(); !reflect.DeepEqual(history, []string{"echo f"}) {
+		t.Errorf("expected history to start empty, got %v", history)
+	}
+}
+
+// newConstRepl returns a REPL with the given name whose commands print the REPL's name.
+func newConstRepl(name string, triggers ...string) *repl.REPL {
+	r := repl.NewRepl()
+	r.SetName(name)
+	for _, trigger := range triggers {
+		r.AddCommand(trigger, func(payload string, config *repl.REPLConfig) error {
+			io.WriteString(config.GetWriter(), name+"\n")
+			return nil
+		}, name+" "+trigger)
+	}
+	return r
+}
+
+func testReplCombineCollisions(t *testing.T) {
+	first := newConstRepl("first", "shared", "one")
+	second := newConstRepl("second", "shared", "two")
+	repls := []*repl.REPL{first, second}
+
+	// Collisions are an error by default
+	if _, err := repl.CombineRepls(repls); err == nil {
+		t.Error("expected a duplicate trigger to be rejected")
+	}
+	if _, err := repl.CombineReplsWithPolicy(repls, repl.COLLISION_ERROR, ioutil.Discard); err == nil {
+		t.Error("expected a duplicate trigger to be rejected")
+	}
+	// Namespacing prefixes every copy of a shared trigger, but leaves the rest alone
+	r, err := repl.CombineReplsWithPolicy(repls, repl.COLLISION_NAMESPACE, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := r.GetCommands()
+	for _, trigger := range []string{"first:shared", "second:shared", "one", "two"} {
+		if _, ok := commands[trigger]; !ok {
+			t.Errorf("expected command %s, got %v", trigger, r.GetHelp())
+		}
+	}
+	if _, ok := commands["shared"]; ok || len(commands) != 4 {
+		t.Errorf("expected exactly four commands, got %v", r.GetHelp())
+	}
+	if help := r.GetHelp()["second:shared"]; help != "second shared" {
+		t.Errorf("expected help to follow its command, got %q", help)
+	}
+	output := runReplScript(t, r, "first:shared\nsecond:shared\n")
+	if !strings.Contains(output, "first\nsecond\n") {
+		t.Errorf("expected each namespaced command to run, got %q", output)
+	}
+	// Unnamed REPLs are namespaced by position
+	r, err = repl.CombineReplsWithPolicy([]*repl.REPL{first, newEchoRepl(), newEchoRepl()}, repl.COLLISION_NAMESPACE, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.GetCommands()["repl2:echo"]; !ok {
+		t.Errorf("expected positional namespaces, got %v", r.GetHelp())
+	}
+	// Namespacing can't separate REPLs with the same name
+	if _, err = repl.CombineReplsWithPolicy([]*repl.REPL{first, first}, repl.COLLISION_NAMESPACE, ioutil.Discard); err == nil {
+		t.Error("expected REPLs with the same name to collide")
+	}
+	// Last wins keeps the later command and warns about it
+	var warnings strings.Builder
+	r, err = repl.CombineReplsWithPolicy(repls, repl.COLLISION_LAST_WINS, &warnings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.GetCommands()) != 3 || r.GetHelp()["shared"] != "second shared" {
+		t.Errorf("expected the second REPL's command to win, got %v", r.GetHelp())
+	}
+	if output = runReplScript(t, r, "shared\n"); !strings.Contains(output, "second\n") {
+		t.Errorf("expected the second REPL's command to run, got %q", output)
+	}
+	if expected := "warning: shared from second overrides shared from first\n"; warnings.String() != expected {
+		t.Errorf("expected warning %q, got %q", expected, warnings.String())
+	}
+	// Settings other than commands carry over to the combined REPL
+	blocks := newEchoRepl()
+	blocks.SetTimeout(time.Second)
+	blocks.SetBlockHandler(func(statements []string, config *repl.REPLConfig) error {
+		fmt.Fprintf(config.GetWriter(), "block of %d\n", len(statements))
+		return nil
+	})
+	r, err = repl.CombineRepls([]*repl.REPL{first, blocks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.GetTimeout() != time.Second {
+		t.Errorf("expected the combined REPL to keep the timeout, got %v", r.GetTimeout())
+	}
+	if output = runReplScript(t, r, "begin;\none\necho hi\ncommit;\n"); !strings.Contains(output, "block of 2\n") {
+		t.Errorf("expected the combined REPL to run blocks, got %q", output)
+	}
+	// Unknown policies are rejected
+	if _, err = repl.CombineReplsWithPolicy(repls, repl.CollisionPolicy(7), ioutil.Discard); err == nil {
+		t.Error("expected an invalid policy to be rejected")
+	}
+}
+
+func testReplTimeout(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	r := newEchoRepl()
+	if r.GetTimeout() != 0 {
+		t.Errorf("expected no timeout by default, got %v", r.GetTimeout())
+	}
+	// A command that waits on its context, timing how long it waited
+	waits := make(chan time.Duration, 2)
+	r.AddCommand("wait", func(payload string, config *repl.REPLConfig) error {
+		start := time.Now()
+		defer func() { waits <- time.Since(start) }()
+		select {
+		case <-config.GetContext().Done():
+			return config.GetContext().Err()
+		case <-time.After(10 * time.Second):
+			return nil
+		}
+	}, "Wait for the context to be cancelled.")
+	// A command that ignores its context
+	r.AddCommand("sleep", func(payload string, config *repl.REPLConfig) error {
+		time.Sleep(2 * timeout)
+		io.WriteString(config.GetWriter(), "slept\n")
+		return nil
+	}, "Sleep past the timeout.")
+	r.AddCommand("deadline", func(payload string, config *repl.REPLConfig) error {
+		_, ok := config.GetContext().Deadline()
+		fmt.Fprintf(config.GetWriter(), "deadline %v\n", ok)
+		return nil
+	}, "Print whether the command has a deadline.")
+	if output := runReplScript(t, r, "deadline\n"); !strings.Contains(output, "deadline false") {
+		t.Errorf("expected no deadline without a timeout, got %q", output)
+	}
+	// Commands that respect their context are cancelled at the limit
+	r.SetTimeout(timeout)
+	output := runReplScript(t, r, "wait\necho after\n")
+	if !strings.Contains(output, fmt.Sprintf("command timed out after %v\n", timeout)) {
+		t.Errorf("expected a timeout message, got %q", output)
+	}
+	if waited := <-waits; waited < timeout || waited > 5*time.Second {
+		t.Errorf("expected the command to be cancelled after %v, waited %v", timeout, waited)
+	}
+	if !strings.Contains(output, "after\n") {
+		t.Errorf("expected the next command to run, got %q", output)
+	}
+	// Commands that ignore it still finish, and later commands are still timed
+	output = runReplScript(t, r, "sleep\nwait\ndeadline\n")
+	if !strings.Contains(output, "slept\n") || !strings.Contains(output, "command timed out") || !strings.Contains(output, "deadline true") {
+		t.Errorf("expected the sleep to finish and the wait to time out, got %q", output)
+	}
+	if strings.Count(output, "command timed out") != 1 {
+		t.Errorf("expected only the wait to time out, got %q", output)
+	}
+	// Context-aware scans stop once the context is cancelled
+	dir, database := getTempDatabase(t)
+	defer os.RemoveAll(dir)
+	defer database.Close()
+	if err := db.HandleCreateTable(database, "create btree table big", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.HandleSelectCtx(ctx, database, "select from big", ioutil.Discard); err != context.Canceled {
+		t.Errorf("expected a cancelled select to error, got %v", err)
+	}
+	if err := db.HandleSelectCtx(context.Background(), database, "select from big", ioutil.Discard); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,188 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	concurrency "github.com/brown-csci1270/db/pkg/concurrency"
+	hash "github.com/brown-csci1270/db/pkg/hash"
+
+	uuid "github.com/google/uuid"
+)
+
+func TestTransaction(t *testing.T) {
+	t.Run("TestTransactionIsolation", testTransactionIsolation)
+	t.Run("TestTransactionUpgrade", testTransactionUpgrade)
+}
+
+// commitWriteAsync updates key in a new transaction and commits it, closing the
+// returned channel once done.
+func commitWriteAsync(t *testing.T, tm *concurrency.TransactionManager, index *hash.HashIndex, key int64, value int64) chan bool {
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		writer := uuid.New()
+		if err := tm.Begin(writer); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := tm.Lock(writer, index, key, concurrency.W_LOCK); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := index.Update(key, value); err != nil {
+			t.Error(err)
+		}
+		if err := tm.Commit(writer); err != nil {
+			t.Error(err)
+		}
+	}()
+	return done
+}
+
+// findValue reads key within the given transaction.
+func findValue(t *testing.T, tm *concurrency.TransactionManager, index *hash.HashIndex, clientId uuid.UUID, key int64) int64 {
+	entry, err := tm.Find(clientId, index, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry.GetValue()
+}
+
+func testTransactionIsolation(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for key := int64(0); key < 2; key++ {
+		if err = index.Insert(key, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	if err = tm.BeginWithIsolation(uuid.New(), concurrency.IsolationLevel(7)); err == nil {
+		t.Error("expected an invalid isolation level to error")
+	}
+
+	// A READ_COMMITTED reader sees another transaction's committed write mid-transaction
+	reader := uuid.New()
+	if err = tm.BeginWithIsolation(reader, concurrency.READ_COMMITTED); err != nil {
+		t.Fatal(err)
+	}
+	if v := findValue(t, tm, index, reader, 0); v != 0 {
+		t.Errorf("expected value 0, got %d", v)
+	}
+	select {
+	case <-commitWriteAsync(t, tm, index, 0, 1):
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer blocked behind a READ_COMMITTED reader")
+	}
+	if v := findValue(t, tm, index, reader, 0); v != 1 {
+		t.Errorf("expected READ_COMMITTED to see the committed value 1, got %d", v)
+	}
+	if err = tm.Commit(reader); err != nil {
+		t.Fatal(err)
+	}
+
+	// A SERIALIZABLE reader keeps seeing the same value until it commits
+	reader = uuid.New()
+	if err = tm.BeginWithIsolation(reader, concurrency.SERIALIZABLE); err != nil {
+		t.Fatal(err)
+	}
+	if v := findValue(t, tm, index, reader, 1); v != 0 {
+		t.Errorf("expected value 0, got %d", v)
+	}
+	done := commitWriteAsync(t, tm, index, 1, 1)
+	select {
+	case <-done:
+		t.Error("writer committed while a SERIALIZABLE reader held its read lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if v := findValue(t, tm, index, reader, 1); v != 0 {
+		t.Errorf("expected SERIALIZABLE to keep seeing value 0, got %d", v)
+	}
+	if err = tm.Commit(reader); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if entry, err := index.Find(1); err != nil || entry.GetValue() != 1 {
+		t.Errorf("expected the write to land after the reader committed")
+	}
+}
+
+func testTransactionUpgrade(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err = index.Insert(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	first, second := uuid.New(), uuid.New()
+	for _, clientId := range []uuid.UUID{first, second} {
+		if err = tm.Begin(clientId); err != nil {
+			t.Fatal(err)
+		}
+		findValue(t, tm, index, clientId, 0)
+	}
+	// Neither reader can upgrade while the other reads the key, and both keep their read locks
+	for _, clientId := range []uuid.UUID{first, second} {
+		if err = tm.Lock(clientId, index, 0, concurrency.W_LOCK); !errors.Is(err, concurrency.ErrConflict) {
+			t.Errorf("expected a conflict, got %v", err)
+		}
+		txn, _ := tm.GetTransaction(clientId)
+		for _, lType := range txn.GetResources() {
+			if lType != concurrency.R_LOCK || len(txn.GetResources()) != 1 {
+				t.Errorf("expected the read lock to be kept, got %v", txn.GetResources())
+			}
+		}
+	}
+	// Once the other reader commits, the upgrade goes through in place, ahead of a writer
+	// that is already waiting for the key
+	if err = tm.Commit(second); err != nil {
+		t.Fatal(err)
+	}
+	done := commitWriteAsync(t, tm, index, 0, 1)
+	select {
+	case <-done:
+		t.Error("writer committed while another transaction read the key")
+	case <-time.After(100 * time.Millisecond):
+	}
+	withDeadline(t, "upgrading the read lock", func() {
+		if err = tm.Lock(first, index, 0, concurrency.W_LOCK); err != nil {
+			t.Error(err)
+		}
+	})
+	txn, _ := tm.GetTransaction(first)
+	for _, lType := range txn.GetResources() {
+		if lType != concurrency.W_LOCK || len(txn.GetResources()) != 1 {
+			t.Errorf("expected the read lock to be replaced by a write lock, got %v", txn.GetResources())
+		}
+	}
+	if err = index.Update(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Error("writer committed while another transaction held the upgraded lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err = tm.Commit(first); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if entry, err := index.Find(0); err != nil || entry.GetValue() != 1 {
+		t.Errorf("expected the waiting write to land after the upgraded lock was released")
+	}
+}